@@ -0,0 +1,57 @@
+package tpsi
+
+import (
+    "fmt"
+    "math/big"
+)
+
+// runs many protocol instances, e.g. one per day or per customer segment,
+// with the keys and setting of one setup. Every instance is identified by a
+// name, which all parties must use for it, and runs on its own stream of a Mux.
+type Batch struct {
+    sk Secret_key
+    mux *Mux
+}
+
+// create the batch of a party, setting must implement PeerReceiver as the
+// settings created by SetupAHE, SetupFHE and the TLS settings do
+func NewBatch(sk Secret_key, setting AHE_setting) (*Batch, error) {
+    mux, err := NewMux(setting)
+    if err != nil {return nil, err}
+    return &Batch{sk, mux}, nil
+}
+
+// setting of the instance name, for running any worker within the batch.
+// Its queues are kept until Close, Diff and Int release them when they return.
+func (b *Batch) Setting(name string) AHE_setting {
+    return b.mux.Stream(name)
+}
+
+func (b *Batch) release(setting AHE_setting) {
+    setting.(streamCloser).close()
+}
+
+// ends the batch once all instances have returned, must be called by all parties
+func (b *Batch) Close() {
+    b.mux.Close()
+}
+
+// TPSIdiffWorker as instance name. Instances with different names may run concurrently.
+func (b *Batch) Diff(name string, items []*big.Int) ([]*big.Int, []*big.Int) {
+    setting := b.Setting(name)
+    defer b.release(setting)
+    return TPSIdiffWorker(items, b.sk, setting)
+}
+
+// TPSIintWorker as instance name, panics if the setting has no FHE cryptosystem.
+// Instances with different names may run concurrently if the cryptosystem
+// implements StreamedCryptosystem, as BFV_encryption and BGV_encryption do,
+// otherwise they must run one at a time and in the same order at all parties.
+func (b *Batch) Int(name string, items []*big.Int) ([]*big.Int, []*big.Int) {
+    setting, ok := b.Setting(name).(FHE_setting)
+    if !ok {
+        panic(fmt.Errorf("batch setting has no FHE cryptosystem"))
+    }
+    defer b.release(setting)
+    return TPSIintWorker(items, b.sk, setting)
+}
@@ -0,0 +1,159 @@
+package tpsi
+
+import (
+    "math/big"
+    "testing"
+)
+
+func TestMuxStreams(t *testing.T) {
+    n := 3
+    settings := SetupAHE(n, 0, nil)
+    muxes := make([]*Mux, n)
+    for i, setting := range settings {
+        var err error
+        muxes[i], err = NewMux(setting)
+        if err != nil {t.Fatal(err)}
+    }
+
+    // outer parties use the streams in opposite order from the central party
+    done := make(chan bool)
+    for i := 0; i < n-1; i += 1 {
+        go func(i int) {
+            b := muxes[i].Stream("b")
+            a := muxes[i].Stream("a")
+            b.Send(big.NewInt(int64(10+i)))
+            a.Send(big.NewInt(int64(i)))
+            if got := a.Receive().(*big.Int); got.Int64() != 100 {
+                t.Errorf("party %d got %d on stream a", i, got)
+            }
+            if got := b.Receive().(*big.Int); got.Int64() != 200 {
+                t.Errorf("party %d got %d on stream b", i, got)
+            }
+            done <- true
+        }(i)
+    }
+    a := muxes[n-1].Stream("a")
+    b := muxes[n-1].Stream("b")
+    for i, any := range a.ReceiveAll() {
+        if any.(*big.Int).Int64() != int64(i) {
+            t.Errorf("got %d on stream a from party %d", any, i)
+        }
+    }
+    a.Distribute(big.NewInt(100))
+    for i, any := range b.ReceiveAll() {
+        if any.(*big.Int).Int64() != int64(10+i) {
+            t.Errorf("got %d on stream b from party %d", any, i)
+        }
+    }
+    b.Distribute(big.NewInt(200))
+    for i := 0; i < n-1; i += 1 {
+        <-done
+    }
+
+    closed := make(chan bool)
+    for _, mux := range muxes {
+        go func(mux *Mux) {
+            mux.Close()
+            closed <- true
+        }(mux)
+    }
+    for range muxes {
+        <-closed
+    }
+
+    if _, err := NewMux(thresholdSetting{settings[0], 0}); err == nil {
+        t.Error("expected error for setting not implementing PeerReceiver")
+    }
+}
+
+// runs two instances concurrently on batches of settings, with TPSIintWorker if fhe
+func testBatch(t *testing.T, sks []Secret_key, settings []AHE_setting, fhe bool) {
+    n := len(settings)
+    instances := []string{"monday", "tuesday"}
+    items := map[string][][]*big.Int{
+        "monday": {bigIntSlice([]int64{2,4,6,8}),
+                   bigIntSlice([]int64{2,4,6,10}),
+                   bigIntSlice([]int64{2,4,6,12})},
+        "tuesday": {bigIntSlice([]int64{2,4,14,16}),
+                    bigIntSlice([]int64{2,4,14,18}),
+                    bigIntSlice([]int64{2,4,14,20})},
+    }
+    type result struct {
+        party int
+        instance string
+        shared, unique []*big.Int
+    }
+    results := make(chan result)
+    closed := make(chan bool)
+    batches := make([]*Batch, n)
+    for i := 0; i < n; i += 1 {
+        batch, err := NewBatch(sks[i], settings[i])
+        if err != nil {t.Fatal(err)}
+        batches[i] = batch
+        returned := make(chan bool)
+        for _, name := range instances {
+            go func(i int, name string) {
+                var sh, uq []*big.Int
+                if fhe {
+                    sh, uq = batch.Int(name, items[name][i])
+                } else {
+                    sh, uq = batch.Diff(name, items[name][i])
+                }
+                returned <- true
+                results <- result{i, name, sh, uq}
+            }(i, name)
+        }
+        go func() {
+            for range instances {
+                <-returned
+            }
+            batch.Close()
+            closed <- true
+        }()
+    }
+    for k := 0; k < n*len(instances); k += 1 {
+        res := <-results
+        if res.shared == nil {
+            t.Errorf("%s: party %d failed cardinality test", res.instance, res.party)
+            continue
+        }
+        shared, unique := expectedDiff(items[res.instance], res.party)
+        if !sameElements(res.shared, shared) || !sameElements(res.unique, unique) {
+            t.Errorf("%s: party %d got shared %v, unique %v", res.instance, res.party, res.shared, res.unique)
+        }
+    }
+    for i := 0; i < n; i += 1 {
+        <-closed
+    }
+    // the streams of the instances and of their sub-protocols are released
+    for i, batch := range batches {
+        if len(batch.mux.inboxes) != 0 {
+            t.Errorf("party %d kept the inboxes of %d streams", i, len(batch.mux.inboxes))
+        }
+    }
+}
+
+func TestBatchDiff(t *testing.T) {
+    n := 3
+    pk, sksdj, err := NewDJCryptosystem(n)
+    if err != nil {t.Fatal(err)}
+    settings := make([]AHE_setting, n)
+    for i, setting := range SetupAHE(n, 3, pk) {
+        settings[i] = setting
+    }
+    testBatch(t, ConvertDJSKSlice(sksdj), settings, false)
+}
+
+// BGV multiplies interactively, so the instances only run concurrently if its
+// messages are carried by the streams
+func TestBatchIntBGV(t *testing.T) {
+    n := 3
+    fhe_settings, bgvsks := SetupBGVTest(n, 1)
+    settings := make([]AHE_setting, n)
+    sks := make([]Secret_key, n)
+    for i := range fhe_settings {
+        settings[i] = fhe_settings[i]
+        sks[i] = bgvsks[i]
+    }
+    testBatch(t, sks, settings, true)
+}
@@ -0,0 +1,217 @@
+package tpsi
+
+import (
+    "encoding/csv"
+    "fmt"
+    "io"
+    "math/big"
+    "strconv"
+    "time"
+)
+
+// parameters of one benchmark run of TPSI-diff or TPSI-int, see RunBench
+type BenchConfig struct {
+    Protocol string // "diff" or "int"
+    Backend string // "dj", "bfv" or "bgv", TPSI-int needs an FHE backend
+    Parties int
+    Threshold int
+    SetSize int // elements of every party, for TPSI-diff of the largest sets, see benchItems
+    KeyBits int // key size of Damgård-Jurik, see NewCustomDJCryptosystem
+    S int // exponent s of Damgård-Jurik
+}
+
+// measurements of a benchmark run. Runtime excludes key generation. Bytes are
+// those of all messages sent by all parties, serialized by EncodeMessage, and
+// Rounds counts the waits of the central party for messages from the outer
+// parties. Messages exchanged internally by BFV_encryption and BGV_encryption
+// are not included.
+type BenchResult struct {
+    BenchConfig
+    Runtime time.Duration
+    Rounds uint64
+    Bytes uint64
+    Passed bool // result of the cardinality test
+}
+
+// sets of parties elements, where the parties share all but the largest number
+// of elements that still lets the cardinality test pass, so that the run is at
+// the threshold unless set_size is too small. TPSI-int allows T elements not
+// shared by all at every party, so every set has set_size elements. TPSI-diff
+// allows T such elements in total, spread as evenly as possible: if parties
+// doesn't divide T, the first T%parties sets have one more of them, and the
+// other sets have set_size-1 elements.
+func benchItems(protocol string, parties, T, set_size int) [][]*big.Int {
+    unique := make([]int, parties)
+    for i := range unique {
+        unique[i] = T
+        if protocol == "diff" {
+            unique[i] = T / parties
+            if i < T % parties {
+                unique[i] += 1
+            }
+        }
+        if unique[i] > set_size {
+            unique[i] = set_size
+        }
+    }
+    shared := set_size - unique[0]
+    items := make([][]*big.Int, parties)
+    next := shared + 1
+    for i := range items {
+        els := make([]*big.Int, 0, shared+unique[i])
+        for j := 1; j <= shared; j += 1 {
+            els = append(els, big.NewInt(int64(j)))
+        }
+        for j := 0; j < unique[i]; j += 1 {
+            els = append(els, big.NewInt(int64(next)))
+            next += 1
+        }
+        items[i] = EncodeElements(els)
+    }
+    return items
+}
+
+// sets up the keys and settings of config, and runs the protocol once at all parties
+func RunBench(config BenchConfig) (BenchResult, error) {
+    n := config.Parties
+    if n < 2 {
+        return BenchResult{}, fmt.Errorf("at least 2 parties needed, got %d", n)
+    }
+    if config.Protocol != "diff" && config.Protocol != "int" {
+        return BenchResult{}, fmt.Errorf("unknown protocol %q", config.Protocol)
+    }
+    central_metrics := NewMetrics()
+    outer_metrics := NewMetrics()
+    metricsOf := func(i int) *Metrics {
+        if i == n-1 {
+            return central_metrics
+        }
+        return outer_metrics
+    }
+    sks := make([]Secret_key, n)
+    var run func(i int, items []*big.Int) bool
+    var teardown func() // unblocks the parties after one of them failed
+
+    switch config.Backend {
+    case "dj":
+        if config.Protocol == "int" {
+            return BenchResult{}, fmt.Errorf("TPSI-int needs an FHE backend")
+        }
+        cs, djsks, err := NewCustomDJCryptosystem(n, config.KeyBits, config.S)
+        if err != nil {return BenchResult{}, err}
+        for i, sk := range djsks {
+            sks[i] = sk
+        }
+        settings := SetupAHE(n, config.Threshold, cs)
+        teardown = settings[n-1].close
+        run = func(i int, items []*big.Int) bool {
+            sh, _ := TPSIdiffWorker(items, sks[i], NewMetricsSetting(settings[i], metricsOf(i)))
+            return sh != nil
+        }
+    case "bfv", "bgv":
+        cs := make([]FHE_Cryptosystem, n)
+        var link evaluationLink // of the central party
+        if config.Backend == "bfv" {
+            bfvcs, bfvsks := SetupBFV(n)
+            for i := range cs {
+                cs[i] = bfvcs[i]
+                sks[i] = bfvsks[i]
+            }
+            link = bfvcs[n-1].link
+        } else {
+            bgvcs, bgvsks := SetupBGV(n)
+            for i := range cs {
+                cs[i] = bgvcs[i]
+                sks[i] = bgvsks[i]
+            }
+            link = bgvcs[n-1].link
+        }
+        settings := SetupFHE(n, config.Threshold, cs)
+        teardown = func() {
+            settings[n-1].close()
+            link.(channelLink).close()
+        }
+        run = func(i int, items []*big.Int) bool {
+            var sh []*big.Int
+            if config.Protocol == "int" {
+                sh, _ = TPSIintWorker(items, sks[i], NewMetricsFHESetting(settings[i], metricsOf(i)))
+            } else {
+                sh, _ = TPSIdiffWorker(items, sks[i], NewMetricsSetting(settings[i], metricsOf(i)))
+            }
+            return sh != nil
+        }
+    default:
+        return BenchResult{}, fmt.Errorf("unknown backend %q", config.Backend)
+    }
+
+    items := benchItems(config.Protocol, n, config.Threshold, config.SetSize)
+    start := time.Now()
+    passed, err := runParties(n, func(i int) bool {
+        return run(i, items[i])
+    }, teardown)
+    if err != nil {
+        return BenchResult{}, err
+    }
+    result := BenchResult{BenchConfig: config, Passed: passed}
+    result.Runtime = time.Since(start)
+    result.Rounds = central_metrics.rounds
+    result.Bytes = central_metrics.bytes_sent + outer_metrics.bytes_sent
+    return result, nil
+}
+
+// runs all parties concurrently, returns whether all of them passed the
+// cardinality test. If a party panics, the failure is returned right away and
+// teardown is called, so that the other parties don't wait for it forever.
+func runParties(n int, run func(i int) bool, teardown func()) (bool, error) {
+    passed := make(chan bool, n)
+    failed := make(chan interface{}, n)
+    for i := 0; i < n; i += 1 {
+        go func(i int) {
+            defer func() {
+                if r := recover(); r != nil {
+                    failed <- r
+                }
+            }()
+            passed <- run(i)
+        }(i)
+    }
+    all := true
+    for i := 0; i < n; i += 1 {
+        select {
+        case pass := <-passed:
+            all = all && pass
+        case r := <-failed:
+            teardown()
+            return false, fmt.Errorf("party failed: %v", r)
+        }
+    }
+    return all, nil
+}
+
+// header of the CSV written by WriteBenchCSV
+var benchCSVHeader = []string{"protocol", "backend", "parties", "threshold", "set_size", "key_bits", "s", "runtime_s", "rounds", "bytes", "passed"}
+
+// write results as CSV with a header line
+func WriteBenchCSV(w io.Writer, results []BenchResult) error {
+    out := csv.NewWriter(w)
+    err := out.Write(benchCSVHeader)
+    if err != nil {return err}
+    for _, r := range results {
+        err = out.Write([]string{
+            r.Protocol,
+            r.Backend,
+            strconv.Itoa(r.Parties),
+            strconv.Itoa(r.Threshold),
+            strconv.Itoa(r.SetSize),
+            strconv.Itoa(r.KeyBits),
+            strconv.Itoa(r.S),
+            strconv.FormatFloat(r.Runtime.Seconds(), 'f', 3, 64),
+            strconv.FormatUint(r.Rounds, 10),
+            strconv.FormatUint(r.Bytes, 10),
+            strconv.FormatBool(r.Passed),
+        })
+        if err != nil {return err}
+    }
+    out.Flush()
+    return out.Error()
+}
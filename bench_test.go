@@ -0,0 +1,143 @@
+package tpsi
+
+import (
+    "bytes"
+    "fmt"
+    "math/big"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestRunBench(t *testing.T) {
+    config := BenchConfig{Protocol: "diff", Backend: "dj", Parties: 3, Threshold: 3, SetSize: 4, KeyBits: 256, S: 1}
+    result, err := RunBench(config)
+    if err != nil {t.Fatal(err)}
+    if !result.Passed || result.Rounds == 0 || result.Bytes == 0 || result.Runtime <= 0 {
+        t.Errorf("got %+v", result)
+    }
+
+    var buf bytes.Buffer
+    err = WriteBenchCSV(&buf, []BenchResult{result})
+    if err != nil {t.Fatal(err)}
+    lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+    if len(lines) != 2 || lines[0] != "protocol,backend,parties,threshold,set_size,key_bits,s,runtime_s,rounds,bytes,passed" {
+        t.Fatalf("got CSV\n%s", buf.String())
+    }
+    expected := fmt.Sprintf("diff,dj,3,3,4,256,1,%.3f,%d,%d,true", result.Runtime.Seconds(), result.Rounds, result.Bytes)
+    if lines[1] != expected {
+        t.Errorf("got %q, expected %q", lines[1], expected)
+    }
+
+    for _, bad := range []BenchConfig{
+        {Protocol: "int", Backend: "dj", Parties: 3, Threshold: 3, SetSize: 4, KeyBits: 256, S: 1},
+        {Protocol: "diff", Backend: "rsa", Parties: 3, Threshold: 3, SetSize: 4},
+        {Protocol: "union", Backend: "dj", Parties: 3, Threshold: 3, SetSize: 4, KeyBits: 256, S: 1},
+        {Protocol: "diff", Backend: "dj", Parties: 1, Threshold: 3, SetSize: 4, KeyBits: 256, S: 1},
+    } {
+        if _, err := RunBench(bad); err == nil {
+            t.Errorf("expected error for %+v", bad)
+        }
+    }
+}
+
+// party 0 fails before sending, the others wait for its message
+func TestRunPartiesFailure(t *testing.T) {
+    n := 3
+    settings := SetupAHE(n, 1, nil)
+    returned := make(chan bool, n)
+    run := func(i int) bool {
+        defer func() {
+            returned <- true
+        }()
+        if i == 0 {
+            panic("no elements")
+        } else if settings[i].IsCentral() {
+            settings[i].Distribute(settings[i].ReceiveAll()[0].(*big.Int))
+        } else {
+            settings[i].Send(big.NewInt(1))
+            settings[i].Receive()
+        }
+        return true
+    }
+    _, err := runParties(n, run, settings[n-1].close)
+    if err == nil || !strings.Contains(err.Error(), "no elements") {
+        t.Errorf("expected failure of party 0, got %v", err)
+    }
+    for i := 0; i < n; i += 1 {
+        select {
+        case <-returned:
+        case <-time.After(10*time.Second):
+            t.Fatalf("%d parties still waiting after teardown", n-i)
+        }
+    }
+}
+
+func TestBenchItems(t *testing.T) {
+    for _, protocol := range []string{"diff", "int"} {
+        items := benchItems(protocol, 3, 4, 6)
+        shared, _ := expectedDiff(items, 0)
+        unique := 0
+        for i := range items {
+            size := 6
+            if protocol == "diff" && i > 0 { // 4 unique elements spread over 3 parties
+                size = 5
+            }
+            if len(items[i]) != size {
+                t.Errorf("%s: party %d has %d elements", protocol, i, len(items[i]))
+            }
+            _, uq := expectedDiff(items, i)
+            unique += len(uq)
+        }
+        if protocol == "diff" && (len(shared) != 4 || unique != 4) {
+            t.Errorf("diff: %d shared and %d unique elements", len(shared), unique)
+        } else if protocol == "int" && (len(shared) != 2 || unique != 12) {
+            t.Errorf("int: %d shared and %d unique elements", len(shared), unique)
+        }
+    }
+}
+
+// run RunBench for every config, reporting rounds and bytes
+func benchConfigs(b *testing.B, configs []BenchConfig) {
+    for _, config := range configs {
+        name := fmt.Sprintf("%s/parties=%d/T=%d/size=%d", config.Backend, config.Parties, config.Threshold, config.SetSize)
+        if config.Backend == "dj" {
+            name += fmt.Sprintf("/bits=%d/s=%d", config.KeyBits, config.S)
+        }
+        b.Run(name, func(b *testing.B) {
+            var result BenchResult
+            var err error
+            for k := 0; k < b.N; k += 1 {
+                result, err = RunBench(config)
+                if err != nil {b.Fatal(err)}
+            }
+            b.ReportMetric(float64(result.Rounds), "rounds/op")
+            b.ReportMetric(float64(result.Bytes), "bytes/op")
+        })
+    }
+}
+
+// go test -run XXX -bench BenchmarkTPSIdiff -benchtime 1x -timeout 0
+func BenchmarkTPSIdiff(b *testing.B) {
+    var configs []BenchConfig
+    for _, parties := range []int{3, 5} {
+        for _, T := range []int{4, 8} {
+            for _, size := range []int{8, 32} {
+                configs = append(configs, BenchConfig{"diff", "dj", parties, T, size, 512, 1})
+            }
+        }
+    }
+    configs = append(configs, BenchConfig{"diff", "dj", 3, 4, 8, 1024, 1})
+    benchConfigs(b, configs)
+}
+
+// go test -run XXX -bench BenchmarkTPSIint -benchtime 1x -timeout 0
+func BenchmarkTPSIint(b *testing.B) {
+    var configs []BenchConfig
+    for _, backend := range []string{"bfv", "bgv"} {
+        for _, T := range []int{2, 4} {
+            configs = append(configs, BenchConfig{"int", backend, 3, T, 8, 0, 0})
+        }
+    }
+    benchConfigs(b, configs)
+}
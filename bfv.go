@@ -20,8 +20,8 @@ type BFV_encryption struct {
     tpk *bfv.PublicKey
     tsk *bfv.SecretKey
     sk *bfv.SecretKey
-    channels []chan interface{}
-    channel chan interface{}
+    link evaluationLink // messages of refreshes and multiplications
+    refreshed func() // called after each refresh by Multiply, see WithRefreshHook
 }
 
 func mulMax(a, b BFV_ciphertext) int {
@@ -49,34 +49,52 @@ func (pk BFV_encryption) Multiply(a, b Ciphertext) (product Ciphertext, err erro
     bc := b.(BFV_ciphertext)
 
     if ac.mult_counter >= mult_limit {
-        if pk.channels != nil {
+        if pk.link.IsCentral() {
             ac = CentralRefresh(ac, pk)
         } else {
             ac = OuterRefresh(ac, pk)
         }
+        pk.afterRefresh()
     }
     if bc.mult_counter >= mult_limit {
-        if pk.channels != nil {
+        if pk.link.IsCentral() {
             bc = CentralRefresh(bc, pk)
         } else {
             bc = OuterRefresh(bc, pk)
         }
+        pk.afterRefresh()
     }
 
     var prod *bfv.Ciphertext
-    if pk.channels != nil {
+    if pk.link.IsCentral() {
         evaluator := bfv.NewEvaluator(pk.params)
         prod = evaluator.MulNew(ac.msg, bc.msg)
         evaluator.Relinearize(prod, pk.rlk, prod)
-        for _, ch := range pk.channels {
-            ch <- prod
-        }
+        pk.link.Distribute(prod)
     } else {
-        prod = (<-pk.channel).(*bfv.Ciphertext)
+        prod = (pk.link.Receive()).(*bfv.Ciphertext)
     }
     return BFV_ciphertext{msg: prod, mult_counter: mulMax(ac, bc) + 1}, nil
 }
 
+// see StreamedCryptosystem
+func (pk BFV_encryption) OnStream(setting AHE_setting) FHE_Cryptosystem {
+    pk.link = setting
+    return pk
+}
+
+// copy of pk calling hook after every refresh of a ciphertext by Multiply
+func (pk BFV_encryption) WithRefreshHook(hook func()) BFV_encryption {
+    pk.refreshed = hook
+    return pk
+}
+
+func (pk BFV_encryption) afterRefresh() {
+    if pk.refreshed != nil {
+        pk.refreshed()
+    }
+}
+
 func (pk BFV_encryption) Encrypt(a *big.Int) (Ciphertext, error) {
     encoder := bfv.NewEncoder(pk.params)
     encryptor := bfv.NewEncryptorFromPk(pk.params, pk.pk)
@@ -122,6 +140,7 @@ func (pk BFV_encryption) N() *big.Int {
 type BFV_secret_key struct {
     sk *bfv.SecretKey
     pk BFV_encryption
+    index int
 }
 
 func (sk BFV_secret_key) PartialDecrypt(ciphertext Ciphertext) (Partial_decryption, error) {
@@ -131,6 +150,25 @@ func (sk BFV_secret_key) PartialDecrypt(ciphertext Ciphertext) (Partial_decrypti
     return BFV_partial{pcksShare, ciphertext.(BFV_ciphertext)}, nil
 }
 
+func (sk BFV_secret_key) ShareIndex() int {
+    return sk.index
+}
+
+// context of the secret key
+func (sk BFV_secret_key) context() *ring.Context {
+    contextKeys, _ := ring.NewContextWithParams(1<<sk.pk.params.LogN, append(sk.pk.params.Qi, sk.pk.params.Pi...))
+    return contextKeys
+}
+
+func (sk BFV_secret_key) SplitShare(shares int) ([][]byte, error) {
+    return splitPoly(sk.context(), sk.sk.Get(), shares)
+}
+
+// the share is also held by the cryptosystem, which sees the new share
+func (sk BFV_secret_key) CombinePieces(pieces [][]byte) error {
+    return combinePolys(sk.context(), pieces, sk.sk.Get())
+}
+
 // ciphertext wrapper
 
 type BFV_ciphertext struct {
@@ -175,6 +213,7 @@ func (pk BFV_eval_space) Scalarspace() bool {
 }
 
 type BFV_init struct {
+    index int // index of the receiving party's key share
     params *bfv.Parameters
     crs *ring.Poly
     crp []*ring.Poly
@@ -185,7 +224,8 @@ func CentralBFVEncryptionGenerator(channels []chan interface{}) (BFV_encryption,
     init.params = bfv.DefaultParams[bfv.PN14QP438]
     init.params.T = 65537
     init.crs, init.crp = GenCRP(init.params)
-    for _, ch := range channels {
+    for i, ch := range channels {
+        init.index = i
         ch <- init
     }
 
@@ -198,8 +238,8 @@ func CentralBFVEncryptionGenerator(channels []chan interface{}) (BFV_encryption,
     }
     
     pk.sk = sk
-    pk.channels = channels
-    return pk, BFV_secret_key{pk: pk, sk: sk}
+    pk.link = channelLink{channels: channels}
+    return pk, BFV_secret_key{pk: pk, sk: sk, index: len(channels)}
 }
 
 func OuterBFVEncryptionGenerator(channel chan interface{}) (BFV_encryption, BFV_secret_key) {
@@ -207,8 +247,8 @@ func OuterBFVEncryptionGenerator(channel chan interface{}) (BFV_encryption, BFV_
     _, sk := OuterKeyGenerator(init, channel)
     pk := (<-channel).(BFV_encryption)
     pk.sk = sk
-    pk.channel = channel
-    return pk, BFV_secret_key{pk: pk, sk: sk}
+    pk.link = channelLink{channel: channel}
+    return pk, BFV_secret_key{pk: pk, sk: sk, index: init.index}
 }
 
 func CentralKeyGenerator(init BFV_init, channels []chan interface{}) (BFV_encryption, *bfv.SecretKey) {
@@ -338,16 +378,14 @@ func CentralRefresh(cipher BFV_ciphertext, pk BFV_encryption) BFV_ciphertext {
     share := rpf.AllocateShares()
     rpf.GenShares(pk.sk.Get(), cipher.msg, pk.crs, share)
 
-    for _, ch := range pk.channels {
-        rpf.Aggregate(share, (<-ch).(dbfv.RefreshShare), share)
+    for _, any := range pk.link.ReceiveAll() {
+        rpf.Aggregate(share, any.(dbfv.RefreshShare), share)
     }
     
     newCipher := bfv.NewCiphertext(pk.params, 1)
     rpf.Finalize(cipher.msg, pk.crs, share, newCipher)
 
-    for _, ch := range pk.channels {
-        ch <- newCipher
-    }
+    pk.link.Distribute(newCipher)
 
     return BFV_ciphertext{msg: newCipher, mult_counter: 0}
 }
@@ -357,9 +395,9 @@ func OuterRefresh(cipher BFV_ciphertext, pk BFV_encryption) BFV_ciphertext {
     share := rpf.AllocateShares()
     rpf.GenShares(pk.sk.Get(), cipher.msg, pk.crs, share)
 
-    pk.channel <- share
+    pk.link.Send(share)
     
-    newCipher := (<-pk.channel).(*bfv.Ciphertext)
+    newCipher := (pk.link.Receive()).(*bfv.Ciphertext)
     
     return BFV_ciphertext{msg: newCipher, mult_counter: 0}
 }
@@ -0,0 +1,486 @@
+package tpsi
+
+import (
+    "crypto/rand"
+    "crypto/sha256"
+    "github.com/tuneinsight/lattigo/v4/bgv"
+    "github.com/tuneinsight/lattigo/v4/dbgv"
+    "github.com/tuneinsight/lattigo/v4/drlwe"
+    "github.com/tuneinsight/lattigo/v4/ring"
+    "github.com/tuneinsight/lattigo/v4/rlwe"
+    "github.com/tuneinsight/lattigo/v4/utils"
+    "math/big"
+    "math/bits"
+    gm "github.com/ontanj/generic-matrix"
+)
+
+// FHE cryptosystem
+
+// threshold BGV of the bgv and dbgv packages of Lattigo v4. The public key and
+// the relinearization key are generated collectively from the secret key
+// shares of all parties. Products are relinearized and rescaled to the next
+// level of the moduli chain by the central party, which distributes them.
+// Before a ciphertext reaches the bottom of the chain it is refreshed by the
+// encryption-to-shares and shares-to-encryption protocols of dbgv.
+//
+// Decryption shares and the masked decryption of a refresh are flooded with
+// uniform noise, see floodingNoise, which Lattigo leaves to the caller: its
+// smudging noise is Gaussian and must stay below the smallest modulus.
+type BGV_encryption struct {
+    params bgv.Parameters
+    pk *rlwe.PublicKey
+    rlk *rlwe.RelinearizationKey
+    sk *rlwe.SecretKey
+    parties int
+    link evaluationLink // messages of multiplications and refreshes
+}
+
+// level at which ciphertexts are decrypted and refreshed. Ciphertexts are
+// rescaled to this level first, which removes the noise of additions and
+// scalings, so that the flooding noise doesn't depend on the computation.
+const bgvDecryptionLevel = 1
+
+// lowest level of a factor of a multiplication, products are one level lower
+// and stay above bgvDecryptionLevel
+const bgvMultiplyLevel = bgvDecryptionLevel + 2
+
+// statistical security of the flooding noise, in bits
+const bgvFloodingSecurity = 40
+
+// noise of the key generation and key switching protocols
+const bgvSigma = rlwe.DefaultSigma
+
+// 128 bit security by the homomorphic encryption standard, log QP = 405 for N = 2^14,
+// leaves four multiplications between refreshes
+var bgvParameters = bgv.ParametersLiteral{
+    LogN: 14,
+    LogQ: []int{50, 50, 50, 50, 50, 50, 50},
+    LogP: []int{55},
+    T: 65537,
+}
+
+func (pk BGV_encryption) evaluator() bgv.Evaluator {
+    return bgv.NewEvaluator(pk.params, rlwe.EvaluationKey{Rlk: pk.rlk})
+}
+
+// a and b multiplied by small factors so that their scales match. Lattigo
+// does the same in additions, but v4.1.1 returns zero factors, and thereby a
+// zero sum, if the ratio of the scales is small already.
+func (pk BGV_encryption) matchScales(a, b *rlwe.Ciphertext) (*rlwe.Ciphertext, *rlwe.Ciphertext) {
+    if a.Scale.Cmp(b.Scale) == 0 {
+        return a, b
+    }
+    t := pk.params.T()
+    center := func(x uint64) uint64 {
+        if x > t/2 {
+            return t - x
+        }
+        return x
+    }
+    inv := new(big.Int).ModInverse(new(big.Int).SetUint64(a.Scale.Uint64()), new(big.Int).SetUint64(t))
+    ratio := inv.Mul(inv, new(big.Int).SetUint64(b.Scale.Uint64())).Mod(inv, new(big.Int).SetUint64(t)).Uint64()
+
+    // r0 = r1*ratio mod t for all steps of the extended Euclidean algorithm on t and ratio
+    r0, r1 := ratio, uint64(1)
+    x, y, A, B := t, uint64(0), ratio, uint64(1)
+    for A != 0 {
+        q := x / A
+        x, A = A, x % A
+        y, B = B, (t + y - B*q % t) % t
+        if A != 0 && center(A) + center(B) < center(r0) + center(r1) {
+            r0, r1 = A, B
+        }
+    }
+
+    evaluator := pk.evaluator()
+    scale := func(ct *rlwe.Ciphertext, r uint64) *rlwe.Ciphertext {
+        if r == 1 {
+            return ct
+        }
+        scaled := evaluator.MulScalarNew(ct, r)
+        scaled.Scale = ct.Scale.Mul(pk.params.NewScale(r))
+        return scaled
+    }
+    return scale(a, r0), scale(b, r1)
+}
+
+func (pk BGV_encryption) Add(a, b Ciphertext) (sum Ciphertext, err error) {
+    ac, bc := pk.matchScales(a.(BGV_ciphertext).msg, b.(BGV_ciphertext).msg)
+    return BGV_ciphertext{pk.evaluator().AddNew(ac, bc)}, nil
+}
+
+func (pk BGV_encryption) Scale(cipher Ciphertext, factor *big.Int) (product Ciphertext, err error) {
+    val := cipher.(BGV_ciphertext)
+    f := new(big.Int).Mod(factor, pk.N()).Uint64()
+    return BGV_ciphertext{pk.evaluator().MulScalarNew(val.msg, f)}, nil
+}
+
+// the central party computes the product and distributes it, so that all
+// parties hold the same ciphertext also if they encrypted the factors themselves
+func (pk BGV_encryption) Multiply(a, b Ciphertext) (product Ciphertext, err error) {
+    ac := a.(BGV_ciphertext)
+    bc := b.(BGV_ciphertext)
+
+    if ac.msg.Level() < bgvMultiplyLevel {
+        if pk.link.IsCentral() {
+            ac = CentralBGVRefresh(ac, pk)
+        } else {
+            ac = OuterBGVRefresh(ac, pk)
+        }
+    }
+    if bc.msg.Level() < bgvMultiplyLevel {
+        if pk.link.IsCentral() {
+            bc = CentralBGVRefresh(bc, pk)
+        } else {
+            bc = OuterBGVRefresh(bc, pk)
+        }
+    }
+
+    var prod BGV_ciphertext
+    if pk.link.IsCentral() {
+        evaluator := pk.evaluator()
+        prod.msg = evaluator.MulRelinNew(ac.msg, bc.msg)
+        err = evaluator.Rescale(prod.msg, prod.msg)
+        if err != nil {return}
+        pk.link.Distribute(prod)
+    } else {
+        prod = (pk.link.Receive()).(BGV_ciphertext)
+    }
+    return prod, nil
+}
+
+func (pk BGV_encryption) Encrypt(a *big.Int) (Ciphertext, error) {
+    pt := bgv.NewPlaintext(pk.params, pk.params.MaxLevel())
+    bgv.NewEncoder(pk.params).Encode([]uint64{new(big.Int).Mod(a, pk.N()).Uint64()}, pt)
+    return BGV_ciphertext{bgv.NewEncryptor(pk.params, pk.pk).EncryptNew(pt)}, nil
+}
+
+func (pk BGV_encryption) CombinePartials(parts []Partial_decryption) (*big.Int, error) {
+    cks := dbgv.NewCKSProtocol(pk.params, bgvSigma)
+    combined := cks.AllocateShare(bgvDecryptionLevel)
+    for _, part := range parts {
+        cks.AggregateShares(part.(BGV_partial).share, combined, combined)
+    }
+
+    cipher := pk.decryptionForm(parts[0].(BGV_partial).ciphertext)
+    switched := bgv.NewCiphertext(pk.params, 1, bgvDecryptionLevel)
+    cks.KeySwitch(cipher, combined, switched)
+
+    // the ciphertext is now encrypted under the zero key
+    pt := bgv.NewDecryptor(pk.params, rlwe.NewSecretKey(pk.params.Parameters)).DecryptNew(switched)
+    return new(big.Int).SetUint64(bgv.NewEncoder(pk.params).DecodeUintNew(pt)[0]), nil
+}
+
+func (pk BGV_encryption) EvaluationSpace() gm.Space {
+    return BGV_eval_space{pk}
+}
+
+// see StreamedCryptosystem
+func (pk BGV_encryption) OnStream(setting AHE_setting) FHE_Cryptosystem {
+    pk.link = setting
+    return pk
+}
+
+func (pk BGV_encryption) N() *big.Int {
+    return new(big.Int).SetUint64(pk.params.T())
+}
+
+// copy of cipher rescaled to bgvDecryptionLevel, which is the same at all parties
+func (pk BGV_encryption) decryptionForm(cipher BGV_ciphertext) *rlwe.Ciphertext {
+    ct := cipher.msg.CopyNew()
+    evaluator := pk.evaluator()
+    for ct.Level() > bgvDecryptionLevel {
+        err := evaluator.Rescale(ct, ct)
+        if err != nil {panic(err)}
+    }
+    return ct
+}
+
+// uniform noise in [-2^b, 2^b] in the NTT domain at bgvDecryptionLevel, for
+// b bgvFloodingSecurity bits larger than the noise of a ciphertext rescaled
+// to that level. The rounding of the last rescaling leaves a noise below
+// N*parties, the size of c1*s, and the noise from before is divided by at
+// least one modulus. The flooding noise of all parties, scaled by t, stays
+// below a quarter of the modulus at bgvDecryptionLevel.
+func (pk BGV_encryption) floodingNoise() *ring.Poly {
+    bound := new(big.Int).Lsh(big.NewInt(1), uint(pk.floodingBits()))
+    width := new(big.Int).Lsh(bound, 1)
+    width.Add(width, big.NewInt(1))
+    coeffs := make([]*big.Int, pk.params.N())
+    for i := range coeffs {
+        e, err := rand.Int(rand.Reader, width)
+        if err != nil {panic(err)}
+        coeffs[i] = e.Sub(e, bound)
+    }
+    ringQ := pk.params.RingQ()
+    e := ringQ.NewPolyLvl(bgvDecryptionLevel)
+    ringQ.SetCoefficientsBigintLvl(bgvDecryptionLevel, coeffs, e)
+    ringQ.NTTLvl(bgvDecryptionLevel, e, e)
+    return e
+}
+
+// bits of the flooding noise, see floodingNoise
+func (pk BGV_encryption) floodingBits() int {
+    flooding := bgvFloodingSecurity + bits.Len(uint(pk.params.N()*pk.parties))
+    modulus := pk.params.RingQ().ModulusAtLevel[bgvDecryptionLevel].BitLen()
+    if flooding + bits.Len(uint(pk.parties)) + pk.params.LogT() + 2 >= modulus {
+        panic("BGV parameters too small for flooding")
+    }
+    return flooding
+}
+
+// share of the decryption of cipher under sk, flooded
+func (pk BGV_encryption) decryptionShare(sk *rlwe.SecretKey, cipher BGV_ciphertext) *drlwe.CKSShare {
+    cks := dbgv.NewCKSProtocol(pk.params, bgvSigma)
+    share := cks.AllocateShare(bgvDecryptionLevel)
+    cks.GenShare(sk, rlwe.NewSecretKey(pk.params.Parameters), pk.decryptionForm(cipher), share)
+    pk.params.RingQ().AddLvl(bgvDecryptionLevel, share.Value, pk.floodingNoise(), share.Value)
+    return share
+}
+
+
+// secret key
+
+type BGV_secret_key struct {
+    sk *rlwe.SecretKey
+    pk BGV_encryption
+    index int
+}
+
+func (sk BGV_secret_key) PartialDecrypt(ciphertext Ciphertext) (Partial_decryption, error) {
+    cipher := ciphertext.(BGV_ciphertext)
+    return BGV_partial{sk.pk.decryptionShare(sk.sk, cipher), cipher}, nil
+}
+
+func (sk BGV_secret_key) ShareIndex() int {
+    return sk.index
+}
+
+func (sk BGV_secret_key) SplitShare(shares int) ([][]byte, error) {
+    return splitQPPoly(sk.pk.params.RingQP(), sk.sk.Value, shares)
+}
+
+// the share is also held by the cryptosystem, which sees the new share
+func (sk BGV_secret_key) CombinePieces(pieces [][]byte) error {
+    return combineQPPolys(sk.pk.params.RingQP(), pieces, sk.sk.Value)
+}
+
+// ciphertext wrapper
+
+type BGV_ciphertext struct {
+    msg *rlwe.Ciphertext
+}
+
+type BGV_partial struct {
+    share *drlwe.CKSShare
+    ciphertext BGV_ciphertext
+}
+
+// sent by outer parties in a refresh
+type bgvRefreshShare struct {
+    decryption *drlwe.CKSShare // masked decryption share of the encryption-to-shares protocol
+    encryption *drlwe.CKSShare // share of the shares-to-encryption protocol
+}
+
+
+// evaluation space
+
+type BGV_eval_space struct {
+    BGV_encryption
+}
+
+func (pk BGV_eval_space) Add(a, b interface{}) (interface{}, error) {
+    return pk.BGV_encryption.Add(a, b)
+}
+
+func (pk BGV_eval_space) Subtract(a, b interface{}) (diff interface{}, err error) {
+    ac, bc := pk.matchScales(a.(BGV_ciphertext).msg, b.(BGV_ciphertext).msg)
+    return BGV_ciphertext{pk.evaluator().SubNew(ac, bc)}, nil
+}
+
+func (pk BGV_eval_space) Multiply(a, b interface{}) (product interface{}, err error) {
+    return pk.BGV_encryption.Multiply(a, b)
+}
+
+func (pk BGV_eval_space) Scale(ciphertext interface{}, factor interface{}) (product interface{}, err error) {
+    return pk.BGV_encryption.Scale(ciphertext, factor.(*big.Int))
+}
+
+func (pk BGV_eval_space) Scalarspace() bool {
+    return false
+}
+
+type BGV_init struct {
+    index int // index of the receiving party's key share
+    params bgv.Parameters
+    parties int
+}
+
+func CentralBGVEncryptionGenerator(channels []chan interface{}) (BGV_encryption, BGV_secret_key) {
+    params, err := bgv.NewParametersFromLiteral(bgvParameters)
+    if err != nil {panic(err)}
+    init := BGV_init{params: params, parties: len(channels)+1}
+    for i, ch := range channels {
+        init.index = i
+        ch <- init
+    }
+    init.index = len(channels)
+
+    pk := BGV_encryption{params: init.params, parties: init.parties}
+    pk.sk = bgv.NewKeyGenerator(pk.params).GenSecretKey()
+    ckg, rkg, ckgCRP, rkgCRP := bgvKeyGenProtocols(pk.params)
+
+    // generate public key
+    ckgCombined := ckg.AllocateShare()
+    ckg.GenShare(pk.sk, ckgCRP, ckgCombined)
+    for _, ch := range channels {
+        ckg.AggregateShares((<-ch).(*drlwe.CKGShare), ckgCombined, ckgCombined)
+    }
+    pk.pk = rlwe.NewPublicKey(pk.params.Parameters)
+    ckg.GenPublicKey(ckgCombined, ckgCRP, pk.pk)
+    for _, ch := range channels {
+        ch <- pk.pk
+    }
+
+    // generate relinearization key
+    ephSk, rkgCombined1, rkgCombined2 := rkg.AllocateShare()
+    rkg.GenShareRoundOne(pk.sk, rkgCRP, ephSk, rkgCombined1)
+    for _, ch := range channels {
+        rkg.AggregateShares((<-ch).(*drlwe.RKGShare), rkgCombined1, rkgCombined1)
+    }
+    for _, ch := range channels {
+        ch <- rkgCombined1
+    }
+    rkg.GenShareRoundTwo(ephSk, pk.sk, rkgCombined1, rkgCombined2)
+    for _, ch := range channels {
+        rkg.AggregateShares((<-ch).(*drlwe.RKGShare), rkgCombined2, rkgCombined2)
+    }
+    pk.rlk = rlwe.NewRelinearizationKey(pk.params.Parameters, 1)
+    rkg.GenRelinearizationKey(rkgCombined1, rkgCombined2, pk.rlk)
+    for _, ch := range channels {
+        ch <- pk.rlk
+    }
+
+    pk.link = channelLink{channels: channels}
+    return pk, BGV_secret_key{pk: pk, sk: pk.sk, index: init.index}
+}
+
+func OuterBGVEncryptionGenerator(channel chan interface{}) (BGV_encryption, BGV_secret_key) {
+    init := (<-channel).(BGV_init)
+    pk := BGV_encryption{params: init.params, parties: init.parties}
+    pk.sk = bgv.NewKeyGenerator(pk.params).GenSecretKey()
+    ckg, rkg, ckgCRP, rkgCRP := bgvKeyGenProtocols(pk.params)
+
+    // generate public key
+    ckgShare := ckg.AllocateShare()
+    ckg.GenShare(pk.sk, ckgCRP, ckgShare)
+    channel <- ckgShare
+    pk.pk = (<-channel).(*rlwe.PublicKey)
+
+    // generate relinearization key
+    ephSk, rkgShareOne, rkgShareTwo := rkg.AllocateShare()
+    rkg.GenShareRoundOne(pk.sk, rkgCRP, ephSk, rkgShareOne)
+    channel <- rkgShareOne
+    rkgCombined1 := (<-channel).(*drlwe.RKGShare)
+    rkg.GenShareRoundTwo(ephSk, pk.sk, rkgCombined1, rkgShareTwo)
+    channel <- rkgShareTwo
+    pk.rlk = (<-channel).(*rlwe.RelinearizationKey)
+
+    pk.link = channelLink{channel: channel}
+    return pk, BGV_secret_key{pk: pk, sk: pk.sk, index: init.index}
+}
+
+// protocols of the public key and the relinearization key with their common
+// random polynomials, sampled from a fixed common reference string
+func bgvKeyGenProtocols(params bgv.Parameters) (*drlwe.CKGProtocol, *drlwe.RKGProtocol, drlwe.CKGCRP, drlwe.RKGCRP) {
+    crs, err := utils.NewKeyedPRNG([]byte{'o', 'n', 't', 'a', 'n', 'j'})
+    if err != nil {panic(err)}
+    ckg := dbgv.NewCKGProtocol(params)
+    rkg := dbgv.NewRKGProtocol(params)
+    ckgCRP := ckg.SampleCRP(crs)
+    return ckg, rkg, ckgCRP, rkg.SampleCRP(crs)
+}
+
+// protocols of a refresh of cipher at bgvDecryptionLevel and the common random
+// polynomial of the new ciphertext, sampled from a hash of cipher so that it
+// is fresh for every refresh
+func (pk BGV_encryption) refreshProtocols(cipher *rlwe.Ciphertext) (*dbgv.E2SProtocol, *dbgv.S2EProtocol, drlwe.CKSCRP) {
+    data, err := cipher.MarshalBinary()
+    if err != nil {panic(err)}
+    seed := sha256.Sum256(data)
+    crs, err := utils.NewKeyedPRNG(seed[:])
+    if err != nil {panic(err)}
+    s2e := dbgv.NewS2EProtocol(pk.params, bgvSigma)
+    return dbgv.NewE2SProtocol(pk.params, bgvSigma), s2e, s2e.SampleCRP(pk.params.MaxLevel(), crs)
+}
+
+// replace cipher by a fresh encryption of the same plaintext at the top
+// level. Every party turns its decryption share into an additive share of the
+// plaintext and encrypts it again, the central party combines the shares.
+func CentralBGVRefresh(cipher BGV_ciphertext, pk BGV_encryption) BGV_ciphertext {
+    ct := pk.decryptionForm(cipher)
+    e2s, s2e, crp := pk.refreshProtocols(ct)
+
+    mask := rlwe.NewAdditiveShare(pk.params.Parameters)
+    decryption := e2s.AllocateShare(bgvDecryptionLevel)
+    e2s.GenShare(pk.sk, ct, mask, decryption)
+    pk.params.RingQ().AddLvl(bgvDecryptionLevel, decryption.Value, pk.floodingNoise(), decryption.Value)
+    encryption := s2e.AllocateShare(pk.params.MaxLevel())
+    shares := pk.link.ReceiveAll()
+    for _, any := range shares {
+        e2s.AggregateShares(any.(bgvRefreshShare).decryption, decryption, decryption)
+    }
+
+    // the plaintext minus the masks of the outer parties
+    e2s.GetShare(mask, decryption, ct, mask)
+    s2e.GenShare(pk.sk, crp, mask, encryption)
+    for _, any := range shares {
+        s2e.AggregateShares(any.(bgvRefreshShare).encryption, encryption, encryption)
+    }
+    fresh := bgv.NewCiphertext(pk.params, 1, pk.params.MaxLevel())
+    fresh.MetaData = ct.MetaData
+    s2e.GetEncryption(encryption, crp, fresh)
+
+    newCipher := BGV_ciphertext{fresh}
+    pk.link.Distribute(newCipher)
+    return newCipher
+}
+
+func OuterBGVRefresh(cipher BGV_ciphertext, pk BGV_encryption) BGV_ciphertext {
+    ct := pk.decryptionForm(cipher)
+    e2s, s2e, crp := pk.refreshProtocols(ct)
+
+    mask := rlwe.NewAdditiveShare(pk.params.Parameters)
+    share := bgvRefreshShare{e2s.AllocateShare(bgvDecryptionLevel), s2e.AllocateShare(pk.params.MaxLevel())}
+    e2s.GenShare(pk.sk, ct, mask, share.decryption)
+    pk.params.RingQ().AddLvl(bgvDecryptionLevel, share.decryption.Value, pk.floodingNoise(), share.decryption.Value)
+    s2e.GenShare(pk.sk, crp, mask, share.encryption)
+    pk.link.Send(share)
+    return (pk.link.Receive()).(BGV_ciphertext)
+}
+
+func SetupBGV(n int) ([]BGV_encryption, []BGV_secret_key) {
+    channels := create_chans(n-1)
+    sk_chan := make(chan BGV_secret_key)
+    pk_chan := make(chan BGV_encryption, n)
+
+    go func() {
+        pk, sk := CentralBGVEncryptionGenerator(channels)
+        sk_chan <- sk
+        pk_chan <- pk
+    }()
+    for i := 0; i < n-1; i += 1 {
+        go func(i int) {
+            pk, sk := OuterBGVEncryptionGenerator(channels[i])
+            sk_chan <- sk
+            pk_chan <- pk
+        }(i)
+    }
+    sks := make([]BGV_secret_key, n)
+    pk := make([]BGV_encryption, n)
+    for i := 0; i < n; i += 1 {
+        sks[i] = <-sk_chan
+        pk[i] = <-pk_chan
+    }
+    return pk, sks
+}
@@ -0,0 +1,147 @@
+package tpsi
+
+import (
+    "testing"
+    "math/big"
+)
+
+func SetupBGVTest(n, T int) ([]FHESetting, []BGV_secret_key) {
+    bgvcs, sks := SetupBGV(n)
+    cs := make([]FHE_Cryptosystem, n)
+    for i, c := range bgvcs {
+        cs[i] = c
+    }
+    return SetupFHE(n, T, cs), sks
+}
+
+func TestBGVEncryptDecrypt(t *testing.T) {
+    n := 4
+    setts, sks := SetupBGVTest(n, 0)
+
+    enc1, err := setts[0].cs.Encrypt(big.NewInt(5))
+    if err != nil {t.Fatal(err)}
+    enc2, err := setts[0].cs.Encrypt(big.NewInt(65530))
+    if err != nil {t.Fatal(err)}
+    // 3*5 - 65530 = 22 mod 65537
+    sum, err := setts[0].cs.Scale(enc1, big.NewInt(3))
+    if err != nil {t.Fatal(err)}
+    sum, err = setts[0].cs.EvaluationSpace().Subtract(sum, enc2)
+    if err != nil {t.Fatal(err)}
+
+    ret := make(chan *big.Int)
+    go func() {
+        ret <- CentralDecryptionWorker(sum, sks[n-1], setts[n-1])
+    }()
+    for i := 0; i < n-1; i += 1 {
+        go func(i int) {
+            ret <- OuterDecryptionWorker(sum, sks[i], setts[i])
+        }(i)
+    }
+    for i := 0; i < n; i += 1 {
+        dec := <-ret
+        if dec.Cmp(big.NewInt(22)) != 0 {
+            t.Errorf("wrong value after decryption, got %d", dec)
+        }
+    }
+}
+
+func TestBGVEvaluation(t *testing.T) {
+    n := 4
+    val1 := big.NewInt(5)
+    val2 := big.NewInt(6)
+    setts, sks := SetupBGVTest(n, 0)
+
+    enc1, err := setts[0].cs.Encrypt(val1)
+    if err != nil {t.Fatal(err)}
+    enc2, err := setts[0].cs.Encrypt(val2)
+    if err != nil {t.Fatal(err)}
+
+    // enough multiplications to require refresh
+    for j := 0; j < 10; j += 1 {
+        products := make(chan Ciphertext, n)
+        for i := 0; i < n; i += 1 {
+            go func(i int) {
+                prod, err := setts[i].cs.Multiply(enc1, enc2)
+                if err != nil {t.Error(err)}
+                products <- prod
+            }(i)
+        }
+        for i := 0; i < n; i += 1 {
+            enc2 = <-products
+        }
+
+        ret := make(chan *big.Int)
+        go func() {
+            ret <- CentralDecryptionWorker(enc2, sks[n-1], setts[n-1])
+        }()
+        for i := 0; i < n-1; i += 1 {
+            go func(i int) {
+                ret <- OuterDecryptionWorker(enc2, sks[i], setts[i])
+            }(i)
+        }
+
+        val2.Mul(val2, val1).Mod(val2, setts[0].FHE_cryptosystem().N())
+        for i := 0; i < n; i += 1 {
+            dec := <-ret
+            if dec.Cmp(val2) != 0 {
+                t.Errorf("wrong value after %d multiplications, got %d expected %d", j+1, dec, val2)
+            }
+        }
+    }
+}
+
+func TestTPSIintBGV(t *testing.T) {
+    testTPSIint(t, func(n, T int) ([]FHE_setting, []Secret_key) {
+        settings, sks := SetupBGVTest(n, T)
+        conv := make([]Secret_key, n)
+        fhe := make([]FHE_setting, n)
+        for i, sk := range sks {
+            conv[i] = sk
+            fhe[i] = settings[i]
+        }
+        return fhe, conv
+    })
+}
+
+func TestBGVFlooding(t *testing.T) {
+    n := 3
+    pks, sks := SetupBGV(n)
+    pk := pks[0]
+    cipher, err := pk.Encrypt(big.NewInt(7))
+    if err != nil {t.Fatal(err)}
+    part, err := sks[0].PartialDecrypt(cipher)
+    if err != nil {t.Fatal(err)}
+
+    // share - s_i*c1 = e
+    ringQ := pk.params.RingQ()
+    ct := pk.decryptionForm(cipher.(BGV_ciphertext))
+    e := ringQ.NewPolyLvl(bgvDecryptionLevel)
+    ringQ.MulCoeffsMontgomeryLvl(bgvDecryptionLevel, sks[0].sk.Value.Q, ct.Value[1], e)
+    ringQ.SubLvl(bgvDecryptionLevel, part.(BGV_partial).share.Value, e, e)
+    ringQ.InvNTTLvl(bgvDecryptionLevel, e, e)
+    coeffs := make([]*big.Int, pk.params.N())
+    for i := range coeffs {
+        coeffs[i] = new(big.Int)
+    }
+    ringQ.PolyToBigintCenteredLvl(bgvDecryptionLevel, e, 1, coeffs)
+
+    flooding := pk.floodingBits()
+    // the Gaussian noise of the key switching adds a few bits
+    bound := new(big.Int).Lsh(big.NewInt(1), uint(flooding))
+    bound.Add(bound, big.NewInt(64))
+    max := new(big.Int)
+    for _, coeff := range coeffs {
+        if coeff.CmpAbs(max) > 0 {
+            max.Abs(coeff)
+        }
+    }
+    if max.Cmp(bound) > 0 {
+        t.Errorf("noise %d bits, larger than %d", max.BitLen(), flooding)
+    }
+    if max.BitLen() < flooding - 8 {
+        t.Errorf("noise %d bits, expected about %d", max.BitLen(), flooding)
+    }
+    if flooding < bgvFloodingSecurity + 14 {
+        t.Errorf("flooding noise of %d bits too small", flooding)
+    }
+}
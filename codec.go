@@ -0,0 +1,311 @@
+package tpsi
+
+import (
+    "bytes"
+    "encoding/gob"
+    "fmt"
+    "math/big"
+    "github.com/ldsec/lattigo/bfv"
+    "github.com/ldsec/lattigo/dbfv"
+    "github.com/tuneinsight/lattigo/v4/drlwe"
+    "github.com/tuneinsight/lattigo/v4/rlwe"
+    "github.com/niclabs/tcpaillier"
+    gm "github.com/ontanj/generic-matrix"
+)
+
+// wire formats of the values exchanged through a setting, used
+// whenever a message has to be serialized, e.g. for signing or
+// for sending it over a network
+
+type wireMatrix struct {
+    Rows, Cols int
+    Plain bool // matrix in gm.Bigint space, otherwise in evaluation space
+    Values []interface{}
+}
+
+type wireCiphertexts []interface{}
+
+type wirePartials []interface{}
+
+type wireCiphertextsSlice []wireCiphertexts
+
+type wireMatrices []wireMatrix
+
+type wireBFVCiphertext struct {
+    Data []byte
+    MultCounter int
+}
+
+type wireBFVPartial struct {
+    Share []byte
+    Ciphertext wireBFVCiphertext
+}
+
+// ciphertext of BFV_encryption.Multiply and of refreshes, see StreamedCryptosystem
+type wireBFVEvaluated struct {
+    Data []byte
+}
+
+type wireBFVRefreshShare struct {
+    Data []byte
+}
+
+type wireBGVCiphertext struct {
+    Data []byte
+}
+
+type wireBGVPartial struct {
+    Share []byte
+    Ciphertext wireBGVCiphertext
+}
+
+type wireBGVRefreshShare struct {
+    Decryption, Encryption []byte
+}
+
+type wireEnvelope struct {
+    Value interface{}
+}
+
+func init() {
+    gob.Register(new(big.Int))
+    gob.Register(new(tcpaillier.DecryptionShare))
+    gob.Register(wireMatrix{})
+    gob.Register(wireCiphertexts{})
+    gob.Register(wirePartials{})
+    gob.Register(wireCiphertextsSlice{})
+    gob.Register(wireMatrices{})
+    gob.Register(wireBFVCiphertext{})
+    gob.Register(wireBFVPartial{})
+    gob.Register(wireBGVCiphertext{})
+    gob.Register(wireBGVPartial{})
+    gob.Register(wireBFVEvaluated{})
+    gob.Register(wireBFVRefreshShare{})
+    gob.Register(wireBGVRefreshShare{})
+    gob.Register(electionCommitment{})
+    gob.Register(electionOpening{})
+    gob.Register([]electionCommitment{})
+    gob.Register([]electionOpening{})
+    gob.Register(sessionHello{})
+    gob.Register(sessionRoster{})
+    gob.Register(inputSummary{})
+    gob.Register(inputVerdict{})
+    gob.Register(ElGamal_ciphertext{})
+    gob.Register(ElGamal_partial{})
+    gob.Register(reshareHello{})
+    gob.Register(reshareRoster{})
+    gob.Register(reshareDeals{})
+    gob.Register(resharePieces{})
+    gob.Register(streamMessage{})
+    gob.Register(muxClose{})
+}
+
+// serialize a message sent through a setting
+func EncodeMessage(any interface{}) ([]byte, error) {
+    wire, err := toWire(any)
+    if err != nil {return nil, err}
+    var buf bytes.Buffer
+    err = gob.NewEncoder(&buf).Encode(wireEnvelope{wire})
+    if err != nil {return nil, err}
+    return buf.Bytes(), nil
+}
+
+// deserialize a message sent through a setting, encrypted matrices
+// are placed in the evaluation space of cs
+func DecodeMessage(data []byte, cs AHE_Cryptosystem) (interface{}, error) {
+    var envelope wireEnvelope
+    err := gob.NewDecoder(bytes.NewReader(data)).Decode(&envelope)
+    if err != nil {return nil, err}
+    return fromWire(envelope.Value, cs)
+}
+
+func toWireSlice(vals []interface{}) ([]interface{}, error) {
+    wire := make([]interface{}, len(vals))
+    var err error
+    for i, val := range vals {
+        wire[i], err = toWire(val)
+        if err != nil {return nil, err}
+    }
+    return wire, nil
+}
+
+func fromWireSlice(wire []interface{}, cs AHE_Cryptosystem) ([]interface{}, error) {
+    vals := make([]interface{}, len(wire))
+    var err error
+    for i, val := range wire {
+        vals[i], err = fromWire(val, cs)
+        if err != nil {return nil, err}
+    }
+    return vals, nil
+}
+
+func toWire(any interface{}) (interface{}, error) {
+    switch val := any.(type) {
+    case gm.Matrix:
+        vals := make([]interface{}, val.Rows*val.Cols)
+        for row := 0; row < val.Rows; row += 1 {
+            for col := 0; col < val.Cols; col += 1 {
+                el, err := val.At(row, col)
+                if err != nil {return nil, err}
+                vals[row*val.Cols+col] = el
+            }
+        }
+        wire, err := toWireSlice(vals)
+        if err != nil {return nil, err}
+        return wireMatrix{Rows: val.Rows, Cols: val.Cols, Plain: val.Space.Scalarspace(), Values: wire}, nil
+    case []Ciphertext:
+        vals := make([]interface{}, len(val))
+        for i, v := range val {
+            vals[i] = v
+        }
+        wire, err := toWireSlice(vals)
+        return wireCiphertexts(wire), err
+    case []Partial_decryption:
+        vals := make([]interface{}, len(val))
+        for i, v := range val {
+            vals[i] = v
+        }
+        wire, err := toWireSlice(vals)
+        return wirePartials(wire), err
+    case [][]Ciphertext:
+        wire := make(wireCiphertextsSlice, len(val))
+        for i, v := range val {
+            w, err := toWire(v)
+            if err != nil {return nil, err}
+            wire[i] = w.(wireCiphertexts)
+        }
+        return wire, nil
+    case []gm.Matrix:
+        wire := make(wireMatrices, len(val))
+        for i, v := range val {
+            w, err := toWire(v)
+            if err != nil {return nil, err}
+            wire[i] = w.(wireMatrix)
+        }
+        return wire, nil
+    case BFV_ciphertext:
+        data, err := val.msg.MarshalBinary()
+        if err != nil {return nil, err}
+        return wireBFVCiphertext{Data: data, MultCounter: val.mult_counter}, nil
+    case BFV_partial:
+        share, err := val.part.MarshalBinary()
+        if err != nil {return nil, err}
+        cipher, err := toWire(val.ciphertext)
+        if err != nil {return nil, err}
+        return wireBFVPartial{Share: share, Ciphertext: cipher.(wireBFVCiphertext)}, nil
+    case BGV_ciphertext:
+        data, err := val.msg.MarshalBinary()
+        if err != nil {return nil, err}
+        return wireBGVCiphertext{Data: data}, nil
+    case BGV_partial:
+        share, err := val.share.MarshalBinary()
+        if err != nil {return nil, err}
+        cipher, err := toWire(val.ciphertext)
+        if err != nil {return nil, err}
+        return wireBGVPartial{Share: share, Ciphertext: cipher.(wireBGVCiphertext)}, nil
+    case *bfv.Ciphertext:
+        data, err := val.MarshalBinary()
+        return wireBFVEvaluated{data}, err
+    case dbfv.RefreshShare:
+        data, err := val.MarshalBinary()
+        return wireBFVRefreshShare{data}, err
+    case bgvRefreshShare:
+        decryption, err := val.decryption.MarshalBinary()
+        if err != nil {return nil, err}
+        encryption, err := val.encryption.MarshalBinary()
+        if err != nil {return nil, err}
+        return wireBGVRefreshShare{Decryption: decryption, Encryption: encryption}, nil
+    case streamMessage:
+        payload, err := toWire(val.Payload)
+        if err != nil {return nil, err}
+        return streamMessage{val.Stream, payload}, nil
+    case *big.Int, *tcpaillier.DecryptionShare, electionCommitment, electionOpening, []electionCommitment, []electionOpening, sessionHello, sessionRoster, inputSummary, inputVerdict, ElGamal_ciphertext, ElGamal_partial, reshareHello, reshareRoster, resharePieces, reshareDeals, muxClose, nil:
+        return val, nil
+    default:
+        return nil, fmt.Errorf("no wire format for message of type %T", any)
+    }
+}
+
+func fromWire(wire interface{}, cs AHE_Cryptosystem) (interface{}, error) {
+    switch val := wire.(type) {
+    case wireMatrix:
+        vals, err := fromWireSlice(val.Values, cs)
+        if err != nil {return nil, err}
+        var space gm.Space = gm.Bigint{}
+        if !val.Plain {
+            space = cs.EvaluationSpace()
+        }
+        return gm.NewMatrix(val.Rows, val.Cols, vals, space)
+    case wireCiphertexts:
+        vals, err := fromWireSlice(val, cs)
+        if err != nil {return nil, err}
+        return toCiphertextSlice(vals), nil
+    case wirePartials:
+        vals, err := fromWireSlice(val, cs)
+        if err != nil {return nil, err}
+        return toPartialSlice(vals), nil
+    case wireCiphertextsSlice:
+        vals := make([][]Ciphertext, len(val))
+        for i, v := range val {
+            cts, err := fromWire(v, cs)
+            if err != nil {return nil, err}
+            vals[i] = cts.([]Ciphertext)
+        }
+        return vals, nil
+    case wireMatrices:
+        vals := make([]gm.Matrix, len(val))
+        for i, v := range val {
+            m, err := fromWire(v, cs)
+            if err != nil {return nil, err}
+            vals[i] = m.(gm.Matrix)
+        }
+        return vals, nil
+    case wireBFVCiphertext:
+        msg := new(bfv.Ciphertext)
+        err := msg.UnmarshalBinary(val.Data)
+        if err != nil {return nil, err}
+        return BFV_ciphertext{msg: msg, mult_counter: val.MultCounter}, nil
+    case wireBFVPartial:
+        var share dbfv.PCKSShare
+        err := share.UnmarshalBinary(val.Share)
+        if err != nil {return nil, err}
+        cipher, err := fromWire(val.Ciphertext, cs)
+        if err != nil {return nil, err}
+        return BFV_partial{part: share, ciphertext: cipher.(BFV_ciphertext)}, nil
+    case wireBGVCiphertext:
+        msg := new(rlwe.Ciphertext)
+        err := msg.UnmarshalBinary(val.Data)
+        if err != nil {return nil, err}
+        return BGV_ciphertext{msg}, nil
+    case wireBGVPartial:
+        share := new(drlwe.CKSShare)
+        err := share.UnmarshalBinary(val.Share)
+        if err != nil {return nil, err}
+        cipher, err := fromWire(val.Ciphertext, cs)
+        if err != nil {return nil, err}
+        return BGV_partial{share: share, ciphertext: cipher.(BGV_ciphertext)}, nil
+    case wireBFVEvaluated:
+        msg := new(bfv.Ciphertext)
+        err := msg.UnmarshalBinary(val.Data)
+        if err != nil {return nil, err}
+        return msg, nil
+    case wireBFVRefreshShare:
+        var share dbfv.RefreshShare
+        err := share.UnmarshalBinary(val.Data)
+        if err != nil {return nil, err}
+        return share, nil
+    case wireBGVRefreshShare:
+        share := bgvRefreshShare{new(drlwe.CKSShare), new(drlwe.CKSShare)}
+        err := share.decryption.UnmarshalBinary(val.Decryption)
+        if err != nil {return nil, err}
+        err = share.encryption.UnmarshalBinary(val.Encryption)
+        if err != nil {return nil, err}
+        return share, nil
+    case streamMessage:
+        payload, err := fromWire(val.Payload, cs)
+        if err != nil {return nil, err}
+        return streamMessage{val.Stream, payload}, nil
+    default:
+        return val, nil
+    }
+}
@@ -1,6 +1,7 @@
 package tpsi
 
 import (
+    "io"
     "math/big"
     gm "github.com/ontanj/generic-matrix"
 )
@@ -33,10 +34,85 @@ type FHE_Cryptosystem interface {
     Multiply(Ciphertext, Ciphertext) (Ciphertext, error)
 }
 
+// optionally implemented by cryptosystems that can only decrypt some
+// plaintexts but can tell whether any plaintext is zero
+type ZeroTester interface {
+    CombinePartialsIsZero([]Partial_decryption) (bool, error)
+}
+
 type Secret_key interface {
     PartialDecrypt(Ciphertext) (Partial_decryption, error)
 }
 
 type Partial_decryption interface {}
 
-type Ciphertext interface {}
\ No newline at end of file
+type Ciphertext interface {}
+
+// optionally implemented by cryptosystems that can draw the randomness of
+// encryption and evaluation from a given source, so that a party can be
+// replayed exactly, see RecordingSetting
+type RandomizedCryptosystem interface {
+    // copy of the cryptosystem taking all randomness from r
+    WithRandomness(r io.Reader) AHE_Cryptosystem
+
+    // source of randomness of the cryptosystem
+    Randomness() io.Reader
+}
+
+// optionally implemented by FHE cryptosystems whose evaluation exchanges
+// messages between the parties, such as the multiplications and refreshes
+// of BFV and BGV, so that independent instances can run concurrently on
+// separate streams, see Mux
+type StreamedCryptosystem interface {
+    // copy of the cryptosystem exchanging its messages over setting
+    OnStream(setting AHE_setting) FHE_Cryptosystem
+}
+
+// the part of AHE_setting an interactive cryptosystem uses during evaluation
+type evaluationLink interface {
+    IsCentral() bool
+    Distribute(any interface{})
+    Send(any interface{})
+    Receive() interface{}
+    ReceiveAll() []interface{}
+}
+
+// evaluationLink over the in-process channels of key generation, where every
+// channel between the central party and an outer party is used both ways
+type channelLink struct {
+    channels []chan interface{} // central party
+    channel chan interface{} // outer party
+}
+
+func (l channelLink) IsCentral() bool {
+    return l.channels != nil
+}
+
+func (l channelLink) Distribute(any interface{}) {
+    for _, ch := range l.channels {
+        ch <- any
+    }
+}
+
+func (l channelLink) Send(any interface{}) {
+    l.channel <- any
+}
+
+func (l channelLink) Receive() interface{} {
+    return <-l.channel
+}
+
+func (l channelLink) ReceiveAll() []interface{} {
+    sl := make([]interface{}, len(l.channels))
+    for i, ch := range l.channels {
+        sl[i] = <-ch
+    }
+    return sl
+}
+
+// closes the channels, called on the link of the central party, see AHESetting.close
+func (l channelLink) close() {
+    for _, ch := range l.channels {
+        close(ch)
+    }
+}
@@ -2,6 +2,10 @@
 package tpsi
 
 import (
+	"crypto/rand"
+	"encoding/gob"
+	"fmt"
+	"io"
 	"math/big"
     "github.com/niclabs/tcpaillier"
     gm "github.com/ontanj/generic-matrix"
@@ -9,6 +13,7 @@ import (
 
 type DJ_encryption struct {
     gm.DJ_public_key
+    random io.Reader // source of randomness, crypto/rand if nil
 }
 
 func (pk DJ_encryption) Add(a, b Ciphertext) (sum Ciphertext, err error) {
@@ -16,29 +21,150 @@ func (pk DJ_encryption) Add(a, b Ciphertext) (sum Ciphertext, err error) {
 }
 
 func (pk DJ_encryption) Scale(cipher Ciphertext, factor *big.Int) (Ciphertext, error) {
-    prod, _, err := pk.PubKey.Multiply(cipher.(*big.Int), factor)
-    return prod, err
+    gamma, err := pk.randomUnit()
+    if err != nil {return nil, err}
+    return pk.PubKey.MultiplyFixed(cipher.(*big.Int), factor, gamma)
 }
 
 func (pk DJ_encryption) Encrypt(plaintext *big.Int) (ciphertext Ciphertext, err error) {
-    ciphertext, _, err = pk.PubKey.Encrypt(plaintext)
-    return
+    r, err := pk.randomUnit()
+    if err != nil {return}
+    return pk.PubKey.EncryptFixed(plaintext, r)
+}
+
+// see RandomizedCryptosystem
+func (pk DJ_encryption) Randomness() io.Reader {
+    if pk.random == nil {
+        return rand.Reader
+    }
+    return pk.random
+}
+
+// see RandomizedCryptosystem
+func (pk DJ_encryption) WithRandomness(r io.Reader) AHE_Cryptosystem {
+    pk.random = r
+    return pk
+}
+
+// random value in [1, N^(s+1)) used to randomize a ciphertext, like
+// tcpaillier's RandomModNToSPlusOneStar but drawn from the randomness of pk
+func (pk DJ_encryption) randomUnit() (*big.Int, error) {
+    bound := new(big.Int).Sub(pk.PubKey.Cache().NToSPlusOne, big.NewInt(1))
+    r, err := rand.Int(pk.Randomness(), bound)
+    if err != nil {return nil, err}
+    return r.Add(r, big.NewInt(1)), nil
 }
 
+// combines the shares like tcpaillier's CombineShares, which only recovers the
+// plaintext modulo N, and extracts the plaintext modulo N^s
 func (pk DJ_encryption) CombinePartials(parts []Partial_decryption) (plaintext *big.Int, err error) { 
-    casted_parts := make([]*tcpaillier.DecryptionShare, len(parts))
-    for i, p := range parts {
-        casted_parts[i] = p.(*tcpaillier.DecryptionShare)
+    if len(parts) < int(pk.K) {
+        return nil, fmt.Errorf("needed %d shares to decrypt, but got %d", pk.K, len(parts))
+    }
+    shares := make([]*tcpaillier.DecryptionShare, pk.K)
+    seen := make(map[uint8]bool)
+    for i := range shares {
+        shares[i] = parts[i].(*tcpaillier.DecryptionShare)
+        if seen[shares[i].Index] {
+            return nil, fmt.Errorf("share %d repeated", shares[i].Index)
+        }
+        seen[shares[i].Index] = true
+    }
+    s := int(pk.S)
+    mod := new(big.Int).Exp(pk.PubKey.N, big.NewInt(int64(s+1)), nil)
+    // (1+N)^(4 Delta^2 m) mod N^(s+1)
+    combined := big.NewInt(1)
+    for _, share := range shares {
+        num := new(big.Int).Mul(pk.Delta, big.NewInt(2))
+        den := big.NewInt(1)
+        for _, other := range shares {
+            if other.Index != share.Index {
+                num.Mul(num, big.NewInt(int64(other.Index)))
+                den.Mul(den, big.NewInt(int64(other.Index)-int64(share.Index)))
+            }
+        }
+        lambda := num.Quo(num, den)
+        combined.Mul(combined, new(big.Int).Exp(share.Ci, lambda, mod)).Mod(combined, mod)
+    }
+    plaintext = djLog(combined, pk.PubKey.N, s)
+    plaintext.Mul(plaintext, pk.Constant).Mod(plaintext, pk.N())
+    return plaintext, nil
+}
+
+// i mod N^s given a = (1+N)^i mod N^(s+1), see Damgård and Jurik, A Generalisation,
+// a Simplification and Some Applications of Paillier's Probabilistic Public-Key System
+func djLog(a, N *big.Int, s int) *big.Int {
+    i := new(big.Int)
+    nToJ := big.NewInt(1) // N^j
+    for j := 1; j <= s; j += 1 {
+        nToJ.Mul(nToJ, N)
+        // t1 = L(a mod N^(j+1))
+        t1 := new(big.Int).Mod(a, new(big.Int).Mul(nToJ, N))
+        t1.Sub(t1, big.NewInt(1)).Quo(t1, N)
+        t2 := new(big.Int).Set(i)
+        nToK := big.NewInt(1) // N^(k-1)
+        kFact := big.NewInt(1)
+        for k := 2; k <= j; k += 1 {
+            i.Sub(i, big.NewInt(1))
+            t2.Mul(t2, i).Mod(t2, nToJ)
+            nToK.Mul(nToK, N)
+            kFact.Mul(kFact, big.NewInt(int64(k)))
+            term := new(big.Int).Mul(t2, nToK)
+            term.Mul(term, new(big.Int).ModInverse(kFact, nToJ))
+            t1.Sub(t1, term).Mod(t1, nToJ)
+        }
+        i.Set(t1)
     }
-    return pk.CombineShares(casted_parts...)
+    return i
 }
 
 func (pk DJ_encryption) EvaluationSpace() gm.Space {
-    return pk.DJ_public_key
+    return djSpace{pk}
+}
+
+// evaluation space of Damgård-Jurik ciphertexts, like gm.DJ_public_key but
+// rerandomizing with the randomness of the cryptosystem
+type djSpace struct {
+    pk DJ_encryption
 }
 
+func djCiphertexts(vals ...interface{}) error {
+    for _, val := range vals {
+        if _, ok := val.(*big.Int); !ok {
+            return fmt.Errorf("expected *big.Int, got %T", val)
+        }
+    }
+    return nil
+}
+
+func (s djSpace) Add(a, b interface{}) (interface{}, error) {
+    if err := djCiphertexts(a, b); err != nil {return nil, err}
+    return s.pk.Add(a, b)
+}
+
+func (s djSpace) Subtract(a, b interface{}) (interface{}, error) {
+    if err := djCiphertexts(a, b); err != nil {return nil, err}
+    neg, err := s.pk.Scale(b, big.NewInt(-1))
+    if err != nil {return nil, err}
+    return s.pk.Add(a, neg)
+}
+
+func (s djSpace) Scale(cipher, factor interface{}) (interface{}, error) {
+    if err := djCiphertexts(cipher, factor); err != nil {return nil, err}
+    return s.pk.Scale(cipher, factor.(*big.Int))
+}
+
+func (s djSpace) Multiply(a, b interface{}) (interface{}, error) {
+    return nil, fmt.Errorf("multiplication not supported")
+}
+
+func (s djSpace) Scalarspace() bool {
+    return false
+}
+
+// the plaintext modulus N^s
 func (pk DJ_encryption) N() *big.Int {
-    return pk.DJ_public_key.PubKey.N
+    return new(big.Int).Exp(pk.PubKey.N, big.NewInt(int64(pk.PubKey.S)), nil)
 }
 
 type DJ_secret_key struct {
@@ -49,6 +175,20 @@ func (sk DJ_secret_key) PartialDecrypt(ciphertext Ciphertext) (Partial_decryptio
     return sk.KeyShare.PartialDecrypt(ciphertext.(*big.Int))
 }
 
+// write the key share sk together with its public key to w, e.g. to replay the
+// party from a transcript later, see ReadDJKey. Must be kept as secret as the share.
+func WriteDJKey(w io.Writer, sk DJ_secret_key) error {
+    return gob.NewEncoder(w).Encode(sk.KeyShare)
+}
+
+// read a key share written by WriteDJKey, returned with the cryptosystem of its public key
+func ReadDJKey(r io.Reader) (DJ_encryption, DJ_secret_key, error) {
+    share := new(tcpaillier.KeyShare)
+    err := gob.NewDecoder(r).Decode(share)
+    if err != nil {return DJ_encryption{}, DJ_secret_key{}, err}
+    return DJ_encryption{DJ_public_key: gm.DJ_public_key{PubKey: share.PubKey}}, DJ_secret_key{share}, nil
+}
+
 type DJ_ds struct {
     *tcpaillier.DecryptionShare
 }
@@ -57,13 +197,149 @@ func NewDJCryptosystem(n int) (cryptosystem DJ_encryption, secret_keys []DJ_secr
     return NewCustomDJCryptosystem(n, 512, 1)
 }
 
+// key of bitSize bits with plaintext space Z_{N^s}, shared between n parties
 func NewCustomDJCryptosystem(n, bitSize, s int) (cryptosystem DJ_encryption, secret_keys []DJ_secret_key, err error) {
-    tcsks, tcpk, err := tcpaillier.NewKey(bitSize, uint8(s), uint8(n), uint8(n))
+    if s < 1 || s > 255 {
+        err = fmt.Errorf("s should be between 1 and 255, but it is %d", s)
+        return
+    }
+    if n < 2 || n > 255 {
+        err = fmt.Errorf("number of parties should be between 2 and 255, but it is %d", n)
+        return
+    }
+    tcsks, tcpk, err := djKey(bitSize, s, n)
     if err != nil {return}
-    cryptosystem = DJ_encryption{gm.DJ_public_key{PubKey: tcpk}}
+    cryptosystem = DJ_encryption{DJ_public_key: gm.DJ_public_key{PubKey: tcpk}}
     secret_keys = make([]DJ_secret_key, n)
     for i, tcsk := range tcsks {
         secret_keys[i] = DJ_secret_key{tcsk}
     }
     return
-}
\ No newline at end of file
+}
+
+// like tcpaillier.NewKey, but for s>1 the shared secret d satisfies d = 1 mod N^s,
+// not only d = 1 mod N, so that decryption is correct in all of Z_{N^s}
+func djKey(bitSize, s, n int) ([]*tcpaillier.KeyShare, *tcpaillier.PubKey, error) {
+    p, p1, err := tcpaillier.GenerateSafePrimes((bitSize + 1) / 2)
+    if err != nil {return nil, nil, err}
+    var q, q1 *big.Int
+    for {
+        q, q1, err = tcpaillier.GenerateSafePrimes(bitSize - (bitSize + 1) / 2)
+        if err != nil {return nil, nil, err}
+        if p.Cmp(q) != 0 && p.Cmp(q1) != 0 && q.Cmp(p1) != 0 {
+            break
+        }
+    }
+    sks, pk, err := tcpaillier.NewFixedKey(bitSize, uint8(s), uint8(n), uint8(n), &tcpaillier.FixedParams{P: p, P1: p1, Q: q, Q1: q1})
+    if err != nil || s == 1 {
+        return sks, pk, err
+    }
+
+    // deal shares of d = 0 mod m, d = 1 mod N^s
+    m := new(big.Int).Mul(p1, q1)
+    nToS := new(big.Int).Exp(pk.N, big.NewInt(int64(s)), nil)
+    nsm := new(big.Int).Mul(nToS, m)
+    d := new(big.Int).ModInverse(m, nToS)
+    d.Mul(d, m)
+    poly := make([]*big.Int, n)
+    poly[0] = d
+    for i := 1; i < n; i += 1 {
+        poly[i], err = SampleInt(nsm)
+        if err != nil {return nil, nil, err}
+    }
+    for _, sk := range sks {
+        x := big.NewInt(int64(sk.Index))
+        si := new(big.Int)
+        for k := n-1; k >= 0; k -= 1 {
+            si.Mul(si, x).Add(si, poly[k])
+        }
+        sk.Si = si.Mod(si, nsm)
+        pk.Vi[sk.Index-1] = djVerificationValue(pk, si)
+    }
+    return sks, pk, nil
+}
+
+// resharing
+
+func (sk DJ_secret_key) ShareIndex() int {
+    return int(sk.Index) - 1
+}
+
+// integer Lagrange coefficients delta * prod k/(k-i) at 0 for the share indices 1..shares
+func djLagrange(shares int, delta *big.Int) []*big.Int {
+    lambda := make([]*big.Int, shares)
+    for i := range lambda {
+        num := new(big.Int).Set(delta)
+        den := big.NewInt(1)
+        for k := 1; k <= shares; k += 1 {
+            if k != i+1 {
+                num.Mul(num, big.NewInt(int64(k)))
+                den.Mul(den, big.NewInt(int64(k-i-1)))
+            }
+        }
+        lambda[i] = num.Quo(num, den)
+    }
+    return lambda
+}
+
+// split the share s_j into pieces p_i such that sum_i lambda_i p_i = lambda_j s_j.
+// The pieces are integers since the order of the group is secret. The random
+// values are bounded by 2^128 times N^(s+1), a multiple of the order, which
+// hides the share modulo the order whatever its size. Shares then change by a
+// zero-mean random walk and grow by about half a bit when the number of
+// resharings doubles. Only keys where all L shares are needed to decrypt can
+// be reshared, since the new shares are not points of a polynomial.
+func (sk DJ_secret_key) SplitShare(shares int) ([][]byte, error) {
+    if sk.K != sk.L {
+        return nil, fmt.Errorf("resharing needs all shares to decrypt, but %d of %d suffice", sk.K, sk.L)
+    }
+    if shares != int(sk.L) {
+        return nil, fmt.Errorf("key is shared between %d parties, not %d", sk.L, shares)
+    }
+    lambda := djLagrange(shares, sk.Delta)
+    j := sk.ShareIndex()
+    nToSPlusOne := new(big.Int).Exp(sk.N, big.NewInt(int64(sk.S) + 1), nil)
+    bound := new(big.Int).Lsh(big.NewInt(1), uint(nToSPlusOne.BitLen() + 128))
+    own := new(big.Int).Set(sk.Si)
+    pieces := make([][]byte, shares)
+    for i := range pieces {
+        if i == j {
+            continue
+        }
+        r, err := SampleInt(bound)
+        if err != nil {return nil, err}
+        own.Sub(own, new(big.Int).Mul(lambda[i], r))
+        pieces[i], err = new(big.Int).Mul(lambda[j], r).GobEncode()
+        if err != nil {return nil, err}
+    }
+    var err error
+    pieces[j], err = own.GobEncode()
+    return pieces, err
+}
+
+func (sk DJ_secret_key) CombinePieces(pieces [][]byte) error {
+    if len(pieces) != int(sk.L) {
+        return fmt.Errorf("got %d pieces, expected %d", len(pieces), sk.L)
+    }
+    sum := new(big.Int)
+    for _, data := range pieces {
+        piece := new(big.Int)
+        if err := piece.GobDecode(data); err != nil {return err}
+        sum.Add(sum, piece)
+    }
+    sk.KeyShare.Si = sum
+    // the keys of NewDJCryptosystem share the public key, which then holds the
+    // new values of all parties once they have combined their pieces
+    sk.Vi[sk.Index-1] = djVerificationValue(sk.PubKey, sum)
+    return nil
+}
+
+// verification value v^(delta*si) of share si, as tcpaillier computes it
+func djVerificationValue(pk *tcpaillier.PubKey, si *big.Int) *big.Int {
+    return new(big.Int).Exp(pk.V, new(big.Int).Mul(si, pk.Delta), pk.Cache().NToSPlusOne)
+}
+
+// key without share for a party replacing the holder of index, see CentralReshareWorker
+func (pk DJ_encryption) ReplacementKey(index int) DJ_secret_key {
+    return DJ_secret_key{&tcpaillier.KeyShare{PubKey: pk.PubKey, Index: uint8(index+1), Si: new(big.Int)}}
+}
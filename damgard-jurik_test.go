@@ -0,0 +1,128 @@
+package tpsi
+
+import (
+    "bytes"
+    "fmt"
+    "math/big"
+    "testing"
+)
+
+func TestDJPlaintextSpace(t *testing.T) {
+    n := 3
+    for s := 1; s <= 3; s += 1 {
+        pk, sks, err := NewCustomDJCryptosystem(n, 256, s)
+        if err != nil {t.Fatal(err)}
+        decrypt := func(c Ciphertext) *big.Int {
+            parts := make([]Partial_decryption, n)
+            for i, sk := range sks {
+                parts[i], err = sk.PartialDecrypt(c)
+                if err != nil {t.Fatal(err)}
+            }
+            plain, err := pk.CombinePartials(parts)
+            if err != nil {t.Fatal(err)}
+            return plain
+        }
+
+        N := pk.N()
+        if expected := new(big.Int).Exp(pk.PubKey.N, big.NewInt(int64(s)), nil); N.Cmp(expected) != 0 {
+            t.Fatalf("s=%d: plaintext modulus %d, expected %d", s, N, expected)
+        }
+
+        // largest plaintext
+        max := new(big.Int).Sub(N, big.NewInt(1))
+        c, err := pk.Encrypt(max)
+        if err != nil {t.Fatal(err)}
+        if plain := decrypt(c); plain.Cmp(max) != 0 {
+            t.Errorf("s=%d: expected %d, got %d", s, max, plain)
+        }
+
+        // 2 - 5 wraps around N^s
+        a, err := pk.Encrypt(big.NewInt(2))
+        if err != nil {t.Fatal(err)}
+        b, err := pk.Encrypt(big.NewInt(5))
+        if err != nil {t.Fatal(err)}
+        diff, err := pk.EvaluationSpace().Subtract(a, b)
+        if err != nil {t.Fatal(err)}
+        expected := new(big.Int).Sub(N, big.NewInt(3))
+        if plain := decrypt(diff); plain.Cmp(expected) != 0 {
+            t.Errorf("s=%d: expected %d, got %d", s, expected, plain)
+        }
+
+        // inverse modulo N^s
+        inv := new(big.Int).ModInverse(big.NewInt(5), N)
+        prod, err := pk.Scale(b, inv)
+        if err != nil {t.Fatal(err)}
+        if plain := decrypt(prod); plain.Cmp(big.NewInt(1)) != 0 {
+            t.Errorf("s=%d: expected 1, got %d", s, plain)
+        }
+    }
+
+    for _, s := range []int{0, 256} {
+        if _, _, err := NewCustomDJCryptosystem(n, 256, s); err == nil {
+            t.Errorf("expected error for s=%d", s)
+        }
+    }
+    if _, _, err := NewCustomDJCryptosystem(256, 256, 1); err == nil {
+        t.Error("expected error for 256 parties")
+    }
+}
+
+func TestTPSIdiffDJ(t *testing.T) {
+    n := 3
+    T := 7
+    items := [][]*big.Int{bigIntSlice([]int64{2,4,6,8,10,12,14}),
+                          bigIntSlice([]int64{2,4,6,8,10,16,18}),
+                          bigIntSlice([]int64{2,4,6,8,12,20,22})}
+    for s := 1; s <= 3; s += 1 {
+        t.Run(fmt.Sprintf("s=%d", s), func(t *testing.T) {
+            pk, sksdj, err := NewCustomDJCryptosystem(n, 256, s)
+            if err != nil {t.Fatal(err)}
+            sks := ConvertDJSKSlice(sksdj)
+            settings := createAHESettings(n, T, pk)
+            returns := make([]chan []*big.Int, n)
+            for i := 0; i < n; i += 1 {
+                returns[i] = make(chan []*big.Int)
+                go func(i int) {
+                    sh, uq := TPSIdiffWorker(items[i], sks[i], settings[i])
+                    returns[i] <- sh
+                    returns[i] <- uq
+                }(i)
+            }
+            for i := 0; i < n; i += 1 {
+                shared := <-returns[i]
+                unique := <-returns[i]
+                if shared == nil {
+                    t.Errorf("cardinality test failed at party %d", i)
+                    continue
+                }
+                expected_shared, expected_unique := expectedDiff(items, i)
+                if !sameElements(shared, expected_shared) || !sameElements(unique, expected_unique) {
+                    t.Errorf("party %d got shared %v and unique %v", i, shared, unique)
+                }
+            }
+        })
+    }
+}
+
+func TestDJKeyFile(t *testing.T) {
+    n := 2
+    pk, sks, err := NewDJCryptosystem(n)
+    if err != nil {t.Fatal(err)}
+    var file bytes.Buffer
+    err = WriteDJKey(&file, sks[0])
+    if err != nil {t.Fatal(err)}
+    read_pk, read_sk, err := ReadDJKey(&file)
+    if err != nil {t.Fatal(err)}
+    cipher, err := read_pk.Encrypt(big.NewInt(42))
+    if err != nil {t.Fatal(err)}
+    parts := make([]Partial_decryption, n)
+    parts[0], err = read_sk.PartialDecrypt(cipher)
+    if err != nil {t.Fatal(err)}
+    parts[1], err = sks[1].PartialDecrypt(cipher)
+    if err != nil {t.Fatal(err)}
+    plain, err := pk.CombinePartials(parts)
+    if err != nil {t.Fatal(err)}
+    if plain.Cmp(big.NewInt(42)) != 0 {
+        t.Errorf("decrypted %d with key read from file, expected 42", plain)
+    }
+}
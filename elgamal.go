@@ -0,0 +1,259 @@
+package tpsi
+
+import (
+    "crypto/elliptic"
+    "fmt"
+    "math/big"
+    "sync"
+    gm "github.com/ontanj/generic-matrix"
+)
+
+// additively homomorphic exponential ElGamal over an elliptic curve, where
+// m is encrypted as (rG, mG + rX) for the public key X = xG. The secret x is
+// dealt by a trusted dealer as an n-of-n additive sharing, so every party is
+// needed to decrypt. This isn't a threshold key. Decryption recovers m by a
+// discrete logarithm, so only plaintexts below Bound can be decrypted; whether
+// a ciphertext encrypts zero can always be determined, see ZeroTester.
+type ElGamal_encryption struct {
+    curve elliptic.Curve
+    X ElGamal_point // public key
+    Bound uint64 // plaintexts below Bound can be decrypted
+    table *elgamalTable // shared by all copies of the key
+}
+
+// baby steps jG of baby-step giant-step, built on the first decryption
+type elgamalTable struct {
+    once sync.Once
+    bound uint64 // Bound the table was built for
+    steps uint64
+    baby map[string]uint64
+}
+
+// point on the curve, the point at infinity is (0, 0)
+type ElGamal_point struct {
+    X, Y *big.Int
+}
+
+type ElGamal_ciphertext struct {
+    C1, C2 ElGamal_point
+}
+
+// one of n additive shares of the secret key, all are needed to decrypt
+type ElGamal_secret_key struct {
+    x *big.Int // additive share of the secret key
+    curve elliptic.Curve
+    index int
+}
+
+type ElGamal_partial struct {
+    Share ElGamal_point // x_i * C1
+    C2 ElGamal_point
+}
+
+// deal a key on P-256 as n-of-n additive shares for n parties
+func NewDealtElGamalCryptosystem(n int) (ElGamal_encryption, []ElGamal_secret_key, error) {
+    return NewCustomDealtElGamalCryptosystem(n, elliptic.P256(), 1 << 16)
+}
+
+// deal a key on curve as n-of-n additive shares for n parties, decrypting
+// plaintexts below bound. The dealer knows the secret key.
+func NewCustomDealtElGamalCryptosystem(n int, curve elliptic.Curve, bound uint64) (cryptosystem ElGamal_encryption, secret_keys []ElGamal_secret_key, err error) {
+    order := curve.Params().N
+    x := new(big.Int)
+    secret_keys = make([]ElGamal_secret_key, n)
+    for i := range secret_keys {
+        var share *big.Int
+        share, err = SampleInt(order)
+        if err != nil {return}
+        x.Add(x, share)
+        secret_keys[i] = ElGamal_secret_key{share, curve, i}
+    }
+    cryptosystem = ElGamal_encryption{curve, scalarBaseMult(curve, x), bound, new(elgamalTable)}
+    return
+}
+
+func isInfinity(p ElGamal_point) bool {
+    return (p.X == nil || p.X.Sign() == 0) && (p.Y == nil || p.Y.Sign() == 0)
+}
+
+func addPoints(curve elliptic.Curve, a, b ElGamal_point) ElGamal_point {
+    if isInfinity(a) {
+        return b
+    } else if isInfinity(b) {
+        return a
+    }
+    x, y := curve.Add(a.X, a.Y, b.X, b.Y)
+    return ElGamal_point{x, y}
+}
+
+func negatePoint(curve elliptic.Curve, a ElGamal_point) ElGamal_point {
+    if isInfinity(a) {
+        return a
+    }
+    return ElGamal_point{a.X, new(big.Int).Sub(curve.Params().P, a.Y)}
+}
+
+func scalarMult(curve elliptic.Curve, a ElGamal_point, k *big.Int) ElGamal_point {
+    k = new(big.Int).Mod(k, curve.Params().N)
+    if isInfinity(a) || k.Sign() == 0 {
+        return ElGamal_point{new(big.Int), new(big.Int)}
+    }
+    x, y := curve.ScalarMult(a.X, a.Y, k.Bytes())
+    return ElGamal_point{x, y}
+}
+
+func scalarBaseMult(curve elliptic.Curve, k *big.Int) ElGamal_point {
+    params := curve.Params()
+    return scalarMult(curve, ElGamal_point{params.Gx, params.Gy}, k)
+}
+
+func (pk ElGamal_encryption) Add(a, b Ciphertext) (sum Ciphertext, err error) {
+    ac := a.(ElGamal_ciphertext)
+    bc := b.(ElGamal_ciphertext)
+    return ElGamal_ciphertext{addPoints(pk.curve, ac.C1, bc.C1), addPoints(pk.curve, ac.C2, bc.C2)}, nil
+}
+
+func (pk ElGamal_encryption) Scale(cipher Ciphertext, factor *big.Int) (product Ciphertext, err error) {
+    c := cipher.(ElGamal_ciphertext)
+    return ElGamal_ciphertext{scalarMult(pk.curve, c.C1, factor), scalarMult(pk.curve, c.C2, factor)}, nil
+}
+
+func (pk ElGamal_encryption) Encrypt(plaintext *big.Int) (ciphertext Ciphertext, err error) {
+    r, err := SampleInt(pk.N())
+    if err != nil {return}
+    c1 := scalarBaseMult(pk.curve, r)
+    c2 := addPoints(pk.curve, scalarBaseMult(pk.curve, plaintext), scalarMult(pk.curve, pk.X, r))
+    return ElGamal_ciphertext{c1, c2}, nil
+}
+
+// combine partial decryptions to the point mG
+func (pk ElGamal_encryption) combine(parts []Partial_decryption) (ElGamal_point, error) {
+    if len(parts) == 0 {
+        return ElGamal_point{}, fmt.Errorf("no partial decryptions")
+    }
+    m := parts[0].(ElGamal_partial).C2
+    for _, part := range parts {
+        m = addPoints(pk.curve, m, negatePoint(pk.curve, part.(ElGamal_partial).Share))
+    }
+    return m, nil
+}
+
+// returns the plaintext if it is below Bound, found by baby-step giant-step
+func (pk ElGamal_encryption) CombinePartials(parts []Partial_decryption) (*big.Int, error) {
+    m, err := pk.combine(parts)
+    if err != nil {return nil, err}
+    if isInfinity(m) {
+        return big.NewInt(0), nil
+    }
+
+    table := pk.babySteps()
+    steps := table.steps
+    giant := negatePoint(pk.curve, scalarBaseMult(pk.curve, new(big.Int).SetUint64(steps)))
+    for i := uint64(0); i < steps; i += 1 {
+        if j, ok := table.baby[m.X.String() + "," + m.Y.String()]; ok {
+            return new(big.Int).SetUint64(i*steps + j), nil
+        }
+        m = addPoints(pk.curve, m, giant)
+    }
+    return nil, fmt.Errorf("plaintext not below %d", pk.Bound)
+}
+
+// table of the baby steps for Bound, built once per key. A key that wasn't
+// created by NewCustomDealtElGamalCryptosystem or whose Bound was changed
+// builds a table for every decryption.
+func (pk ElGamal_encryption) babySteps() *elgamalTable {
+    if pk.table == nil {
+        return pk.buildTable()
+    }
+    pk.table.once.Do(func() {
+        built := pk.buildTable()
+        pk.table.bound, pk.table.steps, pk.table.baby = built.bound, built.steps, built.baby
+    })
+    if pk.table.bound != pk.Bound {
+        return pk.buildTable()
+    }
+    return pk.table
+}
+
+func (pk ElGamal_encryption) buildTable() *elgamalTable {
+    steps := uint64(1)
+    for steps * steps < pk.Bound {
+        steps += 1
+    }
+    baby := make(map[string]uint64, steps)
+    p := ElGamal_point{new(big.Int), new(big.Int)}
+    for j := uint64(0); j < steps; j += 1 {
+        baby[p.X.String() + "," + p.Y.String()] = j
+        p = addPoints(pk.curve, p, scalarBaseMult(pk.curve, big.NewInt(1)))
+    }
+    return &elgamalTable{bound: pk.Bound, steps: steps, baby: baby}
+}
+
+// returns true if the partial decryptions combine to zero
+func (pk ElGamal_encryption) CombinePartialsIsZero(parts []Partial_decryption) (bool, error) {
+    m, err := pk.combine(parts)
+    if err != nil {return false, err}
+    return isInfinity(m), nil
+}
+
+func (pk ElGamal_encryption) EvaluationSpace() gm.Space {
+    return ElGamal_eval_space{pk}
+}
+
+// order of the curve
+func (pk ElGamal_encryption) N() *big.Int {
+    return pk.curve.Params().N
+}
+
+func (sk ElGamal_secret_key) PartialDecrypt(ciphertext Ciphertext) (Partial_decryption, error) {
+    c := ciphertext.(ElGamal_ciphertext)
+    return ElGamal_partial{scalarMult(sk.curve, c.C1, sk.x), c.C2}, nil
+}
+
+// evaluation space
+
+type ElGamal_eval_space struct {
+    ElGamal_encryption
+}
+
+func (pk ElGamal_eval_space) Add(a, b interface{}) (interface{}, error) {
+    return pk.ElGamal_encryption.Add(a, b)
+}
+
+func (pk ElGamal_eval_space) Subtract(a, b interface{}) (interface{}, error) {
+    neg, err := pk.ElGamal_encryption.Scale(b, big.NewInt(-1))
+    if err != nil {return nil, err}
+    return pk.ElGamal_encryption.Add(a, neg)
+}
+
+func (pk ElGamal_eval_space) Multiply(a, b interface{}) (interface{}, error) {
+    return nil, fmt.Errorf("multiplication not supported")
+}
+
+func (pk ElGamal_eval_space) Scale(ciphertext interface{}, factor interface{}) (interface{}, error) {
+    return pk.ElGamal_encryption.Scale(ciphertext, factor.(*big.Int))
+}
+
+func (pk ElGamal_eval_space) Scalarspace() bool {
+    return false
+}
+
+// resharing
+
+func (sk ElGamal_secret_key) ShareIndex() int {
+    return sk.index
+}
+
+func (sk ElGamal_secret_key) SplitShare(shares int) ([][]byte, error) {
+    return splitInt(sk.x, sk.curve.Params().N, shares)
+}
+
+func (sk ElGamal_secret_key) CombinePieces(pieces [][]byte) error {
+    sk.x.Set(combineInts(pieces, sk.curve.Params().N))
+    return nil
+}
+
+// key without share for a party replacing the holder of index, see CentralReshareWorker
+func (pk ElGamal_encryption) ReplacementKey(index int) ElGamal_secret_key {
+    return ElGamal_secret_key{new(big.Int), pk.curve, index}
+}
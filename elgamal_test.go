@@ -0,0 +1,122 @@
+package tpsi
+
+import (
+    "testing"
+    "math/big"
+)
+
+func TestElGamal(t *testing.T) {
+    n := 3
+    pk, sks, err := NewDealtElGamalCryptosystem(n)
+    if err != nil {t.Fatal(err)}
+    decrypt := func(c Ciphertext) (*big.Int, error) {
+        parts := make([]Partial_decryption, n)
+        for i, sk := range sks {
+            parts[i], err = sk.PartialDecrypt(c)
+            if err != nil {t.Fatal(err)}
+        }
+        return pk.CombinePartials(parts)
+    }
+
+    a, err := pk.Encrypt(big.NewInt(12))
+    if err != nil {t.Fatal(err)}
+    b, err := pk.Encrypt(big.NewInt(30))
+    if err != nil {t.Fatal(err)}
+
+    // 3a + b
+    sum, err := pk.Scale(a, big.NewInt(3))
+    if err != nil {t.Fatal(err)}
+    sum, err = pk.Add(sum, b)
+    if err != nil {t.Fatal(err)}
+    plain, err := decrypt(sum)
+    if err != nil {t.Fatal(err)}
+    if plain.Cmp(big.NewInt(66)) != 0 {
+        t.Errorf("expected 66, got %d", plain)
+    }
+
+    diff, err := pk.EvaluationSpace().Subtract(a, a)
+    if err != nil {t.Fatal(err)}
+    plain, err = decrypt(diff)
+    if err != nil {t.Fatal(err)}
+    if plain.Sign() != 0 {
+        t.Errorf("expected 0, got %d", plain)
+    }
+
+    large, err := pk.Encrypt(new(big.Int).SetUint64(pk.Bound))
+    if err != nil {t.Fatal(err)}
+    if _, err := decrypt(large); err == nil {
+        t.Error("plaintext out of range decrypted")
+    }
+
+    // the table is built once and shared by the copies of the key
+    table := pk.babySteps()
+    if table != pk.table || pk.EvaluationSpace().(ElGamal_eval_space).babySteps() != table {
+        t.Error("baby steps not cached for the key")
+    }
+}
+
+func runZeroTest(plain int64, pk AHE_Cryptosystem, sks []Secret_key) []bool {
+    n := len(sks)
+    settings := createAHESettings(n, 0, pk)
+    cipher, err := pk.Encrypt(big.NewInt(plain))
+    if err != nil {panic(err)}
+    return_channel := make(chan bool)
+    go func() {
+        return_channel <- CentralZeroTestWorker(cipher, sks[n-1], settings[n-1])
+    }()
+    for i := 0; i < n-1; i += 1 {
+        go func(i int) {
+            return_channel <- OuterZeroTestWorker(cipher, sks[i], settings[i])
+        }(i)
+    }
+    zero := make([]bool, n)
+    for i := range zero {
+        zero[i] = <-return_channel
+    }
+    return zero
+}
+
+func ConvertElGamalSKSlice(sks []ElGamal_secret_key) []Secret_key {
+    conv := make([]Secret_key, len(sks))
+    for i, sk := range sks {
+        conv[i] = sk
+    }
+    return conv
+}
+
+func TestElGamalZeroTestWorkers(t *testing.T) {
+    n := 4
+    pk, sks, err := NewDealtElGamalCryptosystem(n)
+    if err != nil {t.Fatal(err)}
+    for _, zero := range runZeroTest(0, pk, ConvertElGamalSKSlice(sks)) {
+        if !zero {
+            t.Error("zero test fail for 0")
+        }
+    }
+    // larger than Bound, can't be decrypted but is non-zero
+    for _, zero := range runZeroTest(1 << 40, pk, ConvertElGamalSKSlice(sks)) {
+        if zero {
+            t.Error("zero test true for 2^40")
+        }
+    }
+}
+
+func BenchmarkZeroTestDJ(b *testing.B) {
+    n := 4
+    pk, sks, err := NewDJCryptosystem(n)
+    if err != nil {b.Fatal(err)}
+    b.ResetTimer()
+    for i := 0; i < b.N; i += 1 {
+        runZeroTest(131, pk, ConvertDJSKSlice(sks))
+    }
+}
+
+func BenchmarkZeroTestElGamal(b *testing.B) {
+    n := 4
+    pk, sks, err := NewDealtElGamalCryptosystem(n)
+    if err != nil {b.Fatal(err)}
+    b.ResetTimer()
+    for i := 0; i < b.N; i += 1 {
+        runZeroTest(131, pk, ConvertElGamalSKSlice(sks))
+    }
+}
@@ -0,0 +1,507 @@
+package tpsi
+
+import (
+    "fmt"
+    "math/big"
+    "math/bits"
+    "sync"
+)
+
+// below these lengths the quadratic algorithms are faster
+const karatsubaThreshold = 32
+const fastDivisionThreshold = 64
+const multiEvalThreshold = 32
+
+// below this length of the shorter factor Karatsuba multiplication is faster
+// than transforms modulo several primes, see crtMult
+const crtThreshold = 1024
+
+// product of a and b by Karatsuba multiplication, with schoolbook multiplication
+// for short polynomials. An unbalanced product is split into products of a's halves with b.
+func karatsuba(a, b PlainPoly) PlainPoly {
+    if len(a) < len(b) {
+        a, b = b, a
+    }
+    if len(b) < karatsubaThreshold {
+        return schoolbook(a, b)
+    }
+    m := (len(a)+1)/2
+    prod := zeroPoly(len(a)+len(b)-1)
+    if len(b) <= m {
+        addShifted(prod, karatsuba(a[:m], b), 0)
+        addShifted(prod, karatsuba(a[m:], b), m)
+        return prod
+    }
+    z0 := karatsuba(a[:m], b[:m])
+    z2 := karatsuba(a[m:], b[m:])
+    z1 := karatsuba(addPoly(a[:m], a[m:]), addPoly(b[:m], b[m:]))
+    for i := range z1 {
+        if i < len(z0) {z1[i].Sub(z1[i], z0[i])}
+        if i < len(z2) {z1[i].Sub(z1[i], z2[i])}
+    }
+    addShifted(prod, z0, 0)
+    addShifted(prod, z1, m)
+    addShifted(prod, z2, 2*m)
+    return prod
+}
+
+func schoolbook(a, b PlainPoly) PlainPoly {
+    prod := zeroPoly(len(a)+len(b)-1)
+    term := new(big.Int)
+    for i, x := range a {
+        for j, y := range b {
+            prod[i+j].Add(prod[i+j], term.Mul(x, y))
+        }
+    }
+    return prod
+}
+
+func zeroPoly(l int) PlainPoly {
+    p := make(PlainPoly, l)
+    for i := range p {
+        p[i] = new(big.Int)
+    }
+    return p
+}
+
+// sum of a and b
+func addPoly(a, b PlainPoly) PlainPoly {
+    if len(a) < len(b) {
+        a, b = b, a
+    }
+    sum := make(PlainPoly, len(a))
+    for i := range a {
+        sum[i] = new(big.Int).Set(a[i])
+        if i < len(b) {sum[i].Add(sum[i], b[i])}
+    }
+    return sum
+}
+
+// adds x^shift·q to p. Coefficients beyond the length of p must be zero, as in
+// the middle product of karatsuba.
+func addShifted(p, q PlainPoly, shift int) {
+    for i, c := range q {
+        if i+shift >= len(p) {break}
+        p[i+shift].Add(p[i+shift], c)
+    }
+}
+
+// copy of p with the coefficients reduced modulo mod
+func reducePoly(p PlainPoly, mod *big.Int) PlainPoly {
+    r := make(PlainPoly, len(p))
+    for i, c := range p {
+        r[i] = new(big.Int).Mod(c, mod)
+    }
+    return r
+}
+
+// the first l coefficients of p
+func truncatePoly(p PlainPoly, l int) PlainPoly {
+    if len(p) > l {
+        return p[:l]
+    }
+    return p
+}
+
+// the coefficients of p in reverse order, padded with zeros to length l
+func reversePoly(p PlainPoly, l int) PlainPoly {
+    r := make(PlainPoly, l)
+    for i := range r {
+        if j := l-1-i; j < len(p) {
+            r[i] = p[j]
+        } else {
+            r[i] = new(big.Int)
+        }
+    }
+    return r
+}
+
+// MultPoly with the coefficients of the product reduced modulo mod. Uses the number
+// theoretic transform if mod is a prime with large enough roots of unity, like the
+// BFV plaintext modulus 65537. Long products modulo other moduli, e.g. Damgård-Jurik
+// or BFV beyond a transform of length 2^16, are computed by transforms modulo several
+// primes, see crtMult. Short products use Karatsuba multiplication.
+func MultPolyMod(p1, p2 PlainPoly, mod *big.Int) PlainPoly {
+    if len(p1) >= karatsubaThreshold && len(p2) >= karatsubaThreshold {
+        if field, ok := nttFor(mod, len(p1)+len(p2)-1); ok {
+            return field.mult(p1, p2)
+        }
+    }
+    if len(p1) >= crtThreshold && len(p2) >= crtThreshold {
+        if prod, ok := crtMult(p1, p2, mod); ok {
+            return prod
+        }
+    }
+    return reducePoly(MultPoly(p1, p2), mod)
+}
+
+// prime field for the number theoretic transform, the prime is smaller than 2^31
+// so that products fit in a uint64
+type nttField struct {
+    mod *big.Int
+    p uint64
+    root uint64 // primitive root modulo p
+    max_log int // largest k such that 2^k divides p-1, the largest transform is of length 2^k
+}
+
+// fields by modulus, nil for moduli that aren't suitable
+var nttFields sync.Map
+
+// the field of mod if a transform of length at least l exists
+func nttFor(mod *big.Int, l int) (*nttField, bool) {
+    if mod.BitLen() > 31 || mod.Sign() <= 0 {
+        return nil, false
+    }
+    p := mod.Uint64()
+    cached, ok := nttFields.Load(p)
+    if !ok {
+        var field *nttField
+        if p > 2 && mod.ProbablyPrime(20) {
+            field = &nttField{new(big.Int).Set(mod), p, primitiveRoot(p), bits.TrailingZeros64(p-1)}
+        }
+        cached, _ = nttFields.LoadOrStore(p, field)
+    }
+    field := cached.(*nttField)
+    if field == nil || l > 1<<field.max_log {
+        return nil, false
+    }
+    return field, true
+}
+
+// smallest generator of the multiplicative group modulo the prime p
+func primitiveRoot(p uint64) uint64 {
+    var factors []uint64
+    m := p-1
+    for q := uint64(2); q*q <= m; q += 1 {
+        if m%q == 0 {
+            factors = append(factors, q)
+            for m%q == 0 {
+                m /= q
+            }
+        }
+    }
+    if m > 1 {
+        factors = append(factors, m)
+    }
+    for g := uint64(2); ; g += 1 {
+        generator := true
+        for _, q := range factors {
+            if powMod(g, (p-1)/q, p) == 1 {
+                generator = false
+                break
+            }
+        }
+        if generator {
+            return g
+        }
+    }
+}
+
+func powMod(base, exp, p uint64) uint64 {
+    result := uint64(1)
+    base %= p
+    for ; exp > 0; exp >>= 1 {
+        if exp&1 == 1 {
+            result = result * base % p
+        }
+        base = base * base % p
+    }
+    return result
+}
+
+func (f *nttField) mult(a, b PlainPoly) PlainPoly {
+    l := len(a)+len(b)-1
+    size := 1
+    for size < l {
+        size <<= 1
+    }
+    fa, fb := f.load(a, size), f.load(b, size)
+    f.transform(fa, false)
+    f.transform(fb, false)
+    for i := range fa {
+        fa[i] = fa[i] * fb[i] % f.p
+    }
+    f.transform(fa, true)
+    prod := make(PlainPoly, l)
+    for i := range prod {
+        prod[i] = new(big.Int).SetUint64(fa[i])
+    }
+    return prod
+}
+
+// p reduced modulo the prime and padded with zeros to length size
+func (f *nttField) load(p PlainPoly, size int) []uint64 {
+    a := make([]uint64, size)
+    c := new(big.Int)
+    for i, coeff := range p {
+        a[i] = c.Mod(coeff, f.mod).Uint64()
+    }
+    return a
+}
+
+// in place iterative transform of a, whose length is a power of 2
+func (f *nttField) transform(a []uint64, inverse bool) {
+    n := len(a)
+    for i, j := 1, 0; i < n; i += 1 {
+        bit := n >> 1
+        for ; j&bit != 0; bit >>= 1 {
+            j ^= bit
+        }
+        j ^= bit
+        if i < j {
+            a[i], a[j] = a[j], a[i]
+        }
+    }
+    for length := 2; length <= n; length <<= 1 {
+        w := powMod(f.root, (f.p-1)/uint64(length), f.p)
+        if inverse {
+            w = powMod(w, f.p-2, f.p)
+        }
+        half := length/2
+        for i := 0; i < n; i += length {
+            wj := uint64(1)
+            for j := i; j < i+half; j += 1 {
+                u, v := a[j], a[j+half] * wj % f.p
+                a[j] = (u + v) % f.p
+                a[j+half] = (u + f.p - v) % f.p
+                wj = wj * w % f.p
+            }
+        }
+    }
+    if inverse {
+        n_inv := powMod(uint64(n), f.p-2, f.p)
+        for i := range a {
+            a[i] = a[i] * n_inv % f.p
+        }
+    }
+}
+
+// x modulo the prime, x must not be negative
+func (f *nttField) residue(x *big.Int) uint64 {
+    r := uint64(0)
+    words := x.Bits()
+    for i := len(words)-1; i >= 0; i -= 1 {
+        if bits.UintSize == 64 {
+            r = bits.Rem64(r, uint64(words[i]), f.p)
+        } else {
+            r = (r<<32 | uint64(words[i])) % f.p
+        }
+    }
+    return r
+}
+
+// product of a and b, whose coefficients must be reduced, modulo the prime
+func (f *nttField) multReduced(a, b PlainPoly, size int) []uint64 {
+    fa, fb := make([]uint64, size), make([]uint64, size)
+    for i, c := range a {
+        fa[i] = f.residue(c)
+    }
+    for i, c := range b {
+        fb[i] = f.residue(c)
+    }
+    f.transform(fa, false)
+    f.transform(fb, false)
+    for i := range fa {
+        fa[i] = fa[i] * fb[i] % f.p
+    }
+    f.transform(fa, true)
+    return fa
+}
+
+// primes p = c·2^k + 1 between 2^30 and 2^31 by decreasing c, by k
+var crtPrimes = struct {
+    sync.Mutex
+    by_log map[int][]*nttField
+    searched map[int]uint64 // smallest c tried for k
+}{by_log: make(map[int][]*nttField), searched: make(map[int]uint64)}
+
+// the first count primes for transforms of length 2^k, fewer if there aren't as many
+func crtPrimesFor(k, count int) []*nttField {
+    crtPrimes.Lock()
+    defer crtPrimes.Unlock()
+    fields := crtPrimes.by_log[k]
+    c, ok := crtPrimes.searched[k]
+    if !ok {
+        c = (1<<31 - 1) >> k + 1
+    }
+    for len(fields) < count && c > 1 && (c-1)<<k >= 1<<30 {
+        c -= 1
+        p := c<<k + 1
+        mod := new(big.Int).SetUint64(p)
+        if mod.ProbablyPrime(20) {
+            fields = append(fields, &nttField{mod, p, primitiveRoot(p), bits.TrailingZeros64(p-1)})
+        }
+    }
+    crtPrimes.by_log[k] = fields
+    crtPrimes.searched[k] = c
+    if len(fields) > count {
+        return fields[:count]
+    }
+    return fields
+}
+
+// product of a and b modulo mod by transforms modulo primes whose product exceeds
+// the coefficients of the product over the integers, which are then recovered by
+// the Chinese remainder theorem. The primes are above 2^30, so a product modulo a
+// 2048-bit modulus takes 138 transforms. Returns false if there aren't enough
+// primes for a transform of the length of the product.
+func crtMult(a, b PlainPoly, mod *big.Int) (PlainPoly, bool) {
+    l := len(a)+len(b)-1
+    size, k := 1, 0
+    for size < l {
+        size <<= 1
+        k += 1
+    }
+    short := len(a)
+    if len(b) < short {
+        short = len(b)
+    }
+    // coefficients are below short·mod^2
+    count := (2*mod.BitLen() + bits.Len(uint(short))) / 30 + 1
+    fields := crtPrimesFor(k, count)
+    if len(fields) < count {
+        return nil, false
+    }
+    a, b = reducePoly(a, mod), reducePoly(b, mod)
+    residues := make([][]uint64, count)
+    var wg sync.WaitGroup
+    wg.Add(count)
+    for i, f := range fields {
+        go func(i int, f *nttField) {
+            defer wg.Done()
+            residues[i] = f.multReduced(a, b, size)
+        }(i, f)
+    }
+    wg.Wait()
+
+    // x = sum of residue_i·M/p_i·(M/p_i)^-1 modulo M, the product M of all primes
+    M := big.NewInt(1)
+    for _, f := range fields {
+        M.Mul(M, f.mod)
+    }
+    basis := make([]*big.Int, count)
+    for i, f := range fields {
+        Mi := new(big.Int).Quo(M, f.mod)
+        basis[i] = Mi.Mul(Mi, new(big.Int).ModInverse(new(big.Int).Mod(Mi, f.mod), f.mod))
+    }
+    prod := make(PlainPoly, l)
+    term, r := new(big.Int), new(big.Int)
+    for j := range prod {
+        x := new(big.Int)
+        for i := range fields {
+            x.Add(x, term.Mul(basis[i], r.SetUint64(residues[i][j])))
+        }
+        prod[j] = x.Mod(x.Mod(x, M), mod)
+    }
+    return prod, true
+}
+
+// subproduct tree of the linear factors x - point, modulo mod. The first level holds
+// the factors, every following level the products of pairs of the level before,
+// and the last level the product of all factors. A node without a pair is carried up.
+func subproductTree(points []*big.Int, mod *big.Int) [][]PlainPoly {
+    level := make([]PlainPoly, len(points))
+    for i, point := range points {
+        level[i] = PlainPoly{new(big.Int).Neg(point), big.NewInt(1)}
+        level[i][0].Mod(level[i][0], mod)
+    }
+    tree := [][]PlainPoly{level}
+    for len(level) > 1 {
+        next := make([]PlainPoly, (len(level)+1)/2)
+        for i := range next {
+            if 2*i+1 < len(level) {
+                next[i] = MultPolyMod(level[2*i], level[2*i+1], mod)
+            } else {
+                next[i] = level[2*i]
+            }
+        }
+        tree = append(tree, next)
+        level = next
+    }
+    return tree
+}
+
+// inverse of the power series f modulo x^k and mod by Newton iteration, f[0] must be invertible
+func seriesInverse(f PlainPoly, k int, mod *big.Int) PlainPoly {
+    g0 := new(big.Int).ModInverse(f[0], mod)
+    if g0 == nil {panic(fmt.Errorf("constant term %d isn't invertible", f[0]))}
+    g := PlainPoly{g0}
+    for l := 1; l < k; {
+        l *= 2
+        if l > k {
+            l = k
+        }
+        // g = g·(2 - f·g) mod x^l
+        e := truncatePoly(MultPolyMod(truncatePoly(f, l), g, mod), l)
+        for _, c := range e {
+            c.Neg(c)
+        }
+        e[0].Add(e[0], big.NewInt(2))
+        g = truncatePoly(MultPolyMod(g, e, mod), l)
+    }
+    return g
+}
+
+// remainder of a divided by the monic polynomial b, modulo mod. Long divisions use
+// the inverse of the reversed b, so the quotient takes two multiplications.
+func polyRemMonic(a, b PlainPoly, mod *big.Int) PlainPoly {
+    m := len(b)-1
+    if len(a) <= m {
+        return a
+    }
+    k := len(a)-m // length of the quotient
+    if k < fastDivisionThreshold || m < fastDivisionThreshold {
+        r := reducePoly(a, mod)
+        term := new(big.Int)
+        for i := len(r)-1; i >= m; i -= 1 {
+            if r[i].Sign() == 0 {continue}
+            for j := 0; j < m; j += 1 {
+                r[i-m+j].Sub(r[i-m+j], term.Mul(r[i], b[j])).Mod(r[i-m+j], mod)
+            }
+        }
+        return r[:m]
+    }
+    rev_q := truncatePoly(MultPolyMod(reversePoly(a, len(a))[:k], seriesInverse(reversePoly(b, len(b)), k, mod), mod), k)
+    qb := MultPolyMod(reversePoly(rev_q, k), b, mod)
+    r := make(PlainPoly, m)
+    for i := range r {
+        r[i] = new(big.Int).Sub(a[i], qb[i])
+        r[i].Mod(r[i], mod)
+    }
+    return r
+}
+
+// evaluations of p at points modulo mod. With many points and a long p the values are
+// the remainders of p down the subproduct tree of the points, otherwise EvalPoly is
+// used for each point.
+func MultiEvalPoly(p PlainPoly, points []*big.Int, mod *big.Int) []*big.Int {
+    values := make([]*big.Int, len(points))
+    if len(points) < multiEvalThreshold || len(p) < multiEvalThreshold {
+        for i, x := range points {
+            values[i] = EvalPoly(p, x, mod)
+        }
+        return values
+    }
+    tree := subproductTree(points, mod)
+    rems := []PlainPoly{polyRemMonic(p, tree[len(tree)-1][0], mod)}
+    for level := len(tree)-2; level >= 0; level -= 1 {
+        next := make([]PlainPoly, len(tree[level]))
+        for i, node := range tree[level] {
+            next[i] = polyRemMonic(rems[i/2], node, mod)
+        }
+        rems = next
+    }
+    for i, x := range points {
+        values[i] = EvalPoly(rems[i], x, mod)
+    }
+    return values
+}
+
+// the points 1, 3, 5, ... at which the protocols evaluate polynomials
+func oddPoints(l int) []*big.Int {
+    points := make([]*big.Int, l)
+    for i := range points {
+        points[i] = big.NewInt(int64(2*i+1))
+    }
+    return points
+}
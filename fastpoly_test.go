@@ -0,0 +1,169 @@
+package tpsi
+
+import (
+    "crypto/rand"
+    "math/big"
+    "testing"
+)
+
+func t_randomPoly(t *testing.T, l int, mod *big.Int) PlainPoly {
+    p, err := SampleSlice(l, mod)
+    if err != nil {t.Fatal(err)}
+    return PlainPoly(p)
+}
+
+func t_samePoly(a, b PlainPoly, mod *big.Int) bool {
+    if len(a) != len(b) {
+        return false
+    }
+    for i := range a {
+        if new(big.Int).Mod(a[i], mod).Cmp(new(big.Int).Mod(b[i], mod)) != 0 {
+            return false
+        }
+    }
+    return true
+}
+
+func TestMultPolyMod(t *testing.T) {
+    composite, err := rand.Prime(rand.Reader, 256)
+    if err != nil {t.Fatal(err)}
+    composite.Mul(composite, composite)
+    for _, mod := range []*big.Int{big.NewInt(65537), big.NewInt(7681), composite} {
+        for _, l := range [][2]int{{1, 1}, {5, 40}, {31, 33}, {100, 100}, {257, 70}, {600, 1}, {300, 400}} {
+            a, b := t_randomPoly(t, l[0], mod), t_randomPoly(t, l[1], mod)
+            expected := reducePoly(schoolbook(a, b), mod)
+            if prod := MultPolyMod(a, b, mod); !t_samePoly(prod, expected, mod) {
+                t.Errorf("wrong product of lengths %d and %d modulo %d", l[0], l[1], mod)
+            }
+            if prod := MultPoly(a, b); !t_samePoly(prod, expected, mod) {
+                t.Errorf("wrong Karatsuba product of lengths %d and %d", l[0], l[1])
+            }
+        }
+    }
+    // 7681 - 1 = 2^9·15, longer products don't fit a transform
+    if _, ok := nttFor(big.NewInt(7681), 513); ok {
+        t.Error("expected no transform of length 513 modulo 7681")
+    }
+    if _, ok := nttFor(big.NewInt(65535), 4); ok {
+        t.Error("expected no transform for composite modulus")
+    }
+}
+
+func TestCRTMult(t *testing.T) {
+    composite, err := rand.Prime(rand.Reader, 512)
+    if err != nil {t.Fatal(err)}
+    composite.Mul(composite, big.NewInt(1000003))
+    for _, mod := range []*big.Int{big.NewInt(65537), big.NewInt(7681), composite} {
+        for _, l := range [][2]int{{1, 1}, {300, 300}, {1000, 257}} {
+            a, b := t_randomPoly(t, l[0], mod), t_randomPoly(t, l[1], mod)
+            prod, ok := crtMult(a, b, mod)
+            if !ok {
+                t.Fatalf("no primes for lengths %d and %d modulo %d", l[0], l[1], mod)
+            }
+            if !t_samePoly(prod, reducePoly(karatsuba(a, b), mod), mod) {
+                t.Errorf("wrong product of lengths %d and %d modulo %d", l[0], l[1], mod)
+            }
+        }
+    }
+    // only a few primes c·2^26 + 1 lie between 2^30 and 2^31
+    if fields := crtPrimesFor(26, 100); len(fields) == 0 || len(fields) >= 100 {
+        t.Errorf("got %d primes for transforms of length 2^26", len(fields))
+    }
+    for _, f := range crtPrimesFor(17, 10) {
+        if (f.p-1) % (1<<17) != 0 || f.p < 1<<30 || f.p >= 1<<31 {
+            t.Errorf("%d isn't a prime for transforms of length 2^17", f.p)
+        }
+    }
+}
+
+func TestPolyRemMonic(t *testing.T) {
+    mod := big.NewInt(1000003)
+    for _, l := range [][2]int{{10, 3}, {300, 100}, {500, 1}, {20, 30}} {
+        a := t_randomPoly(t, l[0], mod)
+        b := append(t_randomPoly(t, l[1]-1, mod), big.NewInt(1))
+        r := polyRemMonic(a, b, mod)
+        // schoolbook remainder
+        expected := reducePoly(a, mod)
+        term := new(big.Int)
+        for i := len(expected)-1; i >= len(b)-1; i -= 1 {
+            for j := 0; j < len(b)-1; j += 1 {
+                k := i-(len(b)-1)+j
+                expected[k].Sub(expected[k], term.Mul(expected[i], b[j])).Mod(expected[k], mod)
+            }
+        }
+        expected = truncatePoly(expected, len(b)-1)
+        if !t_samePoly(r, expected, mod) {
+            t.Errorf("wrong remainder of lengths %d and %d", l[0], l[1])
+        }
+    }
+}
+
+func TestMultiEvalPoly(t *testing.T) {
+    composite, err := rand.Prime(rand.Reader, 128)
+    if err != nil {t.Fatal(err)}
+    composite.Mul(composite, big.NewInt(1000003))
+    for _, mod := range []*big.Int{big.NewInt(65537), composite} {
+        for _, l := range [][2]int{{3, 10}, {200, 5}, {40, 40}, {300, 150}, {50, 333}} {
+            p := t_randomPoly(t, l[0], mod)
+            points := t_randomPoly(t, l[1], mod)
+            values := MultiEvalPoly(p, points, mod)
+            for i, x := range points {
+                if expected := EvalPoly(p, x, mod); values[i].Cmp(expected) != 0 {
+                    t.Errorf("polynomial of length %d at %d points: got %d at %d, expected %d", l[0], l[1], values[i], x, expected)
+                }
+            }
+        }
+    }
+}
+
+func TestPolyFromManyRoots(t *testing.T) {
+    for _, mod := range []*big.Int{big.NewInt(65537), new(big.Int).Lsh(big.NewInt(1), 512)} {
+        roots := make([]*big.Int, 1000)
+        for i := range roots {
+            roots[i] = big.NewInt(int64(2*i))
+        }
+        p := PolyFromRoots(roots, mod)
+        if len(p) != len(roots)+1 || p[len(roots)].Cmp(big.NewInt(1)) != 0 {
+            t.Fatalf("expected monic polynomial of degree %d", len(roots))
+        }
+        values := MultiEvalPoly(p, append(roots, big.NewInt(1)), mod)
+        for i := range roots {
+            if values[i].Sign() != 0 {
+                t.Errorf("%d isn't a root", roots[i])
+            }
+        }
+        if values[len(roots)].Sign() == 0 {
+            t.Error("1 is a root")
+        }
+    }
+}
+
+func BenchmarkPolyFromRoots(b *testing.B) {
+    for _, c := range []struct {name string; mod *big.Int; roots int} {
+        {"dj", new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 2048), big.NewInt(1)), 2048}, // size of a Damgård-Jurik modulus
+        {"bfv", big.NewInt(65537), 8192},
+        {"dj-1e5", new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 2048), big.NewInt(1)), 100000},
+        {"bfv-1e5", big.NewInt(65537), 100000}, // longer than a transform modulo 65537
+    } {
+        roots := make([]*big.Int, c.roots)
+        for i := range roots {
+            roots[i] = big.NewInt(int64(2*i))
+        }
+        b.Run(c.name + "/tree", func(b *testing.B) {
+            for i := 0; i < b.N; i += 1 {
+                PolyFromRoots(roots, c.mod)
+            }
+        })
+        if c.roots > 10000 { // too slow one by one
+            continue
+        }
+        b.Run(c.name + "/sequential", func(b *testing.B) {
+            for i := 0; i < b.N; i += 1 {
+                poly := PlainPoly{big.NewInt(1)}
+                for _, root := range roots {
+                    poly = reducePoly(schoolbook(poly, PlainPoly{new(big.Int).Neg(root), big.NewInt(1)}), c.mod)
+                }
+            }
+        })
+    }
+}
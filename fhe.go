@@ -1,35 +1,78 @@
 package tpsi
 
 import (
+    "fmt"
     "math/big"
 )
 
 
 func SetupFHE(n, T int, cs []FHE_Cryptosystem) ([]FHESetting) {
+    return SetupFHEWithCentral(n, T, n-1, cs)
+}
+
+// create settings for n parties where party central acts as central party
+func SetupFHEWithCentral(n, T, central int, cs []FHE_Cryptosystem) ([]FHESetting) {
+    ahe_settings := SetupAHEWithCentral(n, T, central, nil)
     settings := make([]FHESetting, n)
-    channels := create_chans(n-1)
-    for i := 0; i < n-1; i += 1 {
+    for i := range settings {
+        settings[i].AHESetting = ahe_settings[i]
+        settings[i].AHESetting.cs = cs[i]
         settings[i].cs = cs[i]
-        settings[i].n = n
-        settings[i].channel = channels[i]
-        settings[i].T = T
     }
-    settings[n-1].cs = cs[n-1]
-    settings[n-1].n = n
-    settings[n-1].channels = channels
-    settings[n-1].T = T
-
     return settings
 }
 
-func CentralInverseWorker(a Ciphertext, sk Secret_key, setting FHE_setting) Ciphertext {
+// multiplication of two ciphertexts: homomorphic if setting has an FHE
+// cryptosystem, otherwise using the interactive multiplication workers.
+// Must be called by all parties in the same order.
+func ciphertextMultiplier(sk Secret_key, setting AHE_setting) func(a, b Ciphertext) Ciphertext {
+    if fhe, ok := setting.(FHE_setting); ok {
+        return func(a, b Ciphertext) Ciphertext {
+            prod, err := fhe.FHE_cryptosystem().Multiply(a, b)
+            if err != nil {panic(err)}
+            return prod
+        }
+    }
+    return func(a, b Ciphertext) Ciphertext {
+        if setting.IsCentral() {
+            return CentralMultWorker(a, b, sk, setting)
+        }
+        return OuterMultWorker(a, b, sk, setting)
+    }
+}
+
+// multiplication of a ciphertext with a plaintext known to all parties. Without
+// an FHE cryptosystem the central party scales and distributes the result, so
+// that all parties hold the same ciphertext. Must be called by all parties in the same order.
+func plaintextMultiplier(setting AHE_setting) func(a Ciphertext, b *big.Int) Ciphertext {
+    if fhe, ok := setting.(FHE_setting); ok {
+        return func(a Ciphertext, b *big.Int) Ciphertext {
+            b_enc, err := fhe.FHE_cryptosystem().Encrypt(b)
+            if err != nil {panic(err)}
+            prod, err := fhe.FHE_cryptosystem().Multiply(a, b_enc)
+            if err != nil {panic(err)}
+            return prod
+        }
+    }
+    return func(a Ciphertext, b *big.Int) Ciphertext {
+        if !setting.IsCentral() {
+            return (setting.Receive()).(Ciphertext)
+        }
+        prod, err := setting.AHE_cryptosystem().Scale(a, b)
+        if err != nil {panic(err)}
+        setting.Distribute(prod)
+        return prod
+    }
+}
+
+func CentralInverseWorker(a Ciphertext, sk Secret_key, setting AHE_setting) Ciphertext {
     return CentralInverseWorkerWithFactor(a, big.NewInt(1), sk, setting)
 }
 
-func CentralInverseWorkerWithFactor(a Ciphertext, factor *big.Int, sk Secret_key, setting FHE_setting) Ciphertext {
-    mask_clear, err := SampleInt(setting.FHE_cryptosystem().N())
+func CentralInverseWorkerWithFactor(a Ciphertext, factor *big.Int, sk Secret_key, setting AHE_setting) Ciphertext {
+    mask_clear, err := sampleInt(setting, setting.AHE_cryptosystem().N())
     if err != nil {panic(err)}
-    mask, err := setting.FHE_cryptosystem().Encrypt(mask_clear)
+    mask, err := setting.AHE_cryptosystem().Encrypt(mask_clear)
     if err != nil {panic(err)}
 
     // recieve all masks
@@ -40,36 +83,31 @@ func CentralInverseWorkerWithFactor(a Ciphertext, factor *big.Int, sk Secret_key
     setting.Distribute(masks)
 
     // multipy all masks
+    multiply := ciphertextMultiplier(sk, setting)
     mask = masks[0]
     for i := 1; i < setting.Parties(); i += 1 {
-        mask, err = setting.FHE_cryptosystem().Multiply(mask, masks[i])
-        if err != nil {panic(err)}
+        mask = multiply(mask, masks[i])
     }
     
     // mask ciphertext
-    ab_enc, err := setting.FHE_cryptosystem().Multiply(mask, a)
-    if err != nil {panic(err)}
+    ab_enc := multiply(mask, a)
 
     // decrypt and invert
     ab := CentralDecryptionWorker(ab_enc, sk, setting)
-    ab.ModInverse(ab, setting.FHE_cryptosystem().N()).Mul(ab, factor)
-    ab_inv_enc, err := setting.FHE_cryptosystem().Encrypt(ab)
-    if err != nil {panic(err)}
-    
-    a_inv, err := setting.FHE_cryptosystem().Multiply(ab_inv_enc, mask)
-    if err != nil {panic(err)}
+    ab.ModInverse(ab, setting.AHE_cryptosystem().N()).Mul(ab, factor)
+    a_inv := plaintextMultiplier(setting)(mask, ab)
 
     return a_inv
 }
 
-func OuterInverseWorker(a Ciphertext, sk Secret_key, setting FHE_setting) Ciphertext {
+func OuterInverseWorker(a Ciphertext, sk Secret_key, setting AHE_setting) Ciphertext {
     return OuterInverseWorkerWithFactor(a, big.NewInt(1), sk, setting)
 }
 
-func OuterInverseWorkerWithFactor(a Ciphertext, factor *big.Int, sk Secret_key, setting FHE_setting) Ciphertext {
-    mask_clear, err := SampleInt(setting.FHE_cryptosystem().N())
+func OuterInverseWorkerWithFactor(a Ciphertext, factor *big.Int, sk Secret_key, setting AHE_setting) Ciphertext {
+    mask_clear, err := sampleInt(setting, setting.AHE_cryptosystem().N())
     if err != nil {panic(err)}
-    mask, err := setting.FHE_cryptosystem().Encrypt(mask_clear)
+    mask, err := setting.AHE_cryptosystem().Encrypt(mask_clear)
     if err != nil {panic(err)}
 
     // send mask
@@ -79,32 +117,30 @@ func OuterInverseWorkerWithFactor(a Ciphertext, factor *big.Int, sk Secret_key,
     masks := (setting.Receive()).([]Ciphertext)
     
     // multiply all masks
+    multiply := ciphertextMultiplier(sk, setting)
     mask = masks[0]
     for i := 1; i < setting.Parties(); i += 1 {
-        mask, err = setting.FHE_cryptosystem().Multiply(mask, masks[i])
-        if err != nil {panic(err)}
+        mask = multiply(mask, masks[i])
     }
 
     // mask ciphertext
-    ab_enc, err := setting.FHE_cryptosystem().Multiply(mask, a)
-    if err != nil {panic(err)}
+    ab_enc := multiply(mask, a)
 
     // decrypt and invert
     ab := OuterDecryptionWorker(ab_enc, sk, setting)
-    ab.ModInverse(ab, setting.FHE_cryptosystem().N()).Mul(ab, factor)
-    ab_inv_enc, err := setting.FHE_cryptosystem().Encrypt(ab)
-    if err != nil {panic(err)}
-
-    a_inv, err := setting.FHE_cryptosystem().Multiply(ab_inv_enc, mask)
-    if err != nil {panic(err)}
+    ab.ModInverse(ab, setting.AHE_cryptosystem().N()).Mul(ab, factor)
+    a_inv := plaintextMultiplier(setting)(mask, ab)
 
     return a_inv
 }
 
-func FHEInterpolation(q []Ciphertext, sk Secret_key, setting FHE_setting) []Ciphertext {
+func FHEInterpolation(q []Ciphertext, sk Secret_key, setting AHE_setting) []Ciphertext {
     sample_max := 2*setting.Threshold() + 3
     var err error
-    cs := setting.FHE_cryptosystem()
+    cs := setting.AHE_cryptosystem()
+
+    multiply := ciphertextMultiplier(sk, setting)
+    scale := plaintextMultiplier(setting)
 
     relations := make([][]Ciphertext, sample_max)
     zero, err := cs.Encrypt(big.NewInt(0))
@@ -130,10 +166,7 @@ func FHEInterpolation(q []Ciphertext, sk Secret_key, setting FHE_setting) []Ciph
         }
         x_pow = big.NewInt(1)
         for ; j < sample_max + 1; j += 1 {
-            neg_x, err := cs.Encrypt(new(big.Int).Sub(cs.N(), x_pow))
-            if err != nil {panic(err)}
-            eq[j], err = cs.Multiply(q[coeff_pos], neg_x)
-            if err != nil {panic(err)}
+            eq[j] = scale(q[coeff_pos], new(big.Int).Sub(cs.N(), x_pow))
             x_pow.Mul(x_pow, x).Mod(x_pow, cs.N())
         }
 
@@ -141,8 +174,7 @@ func FHEInterpolation(q []Ciphertext, sk Secret_key, setting FHE_setting) []Ciph
         for prev_coeff := 0; prev_coeff < coeff_pos; prev_coeff += 1 {
             coeff := eq[prev_coeff]
             for i := prev_coeff + 1; i < sample_max + 1; i += 1 {
-                store, err := cs.Multiply(relations[prev_coeff][i], coeff)
-                if err != nil {panic(err)}
+                store := multiply(relations[prev_coeff][i], coeff)
                 eq[i], err = cs.Add(store, eq[i])
                 if err != nil {panic(err)}
             }
@@ -174,9 +206,7 @@ func FHEInterpolation(q []Ciphertext, sk Secret_key, setting FHE_setting) []Ciph
             rel_row[rem_coeff] = zero
         }
         for ; rem_coeff < sample_max + 1; rem_coeff += 1 {
-            rel, err := cs.Multiply(eq[rem_coeff], coeff_inv)
-            if err != nil {panic(err)}
-            rel_row[rem_coeff] = rel
+            rel_row[rem_coeff] = multiply(eq[rem_coeff], coeff_inv)
         }
         
         relations[coeff_pos] = rel_row
@@ -198,8 +228,7 @@ func FHEInterpolation(q []Ciphertext, sk Secret_key, setting FHE_setting) []Ciph
 
         if err != nil {panic(err)}
         for known_coeff := solving_coeff + 1; known_coeff <= coeff_pos; known_coeff += 1 {
-            store, err := cs.Multiply(relations[solving_coeff][known_coeff], interpolated_coeffs[known_coeff])
-            if err != nil {panic(err)}
+            store := multiply(relations[solving_coeff][known_coeff], interpolated_coeffs[known_coeff])
             coeff, err = cs.Add(coeff, store)
             if err != nil {panic(err)}
         }
@@ -211,32 +240,30 @@ func FHEInterpolation(q []Ciphertext, sk Secret_key, setting FHE_setting) []Ciph
 }
 
 // returns true if cardinality test passes
-func CentralFHECardinalityTestWorker(items []*big.Int, sk Secret_key, setting FHE_setting) bool {
-    cs := setting.FHE_cryptosystem()
+func CentralFHECardinalityTestWorker(items []*big.Int, sk Secret_key, setting AHE_setting) bool {
+    cs := setting.AHE_cryptosystem()
 
     // step 2
-    z, err := SampleInt(cs.N())
+    z, err := sampleInt(setting, cs.N())
     if err != nil {panic(err)}
     setting.Distribute(z)
 
     // step 3
     // add mask to polynomial
-    rand, err := SampleInt(cs.N())
+    rand, err := sampleInt(setting, cs.N())
     if err != nil {panic(err)}
     p := PolyFromRoots(append(items, rand), cs.N())
     
-    // evaluate root polynomial
-    plain_evals := make([]*big.Int, 2*setting.Threshold()+3)
-    evals := make([]Ciphertext, 2*setting.Threshold()+3)
-    var point *big.Int
-    for i := range evals {
-        point = big.NewInt(int64(i * 2 + 1))
-        e := EvalPoly(p, point, cs.N())
-        plain_evals[i] = e.ModInverse(e, cs.N())
-        evals[i], err = cs.Encrypt(plain_evals[i])
+    // evaluate root polynomial at the odd points and z
+    plain_evals := MultiEvalPoly(p, append(oddPoints(2*setting.Threshold()+3), z), cs.N())
+    eval := plain_evals[len(plain_evals)-1]
+    plain_evals = plain_evals[:len(plain_evals)-1]
+    evals := make([]Ciphertext, len(plain_evals))
+    for i, e := range plain_evals {
+        e.ModInverse(e, cs.N())
+        evals[i], err = cs.Encrypt(e)
         if err != nil {panic(err)}
     }
-    eval := EvalPoly(p, z, cs.N())
     eval.ModInverse(eval, cs.N())
     z_eval, err := cs.Encrypt(eval)
     if err != nil {panic(err)}
@@ -257,8 +284,8 @@ func CentralFHECardinalityTestWorker(items []*big.Int, sk Secret_key, setting FH
         z_exp, err = cs.Add(z_exp, z_evals[i])
         if err != nil {panic(err)}
     }
-    z_exp, err = cs.Multiply(z_exp, z_evals[setting.Parties()-1])
-    if err != nil {panic(err)}
+    multiply := ciphertextMultiplier(sk, setting)
+    z_exp = multiply(z_exp, z_evals[setting.Parties()-1])
     
     // step 4
     // evaluate rational polynomial
@@ -270,8 +297,7 @@ func CentralFHECardinalityTestWorker(items []*big.Int, sk Secret_key, setting FH
             sum, err = cs.Add(sum, all_evals[j][i])
             if err != nil {panic(err)}
         }
-        evals_sum[i], err = cs.Multiply(all_evals[setting.Parties()-1][i], sum)
-        if err != nil {panic(err)}
+        evals_sum[i] = multiply(all_evals[setting.Parties()-1][i], sum)
     }
     
     // interpolate
@@ -284,8 +310,7 @@ func CentralFHECardinalityTestWorker(items []*big.Int, sk Secret_key, setting FH
     
     // compare interpolation with expected result
     den_inv := CentralInverseWorkerWithFactor(den_eval, new(big.Int).Sub(cs.N(), big.NewInt(1)), sk, setting)
-    int_eval, err := cs.Multiply(num_eval, den_inv)
-    if err != nil {panic(err)}
+    int_eval := multiply(num_eval, den_inv)
 
     pred, err := cs.Add(int_eval, z_exp)
     if err != nil {panic(err)}
@@ -294,28 +319,26 @@ func CentralFHECardinalityTestWorker(items []*big.Int, sk Secret_key, setting FH
 }
 
 // returns true if cardinality test passes
-func OuterFHECardinalityTestWorker(items []*big.Int, sk Secret_key, setting FHE_setting) bool {
-    cs := setting.FHE_cryptosystem()
+func OuterFHECardinalityTestWorker(items []*big.Int, sk Secret_key, setting AHE_setting) bool {
+    cs := setting.AHE_cryptosystem()
 
     // step 2
     z := (setting.Receive()).(*big.Int)
 
     // step 3
-    rand, err := SampleInt(setting.FHE_cryptosystem().N())
+    rand, err := sampleInt(setting, setting.AHE_cryptosystem().N())
     if err != nil {panic(err)}
     p := PolyFromRoots(append(items, rand), cs.N())
     
-    // evaluate root polynomial
-    plain_evals := make([]*big.Int, 2*setting.Threshold()+3)
-    evals := make([]Ciphertext, 2*setting.Threshold()+3)
-    var point *big.Int
-    for i := range evals {
-        point = big.NewInt(int64(i * 2 + 1))
-        plain_evals[i] = EvalPoly(p, point, cs.N())
-        evals[i], err = cs.Encrypt(plain_evals[i])
+    // evaluate root polynomial at the odd points and z
+    plain_evals := MultiEvalPoly(p, append(oddPoints(2*setting.Threshold()+3), z), cs.N())
+    eval := plain_evals[len(plain_evals)-1]
+    plain_evals = plain_evals[:len(plain_evals)-1]
+    evals := make([]Ciphertext, len(plain_evals))
+    for i, e := range plain_evals {
+        evals[i], err = cs.Encrypt(e)
         if err != nil {panic(err)}
     }
-    eval := EvalPoly(p, z, cs.N())
     z_eval, err := cs.Encrypt(eval)
     if err != nil {panic(err)}
     setting.Send(evals)
@@ -330,8 +353,8 @@ func OuterFHECardinalityTestWorker(items []*big.Int, sk Secret_key, setting FHE_
         z_exp, err = cs.Add(z_exp, z_evals[i])
         if err != nil {panic(err)}
     }
-    z_exp, err = cs.Multiply(z_exp, z_evals[setting.Parties()-1])
-    if err != nil {panic(err)}
+    multiply := ciphertextMultiplier(sk, setting)
+    z_exp = multiply(z_exp, z_evals[setting.Parties()-1])
     
     // step 4
     // evaluate rational polynomial
@@ -343,8 +366,7 @@ func OuterFHECardinalityTestWorker(items []*big.Int, sk Secret_key, setting FHE_
             sum, err = cs.Add(sum, all_evals[j][i])
             if err != nil {panic(err)}
         }
-        evals_sum[i], err = cs.Multiply(all_evals[setting.Parties()-1][i], sum)
-        if err != nil {panic(err)}
+        evals_sum[i] = multiply(all_evals[setting.Parties()-1][i], sum)
     }
 
     // interpolate
@@ -357,8 +379,7 @@ func OuterFHECardinalityTestWorker(items []*big.Int, sk Secret_key, setting FHE_
     
     // compare interpolation with expected result
     den_inv := OuterInverseWorkerWithFactor(den_eval, new(big.Int).Sub(cs.N(), big.NewInt(1)), sk, setting)
-    int_eval, err := cs.Multiply(num_eval, den_inv)
-    if err != nil {panic(err)}
+    int_eval := multiply(num_eval, den_inv)
     
     pred, err := cs.Add(int_eval, z_exp)
     if err != nil {panic(err)}
@@ -366,28 +387,35 @@ func OuterFHECardinalityTestWorker(items []*big.Int, sk Secret_key, setting FHE_
     return OuterZeroTestWorker(pred, sk, setting)       
 }
 
-func FHEEvaluate(x *big.Int, poly []Ciphertext, setting FHE_setting) Ciphertext {
+func FHEEvaluate(x *big.Int, poly []Ciphertext, setting AHE_setting) Ciphertext {
+    scale := plaintextMultiplier(setting)
     sum := poly[0]
     x_raised := new(big.Int).Set(x)
     for i := 1; i < len(poly); i += 1 {
-        x_enc, err := setting.FHE_cryptosystem().Encrypt(x_raised)
-        prod, err := setting.FHE_cryptosystem().Multiply(x_enc, poly[i])
+        prod := scale(poly[i], new(big.Int).Set(x_raised))
+        var err error
+        sum, err = setting.AHE_cryptosystem().Add(sum, prod)
         if err != nil {panic(err)}
-        sum, err = setting.FHE_cryptosystem().Add(sum, prod)
-        if err != nil {panic(err)}
-        x_raised.Mul(x_raised, x).Mod(x_raised, setting.FHE_cryptosystem().N())
+        x_raised.Mul(x_raised, x).Mod(x_raised, setting.AHE_cryptosystem().N())
     }
     return sum
 }
 
-// returns two slices: shared elements & unique elements if cardinality test passes, otherwise nil, nil
+// returns two slices: shared elements & unique elements if cardinality test passes, otherwise nil, nil.
+// If output is restricted by an OutputPolicy, parties not receiving output get two empty slices when the test passes.
+// Items are treated as a set, repeated elements are removed by Deduplicate. Panics with an InputError
+// or AgreementError if the input check fails, see ValidateIntInput and CentralInputCheckWorker.
 func TPSIintWorker(items []*big.Int, sk Secret_key, setting FHE_setting) ([]*big.Int, []*big.Int) {
+    defer observeStep(setting, "TPSI-int")()
+    items = Deduplicate(items)
+    checkInput(ValidateIntInput(items, setting), setting)
     var pred bool
     if setting.IsCentral() {
         pred = CentralFHECardinalityTestWorker(items, sk, setting)
     } else {
         pred = OuterFHECardinalityTestWorker(items, sk, setting)
     }
+    observeSession(setting, "int", pred)
 
     // exit if cardinality test doesn't pass
     if pred {
@@ -395,4 +423,62 @@ func TPSIintWorker(items []*big.Int, sk Secret_key, setting FHE_setting) ([]*big
     } else {
         return nil, nil
     }
-}
\ No newline at end of file
+}
+
+// returns the number of elements shared by all parties and true if the cardinality test passes,
+// otherwise 0, false. See IntersectionCardinalityWorker.
+func TPSIintCardinalityWorker(items []*big.Int, sk Secret_key, setting FHE_setting) (int, bool) {
+    defer observeStep(setting, "TPSI-int cardinality")()
+    items = Deduplicate(items)
+    checkInput(ValidateIntInput(items, setting), setting)
+    var pred bool
+    if setting.IsCentral() {
+        pred = CentralFHECardinalityTestWorker(items, sk, setting)
+    } else {
+        pred = OuterFHECardinalityTestWorker(items, sk, setting)
+    }
+    observeSession(setting, "int-cardinality", pred)
+    if !pred {
+        return 0, false
+    }
+    return IntersectionCardinalityWorker(items, sk, setting), true
+}
+
+// returns two slices: shared elements & unique elements if at least setting.Threshold()
+// elements are shared by all parties, otherwise nil, nil. The parties agree on the size M
+// of the largest set, and the condition is that no party has more than M - setting.Threshold()
+// elements outside the intersection, which holds for all parties if and only if it holds for
+// a party with M elements. If M is smaller than the threshold, all parties return nil, nil
+// without running the test. Runs on FHE settings as well as on AHE settings such as those
+// of DJ_encryption, where ciphertexts are multiplied interactively.
+func TPSIintersectionSizeWorker(items []*big.Int, sk Secret_key, setting AHE_setting) ([]*big.Int, []*big.Int) {
+    defer observeStep(setting, "TPSI-int size")()
+    items = Deduplicate(items)
+    var local error
+    if setting.Threshold() < 0 {
+        local = InputError{nil, fmt.Sprintf("negative threshold %d", setting.Threshold())}
+    }
+    max_size := checkSizedInput(local, len(items), setting)
+    T := max_size - setting.Threshold()
+    if T < 0 { // decided by all parties, as max_size is agreed on
+        observeSession(setting, "intersection-size", false)
+        return nil, nil
+    }
+    inner := withThreshold(setting, T)
+    checkInput(validateInput(items, inner, max_size+1), inner)
+
+    var pred bool
+    if setting.IsCentral() {
+        pred = CentralFHECardinalityTestWorker(items, sk, inner)
+    } else {
+        pred = OuterFHECardinalityTestWorker(items, sk, inner)
+    }
+    observeSession(setting, "intersection-size", pred)
+
+    // exit if cardinality test doesn't pass
+    if pred {
+        return IntersectionWorker(items, sk, inner)
+    } else {
+        return nil, nil
+    }
+}
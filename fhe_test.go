@@ -292,7 +292,7 @@ func TestFHEInterpolation(t *testing.T) {
 
         int_den := <-ret
         if len(int_den) != len(sol) {
-            t.Errorf("wrong length, expected %d, got %d", den.Cols, len(int_den))
+            t.Errorf("wrong length, expected %d, got %d", len(den), len(int_den))
         }
         rets := create_chans(n)
         for index := range int_den {
@@ -341,7 +341,7 @@ func TestFHEInterpolation(t *testing.T) {
 
         int_den := <-ret
         if len(int_den) != len(sol) {
-            t.Errorf("wrong length, expected %d, got %d", den.Cols, len(int_den))
+            t.Errorf("wrong length, expected %d, got %d", len(den), len(int_den))
         }
         rets := create_chans(n)
         for index := range int_den {
@@ -413,12 +413,26 @@ func TestFHECardinalityTest(t *testing.T) {
 }
 
 func TestTPSIint(t *testing.T) {
+    testTPSIint(t, func(n, T int) ([]FHE_setting, []Secret_key) {
+        settings, sks := SetupTest(n, T)
+        conv := make([]Secret_key, n)
+        fhe := make([]FHE_setting, n)
+        for i, sk := range sks {
+            conv[i] = sk
+            fhe[i] = settings[i]
+        }
+        return fhe, conv
+    })
+}
+
+// run TPSIintWorker with the cryptosystem created by setup
+func testTPSIint(t *testing.T, setup func(n, T int) ([]FHE_setting, []Secret_key)) {
     items := [][]*big.Int{bigIntSlice([]int64{2,4,6,8,10,12,14}),
                           bigIntSlice([]int64{2,4,6,8,10,16,18}),
                           bigIntSlice([]int64{2,4,6,8,12,20,22})}
     n := 3
     t.Run("pass cardinality test", func(t *testing.T) {
-        settings, sks := SetupTest(n, 3)
+        settings, sks := setup(n, 3)
         no_unique := 3
         no_shared := 4
         returns := make([]chan []*big.Int, n)
@@ -462,7 +476,7 @@ func TestTPSIint(t *testing.T) {
         }
     })
     t.Run("fail cardinality test", func(t *testing.T) {
-        settings, sks := SetupTest(n, 2)
+        settings, sks := setup(n, 2)
         returns := make([]chan []*big.Int, n)
         for i := 0; i < n-1; i += 1 {
             returns[i] = make(chan []*big.Int)
@@ -487,3 +501,92 @@ func TestTPSIint(t *testing.T) {
         }
     })
 }
+
+func TestTPSIintersectionSize(t *testing.T) {
+    n := 3
+    pk, sksdj, err := NewDJCryptosystem(n)
+    if err != nil {t.Fatal(err)}
+    sks := ConvertDJSKSlice(sksdj)
+
+    items := [][]*big.Int{bigIntSlice([]int64{2,4,6,8}),
+                          bigIntSlice([]int64{2,4,10,12}),
+                          bigIntSlice([]int64{2,4,14,16})}
+    run := func(min_size int) []chan []*big.Int {
+        settings := createAHESettings(n, min_size, pk)
+        returns := make([]chan []*big.Int, n)
+        for i := 0; i < n; i += 1 {
+            returns[i] = make(chan []*big.Int, 2)
+            go func(i int) {
+                sh, uq := TPSIintersectionSizeWorker(items[i], sks[i], settings[i])
+                returns[i] <- sh
+                returns[i] <- uq
+            }(i)
+        }
+        return returns
+    }
+    t.Run("pass cardinality test", func(t *testing.T) {
+        returns := run(2)
+        for i := 0; i < n; i += 1 {
+            shared := <-returns[i]
+            unique := <-returns[i]
+            if shared == nil {
+                t.Error("cardinality test failed")
+                continue
+            }
+            if len(shared) != 2 || len(unique) != 2 {
+                t.Errorf("wrong number of items, got %d shared and %d unique", len(shared), len(unique))
+                continue
+            }
+            for j := 0; j < 2; j += 1 {
+                if shared[j] != items[i][j] {
+                    t.Errorf("unexpected element in shared, expected %d, got %d", items[i][j], shared[j])
+                }
+                if unique[j] != items[i][j+2] {
+                    t.Errorf("unexpected element in unique, expected %d, got %d", items[i][j+2], unique[j])
+                }
+            }
+        }
+    })
+    t.Run("fail cardinality test", func(t *testing.T) {
+        returns := run(3)
+        for i := 0; i < n; i += 1 {
+            if shared := <-returns[i]; shared != nil {
+                t.Error("cardinality test passed")
+            }
+            <-returns[i]
+        }
+    })
+    t.Run("different sizes", func(t *testing.T) {
+        items[1] = bigIntSlice([]int64{2,4,10})
+        items[2] = bigIntSlice([]int64{2,4,14,16,18})
+        defer func() {
+            items[1] = bigIntSlice([]int64{2,4,10,12})
+            items[2] = bigIntSlice([]int64{2,4,14,16})
+        }()
+        returns := run(2)
+        for i := 0; i < n; i += 1 {
+            shared := <-returns[i]
+            unique := <-returns[i]
+            if len(shared) != 2 || len(unique) != len(items[i])-2 {
+                t.Errorf("party %d: got %d shared and %d unique", i, len(shared), len(unique))
+            }
+        }
+        returns = run(3)
+        for i := 0; i < n; i += 1 {
+            if shared := <-returns[i]; shared != nil {
+                t.Error("cardinality test passed")
+            }
+            <-returns[i]
+        }
+    })
+    t.Run("threshold above all sets", func(t *testing.T) {
+        // all parties exit together after the input check
+        returns := run(5)
+        for i := 0; i < n; i += 1 {
+            if shared := <-returns[i]; shared != nil {
+                t.Error("cardinality test passed")
+            }
+            <-returns[i]
+        }
+    })
+}
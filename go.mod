@@ -6,4 +6,5 @@ require (
 	github.com/ldsec/lattigo v1.3.0
 	github.com/niclabs/tcpaillier v0.0.7
 	github.com/ontanj/generic-matrix v0.0.2
+	github.com/tuneinsight/lattigo/v4 v4.1.1
 )
@@ -0,0 +1,106 @@
+package tpsi
+
+import (
+    "fmt"
+    "math/big"
+    gm "github.com/ontanj/generic-matrix"
+)
+
+// square Hankel matrix, stored as its defining sequence. Entry (i,j) is
+// element i+j of the sequence, so a matrix of size T+1 has 2T+1 distinct
+// entries. Only the sequence is encrypted and sent between the parties;
+// Expand creates the full matrix when it is needed.
+type HankelMatrix struct {
+    Seq gm.Matrix // row vector of the 2*Size()-1 distinct entries
+}
+
+// Hankel matrix defined by the row vector seq, which must have an odd length
+func NewHankelMatrix(seq gm.Matrix) (HankelMatrix, error) {
+    if seq.Rows != 1 || seq.Cols % 2 != 1 {
+        return HankelMatrix{}, fmt.Errorf("defining sequence must be a row vector of odd length, got %dx%d", seq.Rows, seq.Cols)
+    }
+    return HankelMatrix{seq}, nil
+}
+
+// number of rows and columns
+func (h HankelMatrix) Size() int {
+    return (h.Seq.Cols + 1) / 2
+}
+
+func (h HankelMatrix) At(row, col int) (interface{}, error) {
+    if row < 0 || col < 0 || row >= h.Size() || col >= h.Size() {
+        return nil, fmt.Errorf("index (%d,%d) out of bounds for Hankel matrix of size %d", row, col, h.Size())
+    }
+    return h.Seq.At(0, row+col)
+}
+
+// full matrix, sharing its values with the sequence
+func (h HankelMatrix) Expand() gm.Matrix {
+    size := h.Size()
+    vals := make([]interface{}, size*size)
+    for row := 0; row < size; row += 1 {
+        for col := 0; col < size; col += 1 {
+            val, err := h.Seq.At(0, row+col)
+            if err != nil {panic(err)}
+            vals[row*size+col] = val
+        }
+    }
+    m, err := gm.NewMatrix(size, size, vals, h.Seq.Space)
+    if err != nil {panic(err)}
+    return m
+}
+
+func (h HankelMatrix) Add(other HankelMatrix) (HankelMatrix, error) {
+    seq, err := h.Seq.Add(other.Seq)
+    if err != nil {return HankelMatrix{}, err}
+    return HankelMatrix{seq}, nil
+}
+
+func (h HankelMatrix) Subtract(other HankelMatrix) (HankelMatrix, error) {
+    seq, err := h.Seq.Subtract(other.Seq)
+    if err != nil {return HankelMatrix{}, err}
+    return HankelMatrix{seq}, nil
+}
+
+func (h HankelMatrix) Scale(scalar interface{}) (HankelMatrix, error) {
+    seq, err := h.Seq.Scale(scalar)
+    if err != nil {return HankelMatrix{}, err}
+    return HankelMatrix{seq}, nil
+}
+
+// apply f to every distinct entry
+func (h HankelMatrix) Apply(f func(interface{}) (interface{}, error)) (HankelMatrix, error) {
+    seq, err := h.Seq.Apply(f)
+    if err != nil {return HankelMatrix{}, err}
+    return HankelMatrix{seq}, nil
+}
+
+// encrypt the defining sequence
+func EncryptHankelMatrix(h HankelMatrix, setting AHE_setting) (HankelMatrix, error) {
+    seq, err := EncryptMatrix(h.Seq, setting)
+    if err != nil {return HankelMatrix{}, err}
+    return HankelMatrix{seq}, nil
+}
+
+// power sums of u^a over the items a, for the exponents 0 to 2T
+func hankelSequence(items []*big.Int, u *big.Int, setting AHE_setting) gm.Matrix {
+    q := setting.AHE_cryptosystem().N()
+    l := 2 * setting.Threshold() + 1
+    u1_list := make([]*big.Int, len(items)) // u^a for each a
+    u_list := make([]*big.Int, len(items)) // u^a^i for each a
+    for i, item := range items {
+        u1_list[i] = new(big.Int).Exp(u, item, q)
+    }
+    copy(u_list, u1_list)
+    vals := make([]interface{}, l)
+    vals[0] = big.NewInt(int64(len(items)))
+    for i := 1; i < l; i += 1 {
+        vals[i] = sumSlice(u_list, q)
+        if i < l-1 {
+            u_list = elMulSlice(u_list, u1_list, q)
+        }
+    }
+    seq, err := gm.NewMatrix(1, l, vals, gm.Bigint{})
+    if err != nil {panic(err)}
+    return seq
+}
@@ -0,0 +1,84 @@
+package tpsi
+
+import (
+    "math/big"
+    "testing"
+    gm "github.com/ontanj/generic-matrix"
+)
+
+func TestComputePlainHankelMatrix(t *testing.T) {
+    n := 3
+    T := 3
+    pk, _, err := NewDJCryptosystem(n)
+    if err != nil {t.Fatal(err)}
+    settings := createAHESettings(n, T, pk)
+    q := pk.N()
+    items := bigIntSlice([]int64{2, 4, 10, 14})
+    u := big.NewInt(7)
+
+    H := ComputePlainHankelMatrix(items, u, settings[0])
+    if H.Size() != T+1 || H.Seq.Cols != 2*T+1 {
+        t.Fatalf("got Hankel matrix of size %d with %d values", H.Size(), H.Seq.Cols)
+    }
+    m := H.Expand()
+    for row := 0; row <= T; row += 1 {
+        for col := 0; col <= T; col += 1 {
+            expected := big.NewInt(0)
+            for _, item := range items {
+                exp := new(big.Int).Mul(item, big.NewInt(int64(row+col)))
+                expected.Add(expected, new(big.Int).Exp(u, exp, q))
+            }
+            expected.Mod(expected, q)
+            got, err := decodeBI(m.At(row, col))
+            if err != nil {t.Fatal(err)}
+            if got.Cmp(expected) != 0 {
+                t.Errorf("element (%d,%d) is %d, expected %d", row, col, got, expected)
+            }
+            at, err := decodeBI(H.At(row, col))
+            if err != nil {t.Fatal(err)}
+            if at.Cmp(got) != 0 {
+                t.Errorf("At(%d,%d) is %d, expanded matrix has %d", row, col, at, got)
+            }
+        }
+    }
+    if _, err := H.At(T+1, 0); err == nil {
+        t.Error("expected error for index out of bounds")
+    }
+
+    H_enc, err := ComputeHankelMatrix(items, u, settings[0])
+    if err != nil {t.Fatal(err)}
+    if H_enc.Seq.Cols != 2*T+1 || H_enc.Expand().Rows != T+1 {
+        t.Errorf("encrypted %d values for Hankel matrix of size %d", H_enc.Seq.Cols, H_enc.Size())
+    }
+}
+
+func TestNewHankelMatrix(t *testing.T) {
+    even, err := gm.NewMatrixFromInt(1, 4, []int{1, 2, 3, 4})
+    if err != nil {t.Fatal(err)}
+    if _, err := NewHankelMatrix(even); err == nil {
+        t.Error("expected error for sequence of even length")
+    }
+    column, err := gm.NewMatrixFromInt(3, 1, []int{1, 2, 3})
+    if err != nil {t.Fatal(err)}
+    if _, err := NewHankelMatrix(column); err == nil {
+        t.Error("expected error for column vector")
+    }
+    seq, err := gm.NewMatrixFromInt(1, 5, []int{1, 2, 3, 4, 5})
+    if err != nil {t.Fatal(err)}
+    H, err := NewHankelMatrix(seq)
+    if err != nil {t.Fatal(err)}
+    expected, err := gm.NewMatrixFromInt(3, 3, []int{1, 2, 3,
+                                                     2, 3, 4,
+                                                     3, 4, 5})
+    if err != nil {t.Fatal(err)}
+    m := H.Expand()
+    for row := 0; row < 3; row += 1 {
+        for col := 0; col < 3; col += 1 {
+            got, _ := decodeBI(m.At(row, col))
+            exp, _ := decodeBI(expected.At(row, col))
+            if got.Cmp(exp) != 0 {
+                t.Errorf("element (%d,%d) is %d, expected %d", row, col, got, exp)
+            }
+        }
+    }
+}
@@ -0,0 +1,158 @@
+package tpsi
+
+import (
+    "crypto/sha256"
+    "encoding/binary"
+    "fmt"
+    "math"
+    "math/big"
+)
+
+// two elements of the same party with the same hash, see HashEncoding
+type CollisionError struct {
+    A, B *big.Int
+}
+
+func (e CollisionError) Error() string {
+    return fmt.Sprintf("elements %d and %d have the same hash", e.A, e.B)
+}
+
+// estimated false-positive probability of a result above the bound of its
+// HashEncoding, see DecodeResult
+type FalsePositiveError struct {
+    Estimate, Bound float64
+}
+
+func (e FalsePositiveError) Error() string {
+    return fmt.Sprintf("estimated false-positive probability %g exceeds %g", e.Estimate, e.Bound)
+}
+
+// bound on the estimated false-positive probability of a result, set by NewHashEncoding
+var DefaultMaxFalsePositive = 0.01
+
+// number of even values smaller than N, the range of HashElement
+func hashRange(N *big.Int) *big.Int {
+    return new(big.Int).Rsh(new(big.Int).Add(N, big.NewInt(1)), 1)
+}
+
+// hashes element to an even value smaller than N. The value is computed from
+// SHA-256 in counter mode with 128 more bits than N, so it is close to uniform.
+// Like EncodeElements the value is even, so it never equals an evaluation point.
+func HashElement(element, N *big.Int) *big.Int {
+    data := element.Bytes()
+    if element.Sign() < 0 {
+        data = append([]byte{'-'}, data...)
+    }
+    var digest []byte
+    var counter [4]byte
+    for block := uint32(0); len(digest)*8 < N.BitLen()+128; block += 1 {
+        binary.BigEndian.PutUint32(counter[:], block)
+        h := sha256.New()
+        h.Write(counter[:])
+        h.Write(data)
+        digest = h.Sum(digest)
+    }
+    hash := new(big.Int).SetBytes(digest)
+    hash.Mod(hash, hashRange(N))
+    return hash.Lsh(hash, 1)
+}
+
+// encoding of elements of any size into the plaintext space of the protocols by
+// hashing, replacing EncodeElements and DecodeElements. The elements of a party
+// are checked for collisions before the protocol, but the elements of different
+// parties may still collide, see DecodeResult.
+type HashEncoding struct {
+    N *big.Int
+    MaxFalsePositive float64 // bound checked by DecodeResult, no check if zero
+    originals map[string]*big.Int // by hash
+}
+
+func NewHashEncoding(N *big.Int) HashEncoding {
+    return HashEncoding{N, DefaultMaxFalsePositive, make(map[string]*big.Int)}
+}
+
+// hashes elements with repeated elements removed. Returns a CollisionError if
+// two different elements have the same hash.
+func (e HashEncoding) Encode(elements []*big.Int) ([]*big.Int, error) {
+    elements = Deduplicate(elements)
+    hashes := make([]*big.Int, len(elements))
+    for i, element := range elements {
+        hashes[i] = HashElement(element, e.N)
+        key := hashes[i].String()
+        if other, ok := e.originals[key]; ok && other.Cmp(element) != 0 {
+            return nil, CollisionError{other, element}
+        }
+        e.originals[key] = element
+    }
+    return hashes, nil
+}
+
+// the elements encoded by Encode with the given hashes, e.g. the shared and unique
+// elements returned by the protocol workers
+func (e HashEncoding) Decode(hashes []*big.Int) []*big.Int {
+    elements := make([]*big.Int, len(hashes))
+    for i, hash := range hashes {
+        original, ok := e.originals[hash.String()]
+        if !ok {panic(fmt.Errorf("hash %d wasn't encoded", hash))}
+        elements[i] = original
+    }
+    return elements
+}
+
+// estimated probability that an element of one party is taken to be shared because
+// an element of another party has the same hash, for parties with the given set
+// sizes. The hashes are taken to be uniform, and the estimate is the probability
+// that any two elements of different parties collide, 1 - exp(-pairs/range).
+func FalsePositiveProbability(N *big.Int, set_sizes []int) float64 {
+    pairs := new(big.Int)
+    for i := range set_sizes {
+        for j := i+1; j < len(set_sizes); j += 1 {
+            pairs.Add(pairs, big.NewInt(int64(set_sizes[i]) * int64(set_sizes[j])))
+        }
+    }
+    ratio, _ := new(big.Float).Quo(new(big.Float).SetInt(pairs), new(big.Float).SetInt(hashRange(N))).Float64()
+    return -math.Expm1(-ratio)
+}
+
+// see FalsePositiveProbability
+func (e HashEncoding) FalsePositiveProbability(set_sizes []int) float64 {
+    return FalsePositiveProbability(e.N, set_sizes)
+}
+
+// decoded output of a protocol worker, see DecodeResult
+type HashResult struct {
+    Shared []*big.Int
+    Unique []*big.Int
+    FalsePositive float64 // estimated probability, see ResultFalsePositiveProbability
+}
+
+// estimated probability that the shared elements returned by a worker of setting
+// include a false positive. The sizes of the sets of the other parties aren't
+// known, but as the cardinality test passed, none of them has more than the
+// shared elements and Threshold() others, so FalsePositiveProbability is taken
+// for sets of that size.
+func (e HashEncoding) ResultFalsePositiveProbability(shared, unique []*big.Int, setting AHE_setting) float64 {
+    sizes := make([]int, setting.Parties())
+    sizes[0] = len(shared) + len(unique)
+    for i := 1; i < len(sizes); i += 1 {
+        sizes[i] = len(shared) + setting.Threshold()
+    }
+    return e.FalsePositiveProbability(sizes)
+}
+
+// decodes the shared and unique elements returned by a worker of setting, see
+// Decode, and estimates the false-positive probability of the result. Returns
+// a FalsePositiveError together with the result if the estimate exceeds
+// MaxFalsePositive, e.g. for many elements with BFV, where the hashes only
+// take 32769 values.
+func (e HashEncoding) DecodeResult(shared, unique []*big.Int, setting AHE_setting) (HashResult, error) {
+    result := HashResult{
+        Shared: e.Decode(shared),
+        Unique: e.Decode(unique),
+        FalsePositive: e.ResultFalsePositiveProbability(shared, unique, setting),
+    }
+    if e.MaxFalsePositive > 0 && result.FalsePositive > e.MaxFalsePositive {
+        return result, FalsePositiveError{result.FalsePositive, e.MaxFalsePositive}
+    }
+    return result, nil
+}
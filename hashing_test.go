@@ -0,0 +1,145 @@
+package tpsi
+
+import (
+    "errors"
+    "math"
+    "math/big"
+    "testing"
+)
+
+func TestHashElement(t *testing.T) {
+    for _, N := range []*big.Int{big.NewInt(11), big.NewInt(65537), new(big.Int).Lsh(big.NewInt(1), 700)} {
+        for i := int64(0); i < 100; i += 1 {
+            hash := HashElement(big.NewInt(i), N)
+            if hash.Sign() < 0 || hash.Cmp(N) >= 0 || hash.Bit(0) != 0 {
+                t.Errorf("hash %d of %d isn't even and smaller than %d", hash, i, N)
+            }
+            if hash.Cmp(HashElement(big.NewInt(i), N)) != 0 {
+                t.Errorf("hash of %d isn't deterministic", i)
+            }
+        }
+    }
+    N := big.NewInt(65537)
+    if HashElement(big.NewInt(5), N).Cmp(HashElement(big.NewInt(-5), N)) == 0 {
+        t.Error("5 and -5 have the same hash")
+    }
+}
+
+func TestHashEncoding(t *testing.T) {
+    id, _ := new(big.Int).SetString("340282366920938463463374607431768211455", 10) // 2^128 - 1
+    elements := []*big.Int{id, big.NewInt(3), new(big.Int).Set(id), big.NewInt(70000)}
+    encoding := NewHashEncoding(big.NewInt(65537))
+    hashes, err := encoding.Encode(elements)
+    if err != nil {t.Fatal(err)}
+    if len(hashes) != 3 {
+        t.Fatalf("expected repeated elements to be removed, got %d hashes", len(hashes))
+    }
+    decoded := encoding.Decode([]*big.Int{hashes[2], hashes[0]})
+    if decoded[0].Cmp(big.NewInt(70000)) != 0 || decoded[1].Cmp(id) != 0 {
+        t.Errorf("decoded %v", decoded)
+    }
+
+    // 6 hashes below 11
+    elements = bigIntSlice([]int64{0, 1, 2, 3, 4, 5, 6})
+    _, err = NewHashEncoding(big.NewInt(11)).Encode(elements)
+    var collision CollisionError
+    if !errors.As(err, &collision) || collision.A.Cmp(collision.B) == 0 {
+        t.Errorf("expected collision, got %v", err)
+    }
+}
+
+func TestFalsePositiveProbability(t *testing.T) {
+    p := FalsePositiveProbability(big.NewInt(65537), []int{7, 7, 7})
+    expected := 1 - math.Exp(-147.0/32769)
+    if math.Abs(p-expected) > 1e-12 {
+        t.Errorf("got %g, expected %g", p, expected)
+    }
+    p = FalsePositiveProbability(new(big.Int).Lsh(big.NewInt(1), 512), []int{1000, 1000})
+    if p <= 0 || p > 1e-140 {
+        t.Errorf("got %g for 512-bit modulus", p)
+    }
+    if p = FalsePositiveProbability(big.NewInt(11), []int{100, 100}); p < 0.999 {
+        t.Errorf("got %g for tiny modulus", p)
+    }
+}
+
+func TestDecodeResult(t *testing.T) {
+    settings := SetupAHE(3, 3, nil)
+    encoding := NewHashEncoding(big.NewInt(65537))
+    hashes, err := encoding.Encode(bigIntSlice([]int64{1, 2, 3, 4, 5, 6, 7}))
+    if err != nil {t.Fatal(err)}
+    result, err := encoding.DecodeResult(hashes[:4], hashes[4:], settings[0])
+    if err != nil {t.Fatal(err)}
+    if !sameElements(result.Shared, map[int64]bool{1: true, 2: true, 3: true, 4: true}) ||
+        !sameElements(result.Unique, map[int64]bool{5: true, 6: true, 7: true}) {
+        t.Errorf("decoded %v and %v", result.Shared, result.Unique)
+    }
+    // the other parties have at most 4 shared and 3 other elements
+    if expected := FalsePositiveProbability(big.NewInt(65537), []int{7, 7, 7}); result.FalsePositive != expected {
+        t.Errorf("got estimate %g, expected %g", result.FalsePositive, expected)
+    }
+
+    encoding.MaxFalsePositive = 0.001
+    result, err = encoding.DecodeResult(hashes[:4], hashes[4:], settings[0])
+    var bound FalsePositiveError
+    if !errors.As(err, &bound) || bound.Estimate != result.FalsePositive || len(result.Shared) != 4 {
+        t.Errorf("expected estimate above bound with result, got %v and %v", err, result)
+    }
+}
+
+// TPSI-diff of 128-bit elements with a 64-bit key
+func TestTPSIdiffHashed(t *testing.T) {
+    n := 3
+    T := 3
+    pk, sksdj, err := NewCustomDJCryptosystem(n, 64, 1)
+    if err != nil {t.Fatal(err)}
+    sks := ConvertDJSKSlice(sksdj)
+    settings := createAHESettings(n, T, pk)
+    base := new(big.Int).Lsh(big.NewInt(1), 127)
+    offsets := make([][]*big.Int, n)
+    elements := make([][]*big.Int, n)
+    for i := range elements {
+        offsets[i] = bigIntSlice([]int64{1, 2, 3, int64(10+i)})
+        for _, v := range offsets[i] {
+            elements[i] = append(elements[i], new(big.Int).Add(base, v))
+        }
+    }
+    // offsets from base of elements
+    offsetsOf := func(elements []*big.Int) []*big.Int {
+        offsets := make([]*big.Int, len(elements))
+        for i, e := range elements {
+            offsets[i] = new(big.Int).Sub(e, base)
+        }
+        return offsets
+    }
+
+    type result struct {shared, unique []*big.Int}
+    returns := make([]chan result, n)
+    for i := 0; i < n; i += 1 {
+        returns[i] = make(chan result)
+        go func(i int) {
+            encoding := NewHashEncoding(pk.N())
+            items, err := encoding.Encode(elements[i])
+            if err != nil {panic(err)}
+            sh, uq := TPSIdiffWorker(items, sks[i], settings[i])
+            if sh == nil {
+                returns[i] <- result{}
+                return
+            }
+            decoded, err := encoding.DecodeResult(sh, uq, settings[i])
+            if err != nil {panic(err)}
+            returns[i] <- result{decoded.Shared, decoded.Unique}
+        }(i)
+    }
+    for i := 0; i < n; i += 1 {
+        r := <-returns[i]
+        if r.shared == nil {
+            t.Errorf("cardinality test failed at party %d", i)
+            continue
+        }
+        shared, unique := expectedDiff(offsets, i)
+        if !sameElements(offsetsOf(r.shared), shared) || !sameElements(offsetsOf(r.unique), unique) {
+            t.Errorf("party %d got shared %v and unique %v", i, r.shared, r.unique)
+        }
+    }
+}
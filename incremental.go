@@ -0,0 +1,206 @@
+package tpsi
+
+import (
+    "math/big"
+    gm "github.com/ontanj/generic-matrix"
+)
+
+// state of TPSI-diff kept between runs over slowly changing sets, see NewDiffSession
+type DiffSession struct {
+    setting AHE_setting
+    sk Secret_key
+    items []*big.Int
+    position map[string]int // index of each element in items
+    u *big.Int
+    H HankelMatrix // encrypted Hankel matrix of all parties
+    root_values []*big.Int // own root polynomial at the points of EvalIntPolys
+}
+
+// starts a session over the items of every party. All parties call it together,
+// like TPSIdiffWorker. The random u and the encrypted Hankel matrix are computed
+// once and kept, so that Update only has to handle the changed elements. Returns
+// an InputError or AgreementError at all parties if the input check fails.
+func NewDiffSession(items []*big.Int, sk Secret_key, setting AHE_setting) (*DiffSession, error) {
+    items = Deduplicate(items)
+    if err := inputCheckWorker(ValidateDiffInput(items, setting), setting); err != nil {
+        return nil, err
+    }
+    s := &DiffSession{setting: setting, sk: sk, position: make(map[string]int, len(items))}
+    if setting.IsCentral() {
+        s.u, s.H = centralSessionHankel(items, setting)
+    } else {
+        s.u, s.H = outerSessionHankel(items, setting)
+    }
+    s.root_values = make([]*big.Int, setting.Threshold() * 3 + 4)
+    for i := range s.root_values {
+        s.root_values[i] = big.NewInt(1)
+    }
+    s.insert(items)
+    return s, nil
+}
+
+func centralSessionHankel(items []*big.Int, setting AHE_setting) (*big.Int, HankelMatrix) {
+    u, err := sampleInt(setting, setting.AHE_cryptosystem().N())
+    if err != nil {panic(err)}
+    setting.Distribute(u)
+    H, err := CPComputeHankelMatrix(items, u, setting)
+    if err != nil {panic(err)}
+    return u, centralHankelSum(H, setting)
+}
+
+func outerSessionHankel(items []*big.Int, setting AHE_setting) (*big.Int, HankelMatrix) {
+    u := (setting.Receive()).(*big.Int)
+    H, err := ComputeHankelMatrix(items, u, setting)
+    if err != nil {panic(err)}
+    setting.Send(H.Seq)
+    return u, receiveHankel(setting)
+}
+
+// subtracts the matrices of the outer parties from H and distributes the result
+func centralHankelSum(H HankelMatrix, setting AHE_setting) HankelMatrix {
+    var err error
+    for _, Hv := range toHankelSlice(setting.ReceiveAll()) {
+        H, err = H.Subtract(Hv)
+        if err != nil {panic(err)}
+    }
+    setting.Distribute(H.Seq)
+    return H
+}
+
+// current elements of the party
+func (s *DiffSession) Items() []*big.Int {
+    items := make([]*big.Int, len(s.items))
+    copy(items, s.items)
+    return items
+}
+
+// removes and then adds elements, all parties call it together, with empty slices if
+// their set is unchanged. Only the Hankel matrix of the changed elements is computed,
+// and the parties exchange encrypted differences instead of full matrices. Removed
+// elements must be in the set and added elements must not. The input is checked at
+// all parties before anything changes, and on error the session is left as it was.
+func (s *DiffSession) Update(add, remove []*big.Int) error {
+    if err := inputCheckWorker(s.validateUpdate(add, remove), s.setting); err != nil {
+        return err
+    }
+    q := s.setting.AHE_cryptosystem().N()
+    delta, err := ComputePlainHankelMatrix(add, s.u, s.setting).Subtract(ComputePlainHankelMatrix(remove, s.u, s.setting))
+    if err != nil {panic(err)}
+    delta, err = delta.Apply(func(val interface{}) (interface{}, error) {
+        return new(big.Int).Mod(val.(*big.Int), q), nil
+    })
+    if err != nil {panic(err)}
+    if s.setting.IsCentral() {
+        delta, err = delta.Scale(big.NewInt(int64(s.setting.Parties()-1)))
+        if err != nil {panic(err)}
+        delta, err = EncryptHankelMatrix(delta, s.setting)
+        if err != nil {panic(err)}
+        s.H, err = s.H.Add(delta)
+        if err != nil {panic(err)}
+        s.H = centralHankelSum(s.H, s.setting)
+    } else {
+        delta, err = EncryptHankelMatrix(delta, s.setting)
+        if err != nil {panic(err)}
+        s.setting.Send(delta.Seq)
+        s.H = receiveHankel(s.setting)
+    }
+    s.drop(remove)
+    s.insert(add)
+    return nil
+}
+
+func (s *DiffSession) validateUpdate(add, remove []*big.Int) error {
+    removed := make(map[string]bool, len(remove))
+    for _, item := range remove {
+        key := item.String()
+        if _, ok := s.position[key]; !ok || removed[key] {
+            return InputError{item, "not in the set"}
+        }
+        removed[key] = true
+    }
+    added := make(map[string]bool, len(add))
+    for _, item := range add {
+        key := item.String()
+        if _, ok := s.position[key]; (ok && !removed[key]) || added[key] {
+            return InputError{item, "already in the set"}
+        }
+        added[key] = true
+    }
+    size := len(s.items) - len(remove) + len(add)
+    return validateInput(add, s.setting, s.setting.Parties()*size)
+}
+
+func (s *DiffSession) insert(items []*big.Int) {
+    q := s.setting.AHE_cryptosystem().N()
+    for _, item := range items {
+        s.position[item.String()] = len(s.items)
+        s.items = append(s.items, item)
+        for i, val := range s.root_values {
+            factor := big.NewInt(int64(2*i+1))
+            factor.Sub(factor, item)
+            val.Mul(val, factor).Mod(val, q)
+        }
+    }
+}
+
+// elements are never evaluation points of the root polynomial, see validateInput,
+// so their linear factors are invertible
+func (s *DiffSession) drop(items []*big.Int) {
+    q := s.setting.AHE_cryptosystem().N()
+    for _, item := range items {
+        key := item.String()
+        pos := s.position[key]
+        last := len(s.items)-1
+        s.items[pos] = s.items[last]
+        s.position[s.items[pos].String()] = pos
+        s.items = s.items[:last]
+        delete(s.position, key)
+        for i, val := range s.root_values {
+            factor := big.NewInt(int64(2*i+1))
+            factor.Sub(factor, item).Mod(factor, q)
+            val.Mul(val, factor.ModInverse(factor, q)).Mod(val, q)
+        }
+    }
+}
+
+// runs TPSI-diff on the current sets, with the same output as TPSIdiffWorker.
+// The cardinality test runs on the kept Hankel matrix and the intersection step
+// on the kept evaluations of the root polynomial, so the cryptographic work
+// doesn't depend on the set sizes. Only sorting the own elements into shared
+// and unique ones, by evaluating the interpolated polynomial, takes time linear
+// in the set size. Fresh randomness is used for every run, except for u.
+func (s *DiffSession) Run() ([]*big.Int, []*big.Int) {
+    var pred bool
+    if s.setting.IsCentral() {
+        pred = CentralSingularityTestWorker(s.H.Expand(), s.sk, s.setting)
+    } else {
+        pred = OuterSingularityTestWorker(s.H.Expand(), s.sk, s.setting)
+    }
+    if !pred {
+        return nil, nil
+    }
+
+    // the random root of RootMask, applied to the values
+    q := s.setting.AHE_cryptosystem().N()
+    r, err := sampleInt(s.setting, q)
+    if err != nil {panic(err)}
+    p_values, err := gm.NewMatrix(1, len(s.root_values), nil, gm.Bigint{})
+    if err != nil {panic(err)}
+    for i, val := range s.root_values {
+        masked := big.NewInt(int64(2*i+1))
+        masked.Add(masked, r).Mul(masked, val).Mod(masked, q)
+        p_values.Set(0, i, masked)
+    }
+
+    R_values_enc, R_tilde_values := SampleIntMasks(len(s.root_values), s.setting)
+    var vs, ps gm.Matrix
+    if s.setting.IsCentral() {
+        vs, ps = centralIntersectionValues(R_values_enc, R_tilde_values, p_values, s.sk, s.setting)
+    } else {
+        vs, ps = outerIntersectionValues(R_values_enc, R_tilde_values, p_values, s.sk, s.setting)
+    }
+    if !receivesOutput(s.setting) {
+        return []*big.Int{}, []*big.Int{}
+    }
+    return splitByRoots(interpolateValues(vs, ps, s.setting), s.items, s.setting)
+}
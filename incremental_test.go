@@ -0,0 +1,152 @@
+package tpsi
+
+import (
+    "math/big"
+    "testing"
+)
+
+// expected output of TPSI-diff for party i, computed in the clear
+func expectedDiff(sets [][]*big.Int, i int) (shared, unique map[int64]bool) {
+    shared = make(map[int64]bool)
+    unique = make(map[int64]bool)
+    for _, item := range sets[i] {
+        in_all := true
+        for _, set := range sets {
+            found := false
+            for _, other := range set {
+                if other.Cmp(item) == 0 {
+                    found = true
+                }
+            }
+            in_all = in_all && found
+        }
+        if in_all {
+            shared[item.Int64()] = true
+        } else {
+            unique[item.Int64()] = true
+        }
+    }
+    return
+}
+
+func sameElements(items []*big.Int, expected map[int64]bool) bool {
+    if len(items) != len(expected) {
+        return false
+    }
+    for _, item := range items {
+        if !expected[item.Int64()] {
+            return false
+        }
+    }
+    return true
+}
+
+func TestDiffSession(t *testing.T) {
+    n := 3
+    T := 7
+    pk, sksdj, err := NewDJCryptosystem(n)
+    if err != nil {t.Fatal(err)}
+    sks := ConvertDJSKSlice(sksdj)
+    settings := createAHESettings(n, T, pk)
+
+    items := [][]*big.Int{bigIntSlice([]int64{2,4,6,8,10,12,14}),
+                          bigIntSlice([]int64{2,4,6,8,10,16,18}),
+                          bigIntSlice([]int64{2,4,6,8,12,20,22})}
+    type change struct {
+        add, remove [][]int64
+        valid bool
+        pass bool
+    }
+    changes := []change{
+        {[][]int64{{26,28}, nil, nil}, [][]int64{nil, {16}, nil}, true, false},
+        {nil, [][]int64{{30}, nil, nil}, false, false},
+        {[][]int64{nil, {12}, {10}}, [][]int64{{14,26,28}, nil, nil}, true, true},
+    }
+
+    type result struct {
+        err error
+        shared, unique []*big.Int
+    }
+    results := make([]chan result, n)
+    for i := 0; i < n; i += 1 {
+        results[i] = make(chan result, len(changes)+1)
+        go func(i int) {
+            session, err := NewDiffSession(items[i], sks[i], settings[i])
+            if err != nil {
+                results[i] <- result{err: err}
+                return
+            }
+            sh, uq := session.Run()
+            results[i] <- result{nil, sh, uq}
+            for _, c := range changes {
+                var add, remove []*big.Int
+                if c.add != nil {
+                    add = bigIntSlice(c.add[i])
+                }
+                if c.remove != nil {
+                    remove = bigIntSlice(c.remove[i])
+                }
+                if err := session.Update(add, remove); err != nil {
+                    results[i] <- result{err: err}
+                    continue
+                }
+                sh, uq := session.Run()
+                results[i] <- result{nil, sh, uq}
+            }
+        }(i)
+    }
+
+    sets := items
+    check := func(step string, pass bool) {
+        for i := 0; i < n; i += 1 {
+            res := <-results[i]
+            if res.err != nil {
+                t.Errorf("%s: party %d: %v", step, i, res.err)
+                continue
+            }
+            if !pass {
+                if res.shared != nil {
+                    t.Errorf("%s: party %d passed cardinality test", step, i)
+                }
+                continue
+            }
+            shared, unique := expectedDiff(sets, i)
+            if !sameElements(res.shared, shared) {
+                t.Errorf("%s: party %d got shared %v", step, i, res.shared)
+            }
+            if !sameElements(res.unique, unique) {
+                t.Errorf("%s: party %d got unique %v", step, i, res.unique)
+            }
+        }
+    }
+    check("initial", true)
+    for k, c := range changes {
+        if !c.valid {
+            for i := 0; i < n; i += 1 {
+                if res := <-results[i]; res.err == nil {
+                    t.Errorf("update %d: party %d accepted invalid update", k, i)
+                }
+            }
+            continue
+        }
+        next := make([][]*big.Int, n)
+        for i := range sets {
+            removed := make(map[int64]bool)
+            if c.remove != nil {
+                for _, item := range c.remove[i] {
+                    removed[item] = true
+                }
+            }
+            for _, item := range sets[i] {
+                if !removed[item.Int64()] {
+                    next[i] = append(next[i], item)
+                }
+            }
+            if c.add != nil {
+                next[i] = append(next[i], bigIntSlice(c.add[i])...)
+            }
+        }
+        sets = next
+        check("update", c.pass)
+    }
+}
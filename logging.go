@@ -0,0 +1,241 @@
+package tpsi
+
+import (
+    "fmt"
+    "io"
+    "strconv"
+    "sync"
+    "time"
+)
+
+// events of log entries
+const (
+    LogStart = "start" // a protocol step started
+    LogDone = "done" // a protocol step finished, after Elapsed
+    LogWait = "wait" // waiting for a message from Peer
+    LogReceived = "received" // the message from Peer arrived, after waiting for Elapsed
+)
+
+// peers of log entries other than single outer parties
+const (
+    LogCentral = -1 // the central party
+    LogAllOuter = -2 // all outer parties, if they can't be waited on one by one
+)
+
+// structured record of the progress of one party
+type LogEntry struct {
+    Time time.Time
+    Party int // index of the logging party, as given to NewLoggingSetting
+    Session string
+    Step string // protocol step, e.g. "MMult step 3", empty for wait and received
+    Stream string // Mux stream waited on, empty if not waiting on a stream
+    Event string
+    Peer int // outer party position waited on by the central party, LogCentral or LogAllOuter
+    Elapsed time.Duration
+}
+
+// entry as a line of key=value pairs
+func (e LogEntry) String() string {
+    line := fmt.Sprintf("time=%s party=%d", e.Time.Format(time.RFC3339Nano), e.Party)
+    if e.Session != "" {
+        line += " session=" + strconv.Quote(e.Session)
+    }
+    line += " event=" + e.Event
+    if e.Step != "" {
+        line += " step=" + strconv.Quote(e.Step)
+    }
+    if e.Stream != "" {
+        line += " stream=" + strconv.Quote(e.Stream)
+    }
+    if e.Event == LogWait || e.Event == LogReceived {
+        if e.Peer == LogCentral {
+            line += " peer=central"
+        } else if e.Peer == LogAllOuter {
+            line += " peer=all"
+        } else {
+            line += fmt.Sprintf(" peer=%d", e.Peer)
+        }
+    }
+    if e.Event == LogDone || e.Event == LogReceived {
+        line += " elapsed=" + e.Elapsed.String()
+    }
+    return line
+}
+
+// receives the log entries of a LoggingSetting, possibly from several goroutines
+type Logger interface {
+    Log(entry LogEntry)
+}
+
+// Logger writing every entry as a line to w
+type TextLogger struct {
+    w io.Writer
+    lock *sync.Mutex
+}
+
+func NewTextLogger(w io.Writer) TextLogger {
+    return TextLogger{w, new(sync.Mutex)}
+}
+
+func (l TextLogger) Log(entry LogEntry) {
+    l.lock.Lock()
+    defer l.lock.Unlock()
+    fmt.Fprintln(l.w, entry)
+}
+
+// setting decorator logging the protocol steps run by the workers, and every
+// wait for a message. Workers find it by unwrapping settings that implement
+// Unwrap. It doesn't implement Streamer, so a Mux should be created over it
+// rather than it wrapping a stream: the streams then log their waits too.
+type LoggingSetting struct {
+    AHE_setting
+    logger Logger
+    party int
+    session string
+}
+
+// log the progress of the party with index party in session to logger
+func NewLoggingSetting(setting AHE_setting, logger Logger, party int, session string) LoggingSetting {
+    return LoggingSetting{setting, logger, party, session}
+}
+
+func (s LoggingSetting) log(step, stream, event string, peer int, elapsed time.Duration) {
+    s.logger.Log(LogEntry{time.Now(), s.party, s.session, step, stream, event, peer, elapsed})
+}
+
+func (s LoggingSetting) startStep(step string) func() {
+    s.log(step, "", LogStart, LogCentral, 0)
+    start := time.Now()
+    return func() {
+        s.log(step, "", LogDone, LogCentral, time.Since(start))
+    }
+}
+
+func (s LoggingSetting) startWait(stream string, peer int) func() {
+    s.log("", stream, LogWait, peer, 0)
+    start := time.Now()
+    return func() {
+        s.log("", stream, LogReceived, peer, time.Since(start))
+    }
+}
+
+func (s LoggingSetting) Unwrap() AHE_setting {
+    return s.AHE_setting
+}
+
+func (s LoggingSetting) Receive() interface{} {
+    end := s.startWait("", LogCentral)
+    msg := s.AHE_setting.Receive()
+    end()
+    return msg
+}
+
+// if the wrapped setting can receive from single parties, the wait for every
+// outer party is logged, so that a party holding up the protocol can be told
+func (s LoggingSetting) ReceiveAll() []interface{} {
+    if canReceiveFrom(s.AHE_setting) {
+        return s.receiveEach()
+    }
+    end := s.startWait("", LogAllOuter)
+    msgs := s.AHE_setting.ReceiveAll()
+    end()
+    return msgs
+}
+
+// receives from one outer party after the other, panics if the connection
+// to a party fails
+func (s LoggingSetting) receiveEach() []interface{} {
+    receiver := s.AHE_setting.(PeerReceiver)
+    msgs := make([]interface{}, s.Parties()-1)
+    for i := range msgs {
+        end := s.startWait("", i)
+        msg, err := receiver.ReceiveFrom(i)
+        if err != nil {panic(err)}
+        end()
+        msgs[i] = msg
+    }
+    return msgs
+}
+
+// receive without logging, so that a Mux can run over the setting
+func (s LoggingSetting) ReceiveFrom(i int) (interface{}, error) {
+    receiver, ok := s.AHE_setting.(PeerReceiver)
+    if !ok {
+        return nil, fmt.Errorf("setting of type %T can't receive from single parties", s.AHE_setting)
+    }
+    return receiver.ReceiveFrom(i)
+}
+
+// FHE setting decorator logging the progress of the protocol, see LoggingSetting
+type LoggingFHESetting struct {
+    LoggingSetting
+    setting FHE_setting
+}
+
+// log the progress of the party with index party in session to logger
+func NewLoggingFHESetting(setting FHE_setting, logger Logger, party int, session string) LoggingFHESetting {
+    return LoggingFHESetting{NewLoggingSetting(setting, logger, party, session), setting}
+}
+
+func (s LoggingFHESetting) FHE_cryptosystem() FHE_Cryptosystem {
+    return s.setting.FHE_cryptosystem()
+}
+
+// implemented by settings observing the protocol steps run by the workers
+type stepObserver interface {
+    // called when step starts, returns the function to call when it ends
+    startStep(step string) func()
+}
+
+// implemented by settings observing the waits on the streams of a Mux
+// created over them
+type waitObserver interface {
+    // called when a wait for a message from peer on stream starts,
+    // returns the function to call when it arrives
+    startWait(stream string, peer int) func()
+}
+
+// calls f for setting and every setting wrapped by it
+func visitWrapped(setting AHE_setting, f func(AHE_setting)) {
+    for {
+        f(setting)
+        wrapper, ok := setting.(settingWrapper)
+        if !ok {
+            return
+        }
+        setting = wrapper.Unwrap()
+    }
+}
+
+// reports the start of a wait for a message from peer on stream to the wait
+// observers among setting and the settings wrapped by it, and returns the
+// function reporting its end
+func observeWait(setting AHE_setting, stream string, peer int) func() {
+    var ends []func()
+    visitWrapped(setting, func(s AHE_setting) {
+        if observer, ok := s.(waitObserver); ok {
+            ends = append(ends, observer.startWait(stream, peer))
+        }
+    })
+    return func() {
+        for _, end := range ends {
+            end()
+        }
+    }
+}
+
+// reports the start of step to the step observers among setting and the settings
+// wrapped by it, and returns the function reporting its end
+func observeStep(setting AHE_setting, step string) func() {
+    var ends []func()
+    visitWrapped(setting, func(s AHE_setting) {
+        if observer, ok := s.(stepObserver); ok {
+            ends = append(ends, observer.startStep(step))
+        }
+    })
+    return func() {
+        for _, end := range ends {
+            end()
+        }
+    }
+}
@@ -0,0 +1,201 @@
+package tpsi
+
+import (
+    "bytes"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+    gm "github.com/ontanj/generic-matrix"
+)
+
+// Logger keeping all entries
+type collectingLogger struct {
+    lock *sync.Mutex
+    entries *[]LogEntry
+}
+
+func newCollectingLogger() collectingLogger {
+    return collectingLogger{new(sync.Mutex), new([]LogEntry)}
+}
+
+func (l collectingLogger) Log(entry LogEntry) {
+    l.lock.Lock()
+    defer l.lock.Unlock()
+    *l.entries = append(*l.entries, entry)
+}
+
+// entries of party with the given event
+func (l collectingLogger) of(party int, event string) []LogEntry {
+    l.lock.Lock()
+    defer l.lock.Unlock()
+    var entries []LogEntry
+    for _, entry := range *l.entries {
+        if entry.Party == party && entry.Event == event {
+            entries = append(entries, entry)
+        }
+    }
+    return entries
+}
+
+// settings sharing one channel in both directions between the central party
+// and each outer party, which therefore can't receive from single parties
+func sharedChannelSettings(n int, cs AHE_Cryptosystem) []AHESetting {
+    settings := make([]AHESetting, n)
+    channels := create_chans(n-1)
+    for i := 0; i < n; i += 1 {
+        settings[i].n = n
+        settings[i].cs = cs
+        if i == n-1 {
+            settings[i].channels = channels
+        } else {
+            settings[i].channel = channels[i]
+        }
+    }
+    return settings
+}
+
+// runs MMult with every party logging to logger, the central party being party n-1
+func loggedMMult(t *testing.T, settings []AHE_setting, sks []Secret_key, logger Logger) {
+    n := len(settings)
+    a, err := gm.NewMatrixFromInt(2, 2, []int{1, 2, 3, 4})
+    if err != nil {t.Fatal(err)}
+    a, err = EncryptMatrix(a, settings[0])
+    if err != nil {t.Fatal(err)}
+    done := make(chan bool)
+    for i := 0; i < n; i += 1 {
+        go func(i int) {
+            setting := NewLoggingSetting(settings[i], logger, i, "mmult")
+            if setting.IsCentral() {
+                CentralMatrixMultiplicationWorker(a, a, sks[i], setting)
+            } else {
+                OuterMatrixMultiplicationWorker(a, a, sks[i], setting)
+            }
+            done <- true
+        }(i)
+    }
+    for i := 0; i < n; i += 1 {
+        <-done
+    }
+}
+
+func TestLoggingSetting(t *testing.T) {
+    n := 3
+    pk, sksdj, err := NewDJCryptosystem(n)
+    if err != nil {t.Fatal(err)}
+    sks := ConvertDJSKSlice(sksdj)
+
+    t.Run("steps and waits", func(t *testing.T) {
+        logger := newCollectingLogger()
+        settings := make([]AHE_setting, n)
+        for i, setting := range SetupAHE(n, 0, pk) {
+            settings[i] = setting
+        }
+        loggedMMult(t, settings, sks, logger)
+
+        for i := 0; i < n; i += 1 {
+            starts := logger.of(i, LogStart)
+            dones := logger.of(i, LogDone)
+            if len(starts) != 4 || len(dones) != 4 {
+                t.Fatalf("party %d logged %d starts and %d ends of steps", i, len(starts), len(dones))
+            }
+            for k, step := range []string{"MMult step 1", "MMult step 2", "MMult step 3", "MMult step 4"} {
+                if starts[k].Step != step || dones[k].Step != step {
+                    t.Errorf("party %d logged %q and %q, expected %q", i, starts[k].Step, dones[k].Step, step)
+                }
+                if starts[k].Session != "mmult" {
+                    t.Errorf("party %d logged session %q", i, starts[k].Session)
+                }
+            }
+        }
+        // the central party waits for each outer party, which wait for the central party
+        for _, entry := range logger.of(n-1, LogWait) {
+            if entry.Peer < 0 || entry.Peer >= n-1 {
+                t.Errorf("central party waited on peer %d", entry.Peer)
+            }
+        }
+        for _, entry := range logger.of(0, LogWait) {
+            if entry.Peer != LogCentral {
+                t.Errorf("outer party waited on peer %d", entry.Peer)
+            }
+        }
+        if len(logger.of(n-1, LogReceived)) != len(logger.of(n-1, LogWait)) {
+            t.Error("central party didn't log every received message")
+        }
+    })
+
+    t.Run("shared channels", func(t *testing.T) {
+        logger := newCollectingLogger()
+        settings := make([]AHE_setting, n)
+        for i, setting := range sharedChannelSettings(n, pk) {
+            settings[i] = setting
+        }
+        loggedMMult(t, settings, sks, logger)
+        received := logger.of(n-1, LogReceived)
+        if len(received) == 0 {
+            t.Fatal("central party logged no received messages")
+        }
+        for _, entry := range received {
+            if entry.Peer != LogAllOuter {
+                t.Errorf("central party received from peer %d", entry.Peer)
+            }
+        }
+    })
+
+    t.Run("mux streams", func(t *testing.T) {
+        logger := newCollectingLogger()
+        muxes := make([]*Mux, n)
+        streams := make([]AHE_setting, n)
+        for i, setting := range SetupAHE(n, 0, pk) {
+            muxes[i], err = NewMux(NewLoggingSetting(setting, logger, i, ""))
+            if err != nil {t.Fatal(err)}
+            streams[i] = muxes[i].Stream("a")
+        }
+        observeStep(streams[0].(muxStream).Substream("b"), "inner")()
+        if dones := logger.of(0, LogDone); len(dones) != 1 || dones[0].Step != "inner" {
+            t.Errorf("got %v, expected the step of the sub-stream", dones)
+        }
+
+        loggedMMult(t, streams, sks, newCollectingLogger())
+        waits := logger.of(n-1, LogWait)
+        if len(waits) == 0 || len(logger.of(n-1, LogReceived)) != len(waits) {
+            t.Fatalf("central party logged %d waits on streams", len(waits))
+        }
+        for _, entry := range waits {
+            if entry.Stream != "a" || entry.Peer < 0 || entry.Peer >= n-1 {
+                t.Errorf("central party waited on peer %d of stream %q", entry.Peer, entry.Stream)
+            }
+        }
+        for _, entry := range logger.of(0, LogWait) {
+            if entry.Stream != "a" || entry.Peer != LogCentral {
+                t.Errorf("outer party waited on peer %d of stream %q", entry.Peer, entry.Stream)
+            }
+        }
+        closed := make(chan bool)
+        for _, mux := range muxes {
+            go func(mux *Mux) {
+                mux.Close()
+                closed <- true
+            }(mux)
+        }
+        for range muxes {
+            <-closed
+        }
+    })
+}
+
+func TestTextLogger(t *testing.T) {
+    var buf bytes.Buffer
+    logger := NewTextLogger(&buf)
+    at := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+    logger.Log(LogEntry{at, 2, "s1", "MMult step 3", "", LogDone, LogCentral, 1500*time.Millisecond})
+    logger.Log(LogEntry{at, 3, "", "", "batch/a", LogWait, 1, 0})
+    expected := "time=2021-03-04T05:06:07Z party=2 session=\"s1\" event=done step=\"MMult step 3\" elapsed=1.5s\n" +
+        "time=2021-03-04T05:06:07Z party=3 event=wait stream=\"batch/a\" peer=1\n"
+    if buf.String() != expected {
+        t.Errorf("got\n%s\nexpected\n%s", buf.String(), expected)
+    }
+    if !strings.Contains(LogEntry{at, 0, "", "", "", LogReceived, LogAllOuter, time.Second}.String(), "peer=all elapsed=1s") {
+        t.Error("expected all outer parties as peer")
+    }
+}
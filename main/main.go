@@ -1,11 +1,14 @@
 package main
 
 import (
+    "flag"
     "fmt"
     "os"
     "io/ioutil"
     "strings"
     "math/big"
+    "net/http"
+    "path/filepath"
     "github.com/ontanj/tpsi"
     "strconv"
     "sync"
@@ -14,9 +17,30 @@ import (
 
 func main() {
     startT := time.Now()
+
+    if len(os.Args) == 3 && os.Args[1] == "transcript" {
+        printTranscript(os.Args[2])
+        return
+    }
+
+    if len(os.Args) == 5 && os.Args[1] == "replay" {
+        runReplay(os.Args[2], os.Args[3], os.Args[4])
+        return
+    }
+
+    if len(os.Args) >= 2 && os.Args[1] == "bench" {
+        runBench(os.Args[2:])
+        return
+    }
+
+    if len(os.Args) >= 6 && os.Args[1] == "batch" {
+        runBatch(os.Args[2], os.Args[3], os.Args[4], os.Args[5:])
+        fmt.Printf("%f s elapsed\n", time.Now().Sub(startT).Seconds())
+        return
+    }
     
-    if len(os.Args) != 5 {
-        fmt.Println("Wrong number of arguments: protocol cryptosystem threshold file-with-elements")
+    if len(os.Args) != 5 && len(os.Args) != 6 {
+        fmt.Println("Wrong number of arguments: protocol cryptosystem threshold file-with-elements [central-party]")
         os.Exit(1)
     }
 
@@ -35,6 +59,42 @@ func main() {
 
     n := len(elements)
 
+    central := n-1
+    if len(os.Args) == 6 {
+        central, err = strconv.Atoi(os.Args[5])
+        if err != nil || central < 1 || central > n {
+            fmt.Printf("Error when parsing central party: %v\n", os.Args[5])
+            os.Exit(1)
+        }
+        central -= 1 // parties are numbered from 1
+    }
+
+    // progress of every party is logged to stderr if TPSI_LOG is set
+    var logger tpsi.Logger
+    if os.Getenv("TPSI_LOG") != "" {
+        logger = tpsi.NewTextLogger(os.Stderr)
+    }
+    // metrics of all parties are served at the address in TPSI_METRICS, e.g. localhost:9090
+    var metrics *tpsi.Metrics
+    if addr := os.Getenv("TPSI_METRICS"); addr != "" {
+        metrics = tpsi.NewMetrics()
+        http.Handle("/metrics", metrics)
+        go func() {
+            err := http.ListenAndServe(addr, nil)
+            fmt.Printf("Error when serving metrics: %v\n", err)
+        }()
+    }
+
+    // elements are hashed into the plaintext space if TPSI_HASH is set
+    hashing := os.Getenv("TPSI_HASH") != ""
+
+    // every party is recorded to the directory in TPSI_TRANSCRIPT, see recordParty
+    transcripts := os.Getenv("TPSI_TRANSCRIPT")
+    if transcripts != "" && (prt != "diff" || css != "dj") {
+        fmt.Println("Error: transcripts are only recorded for diff with dj")
+        os.Exit(1)
+    }
+
     var wg sync.WaitGroup
     if prt == "int" {
         var cs []tpsi.FHE_Cryptosystem
@@ -47,18 +107,35 @@ func main() {
                 sks[i] = sk
                 cs[i] = bfvcs[i]
             }
+        } else if css == "bgv" {
+            bgvcs, bgvsks := tpsi.SetupBGV(n)
+            sks = make([]tpsi.Secret_key, n)
+            cs = make([]tpsi.FHE_Cryptosystem, n)
+            for i, sk := range bgvsks {
+                sks[i] = sk
+                cs[i] = bgvcs[i]
+            }
         } else {
             fmt.Printf("Cryptosystem %v not available for %v.", css, prt)
             os.Exit(1)
         }
-        settings := tpsi.SetupFHE(n, int(T), cs)
+        settings := tpsi.SetupFHEWithCentral(n, int(T), central, cs)
         wg.Add(n)
         for i := 0; i < n; i += 1 {
             go func(i int) {
-                sh, uq := tpsi.TPSIintWorker(tpsi.EncodeElements(elements[i]), sks[i], settings[i])
+                var setting tpsi.FHE_setting = settings[i]
+                if metrics != nil {
+                    setting = tpsi.NewMetricsFHESetting(setting, metrics)
+                }
+                if logger != nil {
+                    setting = tpsi.NewLoggingFHESetting(setting, logger, i+1, prt)
+                }
+                items, decode := encode(elements[i], setting, hashing)
+                sh, uq := tpsi.TPSIintWorker(items, sks[i], setting)
                 if sh != nil {
+                    sh, uq = decode(i, sh, uq)
                     fmt.Printf("party %d: shared elements: %v\n         unique elements: %v\n", i+1,
-                    readableElements(tpsi.DecodeElements(sh)), readableElements(tpsi.DecodeElements(uq)))
+                    readableElements(sh), readableElements(uq))
                 } else {
                     fmt.Printf("party %d: cardinality test failed\n", i)
                 }
@@ -87,14 +164,82 @@ func main() {
             fmt.Printf("Cryptosystem %v not available for %v.", css, prt)
             os.Exit(1)
         }
-        settings := tpsi.SetupAHE(n, int(T), cs)
+        settings := tpsi.SetupAHEWithCentral(n, int(T), central, cs)
+        wg.Add(n)
+        for i := 0; i < n; i += 1 {
+            go func(i int) {
+                var setting tpsi.AHE_setting = settings[i]
+                if transcripts != "" {
+                    var done func()
+                    setting, done = recordParty(transcripts, i, sks[i], setting)
+                    defer done()
+                }
+                if metrics != nil {
+                    setting = tpsi.NewMetricsSetting(setting, metrics)
+                }
+                if logger != nil {
+                    setting = tpsi.NewLoggingSetting(setting, logger, i+1, prt)
+                }
+                items, decode := encode(elements[i], setting, hashing)
+                sh, uq := tpsi.TPSIdiffWorker(items, sks[i], setting)
+                if sh != nil {
+                    sh, uq = decode(i, sh, uq)
+                    fmt.Printf("party %d: shared elements: %v\n         unique elements: %v\n", i+1,
+                        readableElements(sh), readableElements(uq))
+                } else {
+                    fmt.Printf("party %d: cardinality test failed\n", i)
+                }
+                wg.Done()
+            }(i)
+        }
+    } else if prt == "size" {
+        var settings []tpsi.AHE_setting
+        var sks []tpsi.Secret_key
+        if css == "dj" {
+            cs, djsks, err := tpsi.NewDJCryptosystem(n)
+            if err != nil {panic(err)}
+            sks = make([]tpsi.Secret_key, n)
+            for i, sk := range djsks {
+                sks[i] = sk
+            }
+            for _, setting := range tpsi.SetupAHEWithCentral(n, int(T), central, cs) {
+                settings = append(settings, setting)
+            }
+        } else if css == "bfv" {
+            bfvcs, bfvsks := tpsi.SetupBFV(n)
+            sks = make([]tpsi.Secret_key, n)
+            cs := make([]tpsi.FHE_Cryptosystem, n)
+            for i, sk := range bfvsks {
+                sks[i] = sk
+                cs[i] = bfvcs[i]
+            }
+            for _, setting := range tpsi.SetupFHEWithCentral(n, int(T), central, cs) {
+                settings = append(settings, setting)
+            }
+        } else if css == "bgv" {
+            bgvcs, bgvsks := tpsi.SetupBGV(n)
+            sks = make([]tpsi.Secret_key, n)
+            cs := make([]tpsi.FHE_Cryptosystem, n)
+            for i, sk := range bgvsks {
+                sks[i] = sk
+                cs[i] = bgvcs[i]
+            }
+            for _, setting := range tpsi.SetupFHEWithCentral(n, int(T), central, cs) {
+                settings = append(settings, setting)
+            }
+        } else {
+            fmt.Printf("Cryptosystem %v not available for %v.", css, prt)
+            os.Exit(1)
+        }
         wg.Add(n)
         for i := 0; i < n; i += 1 {
             go func(i int) {
-                sh, uq := tpsi.TPSIdiffWorker(tpsi.EncodeElements(elements[i]), sks[i], settings[i])
+                items, decode := encode(elements[i], settings[i], hashing)
+                sh, uq := tpsi.TPSIintersectionSizeWorker(items, sks[i], settings[i])
                 if sh != nil {
+                    sh, uq = decode(i, sh, uq)
                     fmt.Printf("party %d: shared elements: %v\n         unique elements: %v\n", i+1,
-                        readableElements(tpsi.DecodeElements(sh)), readableElements(tpsi.DecodeElements(uq)))
+                        readableElements(sh), readableElements(uq))
                 } else {
                     fmt.Printf("party %d: cardinality test failed\n", i)
                 }
@@ -107,6 +252,95 @@ func main() {
     fmt.Printf("%f s elapsed\n", t.Sub(startT).Seconds())
 }
 
+func printTranscript(filename string) {
+    file, err := os.Open(filename)
+    if err != nil {
+        fmt.Printf("Error when reading file %v\n", filename)
+        os.Exit(1)
+    }
+    defer file.Close()
+    transcript, err := tpsi.ReadTranscript(file)
+    if err != nil {
+        fmt.Printf("Error when parsing transcript: %v\n", err)
+        os.Exit(1)
+    }
+    fmt.Printf("parties: %d, threshold: %d, central: %t, seeded: %t\n", transcript.Parties, transcript.Threshold, transcript.Central, transcript.Seed != nil)
+    for _, entry := range transcript.Entries {
+        fmt.Println(entry)
+    }
+}
+
+// file of party i in a transcript directory
+func partyFile(dir string, i int, kind string) string {
+    return filepath.Join(dir, fmt.Sprintf("party-%d.%s", i+1, kind))
+}
+
+// records the messages of party i to party-<i>.transcript in dir and writes
+// its key share to party-<i>.key, so that the party can be replayed with
+// runReplay. Returns the recording setting and a function closing the transcript.
+func recordParty(dir string, i int, sk tpsi.Secret_key, setting tpsi.AHE_setting) (tpsi.AHE_setting, func()) {
+    key, err := os.OpenFile(partyFile(dir, i, "key"), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+    if err == nil {
+        err = tpsi.WriteDJKey(key, sk.(tpsi.DJ_secret_key))
+        key.Close()
+    }
+    if err != nil {
+        fmt.Printf("Error when writing key of party %d: %v\n", i+1, err)
+        os.Exit(1)
+    }
+    file, err := os.OpenFile(partyFile(dir, i, "transcript"), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+    if err != nil {
+        fmt.Printf("Error when creating transcript of party %d: %v\n", i+1, err)
+        os.Exit(1)
+    }
+    return tpsi.NewRecordingSetting(setting, file), func() {file.Close()}
+}
+
+// re-drives TPSIdiffWorker of a party from the transcript and key recorded in dir,
+// with the party's elements from the element file, see recordParty
+func runReplay(dir, party, filename string) {
+    i, err := strconv.Atoi(party)
+    elements := parseElementfile(filename)
+    if err != nil || i < 1 || i > len(elements) {
+        fmt.Printf("Error when parsing party: %v\n", party)
+        os.Exit(1)
+    }
+    i -= 1 // parties are numbered from 1
+    key, err := os.Open(partyFile(dir, i, "key"))
+    if err != nil {
+        fmt.Printf("Error when reading key of party %d: %v\n", i+1, err)
+        os.Exit(1)
+    }
+    pk, sk, err := tpsi.ReadDJKey(key)
+    key.Close()
+    if err != nil {
+        fmt.Printf("Error when parsing key of party %d: %v\n", i+1, err)
+        os.Exit(1)
+    }
+    file, err := os.Open(partyFile(dir, i, "transcript"))
+    if err != nil {
+        fmt.Printf("Error when reading transcript of party %d: %v\n", i+1, err)
+        os.Exit(1)
+    }
+    transcript, err := tpsi.ReadTranscript(file)
+    file.Close()
+    if err != nil {
+        fmt.Printf("Error when parsing transcript: %v\n", err)
+        os.Exit(1)
+    }
+
+    hashing := os.Getenv("TPSI_HASH") != ""
+    err = tpsi.ReplayWorker(transcript, pk, func(setting tpsi.AHE_setting) {
+        items, _ := encode(elements[i], setting, hashing)
+        tpsi.TPSIdiffWorker(items, sk, setting)
+    })
+    if err != nil {
+        fmt.Printf("party %d: %v\n", i+1, err)
+        os.Exit(1)
+    }
+    fmt.Printf("party %d: replay matches all %d recorded messages\n", i+1, len(transcript.Entries))
+}
+
 func readableElements(elements []*big.Int) string {
     var sb strings.Builder
     for _, e := range elements {
@@ -120,6 +354,35 @@ func readableElements(elements []*big.Int) string {
     }
 }
 
+// decodes the shared and unique elements returned to party i by the protocol
+type decoder func(i int, sh, uq []*big.Int) ([]*big.Int, []*big.Int)
+
+// encodes elements into the plaintext space of setting, by hashing if hashing is set,
+// and returns the function decoding the output of the protocol. With hashing, the
+// decoder warns if the false-positive estimate of the output is too large.
+func encode(elements []*big.Int, setting tpsi.AHE_setting, hashing bool) ([]*big.Int, decoder) {
+    if !hashing {
+        return tpsi.EncodeElements(elements), func(i int, sh, uq []*big.Int) ([]*big.Int, []*big.Int) {
+            return tpsi.DecodeElements(sh), tpsi.DecodeElements(uq)
+        }
+    }
+    encoding := tpsi.NewHashEncoding(setting.AHE_cryptosystem().N())
+    items, err := encoding.Encode(elements)
+    if err != nil {
+        fmt.Printf("Error when hashing elements: %v\n", err)
+        os.Exit(1)
+    }
+    return items, func(i int, sh, uq []*big.Int) ([]*big.Int, []*big.Int) {
+        result, err := encoding.DecodeResult(sh, uq, setting)
+        if err != nil {
+            fmt.Printf("party %d: warning: %v\n", i+1, err)
+        } else {
+            fmt.Printf("party %d: estimated false-positive probability: %g\n", i+1, result.FalsePositive)
+        }
+        return result.Shared, result.Unique
+    }
+}
+
 func parseElementfile(filename string) [][]*big.Int {
     dat, err := ioutil.ReadFile(filename)
     if err != nil {
@@ -149,4 +412,177 @@ func parseElementfile(filename string) [][]*big.Int {
         }
     }
     return elements
-}
\ No newline at end of file
+}
+
+// runs one instance per element file over a single key setup, concurrently
+func runBatch(prt, css, threshold string, files []string) {
+    T, err := strconv.Atoi(threshold)
+    if err != nil {
+        fmt.Printf("Error when parsing T: %v\n", threshold)
+        os.Exit(1)
+    }
+    instances := make([][][]*big.Int, len(files))
+    for k, file := range files {
+        instances[k] = parseElementfile(file)
+        if k > 0 && len(instances[k]) != len(instances[0]) {
+            fmt.Println("Error: different number of parties")
+            os.Exit(1)
+        }
+    }
+    n := len(instances[0])
+
+    var settings []tpsi.AHE_setting
+    sks := make([]tpsi.Secret_key, n)
+    if prt == "diff" && css == "dj" {
+        cs, djsks, err := tpsi.NewDJCryptosystem(n)
+        if err != nil {panic(err)}
+        for i, sk := range djsks {
+            sks[i] = sk
+        }
+        for _, setting := range tpsi.SetupAHE(n, T, cs) {
+            settings = append(settings, setting)
+        }
+    } else if prt == "int" && (css == "bfv" || css == "bgv") {
+        cs := make([]tpsi.FHE_Cryptosystem, n)
+        if css == "bfv" {
+            bfvcs, bfvsks := tpsi.SetupBFV(n)
+            for i, sk := range bfvsks {
+                sks[i] = sk
+                cs[i] = bfvcs[i]
+            }
+        } else {
+            bgvcs, bgvsks := tpsi.SetupBGV(n)
+            for i, sk := range bgvsks {
+                sks[i] = sk
+                cs[i] = bgvcs[i]
+            }
+        }
+        for _, setting := range tpsi.SetupFHE(n, T, cs) {
+            settings = append(settings, setting)
+        }
+    } else {
+        fmt.Printf("Cryptosystem %v not available for batches of %v.\n", css, prt)
+        os.Exit(1)
+    }
+
+    var wg sync.WaitGroup
+    wg.Add(n)
+    for i := 0; i < n; i += 1 {
+        batch, err := tpsi.NewBatch(sks[i], settings[i])
+        if err != nil {panic(err)}
+        go func(i int) {
+            var instance_wg sync.WaitGroup
+            instance_wg.Add(len(files))
+            for k := range files {
+                run := func(k int) {
+                    name := fmt.Sprintf("%d: %s", k+1, files[k])
+                    items := tpsi.EncodeElements(instances[k][i])
+                    var sh, uq []*big.Int
+                    if prt == "diff" {
+                        sh, uq = batch.Diff(name, items)
+                    } else {
+                        sh, uq = batch.Int(name, items)
+                    }
+                    if sh != nil {
+                        fmt.Printf("%s, party %d: shared elements: %v\n         unique elements: %v\n", name, i+1,
+                            readableElements(tpsi.DecodeElements(sh)), readableElements(tpsi.DecodeElements(uq)))
+                    } else {
+                        fmt.Printf("%s, party %d: cardinality test failed\n", name, i+1)
+                    }
+                    instance_wg.Done()
+                }
+                go run(k)
+            }
+            instance_wg.Wait()
+            batch.Close()
+            wg.Done()
+        }(i)
+    }
+    wg.Wait()
+}
+
+// comma separated list of integers
+func parseInts(name, list string) []int {
+    var vals []int
+    for _, field := range strings.Split(list, ",") {
+        val, err := strconv.Atoi(strings.TrimSpace(field))
+        if err != nil {
+            fmt.Printf("Error when parsing %s: %v\n", name, field)
+            os.Exit(1)
+        }
+        vals = append(vals, val)
+    }
+    return vals
+}
+
+// runs the protocols for every combination of the given parameters and writes CSV
+func runBench(args []string) {
+    flags := flag.NewFlagSet("bench", flag.ExitOnError)
+    protocols := flags.String("protocol", "diff", "protocols, diff and/or int")
+    backends := flags.String("backend", "dj", "cryptosystems, dj, bfv and/or bgv")
+    parties := flags.String("parties", "3", "numbers of parties")
+    thresholds := flags.String("threshold", "4", "thresholds")
+    sizes := flags.String("size", "8", "numbers of elements of every party")
+    bits := flags.String("bits", "512", "Damgård-Jurik key sizes")
+    ss := flags.String("s", "1", "Damgård-Jurik exponents s")
+    out := flags.String("out", "", "CSV file, standard output if empty")
+    flags.Parse(args)
+
+    var configs []tpsi.BenchConfig
+    for _, prt := range strings.Split(*protocols, ",") {
+        for _, css := range strings.Split(*backends, ",") {
+            if prt == "int" && css == "dj" {
+                continue // TPSI-int needs an FHE cryptosystem
+            }
+            keys := [][2]int{{0, 0}} // key parameters only apply to Damgård-Jurik
+            if css == "dj" {
+                keys = nil
+                for _, b := range parseInts("bits", *bits) {
+                    for _, s := range parseInts("s", *ss) {
+                        keys = append(keys, [2]int{b, s})
+                    }
+                }
+            }
+            for _, n := range parseInts("parties", *parties) {
+                for _, T := range parseInts("threshold", *thresholds) {
+                    for _, size := range parseInts("size", *sizes) {
+                        for _, key := range keys {
+                            configs = append(configs, tpsi.BenchConfig{Protocol: prt, Backend: css, Parties: n, Threshold: T, SetSize: size, KeyBits: key[0], S: key[1]})
+                        }
+                    }
+                }
+            }
+        }
+    }
+
+    w := os.Stdout
+    if *out != "" {
+        file, err := os.Create(*out)
+        if err != nil {
+            fmt.Printf("Error when creating %v: %v\n", *out, err)
+            os.Exit(1)
+        }
+        defer file.Close()
+        w = file
+    }
+    var results []tpsi.BenchResult
+    for _, config := range configs {
+        result, err := tpsi.RunBench(config)
+        if err != nil {
+            fmt.Fprintf(os.Stderr, "%+v: %v\n", config, err)
+            continue
+        }
+        backend := config.Backend
+        if backend == "dj" {
+            backend = fmt.Sprintf("dj (%d bits, s=%d)", config.KeyBits, config.S)
+        }
+        fmt.Fprintf(os.Stderr, "%s %s, %d parties, T=%d, %d elements: %f s\n", config.Protocol, backend,
+            config.Parties, config.Threshold, config.SetSize, result.Runtime.Seconds())
+        results = append(results, result)
+    }
+    err := tpsi.WriteBenchCSV(w, results)
+    if err != nil {
+        fmt.Printf("Error when writing CSV: %v\n", err)
+        os.Exit(1)
+    }
+}
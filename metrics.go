@@ -0,0 +1,275 @@
+package tpsi
+
+import (
+    "fmt"
+    "io"
+    "net/http"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// upper bounds in seconds of the buckets of step latencies
+var stepLatencyBuckets = []float64{0.001, 0.01, 0.1, 0.5, 1, 5, 10, 30, 60, 300}
+
+// histogram with the buckets of stepLatencyBuckets
+type histogram struct {
+    counts []uint64 // per bucket, not cumulative, the last for values above all bounds
+    sum float64
+    count uint64
+}
+
+// counters and histograms of a party process, fed by MetricsSetting and
+// exposed in the Prometheus text exposition format. Safe for concurrent use,
+// one Metrics can collect the metrics of many sessions.
+type Metrics struct {
+    lock sync.Mutex
+    sessions map[string]uint64 // by protocol
+    cardinality map[[2]string]uint64 // by protocol and result
+    bytes_sent uint64
+    bytes_received uint64
+    rounds uint64 // calls of Receive and ReceiveAll
+    bfv_refreshes uint64
+    steps map[string]*histogram // latency by step
+}
+
+func NewMetrics() *Metrics {
+    return &Metrics{
+        sessions: make(map[string]uint64),
+        cardinality: make(map[[2]string]uint64),
+        steps: make(map[string]*histogram),
+    }
+}
+
+func (m *Metrics) session(protocol string, passed bool) {
+    result := "fail"
+    if passed {
+        result = "pass"
+    }
+    m.lock.Lock()
+    defer m.lock.Unlock()
+    m.sessions[protocol] += 1
+    m.cardinality[[2]string{protocol, result}] += 1
+}
+
+func (m *Metrics) sent(bytes int) {
+    m.lock.Lock()
+    defer m.lock.Unlock()
+    m.bytes_sent += uint64(bytes)
+}
+
+func (m *Metrics) received(bytes int) {
+    m.lock.Lock()
+    defer m.lock.Unlock()
+    m.bytes_received += uint64(bytes)
+}
+
+func (m *Metrics) round() {
+    m.lock.Lock()
+    defer m.lock.Unlock()
+    m.rounds += 1
+}
+
+func (m *Metrics) refreshed() {
+    m.lock.Lock()
+    defer m.lock.Unlock()
+    m.bfv_refreshes += 1
+}
+
+func (m *Metrics) stepLatency(step string, d time.Duration) {
+    m.lock.Lock()
+    defer m.lock.Unlock()
+    h, ok := m.steps[step]
+    if !ok {
+        h = &histogram{counts: make([]uint64, len(stepLatencyBuckets)+1)}
+        m.steps[step] = h
+    }
+    seconds := d.Seconds()
+    i := sort.SearchFloat64s(stepLatencyBuckets, seconds)
+    h.counts[i] += 1
+    h.sum += seconds
+    h.count += 1
+}
+
+func formatFloat(f float64) string {
+    return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func sortedKeys(m map[string]uint64) []string {
+    keys := make([]string, 0, len(m))
+    for k := range m {
+        keys = append(keys, k)
+    }
+    sort.Strings(keys)
+    return keys
+}
+
+// write all metrics in the Prometheus text exposition format
+func (m *Metrics) WriteText(w io.Writer) error {
+    m.lock.Lock()
+    defer m.lock.Unlock()
+    var b strings.Builder
+
+    b.WriteString("# HELP tpsi_sessions_total Protocol sessions run, by protocol.\n")
+    b.WriteString("# TYPE tpsi_sessions_total counter\n")
+    for _, protocol := range sortedKeys(m.sessions) {
+        fmt.Fprintf(&b, "tpsi_sessions_total{protocol=%q} %d\n", protocol, m.sessions[protocol])
+    }
+
+    b.WriteString("# HELP tpsi_cardinality_tests_total Cardinality tests, by protocol and result.\n")
+    b.WriteString("# TYPE tpsi_cardinality_tests_total counter\n")
+    results := make([][2]string, 0, len(m.cardinality))
+    for key := range m.cardinality {
+        results = append(results, key)
+    }
+    sort.Slice(results, func(i, j int) bool {
+        return results[i][0] < results[j][0] || results[i][0] == results[j][0] && results[i][1] < results[j][1]
+    })
+    for _, key := range results {
+        fmt.Fprintf(&b, "tpsi_cardinality_tests_total{protocol=%q,result=%q} %d\n", key[0], key[1], m.cardinality[key])
+    }
+
+    b.WriteString("# HELP tpsi_sent_bytes_total Bytes of serialized messages sent.\n")
+    b.WriteString("# TYPE tpsi_sent_bytes_total counter\n")
+    fmt.Fprintf(&b, "tpsi_sent_bytes_total %d\n", m.bytes_sent)
+    b.WriteString("# HELP tpsi_received_bytes_total Bytes of serialized messages received.\n")
+    b.WriteString("# TYPE tpsi_received_bytes_total counter\n")
+    fmt.Fprintf(&b, "tpsi_received_bytes_total %d\n", m.bytes_received)
+    b.WriteString("# HELP tpsi_receive_rounds_total Waits for a message from the central party or from every outer party.\n")
+    b.WriteString("# TYPE tpsi_receive_rounds_total counter\n")
+    fmt.Fprintf(&b, "tpsi_receive_rounds_total %d\n", m.rounds)
+    b.WriteString("# HELP tpsi_bfv_refreshes_total Refreshes of BFV ciphertexts before multiplication.\n")
+    b.WriteString("# TYPE tpsi_bfv_refreshes_total counter\n")
+    fmt.Fprintf(&b, "tpsi_bfv_refreshes_total %d\n", m.bfv_refreshes)
+
+    b.WriteString("# HELP tpsi_step_duration_seconds Latency of protocol steps, by step.\n")
+    b.WriteString("# TYPE tpsi_step_duration_seconds histogram\n")
+    steps := make([]string, 0, len(m.steps))
+    for step := range m.steps {
+        steps = append(steps, step)
+    }
+    sort.Strings(steps)
+    for _, step := range steps {
+        h := m.steps[step]
+        var cumulative uint64
+        for i, bound := range stepLatencyBuckets {
+            cumulative += h.counts[i]
+            fmt.Fprintf(&b, "tpsi_step_duration_seconds_bucket{step=%q,le=%q} %d\n", step, formatFloat(bound), cumulative)
+        }
+        fmt.Fprintf(&b, "tpsi_step_duration_seconds_bucket{step=%q,le=\"+Inf\"} %d\n", step, h.count)
+        fmt.Fprintf(&b, "tpsi_step_duration_seconds_sum{step=%q} %s\n", step, formatFloat(h.sum))
+        fmt.Fprintf(&b, "tpsi_step_duration_seconds_count{step=%q} %d\n", step, h.count)
+    }
+
+    _, err := io.WriteString(w, b.String())
+    return err
+}
+
+// serves the metrics, e.g. with http.ListenAndServe("localhost:9090", metrics)
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+    m.WriteText(w)
+}
+
+// implemented by settings observing the outcome of protocol runs
+type sessionObserver interface {
+    endSession(protocol string, passed bool)
+}
+
+// reports the end of a run of protocol to the session observers among
+// setting and the settings wrapped by it, passed being the cardinality test result
+func observeSession(setting AHE_setting, protocol string, passed bool) {
+    visitWrapped(setting, func(s AHE_setting) {
+        if observer, ok := s.(sessionObserver); ok {
+            observer.endSession(protocol, passed)
+        }
+    })
+}
+
+// receives the sizes of the messages sent and received by a transport
+type trafficCounter interface {
+    sent(bytes int)
+    received(bytes int)
+}
+
+// implemented by transports reporting the size of every message, as
+// serialized by EncodeMessage, that they send or receive
+type trafficReporter interface {
+    // copy of the setting reporting to counter
+    withTraffic(counter trafficCounter) AHE_setting
+}
+
+// setting decorator feeding metrics with the latency of the protocol steps,
+// the outcome of runs and the number of rounds. The sizes of the messages are
+// counted by the transport, which must therefore be the wrapped setting itself:
+// TLSSetting, AuthSetting or the settings of SetupAHE and SetupFHE. Like
+// LoggingSetting it doesn't implement Streamer, so a Mux should be created
+// over it rather than it wrapping a stream.
+type MetricsSetting struct {
+    AHE_setting
+    metrics *Metrics
+}
+
+func NewMetricsSetting(setting AHE_setting, metrics *Metrics) MetricsSetting {
+    if transport, ok := setting.(trafficReporter); ok {
+        setting = transport.withTraffic(metrics)
+    }
+    return MetricsSetting{setting, metrics}
+}
+
+func (s MetricsSetting) Unwrap() AHE_setting {
+    return s.AHE_setting
+}
+
+func (s MetricsSetting) startStep(step string) func() {
+    start := time.Now()
+    return func() {
+        s.metrics.stepLatency(step, time.Since(start))
+    }
+}
+
+func (s MetricsSetting) endSession(protocol string, passed bool) {
+    s.metrics.session(protocol, passed)
+}
+
+func (s MetricsSetting) Receive() interface{} {
+    msg := s.AHE_setting.Receive()
+    s.metrics.round()
+    return msg
+}
+
+func (s MetricsSetting) ReceiveAll() []interface{} {
+    msgs := s.AHE_setting.ReceiveAll()
+    s.metrics.round()
+    return msgs
+}
+
+// receive without counting a round, so that a Mux can run over the setting
+func (s MetricsSetting) ReceiveFrom(i int) (interface{}, error) {
+    receiver, ok := s.AHE_setting.(PeerReceiver)
+    if !ok {
+        return nil, fmt.Errorf("setting of type %T can't receive from single parties", s.AHE_setting)
+    }
+    return receiver.ReceiveFrom(i)
+}
+
+// FHE setting decorator feeding metrics, see MetricsSetting. Refreshes are
+// counted if the cryptosystem is BFV_encryption.
+type MetricsFHESetting struct {
+    MetricsSetting
+    cs FHE_Cryptosystem
+}
+
+func NewMetricsFHESetting(setting FHE_setting, metrics *Metrics) MetricsFHESetting {
+    cs := setting.FHE_cryptosystem()
+    if bfv, ok := cs.(BFV_encryption); ok {
+        cs = bfv.WithRefreshHook(metrics.refreshed)
+    }
+    return MetricsFHESetting{NewMetricsSetting(setting, metrics), cs}
+}
+
+func (s MetricsFHESetting) FHE_cryptosystem() FHE_Cryptosystem {
+    return s.cs
+}
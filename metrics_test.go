@@ -0,0 +1,240 @@
+package tpsi
+
+import (
+    "bytes"
+    "math/big"
+    "net"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+    gm "github.com/ontanj/generic-matrix"
+)
+
+func TestMetricsSetting(t *testing.T) {
+    n := 3
+    pk, sksdj, err := NewDJCryptosystem(n)
+    if err != nil {t.Fatal(err)}
+    sks := ConvertDJSKSlice(sksdj)
+    settings := SetupAHE(n, 0, pk)
+    metrics := make([]*Metrics, n)
+    a, err := gm.NewMatrixFromInt(2, 2, []int{1, 2, 3, 4})
+    if err != nil {t.Fatal(err)}
+    a, err = EncryptMatrix(a, settings[0])
+    if err != nil {t.Fatal(err)}
+
+    done := make(chan bool)
+    for i := 0; i < n; i += 1 {
+        metrics[i] = NewMetrics()
+        go func(i int) {
+            setting := NewMetricsSetting(settings[i], metrics[i])
+            if setting.IsCentral() {
+                CentralMatrixMultiplicationWorker(a, a, sks[i], setting)
+            } else {
+                OuterMatrixMultiplicationWorker(a, a, sks[i], setting)
+            }
+            observeSession(setting, "diff", i == 0)
+            done <- true
+        }(i)
+    }
+    for i := 0; i < n; i += 1 {
+        <-done
+    }
+
+    var sent, received uint64
+    for i, m := range metrics {
+        sent += m.bytes_sent
+        received += m.bytes_received
+        if m.bytes_sent == 0 || m.bytes_received == 0 {
+            t.Errorf("party %d sent %d and received %d bytes", i, m.bytes_sent, m.bytes_received)
+        }
+        for _, step := range []string{"MMult step 1", "MMult step 2", "MMult step 3", "MMult step 4"} {
+            if h, ok := m.steps[step]; !ok || h.count != 1 {
+                t.Errorf("party %d has no latency of %s", i, step)
+            }
+        }
+    }
+    if sent != received {
+        t.Errorf("parties sent %d bytes but received %d bytes", sent, received)
+    }
+
+    var buf bytes.Buffer
+    err = metrics[0].WriteText(&buf)
+    if err != nil {t.Fatal(err)}
+    for _, line := range []string{
+        "# TYPE tpsi_sessions_total counter",
+        "tpsi_sessions_total{protocol=\"diff\"} 1",
+        "tpsi_cardinality_tests_total{protocol=\"diff\",result=\"pass\"} 1",
+        "# TYPE tpsi_step_duration_seconds histogram",
+        "tpsi_step_duration_seconds_count{step=\"MMult step 3\"} 1",
+        "tpsi_step_duration_seconds_bucket{step=\"MMult step 3\",le=\"+Inf\"} 1",
+        "tpsi_bfv_refreshes_total 0",
+    } {
+        if !strings.Contains(buf.String(), line+"\n") {
+            t.Errorf("missing %q in\n%s", line, buf.String())
+        }
+    }
+    if !strings.Contains(metricsText(t, metrics[1]), "tpsi_cardinality_tests_total{protocol=\"diff\",result=\"fail\"} 1") {
+        t.Error("expected failed cardinality test of party 1")
+    }
+}
+
+func metricsText(t *testing.T, m *Metrics) string {
+    var buf bytes.Buffer
+    if err := m.WriteText(&buf); err != nil {t.Fatal(err)}
+    return buf.String()
+}
+
+func TestMetricsHistogram(t *testing.T) {
+    m := NewMetrics()
+    m.stepLatency("ZeroTest", 2*time.Millisecond)
+    m.stepLatency("ZeroTest", 2*time.Second)
+    m.stepLatency("ZeroTest", time.Hour)
+    text := metricsText(t, m)
+    for _, line := range []string{
+        "tpsi_step_duration_seconds_bucket{step=\"ZeroTest\",le=\"0.001\"} 0",
+        "tpsi_step_duration_seconds_bucket{step=\"ZeroTest\",le=\"0.01\"} 1",
+        "tpsi_step_duration_seconds_bucket{step=\"ZeroTest\",le=\"5\"} 2",
+        "tpsi_step_duration_seconds_bucket{step=\"ZeroTest\",le=\"300\"} 2",
+        "tpsi_step_duration_seconds_bucket{step=\"ZeroTest\",le=\"+Inf\"} 3",
+        "tpsi_step_duration_seconds_sum{step=\"ZeroTest\"} 3602.002",
+        "tpsi_step_duration_seconds_count{step=\"ZeroTest\"} 3",
+    } {
+        if !strings.Contains(text, line+"\n") {
+            t.Errorf("missing %q in\n%s", line, text)
+        }
+    }
+
+    rec := httptest.NewRecorder()
+    m.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+    if !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain; version=0.0.4") || rec.Body.String() != text {
+        t.Errorf("served %q with content type %q", rec.Body.String(), rec.Header().Get("Content-Type"))
+    }
+}
+
+func TestMetricsBFVRefresh(t *testing.T) {
+    n := 3
+    settings, _ := SetupTest(n, 0)
+    metrics := make([]*Metrics, n)
+    done := make(chan bool)
+    for i := 0; i < n; i += 1 {
+        metrics[i] = NewMetrics()
+        go func(i int) {
+            setting := NewMetricsFHESetting(settings[i], metrics[i])
+            cs := setting.FHE_cryptosystem()
+            factor, err := settings[0].cs.Encrypt(big.NewInt(2))
+            if err != nil {panic(err)}
+            prod := factor
+            for j := 0; j < 7; j += 1 { // the 7th multiplication refreshes prod
+                prod, err = cs.Multiply(prod, factor)
+                if err != nil {panic(err)}
+            }
+            done <- true
+        }(i)
+    }
+    for i := 0; i < n; i += 1 {
+        <-done
+    }
+    for i, m := range metrics {
+        if m.bfv_refreshes != 1 {
+            t.Errorf("party %d counted %d refreshes, expected 1", i, m.bfv_refreshes)
+        }
+    }
+}
+
+// runs a decryption with every party feeding its own Metrics through the
+// transports of settings, and checks that the sizes sent and received match
+func checkTransportTraffic(t *testing.T, settings []AHE_setting, sks []Secret_key, cipher Ciphertext) {
+    n := len(settings)
+    metrics := make([]*Metrics, n)
+    done := make(chan bool)
+    for i := 0; i < n; i += 1 {
+        metrics[i] = NewMetrics()
+        go func(i int) {
+            setting := NewMetricsSetting(settings[i], metrics[i])
+            if setting.IsCentral() {
+                CentralDecryptionWorker(cipher, sks[i], setting)
+            } else {
+                OuterDecryptionWorker(cipher, sks[i], setting)
+            }
+            done <- true
+        }(i)
+    }
+    for i := 0; i < n; i += 1 {
+        <-done
+    }
+    var sent, received uint64
+    for i, m := range metrics {
+        if m.bytes_sent == 0 || m.bytes_received == 0 {
+            t.Errorf("party %d sent %d and received %d bytes", i, m.bytes_sent, m.bytes_received)
+        }
+        sent += m.bytes_sent
+        received += m.bytes_received
+    }
+    if sent != received {
+        t.Errorf("parties sent %d bytes but received %d bytes", sent, received)
+    }
+}
+
+func TestMetricsTransports(t *testing.T) {
+    n := 3
+
+    t.Run("authenticated", func(t *testing.T) {
+        auth, sks, pk := createAuthSettings(n, t)
+        cipher, err := pk.Encrypt(big.NewInt(5))
+        if err != nil {t.Fatal(err)}
+        settings := make([]AHE_setting, n)
+        for i, setting := range auth {
+            settings[i] = setting
+        }
+        checkTransportTraffic(t, settings, sks, cipher)
+    })
+
+    t.Run("tls", func(t *testing.T) {
+        pk, djsks, err := NewDJCryptosystem(n)
+        if err != nil {t.Fatal(err)}
+        cipher, err := pk.Encrypt(big.NewInt(5))
+        if err != nil {t.Fatal(err)}
+        certs, leaves := createTLSCertificates(n, t)
+        ln, err := net.Listen("tcp", "127.0.0.1:0")
+        if err != nil {t.Fatal(err)}
+        defer ln.Close()
+        settings := make([]AHE_setting, n)
+        connected := make(chan error)
+        go func() {
+            setting, err := NewTLSCentralSetting(ln, 0, pk, certs[n-1], leaves[:n-1])
+            settings[n-1] = setting
+            connected <- err
+        }()
+        for i := 0; i < n-1; i += 1 {
+            go func(i int) {
+                setting, err := NewTLSOuterSetting(ln.Addr().String(), n, 0, pk, certs[i], leaves[n-1])
+                settings[i] = setting
+                connected <- err
+            }(i)
+        }
+        for i := 0; i < n; i += 1 {
+            if err := <-connected; err != nil {t.Fatal(err)}
+        }
+        checkTransportTraffic(t, settings, ConvertDJSKSlice(djsks), cipher)
+        for _, setting := range settings {
+            setting.(TLSSetting).Close()
+        }
+    })
+
+    t.Run("rejected by codec", func(t *testing.T) {
+        pk, _, err := NewDJCryptosystem(2)
+        if err != nil {t.Fatal(err)}
+        settings := SetupAHE(2, 0, pk)
+        metrics := NewMetrics()
+        outer := NewMetricsSetting(settings[0], metrics)
+        central := NewMetricsSetting(settings[1], metrics)
+        go outer.Send(make(chan int))
+        if _, ok := central.ReceiveAll()[0].(chan int); !ok {
+            t.Error("message not received")
+        }
+        if metrics.bytes_sent != 0 || metrics.bytes_received != 0 {
+            t.Errorf("counted %d bytes sent and %d received", metrics.bytes_sent, metrics.bytes_received)
+        }
+    })
+}
@@ -0,0 +1,310 @@
+package tpsi
+
+import (
+    "fmt"
+    "sync"
+)
+
+// optionally implemented by settings carrying named sub-streams, so that
+// independent sub-protocols can run concurrently, see concurrentSubstreams
+type Streamer interface {
+    // setting of the sub-stream name, an FHE_setting if this setting is one
+    Substream(name string) AHE_setting
+}
+
+// message of a named stream, see Mux
+type streamMessage struct {
+    Stream string
+    Payload interface{}
+}
+
+// sent by a party closing its Mux, the last message on its connection
+type muxClose struct{}
+
+// received messages of one stream from one party
+type inbox struct {
+    lock sync.Mutex
+    arrived *sync.Cond
+    msgs []interface{}
+    err error // set if the connection failed
+}
+
+func newInbox(err error) *inbox {
+    box := &inbox{err: err}
+    box.arrived = sync.NewCond(&box.lock)
+    return box
+}
+
+func (box *inbox) push(any interface{}) {
+    box.lock.Lock()
+    box.msgs = append(box.msgs, any)
+    box.lock.Unlock()
+    box.arrived.Signal()
+}
+
+func (box *inbox) fail(err error) {
+    box.lock.Lock()
+    box.err = err
+    box.lock.Unlock()
+    box.arrived.Broadcast()
+}
+
+// waits for the next message, panics if the connection failed before it arrived
+func (box *inbox) pop() interface{} {
+    box.lock.Lock()
+    defer box.lock.Unlock()
+    for len(box.msgs) == 0 && box.err == nil {
+        box.arrived.Wait()
+    }
+    if len(box.msgs) == 0 {
+        panic(box.err)
+    }
+    any := box.msgs[0]
+    box.msgs = box.msgs[1:]
+    return any
+}
+
+// carries independent named streams over one setting, which must implement
+// PeerReceiver. Every stream is a setting of its own, so workers running on
+// different streams can run concurrently without their messages crossing.
+// Messages are tagged with the name of their stream and sorted into one queue
+// per stream and party by a goroutine per connection. All parties must create
+// a Mux for the setting, and nothing else may use the setting afterwards.
+// The goroutines run until the peers close their Mux, see Close.
+//
+// The messages that an FHE cryptosystem exchanges during evaluation are
+// carried by the stream too if it implements StreamedCryptosystem, so
+// streams with BFV_encryption or BGV_encryption can also run concurrently.
+type Mux struct {
+    setting AHE_setting
+    receiver PeerReceiver
+    sending sync.Mutex
+    lock sync.Mutex
+    inboxes map[string][]*inbox // by stream and party
+    errs []error // connection failure of each party
+    running sync.WaitGroup // goroutines sorting messages
+}
+
+func NewMux(setting AHE_setting) (*Mux, error) {
+    receiver, ok := setting.(PeerReceiver)
+    if !ok {
+        return nil, fmt.Errorf("setting of type %T can't receive from single parties", setting)
+    }
+    peers := 1
+    if setting.IsCentral() {
+        peers = setting.Parties()-1
+    }
+    m := &Mux{setting: setting, receiver: receiver, inboxes: make(map[string][]*inbox), errs: make([]error, peers)}
+    m.running.Add(peers)
+    for i := 0; i < peers; i += 1 {
+        go m.demux(i)
+    }
+    return m, nil
+}
+
+// tells the peers that no more messages follow and waits until all peers
+// have closed their Mux, which ends the goroutines of the Mux. Streams
+// can't be used afterwards.
+func (m *Mux) Close() {
+    for i := range m.errs {
+        m.send(i, muxClose{})
+    }
+    m.running.Wait()
+}
+
+// setting of the stream with the given name, an FHE_setting if the multiplexed setting is one
+func (m *Mux) Stream(name string) AHE_setting {
+    stream := muxStream{m, name}
+    if fhe, ok := m.setting.(FHE_setting); ok {
+        cs := fhe.FHE_cryptosystem()
+        if streamed, ok := cs.(StreamedCryptosystem); ok {
+            cs = streamed.OnStream(muxStream{m, name + "#cs"})
+        }
+        return muxFHEStream{stream, cs}
+    }
+    return stream
+}
+
+func (m *Mux) inbox(stream string, peer int) *inbox {
+    m.lock.Lock()
+    defer m.lock.Unlock()
+    return m.lockedInbox(stream, peer)
+}
+
+// see inbox, the caller holds m.lock
+func (m *Mux) lockedInbox(stream string, peer int) *inbox {
+    boxes, ok := m.inboxes[stream]
+    if !ok {
+        boxes = make([]*inbox, len(m.errs))
+        for i := range boxes {
+            boxes[i] = newInbox(m.errs[i])
+        }
+        m.inboxes[stream] = boxes
+    }
+    return boxes[peer]
+}
+
+// removes the inboxes of stream once its worker has returned. Inboxes holding
+// messages are kept, they belong to a later use of the same stream name.
+func (m *Mux) release(stream string) {
+    m.lock.Lock()
+    defer m.lock.Unlock()
+    for _, box := range m.inboxes[stream] {
+        box.lock.Lock()
+        pending := len(box.msgs)
+        box.lock.Unlock()
+        if pending > 0 {
+            return
+        }
+    }
+    delete(m.inboxes, stream)
+}
+
+// sorts the messages from peer into the inboxes of their streams
+func (m *Mux) demux(peer int) {
+    defer m.running.Done()
+    for {
+        any, err := m.receiver.ReceiveFrom(peer)
+        if err == nil {
+            switch msg := any.(type) {
+            case streamMessage:
+                // under m.lock, so that the inbox isn't released in between
+                m.lock.Lock()
+                m.lockedInbox(msg.Stream, peer).push(msg.Payload)
+                m.lock.Unlock()
+                continue
+            case muxClose:
+                err = fmt.Errorf("stream closed by peer")
+            default:
+                err = fmt.Errorf("message of type %T outside of any stream", any)
+            }
+        }
+        m.lock.Lock()
+        m.errs[peer] = err
+        for _, boxes := range m.inboxes {
+            boxes[peer].fail(err)
+        }
+        m.lock.Unlock()
+        return
+    }
+}
+
+func (m *Mux) send(peer int, any interface{}) {
+    m.sending.Lock()
+    defer m.sending.Unlock()
+    if m.setting.IsCentral() {
+        m.setting.SendTo(peer, any)
+    } else {
+        m.setting.Send(any)
+    }
+}
+
+type muxStream struct {
+    mux *Mux
+    name string
+}
+
+func (s muxStream) Threshold() int {
+    return s.mux.setting.Threshold()
+}
+
+func (s muxStream) Parties() int {
+    return s.mux.setting.Parties()
+}
+
+func (s muxStream) AHE_cryptosystem() AHE_Cryptosystem {
+    return s.mux.setting.AHE_cryptosystem()
+}
+
+func (s muxStream) Distribute(any interface{}) {
+    for i := range s.mux.errs {
+        s.SendTo(i, any)
+    }
+}
+
+func (s muxStream) Send(any interface{}) {
+    s.mux.send(0, streamMessage{s.name, any})
+}
+
+func (s muxStream) SendTo(i int, any interface{}) {
+    s.mux.send(i, streamMessage{s.name, any})
+}
+
+func (s muxStream) ReceiveAll() []interface{} {
+    sl := make([]interface{}, len(s.mux.errs))
+    for i := range sl {
+        end := observeWait(s.mux.setting, s.name, i)
+        sl[i] = s.mux.inbox(s.name, i).pop()
+        end()
+    }
+    return sl
+}
+
+func (s muxStream) Receive() interface{} {
+    end := observeWait(s.mux.setting, s.name, LogCentral)
+    msg := s.mux.inbox(s.name, 0).pop()
+    end()
+    return msg
+}
+
+func (s muxStream) IsCentral() bool {
+    return s.mux.setting.IsCentral()
+}
+
+func (s muxStream) Unwrap() AHE_setting {
+    return s.mux.setting
+}
+
+// releases the inboxes of the stream and of its cryptosystem, see Mux.release
+func (s muxStream) close() {
+    s.mux.release(s.name)
+    s.mux.release(s.name + "#cs")
+}
+
+// sub-streams are streams of the same Mux, named by the path from the top stream
+func (s muxStream) Substream(name string) AHE_setting {
+    return s.mux.Stream(s.name + "/" + name)
+}
+
+type muxFHEStream struct {
+    muxStream
+    cs FHE_Cryptosystem
+}
+
+func (s muxFHEStream) FHE_cryptosystem() FHE_Cryptosystem {
+    return s.cs
+}
+
+// implemented by streams whose queues can be released once their worker has returned
+type streamCloser interface {
+    close()
+}
+
+// runs work(i, sub) for i below count concurrently, each on its own sub-stream
+// of streams, and waits for all to return. All parties must call it with the
+// same name and count. A panic in any of them is raised again by the caller.
+// The sub-streams are closed when their work returns.
+func concurrentSubstreams(streams Streamer, name string, count int, work func(i int, sub AHE_setting)) {
+    var wg sync.WaitGroup
+    panics := make([]interface{}, count)
+    wg.Add(count)
+    for i := 0; i < count; i += 1 {
+        go func(i int) {
+            defer wg.Done()
+            defer func() {
+                panics[i] = recover()
+            }()
+            sub := streams.Substream(fmt.Sprintf("%s/%d", name, i))
+            if closer, ok := sub.(streamCloser); ok {
+                defer closer.close()
+            }
+            work(i, sub)
+        }(i)
+    }
+    wg.Wait()
+    for _, p := range panics {
+        if p != nil {
+            panic(p)
+        }
+    }
+}
@@ -0,0 +1,128 @@
+package tpsi
+
+import (
+    "fmt"
+    "math/big"
+    gm "github.com/ontanj/generic-matrix"
+)
+
+// layout of several small plaintext slots in one plaintext. Every slot holds
+// a non-negative value of at most SlotBits bits, and Headroom extra bits
+// absorb the growth from homomorphic additions and scalings.
+type Packing struct {
+    SlotBits int
+    Headroom int
+    Slots int // slots per plaintext
+}
+
+// create a packing for plaintexts smaller than N
+func NewPacking(slot_bits, headroom int, N *big.Int) (Packing, error) {
+    if slot_bits <= 0 || headroom < 0 {
+        return Packing{}, fmt.Errorf("invalid slot size %d with headroom %d", slot_bits, headroom)
+    }
+    slots := (N.BitLen() - 1) / (slot_bits + headroom)
+    if slots < 1 {
+        return Packing{}, fmt.Errorf("slots of %d bits don't fit in plaintext of %d bits", slot_bits+headroom, N.BitLen())
+    }
+    return Packing{slot_bits, headroom, slots}, nil
+}
+
+func (p Packing) width() uint {
+    return uint(p.SlotBits + p.Headroom)
+}
+
+// number of packed plaintexts for a matrix with rows x cols values
+func (p Packing) packedLength(rows, cols int) int {
+    return (rows*cols + p.Slots - 1) / p.Slots
+}
+
+// pack the values of a, row by row, into a row vector of plaintexts
+func (p Packing) Pack(a gm.Matrix) (gm.Matrix, error) {
+    packed := make([]interface{}, p.packedLength(a.Rows, a.Cols))
+    for i := range packed {
+        packed[i] = new(big.Int)
+    }
+    for row := 0; row < a.Rows; row += 1 {
+        for col := 0; col < a.Cols; col += 1 {
+            val, err := decodeBI(a.At(row, col))
+            if err != nil {return gm.Matrix{}, err}
+            if val.Sign() < 0 || val.BitLen() > p.SlotBits {
+                return gm.Matrix{}, fmt.Errorf("value %d at (%d, %d) doesn't fit in a slot of %d bits", val, row, col, p.SlotBits)
+            }
+            i := row*a.Cols + col
+            shifted := new(big.Int).Lsh(val, uint(i % p.Slots) * p.width())
+            packed[i / p.Slots].(*big.Int).Add(packed[i / p.Slots].(*big.Int), shifted)
+        }
+    }
+    return gm.NewMatrix(1, len(packed), packed, gm.Bigint{})
+}
+
+// unpack a row vector of plaintexts into a matrix with rows x cols values
+func (p Packing) Unpack(packed gm.Matrix, rows, cols int) (gm.Matrix, error) {
+    vals := make([]interface{}, rows*cols)
+    mask := new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), p.width()), big.NewInt(1))
+    for i := range vals {
+        plain, err := decodeBI(packed.At(0, i / p.Slots))
+        if err != nil {return gm.Matrix{}, err}
+        val := new(big.Int).Rsh(plain, uint(i % p.Slots) * p.width())
+        vals[i] = val.And(val, mask)
+    }
+    return gm.NewMatrix(rows, cols, vals, gm.Bigint{})
+}
+
+// encrypted matrix packed by a Packing, with Slots values per ciphertext
+type PackedMatrix struct {
+    Cipher gm.Matrix // row vector of ciphertexts
+    Rows int
+    Cols int
+    Packing Packing
+    bits int // upper bound on the bits of every slot value
+}
+
+// pack and encrypt a, whose values must fit in the slots of packing
+func EncryptPackedMatrix(a gm.Matrix, packing Packing, setting AHE_setting) (m PackedMatrix, err error) {
+    packed, err := packing.Pack(a)
+    if err != nil {return}
+    cipher, err := EncryptMatrix(packed, setting)
+    if err != nil {return}
+    return PackedMatrix{cipher, a.Rows, a.Cols, packing, packing.SlotBits}, nil
+}
+
+// checks that slot values of bits bits don't overflow into the next slot
+func (m PackedMatrix) withBits(cipher gm.Matrix, bits int) (PackedMatrix, error) {
+    if bits > int(m.Packing.width()) {
+        return PackedMatrix{}, fmt.Errorf("slot values of %d bits exceed the headroom", bits)
+    }
+    return PackedMatrix{cipher, m.Rows, m.Cols, m.Packing, bits}, nil
+}
+
+// slot-wise sum of two packed matrices of the same size and packing
+func (m PackedMatrix) Add(other PackedMatrix) (PackedMatrix, error) {
+    if m.Rows != other.Rows || m.Cols != other.Cols || m.Packing != other.Packing {
+        return PackedMatrix{}, fmt.Errorf("packed matrices differ in size or packing")
+    }
+    sum, err := m.Cipher.Add(other.Cipher)
+    if err != nil {return PackedMatrix{}, err}
+    bits := m.bits
+    if other.bits > bits {
+        bits = other.bits
+    }
+    return m.withBits(sum, bits+1)
+}
+
+// scale every slot by a non-negative factor
+func (m PackedMatrix) Scale(factor *big.Int) (PackedMatrix, error) {
+    if factor.Sign() < 0 {
+        return PackedMatrix{}, fmt.Errorf("negative factor %d", factor)
+    }
+    prod, err := m.Cipher.Scale(factor)
+    if err != nil {return PackedMatrix{}, err}
+    return m.withBits(prod, m.bits+factor.BitLen())
+}
+
+// combine partial decryptions of m.Cipher, see PartialDecryptMatrix, and unpack the values
+func CombinePackedMatrixShares(part_mat []gm.Matrix, m PackedMatrix, setting AHE_setting) (gm.Matrix, error) {
+    packed, err := CombineMatrixShares(part_mat, m.Cipher, setting)
+    if err != nil {return gm.Matrix{}, err}
+    return m.Packing.Unpack(packed, m.Rows, m.Cols)
+}
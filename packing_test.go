@@ -0,0 +1,89 @@
+package tpsi
+
+import (
+    "testing"
+    "math/big"
+    gm "github.com/ontanj/generic-matrix"
+)
+
+func TestPackUnpack(t *testing.T) {
+    packing, err := NewPacking(8, 4, big.NewInt(1 << 40))
+    if err != nil {t.Fatal(err)}
+    if packing.Slots != 3 {
+        t.Errorf("expected 3 slots, got %d", packing.Slots)
+    }
+    a, err := gm.NewMatrixFromInt(2, 2, []int{1, 255, 0, 17})
+    if err != nil {t.Fatal(err)}
+    packed, err := packing.Pack(a)
+    if err != nil {t.Fatal(err)}
+    if packed.Cols != 2 {
+        t.Errorf("expected 2 packed values, got %d", packed.Cols)
+    }
+    b, err := packing.Unpack(packed, 2, 2)
+    if err != nil {t.Fatal(err)}
+    for i := 0; i < 4; i += 1 {
+        a_val, _ := decodeBI(a.At(i/2, i%2))
+        b_val, _ := decodeBI(b.At(i/2, i%2))
+        if a_val.Cmp(b_val) != 0 {
+            t.Errorf("error at %d: expected %d, got %d", i, a_val, b_val)
+        }
+    }
+    large, err := gm.NewMatrixFromInt(1, 1, []int{256})
+    if err != nil {t.Fatal(err)}
+    if _, err := packing.Pack(large); err == nil {
+        t.Error("value larger than slot packed")
+    }
+}
+
+func TestPackedMatrix(t *testing.T) {
+    n := 2
+    pk, sksdj, err := NewDJCryptosystem(n)
+    if err != nil {t.Fatal(err)}
+    sks := ConvertDJSKSlice(sksdj)
+    setting := createAHESettings(n, 0, pk)[n-1]
+    packing, err := NewPacking(16, 8, pk.N())
+    if err != nil {t.Fatal(err)}
+
+    rows, cols := 4, 4
+    a, err := SampleMatrix(rows, cols, big.NewInt(1 << 16))
+    if err != nil {t.Fatal(err)}
+    b, err := SampleMatrix(rows, cols, big.NewInt(1 << 16))
+    if err != nil {t.Fatal(err)}
+    a_enc, err := EncryptPackedMatrix(a, packing, setting)
+    if err != nil {t.Fatal(err)}
+    b_enc, err := EncryptPackedMatrix(b, packing, setting)
+    if err != nil {t.Fatal(err)}
+    if a_enc.Cipher.Cols >= rows*cols {
+        t.Errorf("%d ciphertexts for %d values", a_enc.Cipher.Cols, rows*cols)
+    }
+
+    // 3a + b
+    sum, err := a_enc.Scale(big.NewInt(3))
+    if err != nil {t.Fatal(err)}
+    sum, err = sum.Add(b_enc)
+    if err != nil {t.Fatal(err)}
+
+    parts := make([]gm.Matrix, n)
+    for i := range parts {
+        parts[i], err = PartialDecryptMatrix(sum.Cipher, sks[i])
+        if err != nil {t.Fatal(err)}
+    }
+    dec, err := CombinePackedMatrixShares(parts, sum, setting)
+    if err != nil {t.Fatal(err)}
+    for row := 0; row < rows; row += 1 {
+        for col := 0; col < cols; col += 1 {
+            a_val, _ := decodeBI(a.At(row, col))
+            b_val, _ := decodeBI(b.At(row, col))
+            expected := new(big.Int).Mul(a_val, big.NewInt(3))
+            expected.Add(expected, b_val)
+            dec_val, _ := decodeBI(dec.At(row, col))
+            if dec_val.Cmp(expected) != 0 {
+                t.Errorf("error at (%d, %d): expected %d, got %d", row, col, expected, dec_val)
+            }
+        }
+    }
+
+    if _, err := a_enc.Scale(big.NewInt(1 << 9)); err == nil {
+        t.Error("scaling beyond headroom accepted")
+    }
+}
@@ -0,0 +1,124 @@
+package tpsi
+
+import (
+    "fmt"
+    "math/big"
+    gm "github.com/ontanj/generic-matrix"
+)
+
+// polynomial with plaintext coefficients, lowest degree first
+type PlainPoly []*big.Int
+
+// vector of ciphertexts, e.g. the coefficients of an encrypted polynomial, lowest degree first
+type CipherVector []Ciphertext
+
+// the values of the 1×k matrix m, returns an error if m isn't a row vector of *big.Int
+func bigIntRow(m gm.Matrix) ([]*big.Int, error) {
+    if m.Rows != 1 {
+        return nil, fmt.Errorf("vector of %d rows, expected 1", m.Rows)
+    }
+    row := make([]*big.Int, m.Cols)
+    for i := range row {
+        val, err := m.At(0, i)
+        if err != nil {return nil, err}
+        v, ok := val.(*big.Int)
+        if !ok {
+            return nil, fmt.Errorf("value %d of type %T, expected *big.Int", i, val)
+        }
+        row[i] = v
+    }
+    return row, nil
+}
+
+// the coefficients of the 1×k matrix m, returns an error if m isn't a row vector of *big.Int
+func PlainPolyFromMatrix(m gm.Matrix) (PlainPoly, error) {
+    row, err := bigIntRow(m)
+    return PlainPoly(row), err
+}
+
+// p as a 1×k matrix over gm.Bigint
+func (p PlainPoly) Matrix() gm.Matrix {
+    vals := make([]interface{}, len(p))
+    for i, coeff := range p {
+        vals[i] = coeff
+    }
+    m, err := gm.NewMatrix(1, len(p), vals, gm.Bigint{})
+    if err != nil {panic(err)}
+    return m
+}
+
+// the ciphertexts of the 1×k matrix m, returns an error if m isn't a row vector
+func CipherVectorFromMatrix(m gm.Matrix) (CipherVector, error) {
+    if m.Rows != 1 {
+        return nil, fmt.Errorf("vector of %d rows, expected 1", m.Rows)
+    }
+    v := make(CipherVector, m.Cols)
+    for i := range v {
+        val, err := m.At(0, i)
+        if err != nil {return nil, err}
+        v[i] = val
+    }
+    return v, nil
+}
+
+// v as a 1×k matrix over the evaluation space of the cryptosystem of setting,
+// e.g. for matrix multiplication
+func (v CipherVector) Matrix(setting AHE_setting) gm.Matrix {
+    vals := make([]interface{}, len(v))
+    for i, c := range v {
+        vals[i] = c
+    }
+    m, err := gm.NewMatrix(1, len(v), vals, setting.AHE_cryptosystem().EvaluationSpace())
+    if err != nil {panic(err)}
+    return m
+}
+
+// encrypts every coefficient of p
+func EncryptPoly(p PlainPoly, setting AHE_setting) (CipherVector, error) {
+    v := make(CipherVector, len(p))
+    var err error
+    for i, coeff := range p {
+        v[i], err = setting.AHE_cryptosystem().Encrypt(coeff)
+        if err != nil {return nil, err}
+    }
+    return v, nil
+}
+
+// vector of l encryptions of value
+func encryptedConstantVector(l int, value int64, setting AHE_setting) (CipherVector, error) {
+    v := make(CipherVector, l)
+    var err error
+    for i := range v {
+        v[i], err = setting.AHE_cryptosystem().Encrypt(big.NewInt(value))
+        if err != nil {return nil, err}
+    }
+    return v, nil
+}
+
+func EncryptedZeroVector(l int, setting AHE_setting) (CipherVector, error) {
+    return encryptedConstantVector(l, 0, setting)
+}
+
+func EncryptedOneVector(l int, setting AHE_setting) (CipherVector, error) {
+    return encryptedConstantVector(l, 1, setting)
+}
+
+// vectors are sent as []Ciphertext, which the codec knows. The received vector
+// is copied, as parties in the same process would otherwise share it.
+func receiveCipherVector(setting AHE_setting) CipherVector {
+    return append(CipherVector(nil), (setting.Receive()).([]Ciphertext)...)
+}
+
+// a copy of the first l entries of v
+func (v CipherVector) truncate(l int) CipherVector {
+    return append(CipherVector(nil), v[:l]...)
+}
+
+// Interpolation of the decrypted values vs and the evaluations ps of the own root polynomial
+func interpolateValues(vs, ps gm.Matrix, setting AHE_setting) PlainPoly {
+    v, err := bigIntRow(vs)
+    if err != nil {panic(err)}
+    p, err := bigIntRow(ps)
+    if err != nil {panic(err)}
+    return Interpolation(v, p, setting)
+}
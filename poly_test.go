@@ -0,0 +1,62 @@
+package tpsi
+
+import (
+    "math/big"
+    "testing"
+    gm "github.com/ontanj/generic-matrix"
+)
+
+func TestPolyConversion(t *testing.T) {
+    p := PlainPoly(bigIntSlice([]int64{4, 0, 7}))
+    q, err := PlainPolyFromMatrix(p.Matrix())
+    if err != nil {t.Fatal(err)}
+    if len(q) != len(p) {
+        t.Fatalf("expected %d coefficients, got %d", len(p), len(q))
+    }
+    for i := range p {
+        if p[i].Cmp(q[i]) != 0 {
+            t.Errorf("coefficient %d: expected %d got %d", i, p[i], q[i])
+        }
+    }
+
+    m, err := gm.NewMatrixFromInt(2, 2, []int{1, 2, 3, 4})
+    if err != nil {t.Fatal(err)}
+    if _, err = PlainPolyFromMatrix(m); err == nil {
+        t.Error("expected error for 2×2 matrix")
+    }
+    if _, err = CipherVectorFromMatrix(m); err == nil {
+        t.Error("expected error for 2×2 matrix")
+    }
+    m, err = gm.NewMatrix(1, 2, []interface{}{1, 2}, gm.Bigint{})
+    if err != nil {t.Fatal(err)}
+    if _, err = PlainPolyFromMatrix(m); err == nil {
+        t.Error("expected error for matrix of int")
+    }
+}
+
+func TestCipherVectorMatrix(t *testing.T) {
+    n := 2
+    pk, sksdj, err := NewDJCryptosystem(n)
+    if err != nil {t.Fatal(err)}
+    sks := ConvertDJSKSlice(sksdj)
+    settings := createAHESettings(n, 0, pk)
+
+    p := PlainPoly(bigIntSlice([]int64{3, 1, 2}))
+    v, err := EncryptPoly(p, settings[0])
+    if err != nil {t.Fatal(err)}
+    // adds in the evaluation space
+    m := v.Matrix(settings[0])
+    sum, err := m.Add(m)
+    if err != nil {t.Fatal(err)}
+    w, err := CipherVectorFromMatrix(sum)
+    if err != nil {t.Fatal(err)}
+    if len(w) != len(p) {
+        t.Fatalf("expected %d entries, got %d", len(p), len(w))
+    }
+    for i := range p {
+        expected := new(big.Int).Lsh(p[i], 1)
+        if dec := t_decrypt(w[i], sks, settings); dec.Cmp(expected) != 0 {
+            t.Errorf("entry %d: expected %d got %d", i, expected, dec)
+        }
+    }
+}
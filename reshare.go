@@ -0,0 +1,399 @@
+package tpsi
+
+import (
+    "bytes"
+    "crypto/aes"
+    "crypto/cipher"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/binary"
+    "fmt"
+    "math/big"
+    "github.com/ldsec/lattigo/ring"
+    "github.com/tuneinsight/lattigo/v4/rlwe/ringqp"
+    "github.com/tuneinsight/lattigo/v4/utils"
+)
+
+// optionally implemented by secret keys whose share can be refreshed by
+// proactive resharing, see CentralReshareWorker
+type Resharable interface {
+    Secret_key
+
+    // index of the share, from 0 to one less than the number of shares
+    ShareIndex() int
+
+    // split the share into one random piece for every share index
+    SplitShare(shares int) ([][]byte, error)
+
+    // replace the share, in place, by the combination of the pieces dealt to its index
+    CombinePieces(pieces [][]byte) error
+}
+
+// part of a party in resharing
+type ReshareRole int
+
+const (
+    // refresh own share
+    DealAndReceive ReshareRole = iota
+    // hand over the share to a replacing party, the old share is useless afterwards
+    DealOnly
+    // replacing party, receives a new share for the index of the replaced party
+    ReceiveOnly
+)
+
+// sent by every party before resharing
+type reshareHello struct {
+    Name string // identity of the sender
+    Index int
+    Deal, Receive bool
+    Key []byte // ephemeral ECDH public key
+    Signature []byte // by the identity of Name, see AuthSetting.signRelayed
+}
+
+// bytes covered by the signature of the hello
+func (h reshareHello) signedBytes() []byte {
+    var buf bytes.Buffer
+    buf.WriteString("tpsi reshare hello")
+    for _, field := range [][]byte{[]byte(h.Name), h.Key} {
+        binary.Write(&buf, binary.BigEndian, uint64(len(field)))
+        buf.Write(field)
+    }
+    binary.Write(&buf, binary.BigEndian, int64(h.Index))
+    binary.Write(&buf, binary.BigEndian, []bool{h.Deal, h.Receive})
+    return buf.Bytes()
+}
+
+// sent by central party with the hellos of all parties
+type reshareRoster struct {
+    Hellos []reshareHello
+}
+
+// pieces of a dealer's share, each sealed to the receiver of its index
+type resharePieces struct {
+    Key []byte // ephemeral ECDH public key of the dealer, nil if not dealing
+    Sealed [][]byte
+}
+
+// sent by central party with the pieces of all parties
+type reshareDeals struct {
+    Deals []resharePieces
+}
+
+func newReshareHello(sk Resharable, role ReshareRole, auth AuthSetting) (reshareHello, *ecdhKey, error) {
+    priv, err := newECDHKey()
+    if err != nil {return reshareHello{}, nil, err}
+    hello := reshareHello{
+        Name: auth.Identity().Name,
+        Index: sk.ShareIndex(),
+        Deal: role != ReceiveOnly,
+        Receive: role != DealOnly,
+        Key: priv.public,
+    }
+    hello.Signature = auth.signRelayed(hello.signedBytes())
+    return hello, priv, nil
+}
+
+// the authenticated setting of setting, which resharing requires
+func reshareAuth(setting AHE_setting) (AuthSetting, error) {
+    auth, ok := authSetting(setting)
+    if !ok {
+        return auth, fmt.Errorf("resharing requires an authenticated setting, see AuthSetting")
+    }
+    return auth, nil
+}
+
+// proactive resharing of the secret key: every party deals random pieces of its
+// share, sealed to the receiving party of every index, and every party replaces
+// its share by the combination of the pieces dealt to it. The secret is
+// unchanged, so the public key and ciphertexts stay valid, but shares from before
+// the resharing can't be combined with new shares.
+//
+// To replace a party, the setting includes both the replaced party, with role
+// DealOnly, and the replacing party, with role ReceiveOnly and a key created by
+// ReplacementKey of the cryptosystem. All other parties use DealAndReceive.
+//
+// Messages pass through the central party, but the pieces are encrypted with
+// ephemeral keys between dealer and receiver. The setting must be an
+// AuthSetting, or wrap one, and every party signs its ephemeral key with its
+// long-term identity, so that the central party can't replace the keys of
+// others. Returns an error at all parties if the roles don't give exactly one
+// dealer and one receiver for every index, and an error at the parties that
+// find a hello with a missing or invalid signature.
+func CentralReshareWorker(sk Resharable, role ReshareRole, setting AHE_setting) error {
+    auth, err := reshareAuth(setting)
+    if err != nil {return err}
+    own, priv, err := newReshareHello(sk, role, auth)
+    if err != nil {return err}
+    var roster reshareRoster
+    for _, any := range setting.ReceiveAll() {
+        roster.Hellos = append(roster.Hellos, any.(reshareHello))
+    }
+    roster.Hellos = append(roster.Hellos, own)
+    setting.Distribute(roster)
+
+    return reshare(sk, priv, own, roster, auth, func(deal resharePieces) reshareDeals {
+        var deals reshareDeals
+        for _, any := range setting.ReceiveAll() {
+            deals.Deals = append(deals.Deals, any.(resharePieces))
+        }
+        deals.Deals = append(deals.Deals, deal)
+        setting.Distribute(deals)
+        return deals
+    })
+}
+
+// see CentralReshareWorker
+func OuterReshareWorker(sk Resharable, role ReshareRole, setting AHE_setting) error {
+    auth, err := reshareAuth(setting)
+    if err != nil {return err}
+    own, priv, err := newReshareHello(sk, role, auth)
+    if err != nil {return err}
+    setting.Send(own)
+    roster := (setting.Receive()).(reshareRoster)
+
+    return reshare(sk, priv, own, roster, auth, func(deal resharePieces) reshareDeals {
+        setting.Send(deal)
+        return (setting.Receive()).(reshareDeals)
+    })
+}
+
+func reshare(sk Resharable, priv *ecdhKey, own reshareHello, roster reshareRoster, auth AuthSetting, exchange func(resharePieces) reshareDeals) error {
+    receivers, err := checkRoster(roster)
+    if err != nil {return err}
+    verified := verifyRoster(roster, auth)
+
+    // a party that rejects the roster deals nothing, which fails the resharing for all
+    var deal resharePieces
+    if own.Deal && verified == nil {
+        pieces, err := sk.SplitShare(len(receivers))
+        if err != nil {return err}
+        deal.Key = own.Key
+        deal.Sealed = make([][]byte, len(pieces))
+        for i, piece := range pieces {
+            deal.Sealed[i], err = sealPiece(priv, receivers[i], piece)
+            if err != nil {return err}
+        }
+    }
+
+    deals := exchange(deal)
+    if verified != nil {
+        return verified
+    }
+
+    if !own.Receive {
+        return nil
+    }
+    if len(deals.Deals) != len(roster.Hellos) {
+        return fmt.Errorf("got %d deals for %d parties", len(deals.Deals), len(roster.Hellos))
+    }
+    var pieces [][]byte
+    for i, deal := range deals.Deals {
+        // deals are in the order of the roster, a dealer must use its signed key
+        if !roster.Hellos[i].Deal {
+            continue
+        }
+        if !bytes.Equal(deal.Key, roster.Hellos[i].Key) {
+            return AuthenticationError{roster.Hellos[i].Name, "deal with another key than the signed one"}
+        }
+        if len(deal.Sealed) != len(receivers) {
+            return fmt.Errorf("dealer sent %d pieces, expected %d", len(deal.Sealed), len(receivers))
+        }
+        piece, err := openPiece(priv, deal.Key, deal.Sealed[own.Index])
+        if err != nil {return err}
+        pieces = append(pieces, piece)
+    }
+    return sk.CombinePieces(pieces)
+}
+
+// checks that every hello is signed by the identity it names, and that
+// every party of the session sent one hello
+func verifyRoster(roster reshareRoster, auth AuthSetting) error {
+    seen := make(map[string]bool)
+    for _, hello := range roster.Hellos {
+        if hello.Signature == nil {
+            return AuthenticationError{hello.Name, "unsigned ephemeral key"}
+        }
+        if err := auth.verifyRelayed(hello.Name, hello.signedBytes(), hello.Signature); err != nil {
+            return err
+        }
+        if seen[hello.Name] {
+            return AuthenticationError{hello.Name, "several hellos"}
+        }
+        seen[hello.Name] = true
+    }
+    if len(seen) != len(auth.parties) {
+        return fmt.Errorf("got hellos from %d parties, expected %d", len(seen), len(auth.parties))
+    }
+    return nil
+}
+
+// returns the ECDH public key of the receiver of every index
+func checkRoster(roster reshareRoster) ([][]byte, error) {
+    shares := 0
+    for _, hello := range roster.Hellos {
+        if hello.Deal {
+            shares += 1
+        }
+    }
+    receivers := make([][]byte, shares)
+    dealt := make([]bool, shares)
+    for _, hello := range roster.Hellos {
+        if hello.Index < 0 || hello.Index >= shares {
+            return nil, fmt.Errorf("share index %d out of range for %d shares", hello.Index, shares)
+        }
+        if hello.Deal {
+            if dealt[hello.Index] {
+                return nil, fmt.Errorf("share index %d dealt twice", hello.Index)
+            }
+            dealt[hello.Index] = true
+        }
+        if hello.Receive {
+            if receivers[hello.Index] != nil {
+                return nil, fmt.Errorf("share index %d received twice", hello.Index)
+            }
+            receivers[hello.Index] = hello.Key
+        }
+    }
+    for i, key := range receivers {
+        if key == nil {
+            return nil, fmt.Errorf("no receiver for share index %d", i)
+        }
+    }
+    return receivers, nil
+}
+
+// ephemeral ECDH key on P-256
+type ecdhKey struct {
+    d []byte
+    public []byte // uncompressed point
+}
+
+func newECDHKey() (*ecdhKey, error) {
+    d, x, y, err := elliptic.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {return nil, err}
+    return &ecdhKey{d, elliptic.Marshal(elliptic.P256(), x, y)}, nil
+}
+
+// x-coordinate of the shared point, peer is rejected if not on the curve
+func (priv *ecdhKey) ECDH(peer []byte) ([]byte, error) {
+    curve := elliptic.P256()
+    x, y := elliptic.Unmarshal(curve, peer)
+    if x == nil {
+        return nil, fmt.Errorf("invalid ECDH public key")
+    }
+    x, _ = curve.ScalarMult(x, y, priv.d)
+    return x.FillBytes(make([]byte, (curve.Params().BitSize+7)/8)), nil
+}
+
+func pieceCipher(priv *ecdhKey, peer []byte) (cipher.AEAD, error) {
+    secret, err := priv.ECDH(peer)
+    if err != nil {return nil, err}
+    key := sha256.Sum256(append([]byte("tpsi reshare"), secret...))
+    block, err := aes.NewCipher(key[:])
+    if err != nil {return nil, err}
+    return cipher.NewGCM(block)
+}
+
+func sealPiece(priv *ecdhKey, receiver, piece []byte) ([]byte, error) {
+    aead, err := pieceCipher(priv, receiver)
+    if err != nil {return nil, err}
+    nonce := make([]byte, aead.NonceSize())
+    if _, err := rand.Read(nonce); err != nil {return nil, err}
+    return aead.Seal(nonce, nonce, piece, nil), nil
+}
+
+func openPiece(priv *ecdhKey, dealer, sealed []byte) ([]byte, error) {
+    aead, err := pieceCipher(priv, dealer)
+    if err != nil {return nil, err}
+    if len(sealed) < aead.NonceSize() {
+        return nil, fmt.Errorf("sealed piece too short")
+    }
+    return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+}
+
+// split an additive share modulo q into random pieces
+func splitInt(share, q *big.Int, shares int) ([][]byte, error) {
+    pieces := make([][]byte, shares)
+    last := new(big.Int).Set(share)
+    for i := 0; i < shares-1; i += 1 {
+        piece, err := SampleInt(q)
+        if err != nil {return nil, err}
+        last.Sub(last, piece)
+        pieces[i] = piece.Bytes()
+    }
+    pieces[shares-1] = last.Mod(last, q).Bytes()
+    return pieces, nil
+}
+
+// sum of pieces from splitInt
+func combineInts(pieces [][]byte, q *big.Int) *big.Int {
+    sum := new(big.Int)
+    for _, piece := range pieces {
+        sum.Add(sum, new(big.Int).SetBytes(piece))
+    }
+    return sum.Mod(sum, q)
+}
+
+// split an additive share in the ring into random pieces
+func splitPoly(context *ring.Context, share *ring.Poly, shares int) ([][]byte, error) {
+    pieces := make([][]byte, shares)
+    last := share.CopyNew()
+    var err error
+    for i := 0; i < shares-1; i += 1 {
+        piece := context.NewUniformPoly()
+        context.Sub(last, piece, last)
+        pieces[i], err = piece.MarshalBinary()
+        if err != nil {return nil, err}
+    }
+    pieces[shares-1], err = last.MarshalBinary()
+    return pieces, err
+}
+
+// overwrite share by the sum of pieces from splitPoly
+func combinePolys(context *ring.Context, pieces [][]byte, share *ring.Poly) error {
+    sum := context.NewPoly()
+    for _, data := range pieces {
+        piece := new(ring.Poly)
+        if err := piece.UnmarshalBinary(data); err != nil {return err}
+        if len(piece.Coeffs) != len(sum.Coeffs) {
+            return fmt.Errorf("piece with %d moduli, expected %d", len(piece.Coeffs), len(sum.Coeffs))
+        }
+        context.Add(sum, piece, sum)
+    }
+    share.Copy(sum)
+    return nil
+}
+
+// split an additive share in the ring of a Lattigo v4 key into random pieces
+func splitQPPoly(ringQP *ringqp.Ring, share ringqp.Poly, shares int) ([][]byte, error) {
+    prng, err := utils.NewPRNG()
+    if err != nil {return nil, err}
+    sampler := ringqp.NewUniformSampler(prng, *ringQP)
+    pieces := make([][]byte, shares)
+    last := share.CopyNew()
+    for i := 0; i < shares-1; i += 1 {
+        piece := ringQP.NewPoly()
+        sampler.Read(piece)
+        ringQP.SubLvl(last.LevelQ(), last.LevelP(), last, piece, last)
+        pieces[i], err = piece.MarshalBinary()
+        if err != nil {return nil, err}
+    }
+    pieces[shares-1], err = last.MarshalBinary()
+    return pieces, err
+}
+
+// overwrite share by the sum of pieces from splitQPPoly
+func combineQPPolys(ringQP *ringqp.Ring, pieces [][]byte, share ringqp.Poly) error {
+    sum := ringQP.NewPoly()
+    for _, data := range pieces {
+        var piece ringqp.Poly
+        if err := piece.UnmarshalBinary(data); err != nil {return err}
+        if piece.LevelQ() != sum.LevelQ() || piece.LevelP() != sum.LevelP() {
+            return fmt.Errorf("piece with levels %d, %d, expected %d, %d", piece.LevelQ(), piece.LevelP(), sum.LevelQ(), sum.LevelP())
+        }
+        ringQP.AddLvl(sum.LevelQ(), sum.LevelP(), sum, piece, sum)
+    }
+    share.Copy(sum)
+    return nil
+}
@@ -0,0 +1,273 @@
+package tpsi
+
+import (
+    "testing"
+    "math/big"
+    "fmt"
+)
+
+// authenticated settings of n parties, the last one central
+func createReshareSettings(t *testing.T, n int, cs AHE_Cryptosystem) []AuthSetting {
+    parties := make([]Party, n)
+    for i := range parties {
+        var err error
+        parties[i], err = NewParty(fmt.Sprintf("party-%d", i))
+        if err != nil {t.Fatal(err)}
+    }
+    session, err := NewSessionID()
+    if err != nil {t.Fatal(err)}
+    return SetupAuthAHE(parties, 0, n-1, cs, session)
+}
+
+func runReshare(sks []Resharable, roles []ReshareRole, settings []AuthSetting) []error {
+    n := len(settings)
+    returns := make([]chan error, n)
+    for i := range settings {
+        returns[i] = make(chan error, 1)
+        go func(i int) {
+            if settings[i].IsCentral() {
+                returns[i] <- CentralReshareWorker(sks[i], roles[i], settings[i])
+            } else {
+                returns[i] <- OuterReshareWorker(sks[i], roles[i], settings[i])
+            }
+        }(i)
+    }
+    errs := make([]error, n)
+    for i := range errs {
+        errs[i] = <-returns[i]
+    }
+    return errs
+}
+
+func decryptWith(t *testing.T, cipher Ciphertext, cs AHE_Cryptosystem, sks []Secret_key) *big.Int {
+    parts := make([]Partial_decryption, len(sks))
+    for i, sk := range sks {
+        var err error
+        parts[i], err = sk.PartialDecrypt(cipher)
+        if err != nil {t.Fatal(err)}
+    }
+    plain, err := cs.CombinePartials(parts)
+    if err != nil {t.Fatal(err)}
+    return plain
+}
+
+func TestReshareDJ(t *testing.T) {
+    n := 3
+    pk, sks, err := NewDJCryptosystem(n)
+    if err != nil {t.Fatal(err)}
+    cipher, err := pk.Encrypt(big.NewInt(42))
+    if err != nil {t.Fatal(err)}
+
+    t.Run("refresh", func(t *testing.T) {
+        old_share := *sks[0].KeyShare
+        old := DJ_secret_key{&old_share}
+        resharable := make([]Resharable, n)
+        for i, sk := range sks {
+            resharable[i] = sk
+        }
+        for i, err := range runReshare(resharable, make([]ReshareRole, n), createReshareSettings(t, n, pk)) {
+            if err != nil {t.Errorf("party %d: %v", i, err)}
+        }
+        if old.Si.Cmp(sks[0].Si) == 0 {
+            t.Error("share unchanged")
+        }
+        for i, sk := range sks {
+            if pk.PubKey.Vi[i].Cmp(djVerificationValue(pk.PubKey, sk.Si)) != 0 {
+                t.Errorf("verification value of share %d not updated", i)
+            }
+        }
+        if plain := decryptWith(t, cipher, pk, ConvertDJSKSlice(sks)); plain.Cmp(big.NewInt(42)) != 0 {
+            t.Errorf("expected 42 after resharing, got %d", plain)
+        }
+        mixed := ConvertDJSKSlice(sks)
+        mixed[0] = old
+        if plain := decryptWith(t, cipher, pk, mixed); plain.Cmp(big.NewInt(42)) == 0 {
+            t.Error("old share still usable")
+        }
+    })
+
+    t.Run("bounded growth", func(t *testing.T) {
+        resharable := make([]Resharable, n)
+        for i, sk := range sks {
+            resharable[i] = sk
+        }
+        settings := createReshareSettings(t, n, pk)
+        for round := 0; round < 8; round += 1 {
+            for i, err := range runReshare(resharable, make([]ReshareRole, n), settings) {
+                if err != nil {t.Fatalf("party %d: %v", i, err)}
+            }
+        }
+        // random values of |N^2| + 128 bits, Lagrange coefficients and a few bits of random walk
+        limit := new(big.Int).Mul(pk.PubKey.N, pk.PubKey.N).BitLen() + 128 + djLagrange(n, pk.PubKey.Delta)[0].BitLen() + 16
+        for i, sk := range sks {
+            if sk.Si.BitLen() > limit {
+                t.Errorf("share %d of %d bits after 8 resharings, expected at most %d", i, sk.Si.BitLen(), limit)
+            }
+        }
+        if plain := decryptWith(t, cipher, pk, ConvertDJSKSlice(sks)); plain.Cmp(big.NewInt(42)) != 0 {
+            t.Errorf("expected 42 after resharing, got %d", plain)
+        }
+    })
+
+    t.Run("replace party", func(t *testing.T) {
+        replacement := pk.ReplacementKey(1)
+        resharable := []Resharable{sks[0], sks[1], replacement, sks[2]}
+        roles := []ReshareRole{DealAndReceive, DealOnly, ReceiveOnly, DealAndReceive}
+        for i, err := range runReshare(resharable, roles, createReshareSettings(t, n+1, pk)) {
+            if err != nil {t.Errorf("party %d: %v", i, err)}
+        }
+        new_sks := []Secret_key{sks[0], replacement, sks[2]}
+        if plain := decryptWith(t, cipher, pk, new_sks); plain.Cmp(big.NewInt(42)) != 0 {
+            t.Errorf("expected 42 after replacement, got %d", plain)
+        }
+    })
+
+    t.Run("unauthenticated", func(t *testing.T) {
+        resharable := make([]Resharable, n)
+        for i, sk := range sks {
+            resharable[i] = sk
+        }
+        settings := createAHESettings(n, 0, pk)
+        if err := OuterReshareWorker(resharable[0], DealAndReceive, settings[0]); err == nil {
+            t.Error("unauthenticated setting accepted")
+        }
+    })
+
+    t.Run("missing receiver", func(t *testing.T) {
+        resharable := make([]Resharable, n)
+        for i, sk := range sks {
+            resharable[i] = sk
+        }
+        roles := []ReshareRole{DealAndReceive, DealOnly, DealAndReceive}
+        for i, err := range runReshare(resharable, roles, createReshareSettings(t, n, pk)) {
+            if err == nil {t.Errorf("party %d: missing receiver accepted", i)}
+        }
+    })
+}
+
+func TestReshareElGamal(t *testing.T) {
+    n := 3
+    pk, sks, err := NewDealtElGamalCryptosystem(n)
+    if err != nil {t.Fatal(err)}
+    cipher, err := pk.Encrypt(big.NewInt(42))
+    if err != nil {t.Fatal(err)}
+    old := new(big.Int).Set(sks[0].x)
+    resharable := make([]Resharable, n)
+    for i, sk := range sks {
+        resharable[i] = sk
+    }
+    for i, err := range runReshare(resharable, make([]ReshareRole, n), createReshareSettings(t, n, pk)) {
+        if err != nil {t.Errorf("party %d: %v", i, err)}
+    }
+    if old.Cmp(sks[0].x) == 0 {
+        t.Error("share unchanged")
+    }
+    if plain := decryptWith(t, cipher, pk, ConvertElGamalSKSlice(sks)); plain.Cmp(big.NewInt(42)) != 0 {
+        t.Errorf("expected 42 after resharing, got %d", plain)
+    }
+}
+
+func TestReshareBGV(t *testing.T) {
+    n := 3
+    settings, sks := SetupBGVTest(n, 0)
+    a, err := settings[0].cs.Encrypt(big.NewInt(6))
+    if err != nil {t.Fatal(err)}
+    b, err := settings[0].cs.Encrypt(big.NewInt(7))
+    if err != nil {t.Fatal(err)}
+    old := sks[0].sk.Value.CopyNew()
+
+    resharable := make([]Resharable, n)
+    for i, sk := range sks {
+        resharable[i] = sk
+    }
+    ahe_settings := createReshareSettings(t, n, settings[0].cs)
+    for i, err := range runReshare(resharable, make([]ReshareRole, n), ahe_settings) {
+        if err != nil {t.Errorf("party %d: %v", i, err)}
+    }
+    if old.Equals(sks[0].sk.Value) {
+        t.Error("share unchanged")
+    }
+
+    // the fifth multiplication refreshes, which uses the shares held by the cryptosystems
+    prod := a
+    for j := 0; j < 5; j += 1 {
+        products := make(chan Ciphertext, n)
+        for i := range settings {
+            go func(i int, factor Ciphertext) {
+                prod, err := settings[i].cs.Multiply(factor, b)
+                if err != nil {t.Error(err)}
+                products <- prod
+            }(i, prod)
+        }
+        for i := 0; i < n; i += 1 {
+            prod = <-products
+        }
+    }
+    sk_slice := make([]Secret_key, n)
+    for i, sk := range sks {
+        sk_slice[i] = sk
+    }
+    // 6*7^5 = 35305 mod 65537
+    if plain := decryptWith(t, prod, settings[0].cs, sk_slice); plain.Cmp(big.NewInt(35305)) != 0 {
+        t.Errorf("expected 35305 after resharing, got %d", plain)
+    }
+}
+
+func TestReshareBFV(t *testing.T) {
+    n := 3
+    settings, sks := SetupTest(n, 0)
+    cipher, err := settings[0].cs.Encrypt(big.NewInt(42))
+    if err != nil {t.Fatal(err)}
+
+    resharable := make([]Resharable, n)
+    sk_slice := make([]Secret_key, n)
+    for i, sk := range sks {
+        resharable[i] = sk
+        sk_slice[i] = sk
+    }
+    ahe_settings := createReshareSettings(t, n, settings[0].cs)
+    for i, err := range runReshare(resharable, make([]ReshareRole, n), ahe_settings) {
+        if err != nil {t.Errorf("party %d: %v", i, err)}
+    }
+    if plain := decryptWith(t, cipher, settings[0].cs, sk_slice); plain.Cmp(big.NewInt(42)) != 0 {
+        t.Errorf("expected 42 after resharing, got %d", plain)
+    }
+}
+
+func TestReshareRosterSignatures(t *testing.T) {
+    n := 3
+    pk, sks, err := NewDJCryptosystem(n)
+    if err != nil {t.Fatal(err)}
+    settings := createReshareSettings(t, n, pk)
+    var roster reshareRoster
+    for i, sk := range sks {
+        hello, _, err := newReshareHello(sk, DealAndReceive, settings[i])
+        if err != nil {t.Fatal(err)}
+        roster.Hellos = append(roster.Hellos, hello)
+    }
+    if err := verifyRoster(roster, settings[0]); err != nil {
+        t.Fatal(err)
+    }
+
+    t.Run("substituted key", func(t *testing.T) {
+        forged := reshareRoster{append([]reshareHello{}, roster.Hellos...)}
+        forged.Hellos[1].Key = roster.Hellos[2].Key
+        if err := verifyRoster(forged, settings[0]); err == nil {
+            t.Error("substituted key accepted")
+        }
+    })
+
+    t.Run("unsigned", func(t *testing.T) {
+        unsigned := reshareRoster{append([]reshareHello{}, roster.Hellos...)}
+        unsigned.Hellos[1].Signature = nil
+        if err := verifyRoster(unsigned, settings[0]); err == nil {
+            t.Error("unsigned key accepted")
+        }
+    })
+
+    t.Run("missing party", func(t *testing.T) {
+        if err := verifyRoster(reshareRoster{roster.Hellos[:n-1]}, settings[0]); err == nil {
+            t.Error("roster without party accepted")
+        }
+    })
+}
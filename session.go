@@ -0,0 +1,390 @@
+package tpsi
+
+import (
+    "bytes"
+    "crypto/ed25519"
+    "crypto/rand"
+    "encoding/binary"
+    "fmt"
+    "sync"
+)
+
+// long-term public identity of a party
+type Identity struct {
+    Name string
+    PublicKey ed25519.PublicKey
+}
+
+// a party holding the signing key of its identity
+type Party struct {
+    Identity
+    signing_key ed25519.PrivateKey
+}
+
+// create a party with a fresh long-term signing key
+func NewParty(name string) (party Party, err error) {
+    pub, priv, err := ed25519.GenerateKey(rand.Reader)
+    if err != nil {return}
+    return Party{Identity{name, pub}, priv}, nil
+}
+
+// create a party from a previously generated signing key
+func NewPartyFromKey(name string, key ed25519.PrivateKey) Party {
+    return Party{Identity{name, key.Public().(ed25519.PublicKey)}, key}
+}
+
+// random identifier of a session
+func NewSessionID() ([]byte, error) {
+    id := make([]byte, 16)
+    _, err := rand.Read(id)
+    return id, err
+}
+
+// message as sent between parties of an authenticated setting
+type SignedMessage struct {
+    Sender string
+    Receiver string
+    Session []byte
+    Round uint64 // number of earlier messages from sender to receiver in this session
+    Payload []byte // serialized by EncodeMessage
+    Signature []byte
+}
+
+// bytes covered by the signature
+func (m SignedMessage) signedBytes() []byte {
+    var buf bytes.Buffer
+    for _, field := range [][]byte{[]byte(m.Sender), []byte(m.Receiver), m.Session, m.Payload} {
+        binary.Write(&buf, binary.BigEndian, uint64(len(field)))
+        buf.Write(field)
+    }
+    binary.Write(&buf, binary.BigEndian, m.Round)
+    return buf.Bytes()
+}
+
+// a message was rejected by an authenticated setting
+type AuthenticationError struct {
+    Sender string
+    Reason string
+}
+
+func (e AuthenticationError) Error() string {
+    return fmt.Sprintf("message from %q rejected: %s", e.Sender, e.Reason)
+}
+
+// handshake messages
+type sessionHello struct {
+    Name string
+}
+
+type sessionRoster struct {
+    Names []string
+}
+
+// AHE_setting where every message is signed by its sender and tagged
+// with sender, receiver, session ID and round number. Received messages
+// are verified against the pinned identities of all parties, and
+// replayed or out-of-order messages are rejected.
+type AuthSetting struct {
+    AHESetting // transport
+    self Party
+    parties []Identity // all parties, indexed by party index
+    central int // index of central party
+    session []byte
+    sent map[string]uint64 // next round number towards each party
+    received map[string]uint64 // next expected round number from each party
+    rounds *sync.Mutex // guards received, see ReceiveFrom
+    traffic trafficCounter // counts the sizes of payloads if set, see NewMetricsSetting
+}
+
+// create authenticated settings for in-process parties, where party central acts as central party
+func SetupAuthAHE(parties []Party, T, central int, cs AHE_Cryptosystem, session []byte) []AuthSetting {
+    transports := SetupAHEWithCentral(len(parties), T, central, cs)
+    identities := identitiesOf(parties)
+    settings := make([]AuthSetting, len(parties))
+    for i := range settings {
+        settings[i] = NewAuthSetting(transports[i], parties[i], identities, central, session)
+    }
+    return settings
+}
+
+func identitiesOf(parties []Party) []Identity {
+    identities := make([]Identity, len(parties))
+    for i, party := range parties {
+        identities[i] = party.Identity
+    }
+    return identities
+}
+
+// wrap a transport setting for party self, where parties lists the
+// identities of all parties in party index order
+func NewAuthSetting(transport AHESetting, self Party, parties []Identity, central int, session []byte) AuthSetting {
+    return AuthSetting{
+        AHESetting: transport,
+        self: self,
+        parties: parties,
+        central: central,
+        session: session,
+        sent: make(map[string]uint64),
+        received: make(map[string]uint64),
+        rounds: new(sync.Mutex),
+    }
+}
+
+// identity of this party
+func (s AuthSetting) Identity() Identity {
+    return s.self.Identity
+}
+
+// identifier of the current session
+func (s AuthSetting) Session() []byte {
+    return s.session
+}
+
+// identities of the outer parties, in the order used by SendTo and ReceiveAll
+func (s AuthSetting) outerParties() []Identity {
+    outer := make([]Identity, 0, len(s.parties)-1)
+    for i, party := range s.parties {
+        if i != s.central {
+            outer = append(outer, party)
+        }
+    }
+    return outer
+}
+
+func (s AuthSetting) lookup(name string) (Identity, bool) {
+    for _, party := range s.parties {
+        if party.Name == name {
+            return party, true
+        }
+    }
+    return Identity{}, false
+}
+
+// serialize, tag and sign a message for receiver
+func (s AuthSetting) sign(receiver string, any interface{}) SignedMessage {
+    payload, err := EncodeMessage(any)
+    if err != nil {panic(err)}
+    msg := SignedMessage{
+        Sender: s.self.Name,
+        Receiver: receiver,
+        Session: s.session,
+        Round: s.sent[receiver],
+        Payload: payload,
+    }
+    msg.Signature = ed25519.Sign(s.self.signing_key, msg.signedBytes())
+    s.sent[receiver] += 1
+    if s.traffic != nil {
+        s.traffic.sent(len(payload))
+    }
+    return msg
+}
+
+// verify a received message and return its payload
+func (s AuthSetting) verify(raw interface{}) (sender string, payload interface{}, err error) {
+    msg, ok := raw.(SignedMessage)
+    if !ok {
+        return "", nil, AuthenticationError{"", fmt.Sprintf("unsigned message of type %T", raw)}
+    }
+    sender = msg.Sender
+    if s.traffic != nil {
+        s.traffic.received(len(msg.Payload))
+    }
+    identity, ok := s.lookup(msg.Sender)
+    if !ok {
+        return sender, nil, AuthenticationError{sender, "unknown sender"}
+    }
+    if !ed25519.Verify(identity.PublicKey, msg.signedBytes(), msg.Signature) {
+        return sender, nil, AuthenticationError{sender, "invalid signature"}
+    }
+    if msg.Receiver != s.self.Name {
+        return sender, nil, AuthenticationError{sender, fmt.Sprintf("message addressed to %q", msg.Receiver)}
+    }
+    if !bytes.Equal(msg.Session, s.session) {
+        return sender, nil, AuthenticationError{sender, "wrong session"}
+    }
+    s.rounds.Lock()
+    defer s.rounds.Unlock()
+    expected := s.received[sender]
+    if msg.Round < expected {
+        return sender, nil, AuthenticationError{sender, fmt.Sprintf("replayed round %d, expected %d", msg.Round, expected)}
+    } else if msg.Round > expected {
+        return sender, nil, AuthenticationError{sender, fmt.Sprintf("out-of-order round %d, expected %d", msg.Round, expected)}
+    }
+    s.received[sender] += 1
+    payload, err = DecodeMessage(msg.Payload, s.AHE_cryptosystem())
+    return
+}
+
+func (s AuthSetting) Distribute(any interface{}) {
+    for i := range s.channels {
+        s.SendTo(i, any)
+    }
+}
+
+func (s AuthSetting) Send(any interface{}) {
+    s.AHESetting.Send(s.sign(s.parties[s.central].Name, any))
+}
+
+func (s AuthSetting) SendTo(i int, any interface{}) {
+    s.AHESetting.SendTo(i, s.sign(s.outerParties()[i].Name, any))
+}
+
+// for central to await messages from all outer parties,
+// returned keyed by party name
+func (s AuthSetting) ReceiveAllKeyed() (map[string]interface{}, error) {
+    msgs := make(map[string]interface{}, len(s.channels))
+    for _, raw := range s.AHESetting.ReceiveAll() {
+        sender, payload, err := s.verify(raw)
+        if err != nil {return nil, err}
+        if _, ok := msgs[sender]; ok {
+            return nil, AuthenticationError{sender, "several messages in one round"}
+        }
+        msgs[sender] = payload
+    }
+    return msgs, nil
+}
+
+// ordered by outer party index, panics if a message is rejected
+func (s AuthSetting) ReceiveAll() []interface{} {
+    msgs, err := s.ReceiveAllKeyed()
+    if err != nil {panic(err)}
+    outer := s.outerParties()
+    sl := make([]interface{}, len(outer))
+    for i, party := range outer {
+        sl[i] = msgs[party.Name]
+    }
+    return sl
+}
+
+// panics if the message is rejected
+func (s AuthSetting) Receive() interface{} {
+    sender, payload, err := s.verify(s.AHESetting.Receive())
+    if err != nil {panic(err)}
+    if sender != s.parties[s.central].Name {
+        panic(AuthenticationError{sender, "not sent by central party"})
+    }
+    return payload
+}
+
+// see PeerReceiver, returns an AuthenticationError if the message is rejected
+// or not sent by party i
+func (s AuthSetting) ReceiveFrom(i int) (interface{}, error) {
+    raw, err := s.AHESetting.ReceiveFrom(i)
+    if err != nil {return nil, err}
+    sender, payload, err := s.verify(raw)
+    if err != nil {return nil, err}
+    expected := s.parties[s.central].Name
+    if s.IsCentral() {
+        expected = s.outerParties()[i].Name
+    }
+    if sender != expected {
+        return nil, AuthenticationError{sender, fmt.Sprintf("expected message from %q", expected)}
+    }
+    return payload, nil
+}
+
+// establish the session: every outer party announces itself to the central
+// party, which replies with the roster of all parties once everyone is present
+func (s AuthSetting) Handshake() error {
+    names := make([]string, len(s.parties))
+    for i, party := range s.parties {
+        names[i] = party.Name
+    }
+    if s.IsCentral() {
+        hellos, err := s.ReceiveAllKeyed()
+        if err != nil {return err}
+        for sender, hello := range hellos {
+            if h, ok := hello.(sessionHello); !ok || h.Name != sender {
+                return AuthenticationError{sender, "invalid handshake"}
+            }
+        }
+        s.Distribute(sessionRoster{names})
+        return nil
+    }
+    s.Send(sessionHello{s.self.Name})
+    sender, payload, err := s.verify(s.AHESetting.Receive())
+    if err != nil {return err}
+    roster, ok := payload.(sessionRoster)
+    if !ok || len(roster.Names) != len(names) {
+        return AuthenticationError{sender, "invalid roster"}
+    }
+    for i, name := range names {
+        if roster.Names[i] != name {
+            return AuthenticationError{sender, fmt.Sprintf("roster disagrees on party %d", i)}
+        }
+    }
+    return nil
+}
+
+// authenticated setting of setting or of a setting wrapped by it
+func authSetting(setting AHE_setting) (AuthSetting, bool) {
+    for {
+        switch auth := setting.(type) {
+        case AuthSetting:
+            return auth, true
+        case AuthFHESetting:
+            return auth.AuthSetting, true
+        }
+        wrapper, ok := setting.(settingWrapper)
+        if !ok {
+            return AuthSetting{}, false
+        }
+        setting = wrapper.Unwrap()
+    }
+}
+
+// signature of this party on data that is relayed by the central party,
+// tagged with the session
+func (s AuthSetting) signRelayed(data []byte) []byte {
+    return ed25519.Sign(s.self.signing_key, append(append([]byte{}, s.session...), data...))
+}
+
+// verify a signature from signRelayed of party name
+func (s AuthSetting) verifyRelayed(name string, data, signature []byte) error {
+    identity, ok := s.lookup(name)
+    if !ok {
+        return AuthenticationError{name, "unknown sender"}
+    }
+    if !ed25519.Verify(identity.PublicKey, append(append([]byte{}, s.session...), data...), signature) {
+        return AuthenticationError{name, "invalid signature"}
+    }
+    return nil
+}
+
+// see trafficReporter
+func (s AuthSetting) withTraffic(counter trafficCounter) AHE_setting {
+    s.traffic = counter
+    return s
+}
+
+// FHE_setting with authenticated messages, see AuthSetting
+type AuthFHESetting struct {
+    AuthSetting
+    cs FHE_Cryptosystem
+}
+
+// create authenticated FHE settings for in-process parties, where party central acts as central party
+func SetupAuthFHE(parties []Party, T, central int, cs []FHE_Cryptosystem, session []byte) []AuthFHESetting {
+    transports := SetupFHEWithCentral(len(parties), T, central, cs)
+    identities := identitiesOf(parties)
+    settings := make([]AuthFHESetting, len(parties))
+    for i := range settings {
+        settings[i].AuthSetting = NewAuthSetting(transports[i].AHESetting, parties[i], identities, central, session)
+        settings[i].cs = cs[i]
+    }
+    return settings
+}
+
+func (s AuthFHESetting) AHE_cryptosystem() AHE_Cryptosystem {
+    return s.cs
+}
+
+func (s AuthFHESetting) FHE_cryptosystem() FHE_Cryptosystem {
+    return s.cs
+}
+
+// see trafficReporter
+func (s AuthFHESetting) withTraffic(counter trafficCounter) AHE_setting {
+    s.traffic = counter
+    return s
+}
@@ -0,0 +1,92 @@
+package tpsi
+
+import (
+    "testing"
+    "math/big"
+    "fmt"
+)
+
+func createAuthSettings(n int, t *testing.T) ([]AuthSetting, []Secret_key, DJ_encryption) {
+    pk, djsks, err := NewDJCryptosystem(n)
+    if err != nil {t.Fatal(err)}
+    parties := make([]Party, n)
+    for i := range parties {
+        parties[i], err = NewParty(fmt.Sprintf("party-%d", i))
+        if err != nil {t.Fatal(err)}
+    }
+    session, err := NewSessionID()
+    if err != nil {t.Fatal(err)}
+    return SetupAuthAHE(parties, 0, n-1, pk, session), ConvertDJSKSlice(djsks), pk
+}
+
+func TestAuthSettingWorkers(t *testing.T) {
+    n := 4
+    settings, sks, pk := createAuthSettings(n, t)
+
+    a, err := pk.Encrypt(big.NewInt(3))
+    if err != nil {t.Error(err)}
+    b, err := pk.Encrypt(big.NewInt(4))
+    if err != nil {t.Error(err)}
+
+    return_channel := make(chan *big.Int)
+    go func() {
+        if err := settings[n-1].Handshake(); err != nil {panic(err)}
+        prod := CentralMultWorker(a, b, sks[n-1], settings[n-1])
+        return_channel <- CentralDecryptionWorker(prod, sks[n-1], settings[n-1])
+    }()
+    for i := 0; i < n-1; i += 1 {
+        go func(i int) {
+            if err := settings[i].Handshake(); err != nil {panic(err)}
+            prod := OuterMultWorker(a, b, sks[i], settings[i])
+            return_channel <- OuterDecryptionWorker(prod, sks[i], settings[i])
+        }(i)
+    }
+    for i := 0; i < n; i += 1 {
+        if (<-return_channel).Cmp(big.NewInt(12)) != 0 {
+            t.Error("multiplication error")
+        }
+    }
+}
+
+func TestAuthSettingRejects(t *testing.T) {
+    n := 2
+    settings, _, _ := createAuthSettings(n, t)
+    outer := settings[0]
+    central := settings[1]
+
+    t.Run("replay", func(t *testing.T) {
+        msg := outer.sign(central.Identity().Name, big.NewInt(1))
+        go func() {
+            outer.AHESetting.Send(msg)
+            outer.AHESetting.Send(msg)
+        }()
+        if _, err := central.ReceiveAllKeyed(); err != nil {t.Error(err)}
+        if _, err := central.ReceiveAllKeyed(); err == nil {
+            t.Error("replayed message accepted")
+        }
+    })
+
+    t.Run("out of order", func(t *testing.T) {
+        outer.sign(central.Identity().Name, big.NewInt(2)) // never delivered
+        msg := outer.sign(central.Identity().Name, big.NewInt(3))
+        go func() {
+            outer.AHESetting.Send(msg)
+        }()
+        if _, err := central.ReceiveAllKeyed(); err == nil {
+            t.Error("out-of-order message accepted")
+        }
+    })
+
+    t.Run("impostor", func(t *testing.T) {
+        impostor, err := NewParty(outer.Identity().Name)
+        if err != nil {t.Fatal(err)}
+        fake := NewAuthSetting(outer.AHESetting, impostor, outer.parties, outer.central, outer.session)
+        msg := fake.sign(central.Identity().Name, big.NewInt(4))
+        go func() {
+            outer.AHESetting.Send(msg)
+        }()
+        if _, err := central.ReceiveAllKeyed(); err == nil {
+            t.Error("message with invalid signature accepted")
+        }
+    })
+}
@@ -1,5 +1,9 @@
 package tpsi
 
+import (
+    "fmt"
+)
+
 type AHE_setting interface {
     // threshold value
     Threshold() int
@@ -44,6 +48,49 @@ type AHESetting struct {
     T int // threshold
     channels []chan interface{}
     channel chan interface{}
+    replies []chan interface{} // central: from each outer party, channels is used both ways if nil
+    reply chan interface{} // outer: to central party, channel is used both ways if nil
+    traffic trafficCounter // counts the sizes of messages if set, see NewMetricsSetting
+}
+
+// message of an in-process setting together with its size as serialized by
+// EncodeMessage, sent in place of the message if the sender counts traffic
+type sizedMessage struct {
+    payload interface{}
+    size int
+}
+
+// message to send to receivers parties, wrapped with its size if this setting
+// counts traffic. Messages the codec rejects can't be sent by a serializing
+// transport either, so they are sent as they are and not counted.
+func (s AHESetting) outgoing(any interface{}, receivers int) interface{} {
+    if s.traffic == nil {
+        return any
+    }
+    data, err := EncodeMessage(any)
+    if err != nil {
+        return any
+    }
+    s.traffic.sent(len(data) * receivers)
+    return sizedMessage{any, len(data)}
+}
+
+// unwraps a received message, counting its size if this setting counts traffic
+func (s AHESetting) incoming(any interface{}) interface{} {
+    msg, ok := any.(sizedMessage)
+    if !ok {
+        return any
+    }
+    if s.traffic != nil {
+        s.traffic.received(msg.size)
+    }
+    return msg.payload
+}
+
+// see trafficReporter
+func (s AHESetting) withTraffic(counter trafficCounter) AHE_setting {
+    s.traffic = counter
+    return s
 }
 
 func (s AHESetting) Threshold() int {
@@ -59,35 +106,112 @@ func (s AHESetting) AHE_cryptosystem() AHE_Cryptosystem {
 }
 
 func (s AHESetting) Distribute(any interface{}) {
+    msg := s.outgoing(any, len(s.channels))
     for _, ch := range s.channels {
-        ch <- any
+        ch <- msg
     }
 }
 
 func (s AHESetting) Send(any interface{}) {
-    s.channel <- any
+    s.toCentral() <- s.outgoing(any, 1)
 }
 
 func (s AHESetting) SendTo(i int, any interface{}) {
-    s.channels[i] <- any
+    s.channels[i] <- s.outgoing(any, 1)
 }
 
 func (s AHESetting) ReceiveAll() []interface{} {
     sl := make([]interface{}, s.n-1)
-    for i, ch := range s.channels {
-        sl[i] = <-ch
+    for i := range s.channels {
+        sl[i] = s.incoming(<-s.fromOuter(i))
     }
     return sl
 }
 
 func (s AHESetting) Receive() interface{} {
-    return <-s.channel
+    return s.incoming(<-s.channel)
 }
 
 func (s AHESetting) IsCentral() bool {
     return s.channels != nil
 }
 
+// see PeerReceiver, only for settings with one channel in each direction as created by SetupAHE
+func (s AHESetting) ReceiveFrom(i int) (interface{}, error) {
+    if !s.receivesFromPeers() {
+        return nil, fmt.Errorf("setting uses one channel in both directions")
+    } else if s.IsCentral() {
+        return s.incoming(<-s.replies[i]), nil
+    }
+    return s.incoming(<-s.channel), nil
+}
+
+// see peerReceiverOption
+func (s AHESetting) receivesFromPeers() bool {
+    if s.IsCentral() {
+        return s.replies != nil
+    }
+    return s.reply != nil
+}
+
+func (s AHESetting) toCentral() chan interface{} {
+    if s.reply != nil {
+        return s.reply
+    }
+    return s.channel
+}
+
+func (s AHESetting) fromOuter(i int) chan interface{} {
+    if s.replies != nil {
+        return s.replies[i]
+    }
+    return s.channels[i]
+}
+
+// closes the channels of settings created by SetupAHE, called on the setting of
+// the central party, which holds all of them. Waiting parties then receive nil
+// and sending parties panic, so that they return after another party failed.
+func (s AHESetting) close() {
+    for i := range s.channels {
+        close(s.channels[i])
+        if s.replies != nil {
+            close(s.replies[i])
+        }
+    }
+}
+
+// optionally implemented by settings that can receive from a single party while
+// other goroutines send, needed to multiplex streams, see Mux
+type PeerReceiver interface {
+    // for central: next message from outer party i, for outer parties:
+    // next message from central party, where i is ignored
+    ReceiveFrom(i int) (interface{}, error)
+}
+
+// optionally implemented by PeerReceivers that can receive from single
+// parties in some configurations only
+type peerReceiverOption interface {
+    receivesFromPeers() bool
+}
+
+// returns true if ReceiveFrom of setting works, which for a setting wrapping
+// another one depends on the wrapped setting
+func canReceiveFrom(setting AHE_setting) bool {
+    for {
+        if _, ok := setting.(PeerReceiver); !ok {
+            return false
+        }
+        if option, ok := setting.(peerReceiverOption); ok {
+            return option.receivesFromPeers()
+        }
+        wrapper, ok := setting.(settingWrapper)
+        if !ok {
+            return true
+        }
+        setting = wrapper.Unwrap()
+    }
+}
+
 type FHESetting struct {
     AHESetting
     cs FHE_Cryptosystem
@@ -99,4 +223,130 @@ func (s FHESetting) AHE_cryptosystem() AHE_Cryptosystem {
 
 func (s FHESetting) FHE_cryptosystem() FHE_Cryptosystem {
     return s.cs
-}
\ No newline at end of file
+}
+
+// see trafficReporter
+func (s FHESetting) withTraffic(counter trafficCounter) AHE_setting {
+    s.traffic = counter
+    return s
+}
+
+// implemented by settings restricting which parties receive the output
+type OutputPolicy interface {
+    // true if this party receives the final intersection
+    ReceivesOutput() bool
+}
+
+// implemented by settings wrapping another setting
+type settingWrapper interface {
+    Unwrap() AHE_setting
+}
+
+// output policy of setting or of a setting wrapped by it
+func outputPolicy(setting AHE_setting) (OutputPolicy, bool) {
+    for {
+        if policy, ok := setting.(OutputPolicy); ok {
+            return policy, true
+        }
+        wrapper, ok := setting.(settingWrapper)
+        if !ok {
+            return nil, false
+        }
+        setting = wrapper.Unwrap()
+    }
+}
+
+// returns true if the party of setting receives the final intersection,
+// which is the case for all parties unless restricted by an OutputPolicy
+func receivesOutput(setting AHE_setting) bool {
+    policy, ok := outputPolicy(setting)
+    return !ok || policy.ReceivesOutput()
+}
+
+// returns true if output delivery is restricted, which must hold for all or no parties
+func outputRestricted(setting AHE_setting) bool {
+    _, ok := outputPolicy(setting)
+    return ok
+}
+
+// setting where only designated parties receive the final intersection
+type OutputRestrictedSetting struct {
+    AHE_setting
+    receives bool
+}
+
+func (s OutputRestrictedSetting) ReceivesOutput() bool {
+    return s.receives
+}
+
+// FHE setting where only designated parties receive the final intersection
+type OutputRestrictedFHESetting struct {
+    FHE_setting
+    receives bool
+}
+
+func (s OutputRestrictedFHESetting) ReceivesOutput() bool {
+    return s.receives
+}
+
+// restrict output delivery to the parties with indices in receivers
+func RestrictOutputAHE(settings []AHESetting, receivers []int) []OutputRestrictedSetting {
+    restricted := make([]OutputRestrictedSetting, len(settings))
+    for i, setting := range settings {
+        restricted[i] = OutputRestrictedSetting{setting, containsIndex(receivers, i)}
+    }
+    return restricted
+}
+
+// restrict output delivery to the parties with indices in receivers
+func RestrictOutputFHE(settings []FHESetting, receivers []int) []OutputRestrictedFHESetting {
+    restricted := make([]OutputRestrictedFHESetting, len(settings))
+    for i, setting := range settings {
+        restricted[i] = OutputRestrictedFHESetting{setting, containsIndex(receivers, i)}
+    }
+    return restricted
+}
+
+func containsIndex(indices []int, i int) bool {
+    for _, j := range indices {
+        if i == j {
+            return true
+        }
+    }
+    return false
+}
+
+// setting running workers under a threshold derived from that of the wrapped setting
+type thresholdSetting struct {
+    AHE_setting
+    T int
+}
+
+func (s thresholdSetting) Threshold() int {
+    return s.T
+}
+
+func (s thresholdSetting) Unwrap() AHE_setting {
+    return s.AHE_setting
+}
+
+type thresholdFHESetting struct {
+    FHE_setting
+    T int
+}
+
+func (s thresholdFHESetting) Threshold() int {
+    return s.T
+}
+
+func (s thresholdFHESetting) Unwrap() AHE_setting {
+    return s.FHE_setting
+}
+
+// setting with threshold T, keeping the FHE cryptosystem of setting if it has one
+func withThreshold(setting AHE_setting, T int) AHE_setting {
+    if fhe, ok := setting.(FHE_setting); ok {
+        return thresholdFHESetting{fhe, T}
+    }
+    return thresholdSetting{setting, T}
+}
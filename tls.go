@@ -0,0 +1,309 @@
+package tpsi
+
+import (
+    "bytes"
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/tls"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "encoding/binary"
+    "fmt"
+    "io"
+    "math/big"
+    "net"
+    "time"
+)
+
+// generate a self-signed certificate for a party, usable for local testing
+func GenerateSelfSignedCertificate(name string) (cert tls.Certificate, err error) {
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {return}
+    serial, err := SampleInt(new(big.Int).Lsh(big.NewInt(1), 128))
+    if err != nil {return}
+    template := x509.Certificate{
+        SerialNumber: serial,
+        Subject: pkix.Name{CommonName: name},
+        DNSNames: []string{name},
+        IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+        NotBefore: time.Now().Add(-time.Hour),
+        NotAfter: time.Now().Add(365 * 24 * time.Hour),
+        KeyUsage: x509.KeyUsageDigitalSignature,
+        ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+    }
+    der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+    if err != nil {return}
+    leaf, err := x509.ParseCertificate(der)
+    if err != nil {return}
+    return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, nil
+}
+
+// index of the pinned certificate presented by the peer, or -1
+func pinnedIndex(raw [][]byte, pinned []*x509.Certificate) int {
+    if len(raw) == 0 {
+        return -1
+    }
+    for i, cert := range pinned {
+        if bytes.Equal(raw[0], cert.Raw) {
+            return i
+        }
+    }
+    return -1
+}
+
+// tls configuration presenting cert and only accepting peers in pinned
+func pinnedTLSConfig(cert tls.Certificate, pinned []*x509.Certificate) *tls.Config {
+    return &tls.Config{
+        Certificates: []tls.Certificate{cert},
+        MinVersion: tls.VersionTLS13,
+        ClientAuth: tls.RequireAnyClientCert,
+        InsecureSkipVerify: true, // peers are verified against pinned certificates instead of a CA
+        VerifyPeerCertificate: func(raw [][]byte, _ [][]*x509.Certificate) error {
+            if pinnedIndex(raw, pinned) < 0 {
+                return fmt.Errorf("peer certificate is not pinned")
+            }
+            return nil
+        },
+    }
+}
+
+// write a length prefixed message, returns the size of the serialized message
+func writeFrame(conn net.Conn, any interface{}) (int, error) {
+    data, err := EncodeMessage(any)
+    if err != nil {return 0, err}
+    header := make([]byte, 8)
+    binary.BigEndian.PutUint64(header, uint64(len(data)))
+    _, err = conn.Write(append(header, data...))
+    return len(data), err
+}
+
+// largest message accepted by readFrame, in bytes. Larger frames are rejected
+// before they are read, so a faulty peer can't exhaust memory.
+var MaxFrameSize uint64 = 1 << 28
+
+// time allowed for the TLS handshake and admission of a party, after which
+// the connection is dropped
+var tlsHandshakeTimeout = 10 * time.Second
+
+// read a length prefixed message, returns it with the size of the serialized message
+func readFrame(conn net.Conn, cs AHE_Cryptosystem) (interface{}, int, error) {
+    header := make([]byte, 8)
+    _, err := io.ReadFull(conn, header)
+    if err != nil {return nil, 0, err}
+    size := binary.BigEndian.Uint64(header)
+    if size > MaxFrameSize {
+        return nil, 0, fmt.Errorf("frame of %d bytes exceeds maximum of %d", size, MaxFrameSize)
+    }
+    data := make([]byte, size)
+    _, err = io.ReadFull(conn, data)
+    if err != nil {return nil, 0, err}
+    msg, err := DecodeMessage(data, cs)
+    return msg, len(data), err
+}
+
+// AHE_setting where the parties communicate over mutually authenticated
+// TLS connections. Outer parties connect to the central party, and both
+// sides only accept peers presenting one of the pinned certificates.
+type TLSSetting struct {
+    cs AHE_Cryptosystem
+    n int // number of participants
+    T int // threshold
+    conns []net.Conn // central: connection to each outer party
+    conn net.Conn // outer: connection to central party
+    traffic trafficCounter // counts the sizes of frames if set, see NewMetricsSetting
+}
+
+// sent by central party when an outer party is admitted
+const tlsWelcome = byte(1)
+
+// create setting for the central party, accepting connections on ln from
+// the outer parties, given by their certificates in outer party order
+func NewTLSCentralSetting(ln net.Listener, T int, cs AHE_Cryptosystem, cert tls.Certificate, outer []*x509.Certificate) (setting TLSSetting, err error) {
+    setting = TLSSetting{cs: cs, n: len(outer)+1, T: T, conns: make([]net.Conn, len(outer))}
+    config := pinnedTLSConfig(cert, outer)
+    for connected := 0; connected < len(outer); {
+        var raw net.Conn
+        raw, err = ln.Accept()
+        if err != nil {
+            setting.Close()
+            return
+        }
+        raw.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+        conn := tls.Server(raw, config)
+        if conn.Handshake() != nil { // peer not pinned or too slow
+            conn.Close()
+            continue
+        }
+        i := pinnedIndex([][]byte{conn.ConnectionState().PeerCertificates[0].Raw}, outer)
+        if setting.conns[i] != nil { // party already connected
+            conn.Close()
+            continue
+        }
+        _, err = conn.Write([]byte{tlsWelcome})
+        if err == nil {
+            err = raw.SetDeadline(time.Time{}) // no deadline for the protocol
+        }
+        if err != nil {
+            conn.Close()
+            err = nil
+            continue
+        }
+        setting.conns[i] = conn
+        connected += 1
+    }
+    return setting, nil
+}
+
+// create setting for an outer party, connecting to the central party at addr
+func NewTLSOuterSetting(addr string, n, T int, cs AHE_Cryptosystem, cert tls.Certificate, central *x509.Certificate) (setting TLSSetting, err error) {
+    dialer := &net.Dialer{Timeout: tlsHandshakeTimeout}
+    conn, err := tls.DialWithDialer(dialer, "tcp", addr, pinnedTLSConfig(cert, []*x509.Certificate{central}))
+    if err != nil {return}
+    conn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+    welcome := make([]byte, 1)
+    _, err = io.ReadFull(conn, welcome)
+    if err == nil && welcome[0] == tlsWelcome {
+        err = conn.SetDeadline(time.Time{})
+    } else if err == nil {
+        err = fmt.Errorf("unexpected welcome %d", welcome[0])
+    }
+    if err != nil {
+        conn.Close()
+        err = fmt.Errorf("not admitted by central party: %v", err)
+        return
+    }
+    return TLSSetting{cs: cs, n: n, T: T, conn: conn}, nil
+}
+
+// close all connections
+func (s TLSSetting) Close() error {
+    var err error
+    for _, conn := range s.conns {
+        if conn != nil {
+            if e := conn.Close(); e != nil {
+                err = e
+            }
+        }
+    }
+    if s.conn != nil {
+        err = s.conn.Close()
+    }
+    return err
+}
+
+func (s TLSSetting) Threshold() int {
+    return s.T
+}
+
+func (s TLSSetting) Parties() int {
+    return s.n
+}
+
+func (s TLSSetting) AHE_cryptosystem() AHE_Cryptosystem {
+    return s.cs
+}
+
+func (s TLSSetting) Distribute(any interface{}) {
+    for i := range s.conns {
+        s.SendTo(i, any)
+    }
+}
+
+func (s TLSSetting) Send(any interface{}) {
+    s.write(s.conn, any)
+}
+
+func (s TLSSetting) SendTo(i int, any interface{}) {
+    s.write(s.conns[i], any)
+}
+
+func (s TLSSetting) ReceiveAll() []interface{} {
+    sl := make([]interface{}, len(s.conns))
+    var err error
+    for i, conn := range s.conns {
+        sl[i], err = s.read(conn)
+        if err != nil {panic(err)}
+    }
+    return sl
+}
+
+func (s TLSSetting) Receive() interface{} {
+    msg, err := s.read(s.conn)
+    if err != nil {panic(err)}
+    return msg
+}
+
+func (s TLSSetting) write(conn net.Conn, any interface{}) {
+    size, err := writeFrame(conn, any)
+    if err != nil {panic(err)}
+    if s.traffic != nil {
+        s.traffic.sent(size)
+    }
+}
+
+func (s TLSSetting) read(conn net.Conn) (interface{}, error) {
+    msg, size, err := readFrame(conn, s.cs)
+    if err == nil && s.traffic != nil {
+        s.traffic.received(size)
+    }
+    return msg, err
+}
+
+// see trafficReporter
+func (s TLSSetting) withTraffic(counter trafficCounter) AHE_setting {
+    s.traffic = counter
+    return s
+}
+
+func (s TLSSetting) IsCentral() bool {
+    return s.conns != nil
+}
+
+// see PeerReceiver
+func (s TLSSetting) ReceiveFrom(i int) (interface{}, error) {
+    if s.IsCentral() {
+        return s.read(s.conns[i])
+    }
+    return s.read(s.conn)
+}
+
+// FHE_setting over mutually authenticated TLS connections, see TLSSetting.
+// The messages the cryptosystem exchanges during evaluation, e.g. for the
+// multiplications and refreshes of BFV_encryption, are sent over the same
+// connections in turn with the messages of the protocol.
+type TLSFHESetting struct {
+    TLSSetting
+    cs FHE_Cryptosystem
+}
+
+// wrap a connected TLSSetting to use cs, which must implement StreamedCryptosystem
+// as BFV_encryption and BGV_encryption do. The keys of cs are generated beforehand,
+// e.g. by SetupBFV.
+func NewTLSFHESetting(setting TLSSetting, cs FHE_Cryptosystem) (TLSFHESetting, error) {
+    if _, ok := cs.(StreamedCryptosystem); !ok {
+        return TLSFHESetting{}, fmt.Errorf("cryptosystem of type %T can't exchange messages over TLS", cs)
+    }
+    setting.cs = cs
+    return TLSFHESetting{setting, cs}.linked(), nil
+}
+
+// copy of s whose cryptosystem exchanges its messages over the connections of s
+func (s TLSFHESetting) linked() TLSFHESetting {
+    s.cs = s.cs.(StreamedCryptosystem).OnStream(s.TLSSetting)
+    return s
+}
+
+func (s TLSFHESetting) AHE_cryptosystem() AHE_Cryptosystem {
+    return s.cs
+}
+
+func (s TLSFHESetting) FHE_cryptosystem() FHE_Cryptosystem {
+    return s.cs
+}
+
+// see trafficReporter, messages of the cryptosystem are counted as well
+func (s TLSFHESetting) withTraffic(counter trafficCounter) AHE_setting {
+    s.TLSSetting.traffic = counter
+    return s.linked()
+}
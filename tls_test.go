@@ -0,0 +1,226 @@
+package tpsi
+
+import (
+    "testing"
+    "math/big"
+    "crypto/tls"
+    "crypto/x509"
+    "encoding/binary"
+    "fmt"
+    "net"
+    "time"
+)
+
+func createTLSCertificates(n int, t *testing.T) ([]tls.Certificate, []*x509.Certificate) {
+    certs := make([]tls.Certificate, n)
+    leaves := make([]*x509.Certificate, n)
+    var err error
+    for i := range certs {
+        certs[i], err = GenerateSelfSignedCertificate(fmt.Sprintf("party-%d", i))
+        if err != nil {t.Fatal(err)}
+        leaves[i] = certs[i].Leaf
+    }
+    return certs, leaves
+}
+
+func TestTLSSettingWorkers(t *testing.T) {
+    n := 3
+    pk, sks, err := NewDJCryptosystem(n)
+    if err != nil {t.Fatal(err)}
+    certs, leaves := createTLSCertificates(n, t)
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {t.Fatal(err)}
+    defer ln.Close()
+
+    cipher, err := pk.Encrypt(big.NewInt(83))
+    if err != nil {t.Fatal(err)}
+
+    return_channel := make(chan *big.Int)
+    go func() {
+        setting, err := NewTLSCentralSetting(ln, 0, pk, certs[n-1], leaves[:n-1])
+        if err != nil {panic(err)}
+        defer setting.Close()
+        return_channel <- CentralDecryptionWorker(cipher, sks[n-1], setting)
+    }()
+    for i := 0; i < n-1; i += 1 {
+        go func(i int) {
+            setting, err := NewTLSOuterSetting(ln.Addr().String(), n, 0, pk, certs[i], leaves[n-1])
+            if err != nil {panic(err)}
+            defer setting.Close()
+            return_channel <- OuterDecryptionWorker(cipher, sks[i], setting)
+        }(i)
+    }
+    for i := 0; i < n; i += 1 {
+        if (<-return_channel).Cmp(big.NewInt(83)) != 0 {
+            t.Error("decryption error")
+        }
+    }
+}
+
+func TestTLSSettingRejectsUnpinned(t *testing.T) {
+    pk, _, err := NewDJCryptosystem(2)
+    if err != nil {t.Fatal(err)}
+    certs, leaves := createTLSCertificates(2, t)
+    intruder, err := GenerateSelfSignedCertificate("intruder")
+    if err != nil {t.Fatal(err)}
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {t.Fatal(err)}
+    defer ln.Close()
+
+    central := make(chan TLSSetting)
+    go func() {
+        setting, err := NewTLSCentralSetting(ln, 0, pk, certs[1], leaves[:1])
+        if err != nil {panic(err)}
+        central <- setting
+    }()
+
+    _, err = NewTLSOuterSetting(ln.Addr().String(), 2, 0, pk, intruder, leaves[1])
+    if err == nil {
+        t.Error("unpinned party admitted")
+    }
+    _, err = NewTLSOuterSetting(ln.Addr().String(), 2, 0, pk, certs[0], intruder.Leaf)
+    if err == nil {
+        t.Error("connected to unpinned central party")
+    }
+    outer, err := NewTLSOuterSetting(ln.Addr().String(), 2, 0, pk, certs[0], leaves[1])
+    if err != nil {t.Fatal(err)}
+    outer.Close()
+    (<-central).Close()
+}
+
+func TestTLSSettingDropsStalledConnection(t *testing.T) {
+    timeout := tlsHandshakeTimeout
+    tlsHandshakeTimeout = 200 * time.Millisecond
+    defer func() {tlsHandshakeTimeout = timeout}()
+    pk, _, err := NewDJCryptosystem(2)
+    if err != nil {t.Fatal(err)}
+    certs, leaves := createTLSCertificates(2, t)
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {t.Fatal(err)}
+    defer ln.Close()
+
+    central := make(chan TLSSetting)
+    go func() {
+        setting, err := NewTLSCentralSetting(ln, 0, pk, certs[1], leaves[:1])
+        if err != nil {panic(err)}
+        central <- setting
+    }()
+
+    // connects but never starts the handshake, dropped after the timeout
+    stalled, err := net.Dial("tcp", ln.Addr().String())
+    if err != nil {t.Fatal(err)}
+    defer stalled.Close()
+    stalled.SetReadDeadline(time.Now().Add(5 * time.Second))
+    _, err = stalled.Read(make([]byte, 1))
+    if ne, ok := err.(net.Error); err == nil || ok && ne.Timeout() {
+        t.Fatal("stalled connection not dropped")
+    }
+    outer, err := NewTLSOuterSetting(ln.Addr().String(), 2, 0, pk, certs[0], leaves[1])
+    if err != nil {t.Fatal(err)}
+    outer.Close()
+    (<-central).Close()
+}
+
+func TestReadFrameRejectsLargeFrame(t *testing.T) {
+    pk, _, err := NewDJCryptosystem(2)
+    if err != nil {t.Fatal(err)}
+    a, b := net.Pipe()
+    defer a.Close()
+    defer b.Close()
+    go func() {
+        header := make([]byte, 8)
+        binary.BigEndian.PutUint64(header, MaxFrameSize+1)
+        a.Write(header)
+    }()
+    if _, _, err = readFrame(b, pk); err == nil {
+        t.Error("frame above MaxFrameSize accepted")
+    }
+}
+
+func TestTLSSettingElection(t *testing.T) {
+    n := 3
+    pk, _, err := NewDJCryptosystem(n)
+    if err != nil {t.Fatal(err)}
+    certs, leaves := createTLSCertificates(n, t)
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {t.Fatal(err)}
+    defer ln.Close()
+
+    return_channel := make(chan int)
+    go func() {
+        setting, err := NewTLSCentralSetting(ln, 0, pk, certs[n-1], leaves[:n-1])
+        if err != nil {panic(err)}
+        defer setting.Close()
+        return_channel <- CentralElectionWorker(setting)
+    }()
+    for i := 0; i < n-1; i += 1 {
+        go func(i int) {
+            setting, err := NewTLSOuterSetting(ln.Addr().String(), n, 0, pk, certs[i], leaves[n-1])
+            if err != nil {panic(err)}
+            defer setting.Close()
+            return_channel <- OuterElectionWorker(setting)
+        }(i)
+    }
+    elected := <-return_channel
+    if elected < 0 || elected >= n {
+        t.Errorf("elected central %d out of range", elected)
+    }
+    for i := 1; i < n; i += 1 {
+        if other := <-return_channel; other != elected {
+            t.Errorf("parties disagree on central: %d and %d", elected, other)
+        }
+    }
+}
+
+// FHE settings over TLS for n parties with BFV keys, the last party is central
+func createTLSFHESettings(t *testing.T, n, T int) ([]FHE_setting, []Secret_key) {
+    pks, bfv_sks := SetupBFV(n)
+    certs, leaves := createTLSCertificates(n, t)
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {t.Fatal(err)}
+    t.Cleanup(func() {ln.Close()})
+
+    tls_settings := make([]TLSSetting, n)
+    errs := make(chan error)
+    go func() {
+        var err error
+        tls_settings[n-1], err = NewTLSCentralSetting(ln, T, pks[n-1], certs[n-1], leaves[:n-1])
+        errs <- err
+    }()
+    for i := 0; i < n-1; i += 1 {
+        go func(i int) {
+            var err error
+            tls_settings[i], err = NewTLSOuterSetting(ln.Addr().String(), n, T, pks[i], certs[i], leaves[n-1])
+            errs <- err
+        }(i)
+    }
+    for i := 0; i < n; i += 1 {
+        if err := <-errs; err != nil {t.Fatal(err)}
+    }
+    settings := make([]FHE_setting, n)
+    sks := make([]Secret_key, n)
+    for i := range settings {
+        setting, err := NewTLSFHESetting(tls_settings[i], pks[i])
+        if err != nil {t.Fatal(err)}
+        t.Cleanup(func() {setting.Close()})
+        settings[i] = setting
+        sks[i] = bfv_sks[i]
+    }
+    return settings, sks
+}
+
+func TestTPSIintTLS(t *testing.T) {
+    testTPSIint(t, func(n, T int) ([]FHE_setting, []Secret_key) {
+        return createTLSFHESettings(t, n, T)
+    })
+}
+
+func TestTLSFHESettingRejectsUnstreamed(t *testing.T) {
+    if _, err := NewTLSFHESetting(TLSSetting{}, unstreamedFHE{}); err == nil {
+        t.Error("cryptosystem without StreamedCryptosystem accepted")
+    }
+}
+
+type unstreamedFHE struct {
+    FHE_Cryptosystem
+}
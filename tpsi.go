@@ -3,8 +3,10 @@ package tpsi
 import (
     "math/big"
     "math"
+    "fmt"
     gm "github.com/ontanj/generic-matrix"
     "crypto/rand"
+    "io"
 )
 
 // create a slice of n chan interface{}
@@ -44,22 +46,41 @@ func elMulSlice(sl1, sl2 []*big.Int, q *big.Int) []*big.Int {
 }
 
 func SetupAHE(n, T int, cs AHE_Cryptosystem) ([]AHESetting) {
+    return SetupAHEWithCentral(n, T, n-1, cs)
+}
+
+// create settings for n parties where party central acts as central party
+func SetupAHEWithCentral(n, T, central int, cs AHE_Cryptosystem) ([]AHESetting) {
+    if central < 0 || central >= n {
+        panic(fmt.Errorf("central party %d out of range for %d parties", central, n))
+    }
     settings := make([]AHESetting, n)
     channels := create_chans(n-1)
-    for i := 0; i < n-1; i += 1 {
+    replies := create_chans(n-1)
+    for i := 0; i < n; i += 1 {
         settings[i].cs = cs
         settings[i].n = n
-        settings[i].channel = channels[i]
         settings[i].T = T
+        if i == central {
+            settings[i].channels = channels
+            settings[i].replies = replies
+        } else {
+            settings[i].channel = channels[outerPosition(i, central)]
+            settings[i].reply = replies[outerPosition(i, central)]
+        }
     }
-    settings[n-1].cs = cs
-    settings[n-1].n = n
-    settings[n-1].channels = channels
-    settings[n-1].T = T
-
     return settings
 }
 
+// position of party i among the outer parties, i.e. in the slice
+// returned by ReceiveAll and the index used by SendTo
+func outerPosition(i, central int) int {
+    if i > central {
+        return i - 1
+    }
+    return i
+}
+
 func EncodeElements(elements []*big.Int) []*big.Int {
     new_elements := make([]*big.Int, len(elements))
     for i, e := range elements {
@@ -76,22 +97,52 @@ func DecodeElements(elements []*big.Int) []*big.Int {
     return new_elements
 }
 
+// returns items with repeated elements removed, keeping the first occurrence
+// of each. The protocols treat the input of a party as a set, while PolyFromRoots
+// and the Hankel power sums would count a repeated element once per occurrence.
+func Deduplicate(items []*big.Int) []*big.Int {
+    seen := make(map[string]bool, len(items))
+    unique := make([]*big.Int, 0, len(items))
+    for _, item := range items {
+        key := item.String()
+        if !seen[key] {
+            seen[key] = true
+            unique = append(unique, item)
+        }
+    }
+    return unique
+}
+
 // sample a uniform random integer smaller than q
 func SampleInt(q *big.Int) (*big.Int, error) {
     return rand.Int(rand.Reader, q)
 }
 
+// source of randomness of the party of setting, that of its cryptosystem
+// if it is a RandomizedCryptosystem, otherwise crypto/rand
+func randomness(setting AHE_setting) io.Reader {
+    if cs, ok := setting.AHE_cryptosystem().(RandomizedCryptosystem); ok {
+        return cs.Randomness()
+    }
+    return rand.Reader
+}
+
+// SampleInt using the randomness of setting
+func sampleInt(setting AHE_setting, q *big.Int) (*big.Int, error) {
+    return rand.Int(randomness(setting), q)
+}
+
 // compute the encrypted Hankel Matrix for central party
-func CPComputeHankelMatrix(items []*big.Int, u *big.Int, setting AHE_setting) (H gm.Matrix, err error) {
+func CPComputeHankelMatrix(items []*big.Int, u *big.Int, setting AHE_setting) (H HankelMatrix, err error) {
     H = ComputePlainHankelMatrix(items, u, setting)
     H, err = H.Scale(big.NewInt(int64(setting.Parties()-1)))
     if err != nil {return}
-    return EncryptMatrix(H, setting)
+    return EncryptHankelMatrix(H, setting)
 }
 
 //step 3b of CTest-diff
 func SampleVVector(m gm.Matrix, setting AHE_setting) (v gm.Matrix, err error) {
-    v_plain, err := SampleMatrix(m.Cols, 1, setting.AHE_cryptosystem().N())
+    v_plain, err := sampleMatrix(setting, m.Cols, 1, setting.AHE_cryptosystem().N())
     if err != nil {return}
     return EncryptMatrix(v_plain, setting)
 }
@@ -137,7 +188,7 @@ func CombineMatrixMultiplication(MA_enc, MB_enc gm.Matrix, MAis, MBis []gm.Matri
 
 // sample u from step 3e of CTest-diff
 func SampleUVector(m gm.Matrix, setting AHE_setting) (u gm.Matrix, err error) {
-    return SampleMatrix(1, m.Rows, setting.AHE_cryptosystem().N())
+    return sampleMatrix(setting, 1, m.Rows, setting.AHE_cryptosystem().N())
 }
 
 // step 3e of CTest-diff
@@ -167,44 +218,14 @@ func SecretShare(d, e *big.Int, setting AHE_setting) *big.Int {
 }
 
 // compute the Hankel Matrix for items and (random) u.
-func ComputePlainHankelMatrix(items []*big.Int, u *big.Int, setting AHE_setting) gm.Matrix {
-    q := setting.AHE_cryptosystem().N()
-    m := len(items)
-    u_list := make([]*big.Int, m) // stores u^a^i for each a
-    u1_list := make([]*big.Int, m) // stores u^a for each a
-    H, err := gm.NewMatrix(setting.Threshold() + 1, setting.Threshold() + 1, nil, gm.Bigint{})
-    if err != nil {panic(err)}
-    H.Set(0, 0, big.NewInt(int64(m)))
-    for i := range u1_list {
-        u1_list[i] = new(big.Int).Exp(u, items[i], q); // u^a mod q
-    }
-    copy(u_list, u1_list)
-    for i := 1; ; i += 1 { // each unique element in Hankel matrix
-        var stopCol int
-        var startCol int
-        if i <= setting.Threshold() {
-            startCol = 0
-            stopCol = i + 1
-        } else {
-            startCol = i - setting.Threshold()
-            stopCol = setting.Threshold() + 1
-        }
-        el := sumSlice(u_list, q)
-        for j := startCol; j < stopCol; j += 1 { // each matrix entry with current element
-            H.Set(i-j, j, el)
-        }
-        if i >= 2 * setting.Threshold() {
-            break
-        }
-        u_list = elMulSlice(u_list, u1_list, q)
-    }
-    return H
+func ComputePlainHankelMatrix(items []*big.Int, u *big.Int, setting AHE_setting) HankelMatrix {
+    return HankelMatrix{hankelSequence(items, u, setting)}
 }
 
 // compute and encrypt the Hankel Matrix for items and (random) u.
-func ComputeHankelMatrix(items []*big.Int, u *big.Int, setting AHE_setting) (gm.Matrix, error) {
+func ComputeHankelMatrix(items []*big.Int, u *big.Int, setting AHE_setting) (HankelMatrix, error) {
     H := ComputePlainHankelMatrix(items, u, setting)
-    return EncryptMatrix(H, setting)
+    return EncryptHankelMatrix(H, setting)
 }
 
 // encrypt matrix item-wise
@@ -245,10 +266,19 @@ func CombineMatrixShares(part_mat []gm.Matrix, enc_mat gm.Matrix, setting AHE_se
 }
 
 func SampleSlice(l int, q *big.Int) (a []*big.Int, err error) {
+    return sampleSliceFrom(rand.Reader, l, q)
+}
+
+// SampleSlice using the randomness of setting
+func sampleSlice(setting AHE_setting, l int, q *big.Int) ([]*big.Int, error) {
+    return sampleSliceFrom(randomness(setting), l, q)
+}
+
+func sampleSliceFrom(random io.Reader, l int, q *big.Int) (a []*big.Int, err error) {
     vals := make([]*big.Int, l)
     var r *big.Int
     for i := 0; i < l; i += 1 {
-        r, err = SampleInt(q)
+        r, err = rand.Int(random, q)
         if err != nil {return}
         vals[i] = r
     }
@@ -257,7 +287,16 @@ func SampleSlice(l int, q *big.Int) (a []*big.Int, err error) {
 
 // sample a matrix with size rows x cols, with elements from field defined by q
 func SampleMatrix(rows, cols int, q *big.Int) (a gm.Matrix, err error) {
-    vals_big, err := SampleSlice(rows*cols, q)
+    return sampleMatrixFrom(rand.Reader, rows, cols, q)
+}
+
+// SampleMatrix using the randomness of setting
+func sampleMatrix(setting AHE_setting, rows, cols int, q *big.Int) (gm.Matrix, error) {
+    return sampleMatrixFrom(randomness(setting), rows, cols, q)
+}
+
+func sampleMatrixFrom(random io.Reader, rows, cols int, q *big.Int) (a gm.Matrix, err error) {
+    vals_big, err := sampleSliceFrom(random, rows*cols, q)
     if err != nil {return}
     vals := make([]interface{}, len(vals_big))
     for i, val := range vals_big {
@@ -268,11 +307,11 @@ func SampleMatrix(rows, cols int, q *big.Int) (a gm.Matrix, err error) {
 
 //step 1 of MMult
 func SampleRMatrices(a, b gm.Matrix, setting AHE_setting) (RAi_plain, RAi_enc, RBi_plain, RBi_enc gm.Matrix, err error) {
-    RAi_plain, err = SampleMatrix(a.Rows, a.Cols, setting.AHE_cryptosystem().N())
+    RAi_plain, err = sampleMatrix(setting, a.Rows, a.Cols, setting.AHE_cryptosystem().N())
     if err != nil {return}
     RAi_enc, err = EncryptMatrix(RAi_plain, setting)
     if err != nil {return}
-    RBi_plain, err = SampleMatrix(b.Rows, b.Cols, setting.AHE_cryptosystem().N())
+    RBi_plain, err = sampleMatrix(setting, b.Rows, b.Cols, setting.AHE_cryptosystem().N())
     if err != nil {return}
     RBi_enc, err = EncryptMatrix(RBi_plain, setting)
     if err != nil {return}
@@ -281,6 +320,16 @@ func SampleRMatrices(a, b gm.Matrix, setting AHE_setting) (RAi_plain, RAi_enc, R
 
 // step 3 of MMult
 func GetCti(MA, MB, RA, RAi, RBi gm.Matrix, setting AHE_setting, Secret_key Secret_key) (cti gm.Matrix, MA_part, MB_part gm.Matrix, err error) { //todo: partial
+    cti, err = mmultCti(MA, MB, RA, RAi, RBi)
+    if err != nil {return}
+    MA_part, err = PartialDecryptMatrix(MA, Secret_key)
+    if err != nil {return}
+    MB_part, err = PartialDecryptMatrix(MB, Secret_key)
+    return
+}
+
+// the share RA·RBi - MA·RBi - RAi·MB of step 3 of MMult
+func mmultCti(MA, MB, RA, RAi, RBi gm.Matrix) (cti gm.Matrix, err error) {
     prod1, err := RA.Multiply(RBi)
     if err != nil {
         return
@@ -297,10 +346,7 @@ func GetCti(MA, MB, RA, RAi, RBi gm.Matrix, setting AHE_setting, Secret_key Secr
     if err != nil {
         return
     }
-    cti, err = prod1.Subtract(sum2)
-    MA_part, err = PartialDecryptMatrix(MA, Secret_key)
-    MB_part, err = PartialDecryptMatrix(MB, Secret_key)
-    return
+    return prod1.Subtract(sum2)
 }
 
 // calculates how many instances of MMult is needed to get all H,
@@ -312,14 +358,14 @@ func NbrMMultInstances(m gm.Matrix) int {
 
 // step 3f of CTest-diff
 func SampleHMasks(setting AHE_setting) {
-    SampleMatrix(1, 2*(setting.Threshold()+1), setting.AHE_cryptosystem().N())
+    sampleMatrix(setting, 1, 2*(setting.Threshold()+1), setting.AHE_cryptosystem().N())
 }
 
 //Additive Secret Sharing
 
 //ASS, step 1
 func GetRandomEncrypted(setting AHE_setting) (plain *big.Int, cipher Ciphertext, err error) {
-    plain, err = SampleInt(setting.AHE_cryptosystem().N())
+    plain, err = sampleInt(setting, setting.AHE_cryptosystem().N())
     if err != nil {return}
     cipher, err = setting.AHE_cryptosystem().Encrypt(plain)
     return
@@ -356,200 +402,135 @@ func SumSlice(values []Ciphertext, setting AHE_setting) (sum Ciphertext, err err
 }
 
 // evaluate polynomial p at point x
-func EvalPoly(p gm.Matrix, x, mod *big.Int) *big.Int {
-    val, err := decodeBI(p.At(0,0))
-    if err != nil {panic(err)}
-    sum := new(big.Int).Set(val)
-    x_raised := new(big.Int).Set(x)
-    term := new(big.Int)
-    for i := 1; ; i += 1 {
-        val, err := decodeBI(p.At(0,i))
-        if err != nil {panic(err)}
-        term.Mul(val, x_raised)
-        sum.Add(sum, term)
-        if i >= p.Cols-1 {
-            break
-        }
-        x_raised.Mul(x_raised, x)
+func EvalPoly(p PlainPoly, x, mod *big.Int) *big.Int {
+    sum := new(big.Int)
+    for i := len(p)-1; i >= 0; i -= 1 {
+        sum.Mul(sum, x).Add(sum, p[i]).Mod(sum, mod)
     }
-    return sum.Mod(sum, mod)
+    return sum
 }
 
-// polynomial multiplication
-func MultPoly(p1, p2 gm.Matrix) gm.Matrix {
-    l := p1.Cols + p2.Cols - 1
-    prod := make([]interface{}, l)
-    for i := 0; i < l; i += 1 {
-        prod[i] = big.NewInt(0)
-    }
-    for i := 0; i < p1.Cols; i += 1 {
-        for j := 0; j < p2.Cols; j += 1 {
-            val1, err := decodeBI(p1.At(0,i))
-            if err != nil {panic(err)}
-            val2, err := decodeBI(p2.At(0,j))
-            if err != nil {panic(err)}
-            prod[i+j].(*big.Int).Add(prod[i+j].(*big.Int), new(big.Int).Mul(val1, val2))
-        }
-    }
-    new_poly, err := gm.NewMatrix(1, l, prod, p1.Space)
-    if err != nil {panic(err)}
-    return new_poly
+// polynomial multiplication, see karatsuba
+func MultPoly(p1, p2 PlainPoly) PlainPoly {
+    return karatsuba(p1, p2)
 }
 
-func PolyFromRoots(roots []*big.Int, mod *big.Int) gm.Matrix {
-    n := new(big.Int)
-    n.Set(roots[0]).Neg(n)
-    poly, err := gm.NewMatrix(1,2,[]interface{}{n, big.NewInt(1)}, gm.Bigint{})
-    if err != nil {panic(err)}
-    for i := 1; i < len(roots); i += 1 {
-        n = new(big.Int)
-        n.Set(roots[i]).Neg(n)
-        root, err := gm.NewMatrix(1, 2, []interface{}{n, big.NewInt(1)}, gm.Bigint{})
-        if err != nil {panic(err)}
-        poly = MultPoly(poly, root)
+// monic polynomial with the given roots, with coefficients modulo mod, the root of
+// their subproduct tree
+func PolyFromRoots(roots []*big.Int, mod *big.Int) PlainPoly {
+    if len(roots) == 0 {
+        return PlainPoly{big.NewInt(1)}
     }
-    poly, err = poly.Apply(func(val interface{}) (interface{}, error) {
-        return new(big.Int).Mod(val.(*big.Int), mod), nil
-    })
-    if err != nil {panic(err)}
-    return poly
+    tree := subproductTree(roots, mod)
+    return tree[len(tree)-1][0]
 }
 
 // step 4 of TPSI-diff
-func Interpolation(vs, ps gm.Matrix, setting AHE_setting) gm.Matrix {
+func Interpolation(vs, ps []*big.Int, setting AHE_setting) PlainPoly {
 
     sample_max := setting.Threshold() * 3 + 4
-    space := gm.Bigint{}
+    N := setting.AHE_cryptosystem().N()
     
     // calculate q
-    q_vals := make([]interface{}, vs.Cols)
-    for i := range q_vals {
-        ps_val, err := decodeBI(ps.At(0,i))
-        if err != nil {panic(err)}
-        current_q := new(big.Int).ModInverse(ps_val, setting.AHE_cryptosystem().N())
-        vs_val, err := decodeBI(vs.At(0,i))
-        q_vals[i] = current_q.Mul(current_q, vs_val)
+    q := make([]*big.Int, len(vs))
+    for i := range q {
+        q[i] = new(big.Int).ModInverse(ps[i], N)
+        if q[i] == nil {panic(fmt.Errorf("evaluation %d of root polynomial isn't invertible", i))}
+        q[i].Mul(q[i], vs[i])
     }
-    q, err := gm.NewMatrix(1, vs.Cols, q_vals, space)
-    if err != nil {panic(err)}
-    relations := make([]gm.Matrix, sample_max)
-    x_pow := new(big.Int)
-    coeff := new(big.Int)
+    relations := make([][]*big.Int, sample_max)
     
     coeff_pos := 0
     for ; coeff_pos < sample_max; coeff_pos += 1 {
-        eq, err := gm.NewMatrix(1, sample_max + 1, nil, space)
-        if err != nil {panic(err)}
+        eq := make([]*big.Int, sample_max + 1)
         x := big.NewInt(int64(2*coeff_pos+1))
-        x_pow = big.NewInt(1)
+        x_pow := big.NewInt(1)
         
-        // populate rel_row with full equation
+        // populate eq with full equation
         j := 0
         for ; j <= setting.Threshold() * 2 + 2; j += 1 { // length of V(x)
-            coeff.Set(x_pow).Mod(coeff, setting.AHE_cryptosystem().N())
-            eq.Set(0, j, new(big.Int).Set(coeff))
+            eq[j] = new(big.Int).Mod(x_pow, N)
             x_pow.Mul(x_pow, x)
         }
         x_pow = big.NewInt(1)
         for ; j <= sample_max; j += 1 { // length of p'(x)
-            q_val, err := decodeBI(q.At(0, coeff_pos))
-            if err != nil {panic(err)}
-            coeff.Mul(q_val, x_pow).Neg(coeff).Mod(coeff, setting.AHE_cryptosystem().N())
-            eq.Set(0, j, new(big.Int).Set(coeff))
+            eq[j] = new(big.Int).Mul(q[coeff_pos], x_pow)
+            eq[j].Neg(eq[j]).Mod(eq[j], N)
             x_pow.Mul(x_pow, x)
         }
 
         // substitue previous coefficents
         for prev_coeff := 0; prev_coeff < coeff_pos; prev_coeff += 1 {
-            coeff, err := decodeBI(eq.At(0, prev_coeff))
-            crel, err := relations[prev_coeff].Scale(coeff)
-            if err != nil {panic(err)}
-            eq, err = eq.Add(crel)
-            if err != nil {panic(err)}
-            eq.Set(0, prev_coeff, big.NewInt(0))
-            eq, err = eq.Apply(func(val interface{}) (interface{}, error) {
-                return new(big.Int).Mod(val.(*big.Int), setting.AHE_cryptosystem().N()), nil
-            })
-            if err != nil {panic(err)}
+            coeff := eq[prev_coeff]
+            term := new(big.Int)
+            for k := prev_coeff + 1; k <= sample_max; k += 1 {
+                eq[k].Add(eq[k], term.Mul(relations[prev_coeff][k], coeff)).Mod(eq[k], N)
+            }
+            eq[prev_coeff] = big.NewInt(0)
         }
         
         // if we get 0 = 0, we have all coefficients needed
-        is_zero, err := decodeBI(eq.At(0, coeff_pos))
-        if err != nil {panic(err)}
-        if is_zero.Cmp(big.NewInt(0)) == 0 {
+        if eq[coeff_pos].Sign() == 0 {
             break
         }
         
         // collect current coefficient
-        rel_row, err := gm.NewMatrix(1, sample_max + 1, nil, space)
-        if err != nil {panic(err)}
-        this_coeff, err := decodeBI(eq.At(0, coeff_pos))
-        if err != nil {panic(err)}
-        coeff_inv := new(big.Int).ModInverse(this_coeff, setting.AHE_cryptosystem().N())
+        coeff_inv := new(big.Int).ModInverse(eq[coeff_pos], N)
+        if coeff_inv == nil {panic(fmt.Errorf("coefficient %d isn't invertible", coeff_pos))}
+        rel_row := make([]*big.Int, sample_max + 1)
         rem_coeff := 0
         for ; rem_coeff < coeff_pos + 1; rem_coeff += 1 {
-            rel_row.Set(0, rem_coeff, new(big.Int).SetInt64(0))
+            rel_row[rem_coeff] = big.NewInt(0)
         }
         for ; rem_coeff < sample_max + 1; rem_coeff += 1 {
-            rem, err := decodeBI(eq.At(0, rem_coeff))
-            if err != nil {panic(err)}
-            rel := new(big.Int).Neg(rem)
-            rel.Mul(rel, coeff_inv).Mod(rel, setting.AHE_cryptosystem().N())
-            rel_row.Set(0, rem_coeff, rel)
+            rel := new(big.Int).Neg(eq[rem_coeff])
+            rel_row[rem_coeff] = rel.Mul(rel, coeff_inv).Mod(rel, N)
         }
         
         relations[coeff_pos] = rel_row
     }
 
-    interpolated_coeffs := make([]interface{}, sample_max + 1)
+    interpolated_coeffs := make(PlainPoly, coeff_pos + 1)
     interpolated_coeffs[coeff_pos] = big.NewInt(1)
 
     // solve all coefficients from relations
     for solving_coeff := coeff_pos - 1; solving_coeff >= 0; solving_coeff -= 1 {
         coeff := big.NewInt(0)
         for known_coeff := solving_coeff + 1; known_coeff <= coeff_pos; known_coeff += 1 {
-            rel_s, err := decodeBI(relations[solving_coeff].At(0, known_coeff))
-            if err != nil {panic(err)}
-            coeff.Add(coeff, new(big.Int).Mul(rel_s, interpolated_coeffs[known_coeff].(*big.Int))).Mod(coeff, setting.AHE_cryptosystem().N())
+            coeff.Add(coeff, new(big.Int).Mul(relations[solving_coeff][known_coeff], interpolated_coeffs[known_coeff])).Mod(coeff, N)
         }
         interpolated_coeffs[solving_coeff] = coeff
     }
 
-    den := interpolated_coeffs[setting.Threshold() * 2 + 3:coeff_pos + 1]
-    int_poly, err := gm.NewMatrix(1, len(den), den, space) 
-    return int_poly
+    // the denominator
+    return interpolated_coeffs[setting.Threshold() * 2 + 3:]
 }
 
-func IsRoot(poly gm.Matrix, x *big.Int, mod *big.Int) bool {
-    return EvalPoly(poly, x, mod).Cmp(big.NewInt(0)) == 0
+func IsRoot(poly PlainPoly, x *big.Int, mod *big.Int) bool {
+    return EvalPoly(poly, x, mod).Sign() == 0
 }
 
-func RootMask(root_poly gm.Matrix, setting AHE_setting) (gm.Matrix) {
-    r, err := SampleInt(setting.AHE_cryptosystem().N())
+func RootMask(root_poly PlainPoly, setting AHE_setting) PlainPoly {
+    r, err := sampleInt(setting, setting.AHE_cryptosystem().N())
     if err != nil {panic(err)}
-    random_root, err := gm.NewMatrix(1, 2, []interface{}{r, big.NewInt(1)}, root_poly.Space)
-    if err != nil {panic(err)}
-    root_poly = MultPoly(root_poly, random_root)
-    return root_poly
+    return MultPoly(root_poly, PlainPoly{r, big.NewInt(1)})
 }
 
-func EvalIntPolys(root_poly gm.Matrix, sample_max int, setting AHE_setting) (R_values_enc, R_tilde_values, p_values gm.Matrix) {
-    R, err := SampleMatrix(1, setting.Threshold()+1, setting.AHE_cryptosystem().N())
-    if err != nil {panic(err)}
-    R_tilde, err := SampleMatrix(1, setting.Threshold()+1, setting.AHE_cryptosystem().N())
-    if err != nil {panic(err)}
-    R_values, err := gm.NewMatrix(1, sample_max, nil, gm.Bigint{})
-    if err != nil {panic(err)}
-    R_tilde_values, err = gm.NewMatrix(1, sample_max, nil, gm.Bigint{})
+func EvalIntPolys(root_poly PlainPoly, sample_max int, setting AHE_setting) (R_values_enc, R_tilde_values, p_values gm.Matrix) {
+    R_values_enc, R_tilde_values = SampleIntMasks(sample_max, setting)
+    p_values = PlainPoly(MultiEvalPoly(root_poly, oddPoints(sample_max), setting.AHE_cryptosystem().N())).Matrix()
+    return
+}
+
+// evaluations of the random polynomials R and R_tilde at the points of EvalIntPolys, R encrypted
+func SampleIntMasks(sample_max int, setting AHE_setting) (R_values_enc, R_tilde_values gm.Matrix) {
+    R, err := sampleSlice(setting, setting.Threshold()+1, setting.AHE_cryptosystem().N())
     if err != nil {panic(err)}
-    p_values, err = gm.NewMatrix(1, sample_max, nil, gm.Bigint{})
+    R_tilde, err := sampleSlice(setting, setting.Threshold()+1, setting.AHE_cryptosystem().N())
     if err != nil {panic(err)}
-    for i := 0; i < sample_max; i += 1 {
-        x := big.NewInt(int64(i*2+1))
-        R_values.Set(0, i, EvalPoly(R, x, setting.AHE_cryptosystem().N()))
-        R_tilde_values.Set(0, i, EvalPoly(R_tilde, x, setting.AHE_cryptosystem().N()))
-        p_values.Set(0, i, EvalPoly(root_poly, x, setting.AHE_cryptosystem().N()))
-    }
+    points := oddPoints(sample_max)
+    R_values := PlainPoly(MultiEvalPoly(R, points, setting.AHE_cryptosystem().N())).Matrix()
+    R_tilde_values = PlainPoly(MultiEvalPoly(R_tilde, points, setting.AHE_cryptosystem().N())).Matrix()
     R_values_enc, err = EncryptMatrix(R_values, setting)
     if err != nil {panic(err)}
     return
@@ -257,8 +257,7 @@ func TestMPC(t *testing.T) {
 }
 
 func TestEvalPoly(t *testing.T) {
-    p, err := gm.NewMatrixFromInt(1, 3, []int{2,4,3})
-    if err != nil {t.Error(err)}
+    p := PlainPoly(bigIntSlice([]int64{2,4,3}))
     x := bigIntSlice([]int64{0,1,2})
     y := bigIntSlice([]int64{2,9,0})
     mod := big.NewInt(11)
@@ -271,18 +270,15 @@ func TestEvalPoly(t *testing.T) {
 }
 
 func TestPolyMult(t *testing.T) {
-    a, err := gm.NewMatrixFromInt(1, 3, []int{3,2,1})
-    if err != nil {t.Error(err)}
-    b, err := gm.NewMatrixFromInt(1, 3, []int{2,4,1})
-    if err != nil {t.Error(err)}
+    a := PlainPoly(bigIntSlice([]int64{3,2,1}))
+    b := PlainPoly(bigIntSlice([]int64{2,4,1}))
     ab_corr := []int64{6,16,13,6,1}
     ab := MultPoly(a, b)
-    if ab.Cols != len(ab_corr) {
-        t.Errorf("length mismatch: expected %d, got %d", len(ab_corr), ab.Cols)
+    if len(ab) != len(ab_corr) {
+        t.Fatalf("length mismatch: expected %d, got %d", len(ab_corr), len(ab))
     }
     for i := 0; i < len(ab_corr); i += 1 {
-        ab_val, err := decodeBI(ab.At(0,i))
-        if err != nil {t.Error(err)}
+        ab_val := ab[i]
         if new(big.Int).SetInt64(ab_corr[i]).Cmp(ab_val) != 0 {
             t.Errorf("error at %d: expected %d, got %d", i, ab_corr[i], ab_val)
         }
@@ -294,23 +290,37 @@ func TestPolyFromRoots(t *testing.T) {
     poly := bigIntSlice([]int64{2,8,1})
     mod := big.NewInt(11)
     rpol := PolyFromRoots(roots, mod)
-    if len(poly) != rpol.Cols {
-        t.Errorf("length mismatch: expected %d, got %d", len(poly), rpol.Cols)
+    if len(poly) != len(rpol) {
+        t.Fatalf("length mismatch: expected %d, got %d", len(poly), len(rpol))
     }
     for i := 0; i < len(poly); i += 1 {
-        rpol_val, err := decodeBI(rpol.At(0,i))
-        if err != nil {t.Error(err)}
+        rpol_val := rpol[i]
         if poly[i].Cmp(rpol_val) != 0 {
             t.Errorf("error at %d: expected %d, got %d", i, poly[i], rpol_val)
         }
     }
 }
 
+func TestDeduplicate(t *testing.T) {
+    items := bigIntSlice([]int64{4, 2, 4, 8, 2, 2})
+    expected := bigIntSlice([]int64{4, 2, 8})
+    dedup := Deduplicate(items)
+    if len(dedup) != len(expected) {
+        t.Fatalf("length mismatch: expected %d, got %d", len(expected), len(dedup))
+    }
+    for i := range expected {
+        if dedup[i].Cmp(expected[i]) != 0 {
+            t.Errorf("error at %d: expected %d, got %d", i, expected[i], dedup[i])
+        }
+    }
+    if dedup[0] != items[0] || dedup[2] != items[3] {
+        t.Error("first occurrences not kept")
+    }
+}
+
 func TestInterpolation(t *testing.T) {
-    vs, err := gm.NewMatrixFromInt(1, 7, []int{19, 6, 7, 12, 4, 5, 7})//, 18, 16, 18}))
-    if err != nil {t.Error(err)}
-    ps, err := gm.NewMatrixFromInt(1, 7, []int{22, 21, 5, 20, 20, 5, 21})//, 22, 8, 2}))
-    if err != nil {t.Error(err)}
+    vs := bigIntSlice([]int64{19, 6, 7, 12, 4, 5, 7})//, 18, 16, 18}))
+    ps := bigIntSlice([]int64{22, 21, 5, 20, 20, 5, 21})//, 22, 8, 2}))
     // v_corr := []*big.Int{21,6,12,2,1}
     p_corr := []int64{14,7,1}
     var setting AHESetting
@@ -319,12 +329,11 @@ func TestInterpolation(t *testing.T) {
     setting.cs = pk
     setting.T = 1
     p := Interpolation(vs, ps, setting)
-    if len(p_corr) != p.Cols {
-        t.Errorf("wrong degree on interpolated polynomial; expected %d, got %d", len(p_corr), p.Cols)
+    if len(p_corr) != len(p) {
+        t.Errorf("wrong degree on interpolated polynomial; expected %d, got %d", len(p_corr), len(p))
     } else {
         for i, p_coeff := range p_corr {
-            p_val, err := decodeBI(p.At(0,i))
-            if err != nil {t.Error(err)}
+            p_val := p[i]
             if new(big.Int).SetInt64(p_coeff).Cmp(p_val) != 0 {
                 t.Errorf("expected %d, got %d", p_coeff, p_val)
             }
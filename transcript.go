@@ -0,0 +1,365 @@
+package tpsi
+
+import (
+    "bytes"
+    "crypto/aes"
+    "crypto/cipher"
+    "crypto/rand"
+    "encoding/gob"
+    "fmt"
+    "io"
+    "sync"
+)
+
+// directions of transcript entries
+const (
+    TranscriptSend = "send"
+    TranscriptSendTo = "send-to"
+    TranscriptDistribute = "distribute"
+    TranscriptReceive = "receive"
+    TranscriptReceiveAll = "receive-all"
+)
+
+// setting parameters, first value of a transcript
+type TranscriptHeader struct {
+    Parties int
+    Threshold int
+    Central bool
+    Seed []byte // seed of the party's randomness, nil if the cryptosystem isn't a RandomizedCryptosystem
+    OutputRestricted bool // output delivery restricted by an OutputPolicy
+    ReceivesOutput bool // the party receives output if delivery is restricted
+}
+
+// one message sent or received by the recording party
+type TranscriptEntry struct {
+    Direction string
+    Round int // position of the entry in the transcript
+    Peer int // outer party position for send-to, otherwise -1
+    Type string // Go type of the payload
+    Payloads [][]byte // serialized by EncodeMessage, one per party for receive-all
+}
+
+func (e TranscriptEntry) String() string {
+    size := 0
+    for _, p := range e.Payloads {
+        size += len(p)
+    }
+    if e.Peer >= 0 {
+        return fmt.Sprintf("%d %s(%d) %s, %d bytes", e.Round, e.Direction, e.Peer, e.Type, size)
+    }
+    return fmt.Sprintf("%d %s %s, %d bytes", e.Round, e.Direction, e.Type, size)
+}
+
+// a recorded transcript of one party
+type Transcript struct {
+    TranscriptHeader
+    Entries []TranscriptEntry
+}
+
+// read a transcript written by a RecordingSetting
+func ReadTranscript(r io.Reader) (transcript Transcript, err error) {
+    dec := gob.NewDecoder(r)
+    err = dec.Decode(&transcript.TranscriptHeader)
+    if err != nil {return}
+    for {
+        var entry TranscriptEntry
+        err = dec.Decode(&entry)
+        if err == io.EOF {
+            return transcript, nil
+        } else if err != nil {
+            return
+        }
+        transcript.Entries = append(transcript.Entries, entry)
+    }
+}
+
+// deterministic source of randomness expanding a seed with AES-CTR,
+// safe for concurrent use
+type seededReader struct {
+    mu *sync.Mutex
+    stream cipher.Stream
+}
+
+func newSeededReader(seed []byte) seededReader {
+    block, err := aes.NewCipher(seed)
+    if err != nil {panic(err)}
+    return seededReader{new(sync.Mutex), cipher.NewCTR(block, make([]byte, aes.BlockSize))}
+}
+
+func (r seededReader) Read(p []byte) (int, error) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    for i := range p {
+        p[i] = 0
+    }
+    r.stream.XORKeyStream(p, p)
+    return len(p), nil
+}
+
+// setting decorator writing every message sent or received to a transcript.
+// If the cryptosystem is a RandomizedCryptosystem the party's randomness is
+// expanded from a seed stored in the transcript, so that a replay sends the
+// same messages. The seed reveals all masks of the party, so the transcript
+// must be kept as secret as its input. Received messages are passed to the
+// worker as decoded from the transcript, exactly as in a replay.
+type RecordingSetting struct {
+    AHE_setting
+    cs AHE_Cryptosystem
+    enc *gob.Encoder
+    mu *sync.Mutex // guards round and enc
+    round *int
+}
+
+// record all messages of setting to w
+func NewRecordingSetting(setting AHE_setting, w io.Writer) RecordingSetting {
+    header := TranscriptHeader{Parties: setting.Parties(), Threshold: setting.Threshold(), Central: setting.IsCentral()}
+    if policy, ok := outputPolicy(setting); ok {
+        header.OutputRestricted = true
+        header.ReceivesOutput = policy.ReceivesOutput()
+    }
+    cs := setting.AHE_cryptosystem()
+    if randomized, ok := cs.(RandomizedCryptosystem); ok {
+        header.Seed = make([]byte, 32)
+        _, err := io.ReadFull(rand.Reader, header.Seed)
+        if err != nil {panic(err)}
+        cs = randomized.WithRandomness(newSeededReader(header.Seed))
+    }
+    enc := gob.NewEncoder(w)
+    err := enc.Encode(header)
+    if err != nil {panic(err)}
+    return RecordingSetting{setting, cs, enc, new(sync.Mutex), new(int)}
+}
+
+func (s RecordingSetting) AHE_cryptosystem() AHE_Cryptosystem {
+    return s.cs
+}
+
+func (s RecordingSetting) Unwrap() AHE_setting {
+    return s.AHE_setting
+}
+
+func (s RecordingSetting) record(direction string, peer int, anys ...interface{}) TranscriptEntry {
+    entry := TranscriptEntry{Direction: direction, Peer: peer}
+    if len(anys) > 0 {
+        entry.Type = fmt.Sprintf("%T", anys[0])
+    }
+    for _, any := range anys {
+        payload, err := EncodeMessage(any)
+        if err != nil {panic(err)}
+        entry.Payloads = append(entry.Payloads, payload)
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    entry.Round = *s.round
+    *s.round += 1
+    err := s.enc.Encode(entry)
+    if err != nil {panic(err)}
+    return entry
+}
+
+func (s RecordingSetting) decode(payload []byte) interface{} {
+    msg, err := DecodeMessage(payload, s.cs)
+    if err != nil {panic(err)}
+    return msg
+}
+
+func (s RecordingSetting) Distribute(any interface{}) {
+    s.record(TranscriptDistribute, -1, any)
+    s.AHE_setting.Distribute(any)
+}
+
+func (s RecordingSetting) Send(any interface{}) {
+    s.record(TranscriptSend, -1, any)
+    s.AHE_setting.Send(any)
+}
+
+func (s RecordingSetting) SendTo(i int, any interface{}) {
+    s.record(TranscriptSendTo, i, any)
+    s.AHE_setting.SendTo(i, any)
+}
+
+func (s RecordingSetting) ReceiveAll() []interface{} {
+    entry := s.record(TranscriptReceiveAll, -1, s.AHE_setting.ReceiveAll()...)
+    msgs := make([]interface{}, len(entry.Payloads))
+    for i, payload := range entry.Payloads {
+        msgs[i] = s.decode(payload)
+    }
+    return msgs
+}
+
+func (s RecordingSetting) Receive() interface{} {
+    entry := s.record(TranscriptReceive, -1, s.AHE_setting.Receive())
+    return s.decode(entry.Payloads[0])
+}
+
+// FHE setting decorator writing every message to a transcript, see RecordingSetting
+type RecordingFHESetting struct {
+    RecordingSetting
+    setting FHE_setting
+}
+
+// record all messages of setting to w
+func NewRecordingFHESetting(setting FHE_setting, w io.Writer) RecordingFHESetting {
+    return RecordingFHESetting{NewRecordingSetting(setting, w), setting}
+}
+
+func (s RecordingFHESetting) FHE_cryptosystem() FHE_Cryptosystem {
+    return s.setting.FHE_cryptosystem()
+}
+
+// the replayed worker did not behave as recorded
+type TranscriptDivergence struct {
+    Round int
+    Expected string
+    Got string
+}
+
+func (e TranscriptDivergence) Error() string {
+    return fmt.Sprintf("transcript diverged at round %d: expected %s, got %s", e.Round, e.Expected, e.Got)
+}
+
+// setting driven by a recorded transcript: received messages are taken from
+// the transcript and sent messages are checked byte for byte against it, with
+// both serialized by the replaying process
+type ReplaySetting struct {
+    transcript Transcript
+    cs AHE_Cryptosystem
+    mu *sync.Mutex // guards round
+    round *int
+}
+
+// replay transcript, decoding payloads using cs. If the transcript has a seed,
+// cs takes its randomness from it as in the recording.
+func NewReplaySetting(transcript Transcript, cs AHE_Cryptosystem) ReplaySetting {
+    if randomized, ok := cs.(RandomizedCryptosystem); ok && transcript.Seed != nil {
+        cs = randomized.WithRandomness(newSeededReader(transcript.Seed))
+    }
+    return ReplaySetting{transcript, cs, new(sync.Mutex), new(int)}
+}
+
+// number of entries not yet replayed
+func (s ReplaySetting) Remaining() int {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return len(s.transcript.Entries) - *s.round
+}
+
+// take next entry, which must have the given direction and, if any is
+// sent, the same serialized payload
+func (s ReplaySetting) next(direction string, peer int, any interface{}) TranscriptEntry {
+    got := direction
+    var payload []byte
+    if any != nil {
+        got = fmt.Sprintf("%s %T", direction, any)
+        var err error
+        payload, err = EncodeMessage(any)
+        if err != nil {panic(err)}
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if *s.round >= len(s.transcript.Entries) {
+        panic(TranscriptDivergence{*s.round, "end of transcript", got})
+    }
+    entry := s.transcript.Entries[*s.round]
+    expected := entry.Direction
+    if any != nil {
+        expected = fmt.Sprintf("%s %s", entry.Direction, entry.Type)
+    }
+    if expected != got || entry.Peer != peer {
+        panic(TranscriptDivergence{*s.round, entry.String(), got})
+    }
+    if any != nil && !bytes.Equal(s.reencode(entry.Payloads[0]), payload) {
+        panic(TranscriptDivergence{*s.round, entry.String(), fmt.Sprintf("%s with different payload of %d bytes", got, len(payload))})
+    }
+    *s.round += 1
+    return entry
+}
+
+// recorded payload serialized again by this process, since gob numbers the
+// types in the order a process first encodes them, so the bytes written by
+// another process differ even for the same message
+func (s ReplaySetting) reencode(payload []byte) []byte {
+    data, err := EncodeMessage(s.decode(payload))
+    if err != nil {panic(err)}
+    return data
+}
+
+func (s ReplaySetting) decode(payload []byte) interface{} {
+    msg, err := DecodeMessage(payload, s.cs)
+    if err != nil {panic(err)}
+    return msg
+}
+
+func (s ReplaySetting) Threshold() int {
+    return s.transcript.Threshold
+}
+
+func (s ReplaySetting) Parties() int {
+    return s.transcript.Parties
+}
+
+func (s ReplaySetting) AHE_cryptosystem() AHE_Cryptosystem {
+    return s.cs
+}
+
+func (s ReplaySetting) Distribute(any interface{}) {
+    s.next(TranscriptDistribute, -1, any)
+}
+
+func (s ReplaySetting) Send(any interface{}) {
+    s.next(TranscriptSend, -1, any)
+}
+
+func (s ReplaySetting) SendTo(i int, any interface{}) {
+    s.next(TranscriptSendTo, i, any)
+}
+
+func (s ReplaySetting) ReceiveAll() []interface{} {
+    entry := s.next(TranscriptReceiveAll, -1, nil)
+    msgs := make([]interface{}, len(entry.Payloads))
+    for i, payload := range entry.Payloads {
+        msgs[i] = s.decode(payload)
+    }
+    return msgs
+}
+
+func (s ReplaySetting) Receive() interface{} {
+    entry := s.next(TranscriptReceive, -1, nil)
+    return s.decode(entry.Payloads[0])
+}
+
+func (s ReplaySetting) IsCentral() bool {
+    return s.transcript.Central
+}
+
+// re-drive a single party's worker from its recorded transcript. An error is
+// returned at the first message the worker sends or expects differently from
+// the transcript. If output delivery was restricted in the recording, the
+// worker's setting has the recorded OutputPolicy. Replays of both central and outer parties are deterministic
+// if the transcript has a seed and the worker's inputs are the recorded ones.
+// Encrypted matrix inputs must be in the evaluation space of the recording
+// setting's cryptosystem, since their operations rerandomize with it. Workers
+// running concurrent substreams draw randomness in no fixed order and can't be
+// replayed, RecordingSetting doesn't offer substreams for this reason.
+func ReplayWorker(transcript Transcript, cs AHE_Cryptosystem, worker func(AHE_setting)) (err error) {
+    setting := NewReplaySetting(transcript, cs)
+    defer func() {
+        if r := recover(); r != nil {
+            divergence, ok := r.(TranscriptDivergence)
+            if !ok {
+                panic(r)
+            }
+            err = divergence
+        }
+    }()
+    if transcript.OutputRestricted {
+        worker(OutputRestrictedSetting{setting, transcript.ReceivesOutput})
+    } else {
+        worker(setting)
+    }
+    if setting.Remaining() > 0 {
+        entry := transcript.Entries[len(transcript.Entries)-setting.Remaining()]
+        return TranscriptDivergence{entry.Round, entry.String(), "end of worker"}
+    }
+    return nil
+}
@@ -0,0 +1,162 @@
+package tpsi
+
+import (
+    "testing"
+    "math/big"
+    "bytes"
+    gm "github.com/ontanj/generic-matrix"
+)
+
+func TestTranscriptReplay(t *testing.T) {
+    n := 3
+    pk, sksdj, err := NewDJCryptosystem(n)
+    if err != nil {t.Fatal(err)}
+    sks := ConvertDJSKSlice(sksdj)
+    settings := createAHESettings(n, 0, pk)
+
+    divid, err := gm.NewMatrixFromInt(1, 5, []int{3, 6, 5, 2, 0})
+    if err != nil {t.Fatal(err)}
+    divis, err := gm.NewMatrixFromInt(1, 4, []int{1, 3, 2, 0})
+    if err != nil {t.Fatal(err)}
+    divid_enc := t_encryptVector(t, divid, settings[0])
+    divis_enc := t_encryptVector(t, divis, settings[0])
+    one, err := pk.Encrypt(big.NewInt(1))
+    if err != nil {t.Fatal(err)}
+
+    // record outer party 0 and the central party
+    var outer_file, central_file bytes.Buffer
+    recorded := map[int]RecordingSetting{
+        0: NewRecordingSetting(settings[0], &outer_file),
+        n-1: NewRecordingSetting(settings[n-1], &central_file),
+    }
+    returns := make(chan CipherVector, 2*n)
+    for i := 0; i < n; i += 1 {
+        go func(i int) {
+            var setting AHE_setting = settings[i]
+            if r, ok := recorded[i]; ok {
+                setting = r
+            }
+            _, _, rn, _ := PolynomialDivisionWorker(divid_enc, divis_enc, one, one, sks[i], setting)
+            if i == 0 {
+                returns <- rn
+            }
+        }(i)
+    }
+    rn := <-returns
+
+    transcript, err := ReadTranscript(&outer_file)
+    if err != nil {t.Fatal(err)}
+    if transcript.Parties != n || transcript.Central || len(transcript.Entries) == 0 || len(transcript.Seed) == 0 {
+        t.Fatalf("unexpected transcript header %v with %d entries", transcript.TranscriptHeader, len(transcript.Entries))
+    }
+    central_transcript, err := ReadTranscript(&central_file)
+    if err != nil {t.Fatal(err)}
+    if !central_transcript.Central {
+        t.Fatal("central transcript not marked central")
+    }
+
+    t.Run("reproduce", func(t *testing.T) {
+        var replayed CipherVector
+        err := ReplayWorker(transcript, pk, func(setting AHE_setting) {
+            _, _, replayed, _ = PolynomialDivisionWorker(divid_enc, divis_enc, one, one, sks[0], setting)
+        })
+        if err != nil {t.Fatal(err)}
+        if len(replayed) != len(rn) {
+            t.Fatalf("replayed remainder has %d coefficients, recorded %d", len(replayed), len(rn))
+        }
+        for i := range rn {
+            if rn[i].(*big.Int).Cmp(replayed[i].(*big.Int)) != 0 {
+                t.Errorf("replayed remainder differs at %d", i)
+            }
+        }
+    })
+
+    t.Run("reproduce central", func(t *testing.T) {
+        err := ReplayWorker(central_transcript, pk, func(setting AHE_setting) {
+            PolynomialDivisionWorker(divid_enc, divis_enc, one, one, sks[n-1], setting)
+        })
+        if err != nil {t.Fatal(err)}
+    })
+
+    t.Run("diverge", func(t *testing.T) {
+        err := ReplayWorker(transcript, pk, func(setting AHE_setting) {
+            OuterDecryptionWorker(one, sks[0], setting)
+        })
+        if _, ok := err.(TranscriptDivergence); !ok {
+            t.Errorf("expected divergence, got %v", err)
+        }
+    })
+
+    t.Run("diverge payload", func(t *testing.T) {
+        // the wrong key share sends other partial decryptions, same type and direction
+        err := ReplayWorker(transcript, pk, func(setting AHE_setting) {
+            PolynomialDivisionWorker(divid_enc, divis_enc, one, one, sks[1], setting)
+        })
+        divergence, ok := err.(TranscriptDivergence)
+        if !ok {
+            t.Fatalf("expected divergence, got %v", err)
+        }
+        entry := transcript.Entries[divergence.Round]
+        if entry.Direction != TranscriptSend {
+            t.Errorf("expected divergence at a sent message, got %s", entry)
+        }
+        for _, e := range transcript.Entries[:divergence.Round] {
+            if e.Direction == TranscriptSend && e.Type == entry.Type {
+                t.Errorf("divergence at round %d, not at the first partial decryption in round %d", divergence.Round, e.Round)
+                break
+            }
+        }
+    })
+}
+
+func TestTranscriptRestrictedOutput(t *testing.T) {
+    n := 3
+    pk, sksdj, err := NewDJCryptosystem(n)
+    if err != nil {t.Fatal(err)}
+    sks := ConvertDJSKSlice(sksdj)
+    plain, err := gm.NewMatrixFromInt(1, 2, []int{5, 7})
+    if err != nil {t.Fatal(err)}
+    settings := RestrictOutputAHE(createAHESettings(n, 0, pk), []int{1})
+    cipher, err := EncryptMatrix(plain, settings[0])
+    if err != nil {t.Fatal(err)}
+
+    // record outer party 0 and the central party, neither receives output
+    var outer_file, central_file bytes.Buffer
+    outer := NewRecordingSetting(settings[0], &outer_file)
+    central := NewRecordingSetting(settings[n-1], &central_file)
+    received := make(chan bool, n)
+    go func() {
+        _, ok := CentralOutputDecryptionWorker(cipher, sks[n-1], central)
+        received <- ok
+    }()
+    go func() {
+        _, ok := OuterOutputDecryptionWorker(1, 2, sks[0], outer)
+        received <- ok
+    }()
+    go func() {
+        OuterOutputDecryptionWorker(1, 2, sks[1], settings[1])
+    }()
+    for i := 0; i < 2; i += 1 {
+        if <-received {
+            t.Error("recorded party without output received it")
+        }
+    }
+
+    transcript, err := ReadTranscript(&outer_file)
+    if err != nil {t.Fatal(err)}
+    if !transcript.OutputRestricted || transcript.ReceivesOutput {
+        t.Fatalf("unexpected output policy in transcript header %v", transcript.TranscriptHeader)
+    }
+    err = ReplayWorker(transcript, pk, func(setting AHE_setting) {
+        if _, ok := OuterOutputDecryptionWorker(1, 2, sks[0], setting); ok {
+            t.Error("replayed party without output received it")
+        }
+    })
+    if err != nil {t.Error(err)}
+    central_transcript, err := ReadTranscript(&central_file)
+    if err != nil {t.Fatal(err)}
+    err = ReplayWorker(central_transcript, pk, func(setting AHE_setting) {
+        CentralOutputDecryptionWorker(cipher, sks[n-1], setting)
+    })
+    if err != nil {t.Error(err)}
+}
@@ -0,0 +1,177 @@
+package tpsi
+
+import (
+    "fmt"
+    "math/big"
+)
+
+// an input rejected by local validation
+type InputError struct {
+    Element *big.Int // offending element, nil if the threshold is rejected
+    Reason string
+}
+
+func (e InputError) Error() string {
+    if e.Element == nil {
+        return fmt.Sprintf("invalid input: %s", e.Reason)
+    }
+    return fmt.Sprintf("invalid element %d: %s", e.Element, e.Reason)
+}
+
+// the parties disagree on the parameters, or the input of another party is invalid
+type AgreementError struct {
+    Reason string
+}
+
+func (e AgreementError) Error() string {
+    return fmt.Sprintf("parties disagree: %s", e.Reason)
+}
+
+// checks elements and threshold, where the threshold must be smaller than max_threshold
+func validateInput(items []*big.Int, setting AHE_setting, max_threshold int) error {
+    T := setting.Threshold()
+    if T < 0 {
+        return InputError{nil, fmt.Sprintf("negative threshold %d", T)}
+    }
+    if T >= max_threshold {
+        return InputError{nil, fmt.Sprintf("threshold %d is not smaller than %d", T, max_threshold)}
+    }
+    N := setting.AHE_cryptosystem().N()
+    last_point := big.NewInt(int64(2*(3*T+4) - 1)) // largest evaluation point 2i+1 of EvalIntPolys
+    for _, item := range items {
+        if item.Sign() < 0 {
+            return InputError{item, "negative"}
+        }
+        if item.Cmp(N) >= 0 {
+            return InputError{item, fmt.Sprintf("not smaller than the plaintext modulus %d", N)}
+        }
+        if item.Bit(0) == 1 && item.Cmp(last_point) <= 0 {
+            return InputError{item, "equal to an evaluation point, use EncodeElements"}
+        }
+    }
+    return nil
+}
+
+// local validation of the input to TPSIdiffWorker: elements must be non-negative,
+// smaller than N() of the cryptosystem and not equal to an odd evaluation point,
+// and the threshold must be smaller than the number of elements of all parties
+func ValidateDiffInput(items []*big.Int, setting AHE_setting) error {
+    return validateInput(items, setting, setting.Parties()*len(items))
+}
+
+// local validation of the input to TPSIintWorker, see ValidateDiffInput.
+// The threshold must be smaller than the number of elements.
+func ValidateIntInput(items []*big.Int, setting AHE_setting) error {
+    return validateInput(items, setting, len(items))
+}
+
+// sent by every party in the collective input check
+type inputSummary struct {
+    Parties int
+    Threshold int
+    Modulus *big.Int
+    Valid bool
+    Size int // number of elements, reported by workers depending on the set sizes, otherwise 0
+}
+
+// sent by central party with the outcome of the collective input check, no reason if all agree
+type inputVerdict struct {
+    Reason string
+    MaxSize int // largest set of all parties
+}
+
+func summarize(local error, size int, setting AHE_setting) inputSummary {
+    return inputSummary{setting.Parties(), setting.Threshold(), setting.AHE_cryptosystem().N(), local == nil, size}
+}
+
+// collective check run before any crypto: every party reports its parameters and
+// whether its input passed local validation, without revealing the input itself.
+// local is the result of local validation. Returns local if it is an error, or an
+// AgreementError if the parties disagree on threshold, party count or modulus or
+// if the input of another party is invalid. Either all parties or none get an error.
+func CentralInputCheckWorker(local error, setting AHE_setting) error {
+    _, err := centralSizedInputCheck(local, 0, setting)
+    return err
+}
+
+// CentralInputCheckWorker where every party also reports the size of its set,
+// returns the size of the largest set
+func centralSizedInputCheck(local error, size int, setting AHE_setting) (int, error) {
+    own := summarize(local, size, setting)
+    summaries := setting.ReceiveAll()
+
+    verdict := inputVerdict{MaxSize: size}
+    for i, any := range summaries {
+        summary := any.(inputSummary)
+        if summary.Size > verdict.MaxSize {
+            verdict.MaxSize = summary.Size
+        }
+        if summary.Parties != own.Parties {
+            verdict.Reason = fmt.Sprintf("outer party %d has %d parties, expected %d", i, summary.Parties, own.Parties)
+        } else if summary.Threshold != own.Threshold {
+            verdict.Reason = fmt.Sprintf("outer party %d has threshold %d, expected %d", i, summary.Threshold, own.Threshold)
+        } else if summary.Modulus.Cmp(own.Modulus) != 0 {
+            verdict.Reason = fmt.Sprintf("outer party %d uses another plaintext modulus", i)
+        } else if !summary.Valid {
+            verdict.Reason = fmt.Sprintf("input of outer party %d is invalid", i)
+        } else {
+            continue
+        }
+        break
+    }
+    if verdict.Reason == "" && !own.Valid {
+        verdict.Reason = "input of central party is invalid"
+    }
+    setting.Distribute(verdict)
+    return verdict.MaxSize, verdict.err(local)
+}
+
+// see CentralInputCheckWorker
+func OuterInputCheckWorker(local error, setting AHE_setting) error {
+    _, err := outerSizedInputCheck(local, 0, setting)
+    return err
+}
+
+// see centralSizedInputCheck
+func outerSizedInputCheck(local error, size int, setting AHE_setting) (int, error) {
+    setting.Send(summarize(local, size, setting))
+    verdict := (setting.Receive()).(inputVerdict)
+    return verdict.MaxSize, verdict.err(local)
+}
+
+// error of the check for a party with local validation result local
+func (verdict inputVerdict) err(local error) error {
+    if local != nil {
+        return local
+    }
+    if verdict.Reason != "" {
+        return AgreementError{verdict.Reason}
+    }
+    return nil
+}
+
+// runs the collective input check and panics if it fails
+func checkInput(local error, setting AHE_setting) {
+    if err := inputCheckWorker(local, setting); err != nil {panic(err)}
+}
+
+func inputCheckWorker(local error, setting AHE_setting) error {
+    if setting.IsCentral() {
+        return CentralInputCheckWorker(local, setting)
+    }
+    return OuterInputCheckWorker(local, setting)
+}
+
+// runs the collective input check, where every party reports the size of its
+// set, and returns the size of the largest set. Panics if the check fails.
+func checkSizedInput(local error, size int, setting AHE_setting) int {
+    var max_size int
+    var err error
+    if setting.IsCentral() {
+        max_size, err = centralSizedInputCheck(local, size, setting)
+    } else {
+        max_size, err = outerSizedInputCheck(local, size, setting)
+    }
+    if err != nil {panic(err)}
+    return max_size
+}
@@ -0,0 +1,109 @@
+package tpsi
+
+import (
+    "testing"
+    "math/big"
+)
+
+func TestValidateInput(t *testing.T) {
+    n := 3
+    pk, _, err := NewDJCryptosystem(n)
+    if err != nil {t.Fatal(err)}
+    settings := createAHESettings(n, 2, pk)
+
+    valid := bigIntSlice([]int64{2,4,6,8})
+    if err := ValidateDiffInput(valid, settings[0]); err != nil {
+        t.Errorf("valid input rejected: %v", err)
+    }
+    if err := ValidateIntInput(valid, settings[0]); err != nil {
+        t.Errorf("valid input rejected: %v", err)
+    }
+
+    cases := map[string]*big.Int{
+        "negative": big.NewInt(-2),
+        "too large": new(big.Int).Add(pk.N(), big.NewInt(2)),
+        "evaluation point": big.NewInt(9),
+    }
+    for name, element := range cases {
+        t.Run(name, func(t *testing.T) {
+            err := ValidateDiffInput(append(bigIntSlice([]int64{2,4}), element), settings[0])
+            input_err, ok := err.(InputError)
+            if !ok {
+                t.Fatalf("expected InputError, got %v", err)
+            }
+            if input_err.Element != element {
+                t.Errorf("wrong element reported: %v", input_err.Element)
+            }
+        })
+    }
+
+    t.Run("threshold", func(t *testing.T) {
+        small := bigIntSlice([]int64{2,4})
+        if err := ValidateIntInput(small, settings[0]); err == nil {
+            t.Error("threshold not smaller than set size accepted")
+        }
+        if err := ValidateDiffInput(small, settings[0]); err != nil {
+            t.Errorf("valid threshold rejected: %v", err)
+        }
+    })
+}
+
+func TestInputCheckWorkers(t *testing.T) {
+    n := 3
+    pk, _, err := NewDJCryptosystem(n)
+    if err != nil {t.Fatal(err)}
+
+    run := func(settings []AHE_setting, local []error) []error {
+        returns := make([]chan error, n)
+        for i := 0; i < n; i += 1 {
+            returns[i] = make(chan error, 1)
+            go func(i int) {
+                if settings[i].IsCentral() {
+                    returns[i] <- CentralInputCheckWorker(local[i], settings[i])
+                } else {
+                    returns[i] <- OuterInputCheckWorker(local[i], settings[i])
+                }
+            }(i)
+        }
+        errs := make([]error, n)
+        for i := range errs {
+            errs[i] = <-returns[i]
+        }
+        return errs
+    }
+    settingsWithThresholds := func(thresholds ...int) []AHE_setting {
+        settings := make([]AHE_setting, n)
+        for i, setting := range createAHESettings(n, 0, pk) {
+            settings[i] = withThreshold(setting, thresholds[i])
+        }
+        return settings
+    }
+
+    t.Run("agree", func(t *testing.T) {
+        for i, err := range run(settingsWithThresholds(2, 2, 2), make([]error, n)) {
+            if err != nil {
+                t.Errorf("party %d: %v", i, err)
+            }
+        }
+    })
+    t.Run("threshold mismatch", func(t *testing.T) {
+        for i, err := range run(settingsWithThresholds(2, 3, 2), make([]error, n)) {
+            if _, ok := err.(AgreementError); !ok {
+                t.Errorf("party %d: expected AgreementError, got %v", i, err)
+            }
+        }
+    })
+    t.Run("invalid input", func(t *testing.T) {
+        local := make([]error, n)
+        local[0] = InputError{big.NewInt(-1), "negative"}
+        errs := run(settingsWithThresholds(2, 2, 2), local)
+        if errs[0] != local[0] {
+            t.Errorf("party 0: expected local error, got %v", errs[0])
+        }
+        for i, err := range errs[1:] {
+            if _, ok := err.(AgreementError); !ok {
+                t.Errorf("party %d: expected AgreementError, got %v", i+1, err)
+            }
+        }
+    })
+}
@@ -3,6 +3,8 @@ package tpsi
 import (
     "math/big"
     "fmt"
+    "bytes"
+    "crypto/sha256"
     gm "github.com/ontanj/generic-matrix"
 )
 
@@ -30,6 +32,23 @@ func toMatrixSlice(is []interface{}) []gm.Matrix {
     return cs
 }
 
+// Hankel matrices sent as their defining sequences
+func toHankelSlice(is []interface{}) []HankelMatrix {
+    hs := make([]HankelMatrix, len(is))
+    for i, v := range is {
+        h, err := NewHankelMatrix(v.(gm.Matrix))
+        if err != nil {panic(err)}
+        hs[i] = h
+    }
+    return hs
+}
+
+func receiveHankel(setting AHE_setting) HankelMatrix {
+    h, err := NewHankelMatrix((setting.Receive()).(gm.Matrix))
+    if err != nil {panic(err)}
+    return h
+}
+
 func toCiphertextSliceSlice(is []interface{}) [][]Ciphertext {
     cs := make([][]Ciphertext, len(is))
     for i, v := range is {
@@ -38,6 +57,14 @@ func toCiphertextSliceSlice(is []interface{}) [][]Ciphertext {
     return cs
 }
 
+func toMatrixSliceSlice(is []interface{}) [][]gm.Matrix {
+    cs := make([][]gm.Matrix, len(is))
+    for i, v := range is {
+        cs[i] = v.([]gm.Matrix)
+    }
+    return cs
+}
+
 func CentralASSWorker(a Ciphertext, sk Secret_key, setting AHE_setting) *big.Int {
     // step 1: sample d
     d_plain, d_enc, err := GetRandomEncrypted(setting)
@@ -134,6 +161,7 @@ func OuterMultWorker(a, b Ciphertext, sk Secret_key, setting AHE_setting) Cipher
 }
 
 func CentralDecryptionWorker(cipher Ciphertext, sk Secret_key, setting AHE_setting) *big.Int {
+    defer observeStep(setting, "Decryption")()
     partial, err := sk.PartialDecrypt(cipher)
     if err != nil {panic(err)}
 
@@ -149,6 +177,7 @@ func CentralDecryptionWorker(cipher Ciphertext, sk Secret_key, setting AHE_setti
 }
 
 func OuterDecryptionWorker(cipher Ciphertext, sk Secret_key, setting AHE_setting) *big.Int {
+    defer observeStep(setting, "Decryption")()
     partial, err := sk.PartialDecrypt(cipher)
     if err != nil {panic(err)}
 
@@ -162,8 +191,111 @@ func OuterDecryptionWorker(cipher Ciphertext, sk Secret_key, setting AHE_setting
     return plain
 }
 
+// decrypts cipher only towards the parties receiving output, see OutputPolicy.
+// Every receiving outer party masks the ciphertext with a random matrix known
+// only to itself, so that the central party learns nothing unless it receives output.
+// returns the plaintext and true for receiving parties, otherwise false
+func CentralOutputDecryptionWorker(cipher gm.Matrix, sk Secret_key, setting AHE_setting) (gm.Matrix, bool) {
+    // step 1: receive encrypted masks from receiving parties
+    masks := setting.ReceiveAll()
+
+    // step 2: mask ciphertext for each receiving party
+    targets := make([]int, 0, setting.Parties()) // outer party position, -1 for central
+    masked := make([]gm.Matrix, 0, setting.Parties())
+    for i, mask := range masks {
+        if mask == nil {
+            continue
+        }
+        m, err := cipher.Add(mask.(gm.Matrix))
+        if err != nil {panic(err)}
+        targets = append(targets, i)
+        masked = append(masked, m)
+    }
+    if receivesOutput(setting) {
+        targets = append(targets, -1)
+        masked = append(masked, cipher)
+    }
+    setting.Distribute(masked)
+
+    // step 3: partially decrypt all masked ciphertexts
+    partials := make([]gm.Matrix, len(masked))
+    var err error
+    for j, m := range masked {
+        partials[j], err = PartialDecryptMatrix(m, sk)
+        if err != nil {panic(err)}
+    }
+    all_partials := toMatrixSliceSlice(setting.ReceiveAll())
+    all_partials = append(all_partials, partials)
+
+    // step 4: combine and deliver to each receiving party
+    var plain gm.Matrix
+    received := false
+    for j, target := range targets {
+        parts := make([]gm.Matrix, len(all_partials))
+        for k, p := range all_partials {
+            parts[k] = p[j]
+        }
+        dec, err := CombineMatrixShares(parts, masked[j], setting)
+        if err != nil {panic(err)}
+        if target < 0 {
+            plain = dec
+            received = true
+        } else {
+            setting.SendTo(target, dec)
+        }
+    }
+    return plain, received
+}
+
+// decrypts the rows x cols matrix held by the central party only towards
+// the parties receiving output, see CentralOutputDecryptionWorker
+// returns the plaintext and true for receiving parties, otherwise false
+func OuterOutputDecryptionWorker(rows, cols int, sk Secret_key, setting AHE_setting) (gm.Matrix, bool) {
+    receives := receivesOutput(setting)
+
+    // step 1: send encrypted mask if receiving
+    var mask gm.Matrix
+    var err error
+    if receives {
+        mask, err = sampleMatrix(setting, rows, cols, setting.AHE_cryptosystem().N())
+        if err != nil {panic(err)}
+        mask_enc, err := EncryptMatrix(mask, setting)
+        if err != nil {panic(err)}
+        setting.Send(mask_enc)
+    } else {
+        setting.Send(nil)
+    }
+
+    // step 3: partially decrypt all masked ciphertexts
+    masked := (setting.Receive()).([]gm.Matrix)
+    partials := make([]gm.Matrix, len(masked))
+    for j, m := range masked {
+        partials[j], err = PartialDecryptMatrix(m, sk)
+        if err != nil {panic(err)}
+    }
+    setting.Send(partials)
+
+    if !receives {
+        return gm.Matrix{}, false
+    }
+
+    // step 4: remove mask
+    dec := (setting.Receive()).(gm.Matrix)
+    plain, err := dec.Subtract(mask)
+    if err != nil {panic(err)}
+    plain, err = plain.Apply(func(val interface{}) (interface{}, error) {
+        return new(big.Int).Mod(val.(*big.Int), setting.AHE_cryptosystem().N()), nil
+    })
+    if err != nil {panic(err)}
+    return plain, true
+}
+
 func CentralZeroTestWorker(a Ciphertext, sk Secret_key, setting AHE_setting) bool {
-    plain_mask, err := SampleInt(setting.AHE_cryptosystem().N())
+    defer observeStep(setting, "ZeroTest")()
+    if zt, ok := setting.AHE_cryptosystem().(ZeroTester); ok {
+        return centralScaledZeroTest(a, sk, zt, setting)
+    }
+    plain_mask, err := sampleInt(setting, setting.AHE_cryptosystem().N())
     if err != nil {panic(err)}
 
     mask, err := setting.AHE_cryptosystem().Encrypt(plain_mask)
@@ -185,8 +317,12 @@ func CentralZeroTestWorker(a Ciphertext, sk Secret_key, setting AHE_setting) boo
 }
 
 func OuterZeroTestWorker(a Ciphertext, sk Secret_key, setting AHE_setting) bool {
+    defer observeStep(setting, "ZeroTest")()
+    if zt, ok := setting.AHE_cryptosystem().(ZeroTester); ok {
+        return outerScaledZeroTest(a, sk, zt, setting)
+    }
 
-    plain_mask, err := SampleInt(setting.AHE_cryptosystem().N())
+    plain_mask, err := sampleInt(setting, setting.AHE_cryptosystem().N())
     if err != nil {panic(err)}
 
     mask, err := setting.AHE_cryptosystem().Encrypt(plain_mask)
@@ -203,12 +339,66 @@ func OuterZeroTestWorker(a Ciphertext, sk Secret_key, setting AHE_setting) bool
     return pred.Cmp(big.NewInt(0)) == 0    
 }
 
+// scale a by a random non-zero factor, ciphertexts of zero stay zero
+func randomScale(a Ciphertext, setting AHE_setting) Ciphertext {
+    r, err := sampleInt(setting, new(big.Int).Sub(setting.AHE_cryptosystem().N(), big.NewInt(1)))
+    if err != nil {panic(err)}
+    scaled, err := setting.AHE_cryptosystem().Scale(a, r.Add(r, big.NewInt(1)))
+    if err != nil {panic(err)}
+    return scaled
+}
+
+// zero test for a ZeroTester, where the plaintext can't be recovered by
+// CombinePartials. Every party scales a by a random factor, and only whether
+// the sum of the scaled ciphertexts is zero is revealed.
+func centralScaledZeroTest(a Ciphertext, sk Secret_key, zt ZeroTester, setting AHE_setting) bool {
+    scaled := toCiphertextSlice(setting.ReceiveAll())
+    scaled = append(scaled, randomScale(a, setting))
+
+    sum, err := SumSlice(scaled, setting)
+    if err != nil {panic(err)}
+
+    setting.Distribute(sum)
+
+    partial, err := sk.PartialDecrypt(sum)
+    if err != nil {panic(err)}
+
+    ds := toPartialSlice(setting.ReceiveAll())
+    ds = append(ds, partial)
+
+    setting.Distribute(ds)
+
+    zero, err := zt.CombinePartialsIsZero(ds)
+    if err != nil {panic(err)}
+
+    return zero
+}
+
+// see centralScaledZeroTest
+func outerScaledZeroTest(a Ciphertext, sk Secret_key, zt ZeroTester, setting AHE_setting) bool {
+    setting.Send(randomScale(a, setting))
+
+    sum := (setting.Receive()).(Ciphertext)
+
+    partial, err := sk.PartialDecrypt(sum)
+    if err != nil {panic(err)}
+
+    setting.Send(partial)
+
+    ds := (setting.Receive()).([]Partial_decryption)
+
+    zero, err := zt.CombinePartialsIsZero(ds)
+    if err != nil {panic(err)}
+
+    return zero
+}
+
 // returns:
 //  * q numerator
 //  * q denominator
 //  * r numerator
 //  * r denominator
-func PolynomialDivisionWorker(a, b gm.Matrix, a_den, b_den Ciphertext, sk Secret_key, setting AHE_setting) (gm.Matrix, gm.Matrix, gm.Matrix, Ciphertext) {
+func PolynomialDivisionWorker(a, b CipherVector, a_den, b_den Ciphertext, sk Secret_key, setting AHE_setting) (CipherVector, CipherVector, CipherVector, Ciphertext) {
     zeroTest := func (val Ciphertext) bool {
         if setting.IsCentral() {
             return CentralZeroTestWorker(val, sk, setting)
@@ -223,99 +413,77 @@ func PolynomialDivisionWorker(a, b gm.Matrix, a_den, b_den Ciphertext, sk Secret
             return OuterMultWorker(a, b, sk, setting)
         }
     }
-    space := a.Space
     var la int // degree of dividend
-    for la = a.Cols-1; la >= 0; la -= 1 { // find degree of divisor
-        zero_t, err := decodeC(a.At(0,la))
-        if err != nil {panic(err)}
-        if !zeroTest(zero_t) {
+    for la = len(a)-1; la >= 0; la -= 1 { // find degree of divisor
+        if !zeroTest(a[la]) {
             break
         }
     }
     var lb int // degree of divisor
-    for lb = b.Cols-1; lb >= 0; lb -= 1 { // find degree of divisor
-        zero_t, err := decodeC(b.At(0,lb))
-        if err != nil {panic(err)}
-        if !zeroTest(zero_t) {
+    for lb = len(b)-1; lb >= 0; lb -= 1 { // find degree of divisor
+        if !zeroTest(b[lb]) {
             break
         }
     }
     ql := 1+la-lb
     a_num := a
-    var q_num gm.Matrix
+    var q_num CipherVector
     var err error
     if setting.IsCentral() {
-        q_num, err = EncryptedZeroMatrix(1, ql, setting)
+        q_num, err = EncryptedZeroVector(ql, setting)
         if err != nil {panic(err)}
-        setting.Distribute(q_num)
+        setting.Distribute([]Ciphertext(q_num))
     } else {
-        q_num = (setting.Receive()).(gm.Matrix)
+        q_num = receiveCipherVector(setting)
     }
-    var q_den gm.Matrix
+    var q_den CipherVector
     if setting.IsCentral() {
-        q_den, err = EncryptedOneMatrix(1, ql, setting)
+        q_den, err = EncryptedOneVector(ql, setting)
         if err != nil {panic(err)}
-        setting.Distribute(q_den)
+        setting.Distribute([]Ciphertext(q_den))
     } else {
-        q_den = (setting.Receive()).(gm.Matrix)
+        q_den = receiveCipherVector(setting)
     }
     
     for i := la; i >= lb; i -= 1 { // start at highest degree coefficient, go until dividend smaller than divisor
         // skip 0 coefficents
-        zero_t, err := decodeC(a_num.At(0,i))
-        if err != nil {panic(err)}
-        if zeroTest(zero_t) {
+        if zeroTest(a_num[i]) {
             continue
         }
 
         pos := i-lb // entry in q at pos
 
         // q numerator: b_den * a_num
-        a_val, err := decodeC(a_num.At(0, i))
-        if err != nil {panic(err)}
-        num := multiply(a_val, b_den)
-        q_num.Set(0, pos, num)
+        num := multiply(a_num[i], b_den)
+        q_num[pos] = num
     
         // q denominator: b_num * a_den
-        b_val, err := decodeC(b.At(0, lb))
-        if err != nil {panic(err)}
-        den := multiply(b_val, a_den)
-        q_den.Set(0, pos, den)
+        den := multiply(b[lb], a_den)
+        q_den[pos] = den
 
         // p = q_val * b
-        p_num, err := gm.NewMatrix(1, lb, nil, a.Space) // partial result, size is degree of (partial) dividend - 1 = i , skip highest coefficient as it is cancelling
-        if err != nil {panic(err)}
-        for j := 0; j < lb; j += 1 {
-            b_val, err := decodeC(b.At(0, j))
-            if err != nil {panic(err)}
-            val := multiply(num, b_val)
-            p_num.Set(0, j, val)
+        p_num := make(CipherVector, lb) // partial result, size is degree of (partial) dividend - 1 = i , skip highest coefficient as it is cancelling
+        for j := range p_num {
+            p_num[j] = multiply(num, b[j])
         }
         p_den := multiply(den, b_den)
 
         // make same denominator for p and a
-        r_num, err := gm.NewMatrix(1, i, nil, space)
-        if err != nil {panic(err)}
-        for i := 0; i < r_num.Cols; i += 1 {
-            a_val, err := decodeC(a_num.At(0, i))
-            if err != nil {panic(err)}
-            val := multiply(a_val, p_den)
-            r_num.Set(0, i, val)
+        r_num := make(CipherVector, i)
+        for j := range r_num {
+            r_num[j] = multiply(a_num[j], p_den)
         }
-        for i := 0; i < p_num.Cols; i += 1 {
-            p_val, err := decodeC(p_num.At(0, i))
-            if err != nil {panic(err)}
-            val := multiply(p_val, a_den)
-            p_num.Set(0, i, val)
+        for j := range p_num {
+            p_num[j] = multiply(p_num[j], a_den)
         }
         r_den := multiply(a_den, p_den)
 
         // subtract r2 = r1 - p
         if setting.IsCentral() {
             r_num = divSub(r_num, p_num, setting)
-            setting.Distribute(r_num)
+            setting.Distribute([]Ciphertext(r_num))
         } else {
-            r_num = (setting.Receive()).(gm.Matrix)
+            r_num = receiveCipherVector(setting)
         }
 
         a_num = r_num
@@ -325,52 +493,37 @@ func PolynomialDivisionWorker(a, b gm.Matrix, a_den, b_den Ciphertext, sk Secret
 
     // remove initial zero coefficients
     var lr int
-    for lr = a_num.Cols-1; lr >= 0; lr -=1 {
-        zero_t, err := decodeC(a_num.At(0,lr))
-        if err != nil {panic(err)}
-        if !zeroTest(zero_t) {
+    for lr = len(a_num)-1; lr >= 0; lr -=1 {
+        if !zeroTest(a_num[lr]) {
             break
         }
     }
-    a_num_vals := make([]interface{}, lr+1)
-    for i := range a_num_vals {
-        a_num_val, err := a_num.At(0, i)
-        if err != nil {panic(err)}
-        a_num_vals[i] = a_num_val
-    }
-    a_num, err = gm.NewMatrix(1, lr+1, a_num_vals, space)
-    if err != nil {panic(err)}
-    return q_num, q_den, a_num, a_den
+    return q_num, q_den, a_num.truncate(lr+1), a_den
 }
 
 // subtracts encrypted polynomials r - p, where deg(r) >= deg(p)
-func divSub(r, p gm.Matrix,setting AHE_setting) gm.Matrix {
-    pos_diff := r.Cols-p.Cols
-    for i := 0; i < p.Cols; i += 1 {
-        p_val, err := decodeC(p.At(0,i))
-        if err != nil {panic(err)}
+func divSub(r, p CipherVector, setting AHE_setting) CipherVector {
+    pos_diff := len(r)-len(p)
+    for i, p_val := range p {
         neg, err := setting.AHE_cryptosystem().Scale(p_val, big.NewInt(-1))
         if err != nil {panic(err)}
-        r_val, err := decodeC(r.At(0, i+pos_diff))
+        r[i+pos_diff], err = setting.AHE_cryptosystem().Add(r[i+pos_diff], neg)
         if err != nil {panic(err)}
-        diff, err := setting.AHE_cryptosystem().Add(r_val, neg)
-        if err != nil {panic(err)}
-        r.Set(0, i+pos_diff, diff)
     }
     return r
 }
 
-func CentralMinPolyWorker(seq gm.Matrix, rec_ord int, sk Secret_key, setting AHE_setting) (gm.Matrix, gm.Matrix) {
+func CentralMinPolyWorker(seq CipherVector, rec_ord int, sk Secret_key, setting AHE_setting) (CipherVector, CipherVector) {
+    defer observeStep(setting, "MinPoly")()
 
     // create r0
     coeff, err := setting.AHE_cryptosystem().Encrypt(big.NewInt(1))
     if err != nil {panic(err)}
     
-    al := seq.Cols + 1
-    a, err := EncryptedZeroMatrix(1, al, setting)
+    a, err := EncryptedZeroVector(len(seq) + 1, setting)
     if err != nil {panic(err)}
-    a.Set(0, seq.Cols, coeff)
-    setting.Distribute(a)
+    a[len(seq)] = coeff
+    setting.Distribute([]Ciphertext(a))
 
     a_den, err := setting.AHE_cryptosystem().Encrypt(big.NewInt(1))
     if err != nil {panic(err)}
@@ -383,27 +536,27 @@ func CentralMinPolyWorker(seq gm.Matrix, rec_ord int, sk Secret_key, setting AHE
     setting.Distribute(b_den)
     
     // create t0, t1
-    t0_num, err := EncryptedZeroMatrix(1, 1, setting)
+    t0_num, err := EncryptedZeroVector(1, setting)
     if err != nil {panic(err)}
-    setting.Distribute(t0_num)
-    t0_den, err := EncryptedOneMatrix(1, 1, setting)
+    setting.Distribute([]Ciphertext(t0_num))
+    t0_den, err := EncryptedOneVector(1, setting)
     if err != nil {panic(err)}
-    setting.Distribute(t0_den)
-    t1_num, err := EncryptedOneMatrix(1, 1, setting)
+    setting.Distribute([]Ciphertext(t0_den))
+    t1_num, err := EncryptedOneVector(1, setting)
     if err != nil {panic(err)}
-    setting.Distribute(t1_num)
-    t1_den, err := EncryptedOneMatrix(1, 1, setting)
+    setting.Distribute([]Ciphertext(t1_num))
+    t1_den, err := EncryptedOneVector(1, setting)
     if err != nil {panic(err)}
-    setting.Distribute(t1_den)
+    setting.Distribute([]Ciphertext(t1_den))
     
-    var t2_num gm.Matrix
-    var t2_den gm.Matrix
+    var t2_num CipherVector
+    var t2_den CipherVector
 
     for {
         q_num, q_den, r_num, r_den := PolynomialDivisionWorker(a, b, a_den, b_den, sk, setting)
         t2_num, t2_den, err = nextT(t0_num, t0_den, t1_num, t1_den, q_num, q_den, sk, setting)
         if err != nil {panic(err)}
-        if r_num.Cols <= rec_ord {
+        if len(r_num) <= rec_ord {
             break
         }
         a = b
@@ -418,10 +571,11 @@ func CentralMinPolyWorker(seq gm.Matrix, rec_ord int, sk Secret_key, setting AHE
     return t2_num, t2_den
 }
 
-func OuterMinPolyWorker(seq gm.Matrix, rec_ord int, sk Secret_key, setting AHE_setting) (gm.Matrix, gm.Matrix) {
+func OuterMinPolyWorker(seq CipherVector, rec_ord int, sk Secret_key, setting AHE_setting) (CipherVector, CipherVector) {
+    defer observeStep(setting, "MinPoly")()
 
     // create r0
-    a := (setting.Receive()).(gm.Matrix)
+    a := receiveCipherVector(setting)
     a_den := (setting.Receive()).(Ciphertext)
 
     // create r1
@@ -429,20 +583,20 @@ func OuterMinPolyWorker(seq gm.Matrix, rec_ord int, sk Secret_key, setting AHE_s
     b_den := (setting.Receive()).(Ciphertext)
     
     // create t0, t1
-    t0_num := (setting.Receive()).(gm.Matrix)
-    t0_den := (setting.Receive()).(gm.Matrix)
-    t1_num := (setting.Receive()).(gm.Matrix)
-    t1_den := (setting.Receive()).(gm.Matrix)
+    t0_num := receiveCipherVector(setting)
+    t0_den := receiveCipherVector(setting)
+    t1_num := receiveCipherVector(setting)
+    t1_den := receiveCipherVector(setting)
     
-    var t2_num gm.Matrix
-    var t2_den gm.Matrix
+    var t2_num CipherVector
+    var t2_den CipherVector
     var err error
 
     for {
         q_num, q_den, r_num, r_den := PolynomialDivisionWorker(a, b, a_den, b_den, sk, setting)
         t2_num, t2_den, err = nextT(t0_num, t0_den, t1_num, t1_den, q_num, q_den, sk, setting)
         if err != nil {panic(err)}
-        if r_num.Cols <= rec_ord {
+        if len(r_num) <= rec_ord {
             break
         }
         a = b
@@ -457,145 +611,129 @@ func OuterMinPolyWorker(seq gm.Matrix, rec_ord int, sk Secret_key, setting AHE_s
     return t2_num, t2_den
 }
 
-func nextT(t0_num, t0_den, t1_num, t1_den, q_num, q_den gm.Matrix, sk Secret_key, setting AHE_setting) (t2_num, t2_den gm.Matrix, err error) {
+func nextT(t0_num, t0_den, t1_num, t1_den, q_num, q_den CipherVector, sk Secret_key, setting AHE_setting) (t2_num, t2_den CipherVector, err error) {
     p_num, p_den, err := PolyMult(t1_num, t1_den, q_num, q_den, sk, setting)
     if err != nil {return}
     t2_num, t2_den, err = PolySub(t0_num, t0_den, p_num, p_den, sk, setting)
     return
 }
 
-func PolySub(a_num, a_den, b_num, b_den gm.Matrix, sk Secret_key, setting AHE_setting) (diff_num, diff_den gm.Matrix, err error) {
-    if a_num.Cols != a_den.Cols || b_num.Cols != b_den.Cols {
+// difference of two polynomials of fractions. The coefficients are independent,
+// so they are computed concurrently if setting is a Streamer.
+func PolySub(a_num, a_den, b_num, b_den CipherVector, sk Secret_key, setting AHE_setting) (diff_num, diff_den CipherVector, err error) {
+    if len(a_num) != len(a_den) || len(b_num) != len(b_den) {
         panic("mismatched length of denominator")
     }
     var diff_l int
-    if a_num.Cols > b_num.Cols {
-        diff_l = a_num.Cols
+    if len(a_num) > len(b_num) {
+        diff_l = len(a_num)
     } else {
-        diff_l = b_num.Cols
+        diff_l = len(b_num)
     }
-    diff_num, err = gm.NewMatrix(1, diff_l, nil, a_num.Space)
-    if err != nil {return}
-    diff_den, err = gm.NewMatrix(1, diff_l, nil, a_num.Space)
-    if err != nil {return}
-    multiply := func (a, b Ciphertext) Ciphertext {
-        if setting.IsCentral() {
-            return CentralMultWorker(a, b, sk, setting)
-        } else {
-            return OuterMultWorker(a, b, sk, setting)
+    diff_num = make(CipherVector, diff_l)
+    diff_den = make(CipherVector, diff_l)
+    errs := make([]error, diff_l)
+    coefficient := func (i int, setting AHE_setting) {
+        multiply := func (a, b Ciphertext) Ciphertext {
+            if setting.IsCentral() {
+                return CentralMultWorker(a, b, sk, setting)
+            } else {
+                return OuterMultWorker(a, b, sk, setting)
+            }
         }
-    }
-    scale := func (a Ciphertext, factor *big.Int) Ciphertext {
-        if setting.IsCentral() {
-            val, err := setting.AHE_cryptosystem().Scale(a, factor)
-            if err != nil {panic(err)}
-            setting.Distribute(val)
-            return val
-        } else {
-            return (setting.Receive()).(Ciphertext)
+        scale := func (a Ciphertext, factor *big.Int) Ciphertext {
+            if setting.IsCentral() {
+                val, err := setting.AHE_cryptosystem().Scale(a, factor)
+                if err != nil {panic(err)}
+                setting.Distribute(val)
+                return val
+            } else {
+                return (setting.Receive()).(Ciphertext)
+            }
         }
-    }
-    var num Ciphertext
-    for i := 0; i < diff_l; i += 1 {
-        if i >= b_num.Cols { // todo: not covered by test
-            var a_val interface{}
-            a_val, err = a_num.At(0, i)
-            if err != nil {return}
-            diff_num.Set(0, i, a_val)
-            a_val, err = a_den.At(0, i)
-            if err != nil {return}
-            diff_den.Set(0, i, a_val)
-        } else if i >= a_num.Cols {
-            var b_val Ciphertext
-            b_val, err = decodeC(b_num.At(0, i))
-            if err != nil {return}
-            num = scale(b_val, big.NewInt(-1))
-            diff_num.Set(0, i, num)
-            b_val, err = decodeC(b_den.At(0, i))
-            if err != nil {return}
-            diff_den.Set(0, i, b_val)
+        if i >= len(b_num) { // todo: not covered by test
+            diff_num[i] = a_num[i]
+            diff_den[i] = a_den[i]
+        } else if i >= len(a_num) {
+            diff_num[i] = scale(b_num[i], big.NewInt(-1))
+            diff_den[i] = b_den[i]
         } else {
-            var a_num_val Ciphertext
-            a_num_val, err = decodeC(a_num.At(0, i))
-            if err != nil {return}
-            var b_den_val Ciphertext
-            b_den_val, err = decodeC(b_den.At(0, i))
-            if err != nil {return}
-            long_a_num := multiply(a_num_val, b_den_val)
-            var b_num_val Ciphertext
-            b_num_val, err = decodeC(b_num.At(0, i))
-            if err != nil {return}
-            var a_den_val Ciphertext
-            a_den_val, err = decodeC(a_den.At(0, i))
-            if err != nil {return}
-            long_b_num := multiply(b_num_val, a_den_val)
+            long_a_num := multiply(a_num[i], b_den[i])
+            long_b_num := multiply(b_num[i], a_den[i])
             neg := scale(long_b_num, big.NewInt(-1))
-            num, err = setting.AHE_cryptosystem().Add(long_a_num, neg)
-            if err != nil {return}
-            diff_num.Set(0, i, num)
-            den := multiply(a_den_val, b_den_val)
-            diff_den.Set(0, i, den)
+            diff_num[i], errs[i] = setting.AHE_cryptosystem().Add(long_a_num, neg)
+            diff_den[i] = multiply(a_den[i], b_den[i])
         }
     }
+    if streams, ok := setting.(Streamer); ok {
+        concurrentSubstreams(streams, "polysub", diff_l, coefficient)
+    } else {
+        for i := 0; i < diff_l; i += 1 {
+            coefficient(i, setting)
+        }
+    }
+    for _, err = range errs {
+        if err != nil {return}
+    }
     return
 }
 
-func PolyMult(a_num, a_den, b_num, b_den gm.Matrix, sk Secret_key, setting AHE_setting) (prod_num, prod_den gm.Matrix, err error) {
-    prod_len := a_num.Cols+b_num.Cols-1
+// product of two polynomials of fractions. The products of coefficient pairs
+// are computed concurrently if setting is a Streamer, then summed in order.
+func PolyMult(a_num, a_den, b_num, b_den CipherVector, sk Secret_key, setting AHE_setting) (prod_num, prod_den CipherVector, err error) {
+    prod_len := len(a_num)+len(b_num)-1
     if setting.IsCentral() {
-        prod_num, err = EncryptedZeroMatrix(1, prod_len, setting)
+        prod_num, err = EncryptedZeroVector(prod_len, setting)
         if err != nil {panic(err)}
-        setting.Distribute(prod_num)
+        setting.Distribute([]Ciphertext(prod_num))
     } else {
-        prod_num = (setting.Receive()).(gm.Matrix)
+        prod_num = receiveCipherVector(setting)
     }
     if setting.IsCentral() {
-        prod_den, err = EncryptedOneMatrix(1, prod_len, setting)
+        prod_den, err = EncryptedOneVector(prod_len, setting)
         if err != nil {panic(err)}
-        setting.Distribute(prod_den)
+        setting.Distribute([]Ciphertext(prod_den))
     } else {
-        prod_den = (setting.Receive()).(gm.Matrix)
+        prod_den = receiveCipherVector(setting)
     }
-    multiply := func (a, b Ciphertext) Ciphertext {
-        if setting.IsCentral() {
-            return CentralMultWorker(a, b, sk, setting)
-        } else {
-            return OuterMultWorker(a, b, sk, setting)
+    multiplier := func (setting AHE_setting) func (a, b Ciphertext) Ciphertext {
+        return func (a, b Ciphertext) Ciphertext {
+            if setting.IsCentral() {
+                return CentralMultWorker(a, b, sk, setting)
+            } else {
+                return OuterMultWorker(a, b, sk, setting)
+            }
         }
     }
-    for i := 0; i < a_num.Cols; i += 1 {
-        for j := 0; j < b_num.Cols; j += 1 {
-            var a_num_val Ciphertext
-            a_num_val, err = decodeC(a_num.At(0,i))
-            if err != nil {return}
-            var b_num_val Ciphertext
-            b_num_val, err = decodeC(b_num.At(0,j))
-            if err != nil {return}
-            num := multiply(a_num_val, b_num_val)
-            var current_num Ciphertext
-            current_num, err = decodeC(prod_num.At(0, i+j))
-            if err != nil {return}
-            
-            var a_den_val Ciphertext
-            a_den_val, err = decodeC(a_den.At(0,i))
-            if err != nil {return}
-            var b_den_val Ciphertext
-            b_den_val, err = decodeC(b_den.At(0,j))
-            if err != nil {return}
-            den := multiply(a_den_val, b_den_val)
-            var current_den Ciphertext
-            current_den, err = decodeC(prod_den.At(0, i+j))
-            if err != nil {return}
-            
-            long_num := multiply(num, current_den)
-            long_current_num := multiply(current_num, den)
+
+    // products of coefficient pairs, i*len(b_num)+j for a_i*b_j
+    nums := make([]Ciphertext, len(a_num)*len(b_num))
+    dens := make([]Ciphertext, len(a_num)*len(b_num))
+    pair := func (k int, setting AHE_setting) {
+        multiply := multiplier(setting)
+        i, j := k / len(b_num), k % len(b_num)
+        nums[k] = multiply(a_num[i], b_num[j])
+        dens[k] = multiply(a_den[i], b_den[j])
+    }
+    if streams, ok := setting.(Streamer); ok {
+        concurrentSubstreams(streams, "polymult", len(nums), pair)
+    } else {
+        for k := range nums {
+            pair(k, setting)
+        }
+    }
+
+    multiply := multiplier(setting)
+    for i := range a_num {
+        for j := range b_num {
+            num, den := nums[i*len(b_num)+j], dens[i*len(b_num)+j]
+            long_num := multiply(num, prod_den[i+j])
+            long_current_num := multiply(prod_num[i+j], den)
             var new_num Ciphertext
             new_num, err = setting.AHE_cryptosystem().Add(long_num, long_current_num)
             if err != nil {return}
-            prod_num.Set(0, i+j, new_num)
-            
-            new_den := multiply(den, current_den)
-            prod_den.Set(0, i+j, new_den)
+            prod_num[i+j] = new_num
+            prod_den[i+j] = multiply(den, prod_den[i+j])
         }
     }
     return
@@ -629,22 +767,26 @@ func CentralMatrixMultiplicationWorker(a, b gm.Matrix, sk Secret_key, setting AH
     }
     
     // step 1
+    done := observeStep(setting, "MMult step 1")
     RAi_clear, RAi_crypt, RBi_clear, RBi_crypt, err := SampleRMatrices(a, b, setting)
     if err != nil {panic(err)}
     RAs_crypt := toMatrixSlice(setting.ReceiveAll())
     RBs_crypt := toMatrixSlice(setting.ReceiveAll())
     RAs_crypt = append(RAs_crypt, RAi_crypt)
     RBs_crypt = append(RBs_crypt, RBi_crypt)
-    
+    done()
 
     // step 2
+    done = observeStep(setting, "MMult step 2")
     RA, MA, MB, err := GetMulMatrices(a, b, RAs_crypt, RBs_crypt, setting)
     if err != nil {panic(err)}
     setting.Distribute(RA)
     setting.Distribute(MA)
     setting.Distribute(MB)
+    done()
 
     // step 3
+    done = observeStep(setting, "MMult step 3")
     cti, MA_part, MB_part, err := GetCti(MA, MB, RA, RAi_clear, RBi_clear, setting, sk)
     if err != nil {panic(err)}
     cts := toMatrixSlice(setting.ReceiveAll())
@@ -653,10 +795,14 @@ func CentralMatrixMultiplicationWorker(a, b gm.Matrix, sk Secret_key, setting AH
     MA_parts = append(MA_parts, MA_part)
     MB_parts := toMatrixSlice(setting.ReceiveAll())
     MB_parts = append(MB_parts, MB_part)
+    done()
 
     // step 4
+    done = observeStep(setting, "MMult step 4")
     AB, err := CombineMatrixMultiplication(MA, MB, MA_parts, MB_parts, cts, setting)
+    if err != nil {panic(err)}
     setting.Distribute(AB)
+    done()
 
     return AB
 
@@ -668,51 +814,102 @@ func OuterMatrixMultiplicationWorker(a, b gm.Matrix, sk Secret_key, setting AHE_
     }
 
     // step 1
+    done := observeStep(setting, "MMult step 1")
     RAi_clear, RAi_crypt, RBi_clear, RBi_crypt, err := SampleRMatrices(a, b, setting)
     if err != nil {panic(err)}
     setting.Send(RAi_crypt)
     setting.Send(RBi_crypt)
+    done()
 
     // step 2
+    done = observeStep(setting, "MMult step 2")
     RA := (setting.Receive()).(gm.Matrix)
     MA := (setting.Receive()).(gm.Matrix)
     MB := (setting.Receive()).(gm.Matrix)
+    done()
 
     // step 3
+    done = observeStep(setting, "MMult step 3")
     cti, MA_part, MB_part, err := GetCti(MA, MB, RA, RAi_clear, RBi_clear, setting, sk)
     if err != nil {panic(err)}
     setting.Send(cti)
     setting.Send(MA_part)
     setting.Send(MB_part)
+    done()
 
     // step 4
+    done = observeStep(setting, "MMult step 4")
     AB := (setting.Receive()).(gm.Matrix)
+    done()
 
     return AB
 }
 
+// steps c and d of the singularity test: the powers m^(2^i) by repeated squaring,
+// and the semi-sequence [m^(2^k-1) v | ... | m v | v] by multiplying every power
+// with the semi-sequence so far. Both products of a power only need the power and
+// the semi-sequence, so if setting is a Streamer they are computed concurrently on
+// two sub-streams. Otherwise they are computed by one MMult of the power with the
+// two concatenated. Either way the number of sequential MMult instances is halved.
+func semiSequence(m, v gm.Matrix, mmult func(a, b gm.Matrix, setting AHE_setting) gm.Matrix, setting AHE_setting) gm.Matrix {
+    its := NbrMMultInstances(m)
+    mat := m
+    semi_seq := v
+    for i := 0; i <= its; i += 1 {
+        var new_semi_seq gm.Matrix
+        if i == its { // the last power is not squared
+            new_semi_seq = mmult(mat, semi_seq, setting)
+        } else if streams, ok := setting.(Streamer); ok {
+            prods := make([]gm.Matrix, 2)
+            concurrentSubstreams(streams, "semiseq", 2, func(k int, sub AHE_setting) {
+                if k == 0 {
+                    prods[k] = mmult(mat, mat, sub)
+                } else {
+                    prods[k] = mmult(mat, semi_seq, sub)
+                }
+            })
+            mat, new_semi_seq = prods[0], prods[1]
+        } else {
+            both, err := mat.Concatenate(semi_seq)
+            if err != nil {panic(err)}
+            prod := mmult(mat, both, setting)
+            new_semi_seq = prod.CropHorizontally(semi_seq.Cols)
+            mat = cropLeft(prod, mat.Cols)
+        }
+        var err error
+        semi_seq, err = new_semi_seq.Concatenate(semi_seq)
+        if err != nil {panic(err)}
+    }
+    return semi_seq
+}
+
+// matrix of the first k columns of a
+func cropLeft(a gm.Matrix, k int) gm.Matrix {
+    vals := make([]interface{}, 0, k*a.Rows)
+    for row := 0; row < a.Rows; row += 1 {
+        for col := 0; col < k; col += 1 {
+            val, err := a.At(row, col)
+            if err != nil {panic(err)}
+            vals = append(vals, val)
+        }
+    }
+    c, err := gm.NewMatrix(a.Rows, k, vals, a.Space)
+    if err != nil {panic(err)}
+    return c
+}
+
 // returns true if m is singular
 func CentralSingularityTestWorker(m gm.Matrix, sk Secret_key, setting AHE_setting) bool {
+    defer observeStep(setting, "SingularityTest")()
     // step b
     v, err := SampleVVector(m, setting)
     if err != nil {panic(err)}
     setting.Distribute(v)
 
-    // step c
-    its := NbrMMultInstances(m)
-    mats := make([]gm.Matrix, its+1)
-    mats[0] = m
-    for i := 0; i < its; i += 1 {
-        mats[i+1] = CentralMatrixMultiplicationWorker(mats[i], mats[i], sk, setting)
-    }
-
-    //step d
-    semi_seq := v
-    for _, mat := range mats {
-        new_semi_seq := CentralMatrixMultiplicationWorker(mat, semi_seq, sk, setting)
-        semi_seq, err = new_semi_seq.Concatenate(semi_seq)
-        if err != nil {panic(err)}
-    }
+    // step c & d
+    semi_seq := semiSequence(m, v, func(a, b gm.Matrix, setting AHE_setting) gm.Matrix {
+        return CentralMatrixMultiplicationWorker(a, b, sk, setting)
+    }, setting)
 
     // step e
     seq, err := HSeq(semi_seq, m.Cols, setting)
@@ -723,74 +920,65 @@ func CentralSingularityTestWorker(m gm.Matrix, sk Secret_key, setting AHE_settin
 
     // step i
     rec_ord := m.Cols
-    min_poly, _ := CentralMinPolyWorker(seq, rec_ord, sk, setting)
-    
-    zero_t, err := decodeC(min_poly.At(0,0))
+    seq_vec, err := CipherVectorFromMatrix(seq)
     if err != nil {panic(err)}
-    return CentralZeroTestWorker(zero_t, sk, setting)
+    min_poly, _ := CentralMinPolyWorker(seq_vec, rec_ord, sk, setting)
+    
+    return CentralZeroTestWorker(min_poly[0], sk, setting)
 }
 
 // returns true if m is singular
 func OuterSingularityTestWorker(m gm.Matrix, sk Secret_key, setting AHE_setting) bool {
+    defer observeStep(setting, "SingularityTest")()
     // step b
     v := (setting.Receive()).(gm.Matrix)
 
-    // step c
-    its := NbrMMultInstances(m)
-    mats := make([]gm.Matrix, its+1)
-    mats[0] = m
-    for i := 0; i < its; i += 1 {
-        mats[i+1] = OuterMatrixMultiplicationWorker(mats[i], mats[i], sk, setting)
-    }
-
-    //step d
-    semi_seq := v
-    var err error
-    for i := range mats {
-        new_semi_seq := OuterMatrixMultiplicationWorker(mats[i], semi_seq, sk, setting)
-        semi_seq, err = new_semi_seq.Concatenate(semi_seq)
-        if err != nil {panic(err)}
-    }
+    // step c & d
+    semiSequence(m, v, func(a, b gm.Matrix, setting AHE_setting) gm.Matrix {
+        return OuterMatrixMultiplicationWorker(a, b, sk, setting)
+    }, setting)
 
     seq := (setting.Receive()).(gm.Matrix)
 
     // step i
     rec_ord := m.Cols
-    min_poly, _ := OuterMinPolyWorker(seq, rec_ord, sk, setting)
-
-    zero_t, err := decodeC(min_poly.At(0,0))
+    seq_vec, err := CipherVectorFromMatrix(seq)
     if err != nil {panic(err)}
-    return OuterZeroTestWorker(zero_t, sk, setting)
+    min_poly, _ := OuterMinPolyWorker(seq_vec, rec_ord, sk, setting)
+
+    return OuterZeroTestWorker(min_poly[0], sk, setting)
 }
 
 func CentralHankelMatrix(items []*big.Int, sk Secret_key, setting AHE_setting) gm.Matrix {
-    u, err := SampleInt(setting.AHE_cryptosystem().N())
+    defer observeStep(setting, "HankelMatrix")()
+    u, err := sampleInt(setting, setting.AHE_cryptosystem().N())
     if err != nil {panic(err)}
     setting.Distribute(u)
 
     H, err := CPComputeHankelMatrix(items, u, setting)
     if err != nil {panic(err)}
-    Hi := toMatrixSlice(setting.ReceiveAll())
-    for _, Hv := range Hi {
+    for _, Hv := range toHankelSlice(setting.ReceiveAll()) {
         H, err = H.Subtract(Hv)
         if err != nil {panic(err)}
     }
-    setting.Distribute(H)
-    return H
+    setting.Distribute(H.Seq)
+    return H.Expand()
 }
 
 func OuterHankelMatrix(items []*big.Int, sk Secret_key, setting AHE_setting) gm.Matrix {
+    defer observeStep(setting, "HankelMatrix")()
     u := (setting.Receive()).(*big.Int)
 
     H1, err := ComputeHankelMatrix(items, u, setting)
     if err != nil {panic(err)}
-    setting.Send(H1)
-    H := (setting.Receive()).(gm.Matrix)
-    return H
+    setting.Send(H1.Seq)
+    H := receiveHankel(setting)
+    return H.Expand()
 }
 
 // returns true if number of elements not shared by all is <= setting.Threshold()
 func CentralCardinalityTestWorker(items []*big.Int, sk Secret_key, setting AHE_setting) bool {
+    defer observeStep(setting, "CardinalityTest")()
     H := CentralHankelMatrix(items, sk, setting)
     
     return CentralSingularityTestWorker(H, sk, setting)
@@ -798,21 +986,55 @@ func CentralCardinalityTestWorker(items []*big.Int, sk Secret_key, setting AHE_s
 
 // returns true if number of elements not shared by all is <= setting.Threshold()
 func OuterCardinalityTestWorker(items []*big.Int, sk Secret_key, setting AHE_setting) bool {
+    defer observeStep(setting, "CardinalityTest")()
     H := OuterHankelMatrix(items, sk, setting)
 
     return OuterSingularityTestWorker(H, sk, setting)
 }
 
 // step 3 of TPSI-diff
-func CentralIntersectionPolyWorker(root_poly gm.Matrix, sk Secret_key, setting AHE_setting) (gm.Matrix, gm.Matrix) {
+func CentralIntersectionPolyWorker(root_poly PlainPoly, sk Secret_key, setting AHE_setting) (gm.Matrix, gm.Matrix) {
+    defer observeStep(setting, "IntersectionPoly")()
     sample_max := setting.Threshold() * 3 + 4
-    self := setting.Parties()-1
     
     // step a
     root_poly = RootMask(root_poly, setting)
     
     // step b
     R_values_enc, R_tilde_values, p_values := EvalIntPolys(root_poly, sample_max, setting)
+    return centralIntersectionValues(R_values_enc, R_tilde_values, p_values, sk, setting)
+}
+
+// steps b to g of CentralIntersectionPolyWorker, given the evaluations of the masked root polynomial
+func centralIntersectionValues(R_values_enc, R_tilde_values, p_values gm.Matrix, sk Secret_key, setting AHE_setting) (gm.Matrix, gm.Matrix) {
+    // step b to e
+    v := centralMaskedValues(R_values_enc, R_tilde_values, p_values, setting)
+    if outputRestricted(setting) {
+        // step f & g, only towards receiving parties
+        v, _ = CentralOutputDecryptionWorker(v, sk, setting)
+        return v, p_values
+    }
+    setting.Distribute(v)
+
+    // step f
+    pm, err := PartialDecryptMatrix(v, sk)
+    partials := toMatrixSlice(setting.ReceiveAll())
+    partials = append(partials, pm)
+
+    // step g
+    v, err = CombineMatrixShares(partials, v, setting)
+    if err != nil {panic(err)}
+    setting.Distribute(v)
+
+    return v, p_values
+}
+
+// steps b to e of CentralIntersectionPolyWorker, returns the encrypted sum of the masked root polynomials
+func centralMaskedValues(R_values_enc, R_tilde_values, p_values gm.Matrix, setting AHE_setting) gm.Matrix {
+    sample_max := p_values.Cols
+    self := setting.Parties()-1 // central party is last in gathered slices, regardless of its index
+
+    // step b
     all_R_values := toMatrixSlice(setting.ReceiveAll())
     all_R_values = append(all_R_values, R_values_enc)
 
@@ -848,23 +1070,12 @@ func CentralIntersectionPolyWorker(root_poly gm.Matrix, sk Secret_key, setting A
         v, err = v.Add((vv).(gm.Matrix))
         if err != nil {panic(err)}
     }
-    setting.Distribute(v)
-
-    // step f
-    pm, err := PartialDecryptMatrix(v, sk)
-    partials := toMatrixSlice(setting.ReceiveAll())
-    partials = append(partials, pm)
-
-    // step g
-    v, err = CombineMatrixShares(partials, v, setting)
-    if err != nil {panic(err)}
-    setting.Distribute(v)
-
-    return v, p_values
+    return v
 }
 
 // step 3 of TPSI-diff
-func OuterIntersectionPolyWorker(root_poly gm.Matrix, sk Secret_key, setting AHE_setting) (gm.Matrix, gm.Matrix) {
+func OuterIntersectionPolyWorker(root_poly PlainPoly, sk Secret_key, setting AHE_setting) (gm.Matrix, gm.Matrix) {
+    defer observeStep(setting, "IntersectionPoly")()
     sample_max := setting.Threshold() * 3 + 4
     
     // step a
@@ -872,14 +1083,21 @@ func OuterIntersectionPolyWorker(root_poly gm.Matrix, sk Secret_key, setting AHE
     
     // step b
     R_values_enc, R_tilde_values, p_values := EvalIntPolys(root_poly, sample_max, setting)
-    setting.Send(R_values_enc)
-
-    // step c
-    party_values := (setting.Receive()).(gm.Matrix)
+    return outerIntersectionValues(R_values_enc, R_tilde_values, p_values, sk, setting)
+}
 
-    // step d
-    v := MaskRootPoly(p_values, party_values, R_tilde_values, sample_max, setting)
-    setting.Send(v)
+// steps b to g of OuterIntersectionPolyWorker, given the evaluations of the masked root polynomial
+func outerIntersectionValues(R_values_enc, R_tilde_values, p_values gm.Matrix, sk Secret_key, setting AHE_setting) (gm.Matrix, gm.Matrix) {
+    sample_max := p_values.Cols
+
+    // step b to d
+    outerMaskedValues(R_values_enc, R_tilde_values, p_values, setting)
+    var v gm.Matrix
+    if outputRestricted(setting) {
+        // step e, f & g, only towards receiving parties
+        v, _ = OuterOutputDecryptionWorker(1, sample_max, sk, setting)
+        return v, p_values
+    }
     
     // step e
     v = (setting.Receive()).(gm.Matrix)
@@ -894,8 +1112,22 @@ func OuterIntersectionPolyWorker(root_poly gm.Matrix, sk Secret_key, setting AHE
     return v, p_values
 }
 
-// returns two slices, shared elements & unique elements
-func IntersectionWorker(items []*big.Int, sk Secret_key, setting AHE_setting) ([]*big.Int, []*big.Int) {
+// steps b to d of OuterIntersectionPolyWorker, see centralMaskedValues
+func outerMaskedValues(R_values_enc, R_tilde_values, p_values gm.Matrix, setting AHE_setting) {
+    // step b
+    setting.Send(R_values_enc)
+
+    // step c
+    party_values := (setting.Receive()).(gm.Matrix)
+
+    // step d
+    v := MaskRootPoly(p_values, party_values, R_tilde_values, p_values.Cols, setting)
+    setting.Send(v)
+}
+
+// returns the interpolated polynomial whose roots are the unique elements
+// and the random root added by RootMask, and false if the party doesn't receive output
+func intersectionPolyWorker(items []*big.Int, sk Secret_key, setting AHE_setting) (PlainPoly, bool) {
     root_poly := PolyFromRoots(items, setting.AHE_cryptosystem().N())
     var vs gm.Matrix
     var ps gm.Matrix
@@ -904,12 +1136,30 @@ func IntersectionWorker(items []*big.Int, sk Secret_key, setting AHE_setting) ([
     } else {
         vs, ps = OuterIntersectionPolyWorker(root_poly, sk, setting)
     }
-    
-    p := Interpolation(vs, ps, setting)
+    if !receivesOutput(setting) {
+        return nil, false
+    }
+    defer observeStep(setting, "Interpolation")()
+    return interpolateValues(vs, ps, setting), true
+}
+
+// returns two slices, shared elements & unique elements,
+// both empty if the party doesn't receive output
+func IntersectionWorker(items []*big.Int, sk Secret_key, setting AHE_setting) ([]*big.Int, []*big.Int) {
+    p, ok := intersectionPolyWorker(items, sk, setting)
+    if !ok {
+        return []*big.Int{}, []*big.Int{}
+    }
+    return splitByRoots(p, items, setting)
+}
+
+// returns the items that are not roots of p, and those that are
+func splitByRoots(p PlainPoly, items []*big.Int, setting AHE_setting) ([]*big.Int, []*big.Int) {
     shared := make([]*big.Int, 0, len(items))
     unique := make([]*big.Int, 0, len(items))
-    for _, item := range items {
-        if IsRoot(p, item, setting.AHE_cryptosystem().N()) {
+    values := MultiEvalPoly(p, items, setting.AHE_cryptosystem().N())
+    for i, item := range items {
+        if values[i].Sign() == 0 {
             unique = append(unique, item)
         } else {
             shared = append(shared, item)
@@ -919,14 +1169,192 @@ func IntersectionWorker(items []*big.Int, sk Secret_key, setting AHE_setting) ([
     return shared, unique
 }
 
-// returns two slices: shared elements & unique elements if cardinality test passes, otherwise nil, nil
+// returns the number of elements shared by all parties. The masked values of
+// IntersectionPolyWorker are never decrypted: the central party builds the encrypted
+// linear system solved by Interpolation, eliminates the public numerator columns and
+// multiplies the remaining system by random matrices on both sides, see
+// preconditionedDenominatorSystem. Its leading minor of size r is then non-singular
+// if and only if r is at most the degree of the interpolated polynomial, except with
+// probability about r²/N(), and the degree is found by a binary search using the
+// singularity test. The parties learn whether each tested minor is singular, which
+// together only reveals the degree, so no party learns the interpolated polynomial.
+// The degree is one more than the number of unique elements of the central party, so
+// the result is only correct for sets of the same size, as in TPSI-diff and TPSI-int,
+// and like for IntersectionWorker only if the cardinality test passes. The count is
+// revealed to all parties, so output restrictions by an OutputPolicy are rejected.
+func IntersectionCardinalityWorker(items []*big.Int, sk Secret_key, setting AHE_setting) int {
+    defer observeStep(setting, "IntersectionCardinality")()
+    if outputRestricted(setting) {
+        panic(fmt.Errorf("the intersection cardinality is revealed to all parties and can't be restricted by an OutputPolicy"))
+    }
+    sample_max := setting.Threshold() * 3 + 4
+    root_poly := RootMask(PolyFromRoots(items, setting.AHE_cryptosystem().N()), setting)
+    R_values_enc, R_tilde_values, p_values := EvalIntPolys(root_poly, sample_max, setting)
+    var system gm.Matrix
+    if setting.IsCentral() {
+        v := centralMaskedValues(R_values_enc, R_tilde_values, p_values, setting)
+        system = preconditionedDenominatorSystem(v, p_values, setting)
+        setting.Distribute(system)
+    } else {
+        outerMaskedValues(R_values_enc, R_tilde_values, p_values, setting)
+        system = (setting.Receive()).(gm.Matrix)
+    }
+    unique := interpolationDegreeWorker(system, sk, setting) - 1 // minus the random root
+    return len(items) - unique
+}
+
+// The linear system of Interpolation has one row per point x and the columns
+// 1, x, ..., x^(2T+2) of the numerator followed by -q, -q·x, ..., -q·x^(T+1) of the
+// denominator, where q = v/p at x. Its rank is 2T+3 plus the degree of the
+// interpolated polynomial. The numerator columns are public and linearly independent,
+// so the degree is the rank of K·E, where E are the denominator columns and the T+1
+// rows of K span the left kernel of the numerator columns: row t holds the weights
+// of the divided difference over the points t to t+2T+3, which vanishes for every
+// polynomial of degree at most 2T+2. Returns L·K·E·R for random L and R, a square
+// matrix of size T+1, given the encrypted values vs and the root polynomial values ps.
+func preconditionedDenominatorSystem(vs, ps gm.Matrix, setting AHE_setting) gm.Matrix {
+    cs := setting.AHE_cryptosystem()
+    N := cs.N()
+    T := setting.Threshold()
+    points, size, den_cols := vs.Cols, T+1, T+2
+    left, err := sampleSlice(setting, size*size, N) // row major
+    if err != nil {panic(err)}
+    right, err := sampleSlice(setting, den_cols*size, N) // row major
+    if err != nil {panic(err)}
+
+    // L·K, where row t of K has the divided difference weights 1/prod_{l != k} (x_k - x_l)
+    lk := make([][]*big.Int, size)
+    for i := range lk {
+        lk[i] = make([]*big.Int, points)
+        for k := range lk[i] {
+            lk[i][k] = new(big.Int)
+        }
+    }
+    for t := 0; t < size; t += 1 {
+        for k := t; k <= t+2*T+3; k += 1 {
+            weight := big.NewInt(1)
+            for l := t; l <= t+2*T+3; l += 1 {
+                if l != k {
+                    weight.Mul(weight, big.NewInt(int64(2*(k-l)))).Mod(weight, N)
+                }
+            }
+            if weight.ModInverse(weight, N) == nil {panic(fmt.Errorf("point differences aren't invertible modulo %d", N))}
+            for i := 0; i < size; i += 1 {
+                term := new(big.Int).Mul(left[i*size+t], weight)
+                lk[i][k].Add(lk[i][k], term).Mod(lk[i][k], N)
+            }
+        }
+    }
+
+    // (L·K·E·R)[i][c] = sum over points of q·(L·K)[i][k]·(-sum_j x^j R[j][c])
+    system := make([]interface{}, size*size)
+    for k := 0; k < points; k += 1 {
+        v, err := decodeC(vs.At(0, k))
+        if err != nil {panic(err)}
+        p, err := decodeBI(ps.At(0, k))
+        if err != nil {panic(err)}
+        p_inv := new(big.Int).ModInverse(p, N)
+        if p_inv == nil {panic(fmt.Errorf("evaluation %d of root polynomial isn't invertible", k))}
+        q, err := cs.Scale(v, p_inv)
+        if err != nil {panic(err)}
+        x := big.NewInt(int64(2*k+1))
+        for c := 0; c < size; c += 1 {
+            w := new(big.Int)
+            x_pow := big.NewInt(1)
+            for j := 0; j < den_cols; j += 1 {
+                w.Sub(w, new(big.Int).Mul(x_pow, right[j*size+c]))
+                x_pow.Mul(x_pow, x).Mod(x_pow, N)
+            }
+            w.Mod(w, N)
+            for i := 0; i < size; i += 1 {
+                factor := new(big.Int).Mul(lk[i][k], w)
+                term, err := cs.Scale(q, factor.Mod(factor, N))
+                if err != nil {panic(err)}
+                if k == 0 {
+                    system[i*size+c] = term
+                } else {
+                    system[i*size+c], err = cs.Add(system[i*size+c], term)
+                    if err != nil {panic(err)}
+                }
+            }
+        }
+    }
+    product, err := gm.NewMatrix(size, size, system, cs.EvaluationSpace())
+    if err != nil {panic(err)}
+    return product
+}
+
+// the degree of the interpolated polynomial, which is between 1 and T+1 and equals
+// the rank of the system of preconditionedDenominatorSystem
+func interpolationDegreeWorker(system gm.Matrix, sk Secret_key, setting AHE_setting) int {
+    low, high := 1, system.Rows
+    for low < high {
+        mid := (low+high+1)/2
+        minor := leadingMinor(system, mid)
+        var singular bool
+        if setting.IsCentral() {
+            singular = CentralSingularityTestWorker(minor, sk, setting)
+        } else {
+            singular = OuterSingularityTestWorker(minor, sk, setting)
+        }
+        if singular {
+            high = mid-1
+        } else {
+            low = mid
+        }
+    }
+    return low
+}
+
+// the leading r x r submatrix of m
+func leadingMinor(m gm.Matrix, r int) gm.Matrix {
+    vals := make([]interface{}, r*r)
+    var err error
+    for i := 0; i < r; i += 1 {
+        for j := 0; j < r; j += 1 {
+            vals[i*r+j], err = m.At(i, j)
+            if err != nil {panic(err)}
+        }
+    }
+    minor, err := gm.NewMatrix(r, r, vals, m.Space)
+    if err != nil {panic(err)}
+    return minor
+}
+
+// returns the number of elements shared by all parties and true if the cardinality test passes,
+// otherwise 0, false. See IntersectionCardinalityWorker.
+func TPSIdiffCardinalityWorker(items []*big.Int, sk Secret_key, setting AHE_setting) (int, bool) {
+    defer observeStep(setting, "TPSI-diff cardinality")()
+    items = Deduplicate(items)
+    checkInput(ValidateDiffInput(items, setting), setting)
+    var pred bool
+    if setting.IsCentral() {
+        pred = CentralCardinalityTestWorker(items, sk, setting)
+    } else {
+        pred = OuterCardinalityTestWorker(items, sk, setting)
+    }
+    observeSession(setting, "diff-cardinality", pred)
+    if !pred {
+        return 0, false
+    }
+    return IntersectionCardinalityWorker(items, sk, setting), true
+}
+
+// returns two slices: shared elements & unique elements if cardinality test passes, otherwise nil, nil.
+// If output is restricted by an OutputPolicy, parties not receiving output get two empty slices when the test passes.
+// Items are treated as a set, repeated elements are removed by Deduplicate. Panics with an InputError
+// or AgreementError if the input check fails, see ValidateDiffInput and CentralInputCheckWorker.
 func TPSIdiffWorker(items []*big.Int, sk Secret_key, setting AHE_setting) ([]*big.Int, []*big.Int) {
+    defer observeStep(setting, "TPSI-diff")()
+    items = Deduplicate(items)
+    checkInput(ValidateDiffInput(items, setting), setting)
     var pred bool
     if setting.IsCentral() {
         pred = CentralCardinalityTestWorker(items, sk, setting)
     } else {
         pred = OuterCardinalityTestWorker(items, sk, setting)
     }
+    observeSession(setting, "diff", pred)
 
     // exit if cardinality test doesn't pass
     if pred {
@@ -934,4 +1362,73 @@ func TPSIdiffWorker(items []*big.Int, sk Secret_key, setting AHE_setting) ([]*bi
     } else {
         return nil, nil
     }
-}
\ No newline at end of file
+}
+
+// commitment and opening used in central party election
+type electionCommitment [sha256.Size]byte
+type electionOpening []byte
+
+// sample a random contribution to the election and commit to it
+func electionContribution(setting AHE_setting) (electionOpening, electionCommitment) {
+    r, err := sampleInt(setting, new(big.Int).Lsh(big.NewInt(1), 256))
+    if err != nil {panic(err)}
+    opening := electionOpening(r.Bytes())
+    return opening, sha256.Sum256(opening)
+}
+
+// verify all openings against commitments and compute elected index
+func electionResult(commitments []electionCommitment, openings []electionOpening, n int) int {
+    sum := big.NewInt(0)
+    for i, opening := range openings {
+        commitment := sha256.Sum256(opening)
+        if !bytes.Equal(commitment[:], commitments[i][:]) {
+            panic(fmt.Errorf("election opening %d does not match commitment", i))
+        }
+        sum.Add(sum, new(big.Int).SetBytes(opening))
+    }
+    return int(sum.Mod(sum, big.NewInt(int64(n))).Int64())
+}
+
+// returns the party index to act as central party in the next session,
+// decided by a commit-and-open coin toss where every party contributes
+func CentralElectionWorker(setting AHE_setting) int {
+    opening, commitment := electionContribution(setting)
+
+    // collect and distribute commitments
+    commitments := make([]electionCommitment, 0, setting.Parties())
+    for _, c := range setting.ReceiveAll() {
+        commitments = append(commitments, c.(electionCommitment))
+    }
+    commitments = append(commitments, commitment)
+    setting.Distribute(commitments)
+
+    // collect and distribute openings
+    openings := make([]electionOpening, 0, setting.Parties())
+    for _, o := range setting.ReceiveAll() {
+        openings = append(openings, o.(electionOpening))
+    }
+    openings = append(openings, opening)
+    setting.Distribute(openings)
+
+    return electionResult(commitments, openings, setting.Parties())
+}
+
+// returns the party index to act as central party in the next session,
+// decided by a commit-and-open coin toss where every party contributes
+func OuterElectionWorker(setting AHE_setting) int {
+    opening, commitment := electionContribution(setting)
+
+    setting.Send(commitment)
+    commitments := (setting.Receive()).([]electionCommitment)
+
+    setting.Send(opening)
+    openings := (setting.Receive()).([]electionOpening)
+
+    return electionResult(commitments, openings, setting.Parties())
+}
+
+// returns the central party for the given session number when
+// the central role rotates round-robin among the parties
+func RotatingCentral(session, n int) int {
+    return session % n
+}
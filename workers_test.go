@@ -3,23 +3,15 @@ package tpsi
 import (
     "testing"
     "math/big"
+    "fmt"
+    "flag"
+    "strings"
     gm "github.com/ontanj/generic-matrix"
 )
 
+// settings with one channel in each direction, so that a party never reads back its own message
 func createAHESettings(n, T int, cs AHE_Cryptosystem) []AHESetting {
-    settings := make([]AHESetting, n)
-    channels := create_chans(n-1)
-    for i := 0; i < n-1; i += 1 {
-        settings[i].T = T
-        settings[i].n = n
-        settings[i].channel = channels[i]
-        settings[i].cs = cs
-    }
-    settings[n-1].T = T
-    settings[n-1].n = n
-    settings[n-1].channels = channels
-    settings[n-1].cs = cs
-    return settings
+    return SetupAHE(n, T, cs)
 }
 
 func TestASSWorkers(t *testing.T) {
@@ -168,9 +160,9 @@ func TestDecryptionWorkers(t *testing.T) {
     }
 }
 
-func t_decrypt(cipher *big.Int, sks []Secret_key, settings []AHESetting) *big.Int {
+func t_decrypt(cipher Ciphertext, sks []Secret_key, settings []AHESetting) *big.Int {
     n := settings[0].Parties()
-    return_channel := make(chan *big.Int, n) // only read first return value
+    return_channel := make(chan *big.Int, n)
     go func() {
         return_channel <- CentralDecryptionWorker(cipher, sks[n-1], settings[n-1])
     }()
@@ -180,22 +172,32 @@ func t_decrypt(cipher *big.Int, sks []Secret_key, settings []AHESetting) *big.In
         }(i)
     }
     val := <-return_channel
+    for i := 1; i < n; i += 1 { // wait for all parties, so that the next call doesn't cross their messages
+        <-return_channel
+    }
     return val
 }
 
-func t_decryptPoly(num, den gm.Matrix, sks []Secret_key, settings []AHESetting) []*big.Int {
-    p := make([]*big.Int, num.Cols)
-    for i := 0; i < num.Cols; i += 1 {
-        num_enc, _ := decodeBI(num.At(0,i))
-        num_val := t_decrypt(num_enc, sks, settings)
-        den_enc, _ := decodeBI(den.At(0,i))
-        den_val := t_decrypt(den_enc, sks, settings)
+func t_decryptPoly(num, den CipherVector, sks []Secret_key, settings []AHESetting) []*big.Int {
+    p := make([]*big.Int, len(num))
+    for i := range num {
+        num_val := t_decrypt(num[i], sks, settings)
+        den_val := t_decrypt(den[i], sks, settings)
         den_val.ModInverse(den_val, settings[0].cs.N())
         p[i] = num_val.Mul(num_val, den_val).Mod(num_val, settings[0].cs.N())
     }
     return p
 }
 
+// encrypts the 1×k matrix m as a vector
+func t_encryptVector(t *testing.T, m gm.Matrix, setting AHE_setting) CipherVector {
+    m, err := EncryptMatrix(m, setting)
+    if err != nil {t.Fatal(err)}
+    v, err := CipherVectorFromMatrix(m)
+    if err != nil {t.Fatal(err)}
+    return v
+}
+
 func TestPolynomialDivisionWorkers(t *testing.T) {
     n := 4
     pk, sksdj, err := NewDJCryptosystem(n)
@@ -210,58 +212,49 @@ func TestPolynomialDivisionWorkers(t *testing.T) {
     q := []int64{1, 1}
     r := []int64{2, 2}
 
-    divid_enc, err := EncryptMatrix(divid, settings[0])
-    if err != nil {t.Error(err)}
+    divid_enc := t_encryptVector(t, divid, settings[0])
     divid_den, err := pk.Encrypt(big.NewInt(1))
     if err != nil {t.Error(err)}
-    divis_enc, err := EncryptMatrix(divis, settings[0])
-    if err != nil {t.Error(err)}
+    divis_enc := t_encryptVector(t, divis, settings[0])
     divis_den, err := pk.Encrypt(big.NewInt(1))
     if err != nil {t.Error(err)}
 
-    validator := func(num gm.Matrix, den gm.Matrix, corr []int64) {
-        dec := make([]*big.Int, num.Cols)
+    validator := func(num CipherVector, den CipherVector, corr []int64) {
+        dec := make([]*big.Int, len(num))
         var den_i *big.Int // denominator inverse
         
         // if denominator shared among all coefficients -> decrypt it
-        if den.Cols == 1 {
-            den_val, err := decodeBI(den.At(0, 0))
-            if err != nil {t.Error(err)}
-            den_i = t_decrypt(den_val, sks, settings)
+        if len(den) == 1 {
+            den_i = t_decrypt(den[0], sks, settings)
             den_i.ModInverse(den_i, pk.N())
         }
         
         // iterate over coefficients
         for j := 0; j < len(corr); j += 1 {
             // decrypt current denominator if not shared
-            if den.Cols != 1 {
-                den_val, err := decodeBI(den.At(0, j))
-                if err != nil {t.Error(err)}
-                den_i = t_decrypt(den_val, sks, settings)
+            if len(den) != 1 {
+                den_i = t_decrypt(den[j], sks, settings)
                 den_i.ModInverse(den_i, pk.N())
             }
-            num_val, err := decodeBI(num.At(0, j))
-            if err != nil {t.Error(err)}
-            dec[j] = t_decrypt(num_val, sks, settings) // decrypt current numerator
+            dec[j] = t_decrypt(num[j], sks, settings) // decrypt current numerator
             dec[j].Mul(dec[j], den_i).Mod(dec[j], pk.N()) // multiply numerator and denominator inverse
             if dec[j].Cmp(new(big.Int).SetInt64(corr[j])) != 0 {
                 t.Errorf("error in polynomial division, expected %d got %d", corr[j], dec[j])
             }
         }
-        if den.Cols > len(corr) {
+        if len(den) > len(corr) {
             t.Error("exceeding coefficients")
         }
     }
 
-    returns := []chan gm.Matrix{make(chan gm.Matrix), make(chan gm.Matrix, 4), make(chan gm.Matrix, 4), make(chan gm.Matrix)}
+    returns := []chan CipherVector{make(chan CipherVector), make(chan CipherVector, 4), make(chan CipherVector, 4), make(chan CipherVector)}
     
     go func() {
         qn, qd, rn, rd := PolynomialDivisionWorker(divid_enc, divis_enc, divid_den, divis_den, sks[n-1], settings[n-1])
         returns[n-1] <- qn
         returns[n-1] <- qd
         returns[n-1] <- rn
-        rd_ret, _ := gm.NewMatrix(1, 1, []interface{}{rd}, gm.Bigint{})
-        returns[n-1] <- rd_ret
+        returns[n-1] <- CipherVector{rd}
     }()
     for i := 0; i < n-1; i += 1 {
         go func(i int) {
@@ -269,8 +262,7 @@ func TestPolynomialDivisionWorkers(t *testing.T) {
             returns[i] <- qn
             returns[i] <- qd
             returns[i] <- rn
-            rd_ret, _ := gm.NewMatrix(1, 1, []interface{}{rd}, gm.Bigint{})
-            returns[i] <- rd_ret
+            returns[i] <- CipherVector{rd}
         }(i)
     }
     
@@ -300,58 +292,49 @@ func TestAnotherPolynomialDivisionWorkers(t *testing.T) {
     r := []*big.Int{new(big.Int).Mod(new(big.Int).Mul(big.NewInt(9918531), new(big.Int).ModInverse(big.NewInt(201856), pk.N())), pk.N()),
                     new(big.Int).Mod(new(big.Int).Mul(big.NewInt(-1361367), new(big.Int).ModInverse(big.NewInt(50464), pk.N())), pk.N())}
 
-    divid_enc, err := EncryptMatrix(divid, settings[0])
-    if err != nil {t.Error(err)}
+    divid_enc := t_encryptVector(t, divid, settings[0])
     divid_den, err := pk.Encrypt(big.NewInt(1))
     if err != nil {t.Error(err)}
-    divis_enc, err := EncryptMatrix(divis, settings[0])
-    if err != nil {t.Error(err)}
+    divis_enc := t_encryptVector(t, divis, settings[0])
     divis_den, err := pk.Encrypt(big.NewInt(50464))
     if err != nil {t.Error(err)}
 
-    validator := func(num gm.Matrix, den gm.Matrix, corr []*big.Int) {
-        dec := make([]*big.Int, num.Cols)
+    validator := func(num CipherVector, den CipherVector, corr []*big.Int) {
+        dec := make([]*big.Int, len(num))
         var den_i *big.Int // denominator inverse
         
         // if denominator shared among all coefficients -> decrypt it
-        if den.Cols == 1 {
-            den_val, err := decodeBI(den.At(0, 0))
-            if err != nil {t.Error(err)}
-            den_i = t_decrypt(den_val, sks, settings)
+        if len(den) == 1 {
+            den_i = t_decrypt(den[0], sks, settings)
             den_i.ModInverse(den_i, pk.N())
         }
         
         // iterate over coefficients
         for j := 0; j < len(corr); j += 1 {
             // decrypt current denominator if not shared
-            if den.Cols != 1 {
-                den_val, err := decodeBI(den.At(0, j))
-                if err != nil {t.Error(err)}
-                den_i = t_decrypt(den_val, sks, settings)
+            if len(den) != 1 {
+                den_i = t_decrypt(den[j], sks, settings)
                 den_i.ModInverse(den_i, pk.N())
             }
-            num_val, err := decodeBI(num.At(0, j))
-            if err != nil {t.Error(err)}
-            dec[j] = t_decrypt(num_val, sks, settings) // decrypt current numerator
+            dec[j] = t_decrypt(num[j], sks, settings) // decrypt current numerator
             dec[j].Mul(dec[j], den_i).Mod(dec[j], pk.N()) // multiply numerator and denominator inverse
             if dec[j].Cmp(corr[j]) != 0 {
                 t.Errorf("error in polynomial division, expected %d got %d", corr[j], dec[j])
             }
         }
-        if den.Cols > len(corr) {
+        if len(den) > len(corr) {
             t.Error("exceeding coefficients")
         }
     }
 
-    returns := []chan gm.Matrix{make(chan gm.Matrix), make(chan gm.Matrix, 4), make(chan gm.Matrix, 4), make(chan gm.Matrix)}
+    returns := []chan CipherVector{make(chan CipherVector), make(chan CipherVector, 4), make(chan CipherVector, 4), make(chan CipherVector)}
     
     go func() {
         qn, qd, rn, rd := PolynomialDivisionWorker(divid_enc, divis_enc, divid_den, divis_den, sks[n-1], settings[n-1])
         returns[n-1] <- qn
         returns[n-1] <- qd
         returns[n-1] <- rn
-        rd_ret, _ := gm.NewMatrix(1, 1, []interface{}{rd}, gm.Bigint{})
-        returns[n-1] <- rd_ret
+        returns[n-1] <- CipherVector{rd}
     }()
     for i := 0; i < n-1; i += 1 {
         go func(i int) {
@@ -359,8 +342,7 @@ func TestAnotherPolynomialDivisionWorkers(t *testing.T) {
             returns[i] <- qn
             returns[i] <- qd
             returns[i] <- rn
-            rd_ret, _ := gm.NewMatrix(1, 1, []interface{}{rd}, gm.Bigint{})
-            returns[i] <- rd_ret
+            returns[i] <- CipherVector{rd}
         }(i)
     }
     
@@ -384,39 +366,39 @@ func TestEncryptedPolyMult(t *testing.T) { //TODO: error sometimes
 
     a_num, err := gm.NewMatrixFromInt(1, 3, []int{3, 9, 3})
     if err != nil {t.Error(err)}
-    a_num, err = EncryptMatrix(a_num, settings[0])
-    if err != nil {t.Error(err)}
+    a_num_enc := t_encryptVector(t, a_num, settings[0])
     a_den, err := gm.NewMatrixFromInt(1, 3, []int{1, 4, 2})
     if err != nil {t.Error(err)}
-    a_den, err = EncryptMatrix(a_den, settings[0])
-    if err != nil {t.Error(err)}
+    a_den_enc := t_encryptVector(t, a_den, settings[0])
 
     b_num, err := gm.NewMatrixFromInt(1, 2, []int{4, 4})
     if err != nil {t.Error(err)}
-    b_num, err = EncryptMatrix(b_num, settings[0])
-    if err != nil {t.Error(err)}
+    b_num_enc := t_encryptVector(t, b_num, settings[0])
     b_den, err := gm.NewMatrixFromInt(1, 2, []int{3, 1})
     if err != nil {t.Error(err)}
-    b_den, err = EncryptMatrix(b_den, settings[0])
-    if err != nil {t.Error(err)}
+    b_den_enc := t_encryptVector(t, b_den, settings[0])
     
     corr := []int64{4, 15, 11, 6}
 
-    return_channel := make(chan []gm.Matrix)
+    return_channel := make(chan []CipherVector)
     go func() {
-        p_num, p_den, err := PolyMult(a_num, a_den, b_num, b_den, sks[n-1], settings[n-1])
+        p_num, p_den, err := PolyMult(a_num_enc, a_den_enc, b_num_enc, b_den_enc, sks[n-1], settings[n-1])
         if err != nil {t.Error(err)}
-        return_channel <- []gm.Matrix{p_num, p_den}
+        return_channel <- []CipherVector{p_num, p_den}
     }()
     for i := 0; i < n-1; i += 1 {
         go func(j int) {
-            p_num, p_den, err := PolyMult(a_num, a_den, b_num, b_den, sks[j], settings[j])
+            p_num, p_den, err := PolyMult(a_num_enc, a_den_enc, b_num_enc, b_den_enc, sks[j], settings[j])
             if err != nil {t.Error(err)}
-            return_channel <- []gm.Matrix{p_num, p_den}
+            return_channel <- []CipherVector{p_num, p_den}
         }(i)
     }
+    // decrypt once all parties are done, as decryption uses the same channels
+    p_calcs := make([][]CipherVector, n)
     for i := 0; i < n; i += 1{
-        p_calc := <- return_channel
+        p_calcs[i] = <- return_channel
+    }
+    for _, p_calc := range p_calcs {
         p := t_decryptPoly(p_calc[0], p_calc[1], sks, settings)
         for k := 0; k < len(corr); k += 1 {
             if p[k].Cmp(new(big.Int).SetInt64(corr[k])) != 0 {
@@ -435,39 +417,39 @@ func TestPolySub(t *testing.T) {
 
     a_num, err := gm.NewMatrixFromInt(1, 2, []int{5, 4})
     if err != nil {t.Error(err)}
-    a_num, err = EncryptMatrix(a_num, settings[0])
-    if err != nil {t.Error(err)}
+    a_num_enc := t_encryptVector(t, a_num, settings[0])
     a_den, err := gm.NewMatrixFromInt(1, 2, []int{2, 3})
     if err != nil {t.Error(err)}
-    a_den, err = EncryptMatrix(a_den, settings[0])
-    if err != nil {t.Error(err)}
+    a_den_enc := t_encryptVector(t, a_den, settings[0])
 
     b_num, err := gm.NewMatrixFromInt(1, 2, []int{1, 2})
     if err != nil {t.Error(err)}
-    b_num, err = EncryptMatrix(b_num, settings[0])
-    if err != nil {t.Error(err)}
+    b_num_enc := t_encryptVector(t, b_num, settings[0])
     b_den, err := gm.NewMatrixFromInt(1, 2, []int{2, 6})
-    if err !=   nil {t.Error(err)}
-    b_den, err = EncryptMatrix(b_den, settings[0])
     if err != nil {t.Error(err)}
+    b_den_enc := t_encryptVector(t, b_den, settings[0])
 
     corr := []int64{2, 1}
 
-    return_channel := make(chan []gm.Matrix, n)
+    return_channel := make(chan []CipherVector, n)
     go func() {
-        p_num, p_den, err := PolySub(a_num, a_den, b_num, b_den, sks[n-1], settings[n-1])
+        p_num, p_den, err := PolySub(a_num_enc, a_den_enc, b_num_enc, b_den_enc, sks[n-1], settings[n-1])
         if err != nil {t.Error(err)}
-        return_channel <- []gm.Matrix{p_num, p_den}
+        return_channel <- []CipherVector{p_num, p_den}
     }()
     for i := 0; i < n-1; i += 1 {
         go func(j int) {
-            p_num, p_den, err := PolySub(a_num, a_den, b_num, b_den, sks[j], settings[j])
+            p_num, p_den, err := PolySub(a_num_enc, a_den_enc, b_num_enc, b_den_enc, sks[j], settings[j])
             if err != nil {t.Error(err)}
-            return_channel <- []gm.Matrix{p_num, p_den}
+            return_channel <- []CipherVector{p_num, p_den}
         }(i)
     }
+    // decrypt once all parties are done, as decryption uses the same channels
+    p_calcs := make([][]CipherVector, n)
     for i := 0; i < n; i += 1{
-        p_calc := <- return_channel
+        p_calcs[i] = <- return_channel
+    }
+    for _, p_calc := range p_calcs {
         p := t_decryptPoly(p_calc[0], p_calc[1], sks, settings)
         for k := 0; k < len(corr); k += 1 {
             if p[k].Cmp(new(big.Int).SetInt64(corr[k])) != 0 {
@@ -477,6 +459,51 @@ func TestPolySub(t *testing.T) {
     }
 }
 
+func TestPolyArithmeticSubstreams(t *testing.T) {
+    n := 3
+    pk, sksdj, err := NewDJCryptosystem(n)
+    if err != nil {t.Fatal(err)}
+    sks := ConvertDJSKSlice(sksdj)
+    settings := SetupAHE(n, 0, pk)
+    dec_settings := createAHESettings(n, 0, pk)
+
+    encrypt := func(vals []int) CipherVector {
+        m, err := gm.NewMatrixFromInt(1, len(vals), vals)
+        if err != nil {t.Fatal(err)}
+        return t_encryptVector(t, m, settings[0])
+    }
+    a_num, a_den := encrypt([]int{3, 9, 3}), encrypt([]int{1, 4, 2})
+    b_num, b_den := encrypt([]int{4, 4}), encrypt([]int{3, 1})
+    mult_corr := []int64{4, 15, 11, 6}
+    c_num, c_den := encrypt([]int{5, 4}), encrypt([]int{2, 3})
+    d_num, d_den := encrypt([]int{1, 2}), encrypt([]int{2, 6})
+    sub_corr := []int64{2, 1}
+
+    return_channel := make(chan []CipherVector, n)
+    for i := 0; i < n; i += 1 {
+        mux, err := NewMux(settings[i])
+        if err != nil {t.Fatal(err)}
+        go func(j int, setting AHE_setting) {
+            p_num, p_den, err := PolyMult(a_num, a_den, b_num, b_den, sks[j], setting)
+            if err != nil {t.Error(err)}
+            s_num, s_den, err := PolySub(c_num, c_den, d_num, d_den, sks[j], setting)
+            if err != nil {t.Error(err)}
+            return_channel <- []CipherVector{p_num, p_den, s_num, s_den}
+        }(i, mux.Stream("test"))
+    }
+    for i := 0; i < n; i += 1 {
+        p_calc := <-return_channel
+        for _, c := range []struct {num, den CipherVector; corr []int64}{{p_calc[0], p_calc[1], mult_corr}, {p_calc[2], p_calc[3], sub_corr}} {
+            p := t_decryptPoly(c.num, c.den, sks, dec_settings)
+            for k := 0; k < len(c.corr); k += 1 {
+                if p[k].Cmp(big.NewInt(c.corr[k])) != 0 {
+                    t.Errorf("non-matching value at %d, got %d expected %d", k, p[k], c.corr[k])
+                }
+            }
+        }
+    }
+}
+
 func TestTDecryptPoly(t *testing.T) {
     n := 4
     pk, sksdj, err := NewDJCryptosystem(n)
@@ -484,10 +511,8 @@ func TestTDecryptPoly(t *testing.T) {
     sks := ConvertDJSKSlice(sksdj)
     settings := createAHESettings(n, 0, pk)
 
-    num, _ := gm.NewMatrixFromInt(1, 3, []int{6, 9, 4})
-    num, _ = EncryptMatrix(num, settings[0])
-    den, _ := gm.NewMatrixFromInt(1, 3, []int{3, 3, 2})
-    den, _ = EncryptMatrix(den, settings[0])
+    num, _ := EncryptPoly(bigIntSlice([]int64{6, 9, 4}), settings[0])
+    den, _ := EncryptPoly(bigIntSlice([]int64{3, 3, 2}), settings[0])
     corr := []int64{2, 3, 2}
     dec := t_decryptPoly(num, den, sks, settings)
     for i := 0; i < len(corr); i += 1 {
@@ -510,25 +535,24 @@ func TestMinPolyWorker(t *testing.T) {
     
     seq, err := gm.NewMatrix(1, 4, []interface{}{big.NewInt(51), big.NewInt(-79), big.NewInt(-125), big.NewInt(441)}, gm.Bigint{})
     if err != nil {t.Error(err)}
-    seq, err = EncryptMatrix(seq, settings[0])
-    if err != nil {t.Error(err)}
+    seq_enc := t_encryptVector(t, seq, settings[0])
     rec_ord := 2
     inv4 := new(big.Int).ModInverse(big.NewInt(4), pk.N())
     corr := []*big.Int{inv4, inv4, big.NewInt(1)}
 
-    returns := make([]chan gm.Matrix, n)
+    returns := make([]chan CipherVector, n)
     for i := 0; i < n; i += 1 {
-        returns[i] = make(chan gm.Matrix, 2)
+        returns[i] = make(chan CipherVector, 2)
     }
 
     go func() {
-        num, den := CentralMinPolyWorker(seq, rec_ord, sks[n-1], settings[n-1])
+        num, den := CentralMinPolyWorker(seq_enc, rec_ord, sks[n-1], settings[n-1])
         returns[n-1] <- num
         returns[n-1] <- den
     }()
     for i := 0; i < n-1; i += 1 {
         go func(i int) {
-            num, den := OuterMinPolyWorker(seq, rec_ord, sks[i], settings[i])
+            num, den := OuterMinPolyWorker(seq_enc, rec_ord, sks[i], settings[i])
             returns[i] <- num
             returns[i] <- den
         }(i)
@@ -654,6 +678,203 @@ func TestSingularityTestWorker(t *testing.T) {
     })
 }
 
+func TestSingularityTestSubstreams(t *testing.T) {
+    n := 3
+    pk, sksdj, err := NewDJCryptosystem(n)
+    if err != nil {t.Fatal(err)}
+    sks := ConvertDJSKSlice(sksdj)
+    settings := SetupAHE(n, 0, pk)
+    sing, err := gm.NewMatrixFromInt(4, 4, []int{1, 2, 3, 5,
+                                            4, 5, 6, 9,
+                                            2, 4, 6, 10,
+                                            7, 11, 15, 24})
+    if err != nil {t.Fatal(err)}
+    sing, err = EncryptMatrix(sing, settings[0])
+    if err != nil {t.Fatal(err)}
+    return_channel := make(chan bool, n)
+    muxes := make([]*Mux, n)
+    for i := 0; i < n; i += 1 {
+        muxes[i], err = NewMux(settings[i])
+        if err != nil {t.Fatal(err)}
+        go func(i int, setting AHE_setting) {
+            if setting.IsCentral() {
+                return_channel <- CentralSingularityTestWorker(sing, sks[i], setting)
+            } else {
+                return_channel <- OuterSingularityTestWorker(sing, sks[i], setting)
+            }
+        }(i, muxes[i].Stream("test"))
+    }
+    for i := 0; i < n; i += 1 {
+        if !(<-return_channel) {
+            t.Error("should be singular")
+        }
+    }
+    closed := make(chan bool)
+    for _, mux := range muxes {
+        go func(mux *Mux) {
+            mux.Close()
+            closed <- true
+        }(mux)
+    }
+    for range muxes {
+        <-closed
+    }
+}
+
+// steps c and d as before semiSequence merged them, for comparison
+func sequentialSemiSequence(m, v gm.Matrix, mmult func(a, b gm.Matrix) gm.Matrix) gm.Matrix {
+    its := NbrMMultInstances(m)
+    mats := make([]gm.Matrix, its+1)
+    mats[0] = m
+    for i := 0; i < its; i += 1 {
+        mats[i+1] = mmult(mats[i], mats[i])
+    }
+    semi_seq := v
+    for _, mat := range mats {
+        new_semi_seq := mmult(mat, semi_seq)
+        var err error
+        semi_seq, err = new_semi_seq.Concatenate(semi_seq)
+        if err != nil {panic(err)}
+    }
+    return semi_seq
+}
+
+func TestSemiSequence(t *testing.T) {
+    m, err := gm.NewMatrixFromInt(5, 5, []int{1, 2, 0, 1, 3,
+                                              0, 1, 4, 2, 1,
+                                              2, 0, 1, 0, 1,
+                                              1, 3, 0, 2, 0,
+                                              0, 1, 1, 1, 2})
+    if err != nil {t.Fatal(err)}
+    v, err := gm.NewMatrixFromInt(5, 1, []int{1, 0, 2, 1, 3})
+    if err != nil {t.Fatal(err)}
+    calls := 0
+    mmult := func(a, b gm.Matrix) gm.Matrix {
+        calls += 1
+        c, err := a.Multiply(b)
+        if err != nil {panic(err)}
+        return c
+    }
+
+    expected := sequentialSemiSequence(m, v, mmult)
+    sequential_calls := calls
+    calls = 0
+    semi_seq := semiSequence(m, v, func(a, b gm.Matrix, setting AHE_setting) gm.Matrix {
+        return mmult(a, b)
+    }, nil)
+
+    if semi_seq.Rows != expected.Rows || semi_seq.Cols != expected.Cols {
+        t.Fatalf("got %dx%d semi-sequence, expected %dx%d", semi_seq.Rows, semi_seq.Cols, expected.Rows, expected.Cols)
+    }
+    for row := 0; row < expected.Rows; row += 1 {
+        for col := 0; col < expected.Cols; col += 1 {
+            got, _ := decodeBI(semi_seq.At(row, col))
+            exp, _ := decodeBI(expected.At(row, col))
+            if got.Cmp(exp) != 0 {
+                t.Errorf("element (%d,%d) is %d, expected %d", row, col, got, exp)
+            }
+        }
+    }
+    its := NbrMMultInstances(m)
+    if calls != its+1 || sequential_calls != 2*its+1 {
+        t.Errorf("got %d MMult instances, expected %d instead of %d", calls, its+1, sequential_calls)
+    }
+}
+
+// largest threshold of BenchmarkSemiSequence, T=16 runs for minutes and T=32 for hours
+var semiSequenceMaxT = flag.Int("semiseq.maxT", 8, "largest threshold of BenchmarkSemiSequence")
+
+// steps c and d for a random encrypted Hankel-sized matrix: sequentially, merged
+// into one MMult per power, and with the two products of a power concurrently on
+// the sub-streams of a Mux
+// go test -run XXX -bench BenchmarkSemiSequence -semiseq.maxT 32 -timeout 0
+func BenchmarkSemiSequence(b *testing.B) {
+    n := 3
+    pk, sksdj, err := NewDJCryptosystem(n)
+    if err != nil {b.Fatal(err)}
+    sks := ConvertDJSKSlice(sksdj)
+    mmult := func(party int) func(x, y gm.Matrix, setting AHE_setting) gm.Matrix {
+        return func(x, y gm.Matrix, setting AHE_setting) gm.Matrix {
+            if setting.IsCentral() {
+                return CentralMatrixMultiplicationWorker(x, y, sks[party], setting)
+            }
+            return OuterMatrixMultiplicationWorker(x, y, sks[party], setting)
+        }
+    }
+    steps := map[string]func(m, v gm.Matrix, party int, setting AHE_setting) gm.Matrix{
+        "sequential": func(m, v gm.Matrix, party int, setting AHE_setting) gm.Matrix {
+            return sequentialSemiSequence(m, v, func(x, y gm.Matrix) gm.Matrix {
+                return mmult(party)(x, y, setting)
+            })
+        },
+        "merged": func(m, v gm.Matrix, party int, setting AHE_setting) gm.Matrix {
+            return semiSequence(m, v, func(x, y gm.Matrix, _ AHE_setting) gm.Matrix {
+                return mmult(party)(x, y, setting)
+            }, nil)
+        },
+        "concurrent": func(m, v gm.Matrix, party int, setting AHE_setting) gm.Matrix {
+            return semiSequence(m, v, mmult(party), setting)
+        },
+    }
+    for _, T := range []int{4, 8, 16, 32} {
+        if T > *semiSequenceMaxT {
+            break
+        }
+        settings := createAHESettings(n, T, pk)
+        m, err := SampleMatrix(T+1, T+1, pk.N())
+        if err != nil {b.Fatal(err)}
+        m, err = EncryptMatrix(m, settings[0])
+        if err != nil {b.Fatal(err)}
+        v, err := SampleMatrix(T+1, 1, pk.N())
+        if err != nil {b.Fatal(err)}
+        v, err = EncryptMatrix(v, settings[0])
+        if err != nil {b.Fatal(err)}
+        for _, name := range []string{"sequential", "merged", "concurrent"} {
+            step := steps[name]
+            b.Run(fmt.Sprintf("T=%d/%s", T, name), func(b *testing.B) {
+                // the concurrent step runs on a stream of a Mux per party
+                var muxes []*Mux
+                if name == "concurrent" {
+                    muxes = make([]*Mux, n)
+                    for i := range muxes {
+                        muxes[i], err = NewMux(settings[i])
+                        if err != nil {b.Fatal(err)}
+                    }
+                }
+                setting := func(i, k int) AHE_setting {
+                    if muxes == nil {
+                        return settings[i]
+                    }
+                    return muxes[i].Stream(fmt.Sprintf("run %d", k))
+                }
+                for k := 0; k < b.N; k += 1 {
+                    done := make(chan bool)
+                    for i := 0; i < n; i += 1 {
+                        go func(i int) {
+                            step(m, v, i, setting(i, k))
+                            done <- true
+                        }(i)
+                    }
+                    for i := 0; i < n; i += 1 {
+                        <-done
+                    }
+                }
+                b.StopTimer()
+                closed := make(chan bool)
+                for _, mux := range muxes {
+                    go func(mux *Mux) {
+                        mux.Close()
+                        closed <- true
+                    }(mux)
+                }
+                for range muxes {
+                    <-closed
+                }
+            })
+        }
+    }
+}
+
 func TestCardinalityTestWorker(t *testing.T) {
     t.Run("below threshold", func (t *testing.T) {
         n := 4
@@ -732,7 +953,7 @@ func TestIntersectionPoly(t *testing.T) {
     sks := ConvertDJSKSlice(sksdj)
     settings := createAHESettings(n, T, pk)
     
-    roots := make([]gm.Matrix, 4)
+    roots := make([]PlainPoly, 4)
     for i := range items {
         roots[i] = PolyFromRoots(items[i], pk.N())
     }
@@ -929,3 +1150,258 @@ func TestEncryptedZeroMatrix(t *testing.T) {
         }
     }
 }
+
+func TestElectionWorkers(t *testing.T) {
+    n := 4
+    pk, _, err := NewDJCryptosystem(n)
+    if err != nil {t.Error(err)}
+    settings := createAHESettings(n, 0, pk)
+
+    return_channel := make(chan int)
+    go func() {
+        return_channel <- CentralElectionWorker(settings[n-1])
+    }()
+    for i := 0; i < n-1; i += 1 {
+        go func(i int) {
+            return_channel <- OuterElectionWorker(settings[i])
+        }(i)
+    }
+
+    elected := <-return_channel
+    if elected < 0 || elected >= n {
+        t.Errorf("elected central %d out of range", elected)
+    }
+    for i := 1; i < n; i += 1 {
+        if other := <-return_channel; other != elected {
+            t.Errorf("parties disagree on central: %d and %d", elected, other)
+        }
+    }
+}
+
+func TestTPSIdiffOtherCentral(t *testing.T) {
+    n := 3
+    T := 7
+    central := 0
+    pk, sksdj, err := NewDJCryptosystem(n)
+    if err != nil {t.Error(err)}
+    sks := ConvertDJSKSlice(sksdj)
+
+    items := [][]*big.Int{bigIntSlice([]int64{2,4,6,8,10,12,14}),
+                          bigIntSlice([]int64{2,4,6,8,10,16,18}),
+                          bigIntSlice([]int64{2,4,6,8,12,20,22})}
+    settings := SetupAHEWithCentral(n, T, central, pk)
+    if !settings[central].IsCentral() {
+        t.Fatalf("party %d is not central", central)
+    }
+    no_shared := 4
+    returns := make([]chan []*big.Int, n)
+    for i := 0; i < n; i += 1 {
+        returns[i] = make(chan []*big.Int, 2)
+        go func(i int) {
+            sh, uq := TPSIdiffWorker(items[i], sks[i], settings[i])
+            returns[i] <- sh
+            returns[i] <- uq
+        }(i)
+    }
+    for i := 0; i < n; i += 1 {
+        shared := <-returns[i]
+        <-returns[i]
+        if len(shared) != no_shared {
+            t.Errorf("party %d: wrong number of shared items, expected %d, got %d", i, no_shared, len(shared))
+            continue
+        }
+        for j := 0; j < no_shared; j += 1 {
+            if shared[j] != items[i][j] {
+                t.Errorf("unexpected element in shared, expected %d, got %d", items[i][j], shared[j])
+            }
+        }
+    }
+}
+
+func TestOutputDecryptionWorkers(t *testing.T) {
+    n := 4
+    pk, sksdj, err := NewDJCryptosystem(n)
+    if err != nil {t.Error(err)}
+    sks := ConvertDJSKSlice(sksdj)
+    plain, err := gm.NewMatrixFromInt(1, 3, []int{5, 0, 7})
+    if err != nil {t.Error(err)}
+    cipher, err := EncryptMatrix(plain, createAHESettings(n, 0, pk)[0])
+    if err != nil {t.Error(err)}
+
+    for _, receivers := range [][]int{{0}, {n-1}, {1, 2, n-1}} {
+        t.Run(fmt.Sprintf("receivers %v", receivers), func(t *testing.T) {
+            settings := RestrictOutputAHE(createAHESettings(n, 0, pk), receivers)
+            type output struct {
+                dec gm.Matrix
+                received bool
+            }
+            returns := make([]chan output, n)
+            for i := range returns {
+                returns[i] = make(chan output, 1)
+            }
+            go func() {
+                dec, received := CentralOutputDecryptionWorker(cipher, sks[n-1], settings[n-1])
+                returns[n-1] <- output{dec, received}
+            }()
+            for i := 0; i < n-1; i += 1 {
+                go func(i int) {
+                    dec, received := OuterOutputDecryptionWorker(1, 3, sks[i], settings[i])
+                    returns[i] <- output{dec, received}
+                }(i)
+            }
+            for i := 0; i < n; i += 1 {
+                out := <-returns[i]
+                if out.received != containsIndex(receivers, i) {
+                    t.Errorf("party %d: received output %t", i, out.received)
+                    continue
+                }
+                if !out.received {
+                    continue
+                }
+                for j := 0; j < plain.Cols; j += 1 {
+                    dec_val, err := decodeBI(out.dec.At(0, j))
+                    if err != nil {t.Error(err)}
+                    plain_val, _ := decodeBI(plain.At(0, j))
+                    if dec_val.Cmp(plain_val) != 0 {
+                        t.Errorf("party %d: expected %d, got %d", i, plain_val, dec_val)
+                    }
+                }
+            }
+        })
+    }
+}
+
+func TestRestrictedIntersection(t *testing.T) {
+    items := [][]*big.Int{
+        bigIntSlice([]int64{100,102,202,204,206}),
+        bigIntSlice([]int64{100,102,302,304,306}),
+        bigIntSlice([]int64{100,102,402,404,406})}
+    no_shared := 2
+    receivers := []int{0}
+
+    n := 3
+    T := 3 * n
+    pk, sksdj, err := NewDJCryptosystem(n)
+    if err != nil {t.Error(err)}
+    sks := ConvertDJSKSlice(sksdj)
+    settings := RestrictOutputAHE(createAHESettings(n, T, pk), receivers)
+
+    returns := make([]chan []*big.Int, n)
+    for i := 0; i < n; i += 1 {
+        returns[i] = make(chan []*big.Int, 2)
+        go func(i int) {
+            shared, unique := IntersectionWorker(items[i], sks[i], settings[i])
+            returns[i] <- shared
+            returns[i] <- unique
+        }(i)
+    }
+    for i := 0; i < n; i += 1 {
+        shared := <-returns[i]
+        unique := <-returns[i]
+        if !containsIndex(receivers, i) {
+            if len(shared) != 0 || len(unique) != 0 {
+                t.Errorf("party %d without output got elements", i)
+            }
+        } else if len(shared) != no_shared {
+            t.Errorf("wrong number of shared elements; expected %d, got %d", no_shared, len(shared))
+        }
+    }
+}
+
+func TestTPSIdiffCardinality(t *testing.T) {
+    items := [][]*big.Int{bigIntSlice([]int64{2,4,6,8}),
+                          bigIntSlice([]int64{2,4,10,12}),
+                          bigIntSlice([]int64{2,4,6,14})}
+    no_shared := 2
+    n := 3
+    pk, sksdj, err := NewDJCryptosystem(n)
+    if err != nil {t.Error(err)}
+    sks := ConvertDJSKSlice(sksdj)
+
+    type result struct {
+        count int
+        passed bool
+    }
+    var metrics []*Metrics
+    run := func(T int) []chan result {
+        settings := createAHESettings(n, T, pk)
+        returns := make([]chan result, n)
+        metrics = make([]*Metrics, n)
+        for i := 0; i < n; i += 1 {
+            returns[i] = make(chan result, 1)
+            metrics[i] = NewMetrics()
+            go func(i int) {
+                count, passed := TPSIdiffCardinalityWorker(items[i], sks[i], NewMetricsSetting(settings[i], metrics[i]))
+                returns[i] <- result{count, passed}
+            }(i)
+        }
+        return returns
+    }
+    t.Run("pass cardinality test", func(t *testing.T) {
+        returns := run(5)
+        for i := 0; i < n; i += 1 {
+            res := <-returns[i]
+            if !res.passed {
+                t.Error("cardinality test failed")
+            } else if res.count != no_shared {
+                t.Errorf("wrong cardinality; expected %d, got %d", no_shared, res.count)
+            }
+        }
+        for i, m := range metrics {
+            text := metricsText(t, m)
+            for _, line := range []string{
+                "tpsi_sessions_total{protocol=\"diff-cardinality\"} 1",
+                "tpsi_cardinality_tests_total{protocol=\"diff-cardinality\",result=\"pass\"} 1",
+                "tpsi_step_duration_seconds_count{step=\"TPSI-diff cardinality\"} 1",
+            } {
+                if !strings.Contains(text, line) {
+                    t.Errorf("party %d: missing %q", i, line)
+                }
+            }
+        }
+    })
+    t.Run("fail cardinality test", func(t *testing.T) {
+        returns := run(4)
+        for i := 0; i < n; i += 1 {
+            if res := <-returns[i]; res.passed {
+                t.Error("cardinality test passed")
+            }
+        }
+    })
+}
+
+func TestTPSIdiffRepeatedItems(t *testing.T) {
+    items := [][]*big.Int{bigIntSlice([]int64{2,4,4,6,8}),
+                          bigIntSlice([]int64{2,2,4,10,12}),
+                          bigIntSlice([]int64{2,4,6,14,14})}
+    no_shared := 2
+    n := 3
+    pk, sksdj, err := NewDJCryptosystem(n)
+    if err != nil {t.Error(err)}
+    sks := ConvertDJSKSlice(sksdj)
+    settings := createAHESettings(n, 5, pk)
+
+    returns := make([]chan []*big.Int, n)
+    for i := 0; i < n; i += 1 {
+        returns[i] = make(chan []*big.Int, 2)
+        go func(i int) {
+            sh, uq := TPSIdiffWorker(items[i], sks[i], settings[i])
+            returns[i] <- sh
+            returns[i] <- uq
+        }(i)
+    }
+    for i := 0; i < n; i += 1 {
+        shared := <-returns[i]
+        unique := <-returns[i]
+        if shared == nil {
+            t.Error("cardinality test failed")
+            continue
+        }
+        if len(shared) != no_shared {
+            t.Errorf("wrong number of shared items, expected %d, got %d", no_shared, len(shared))
+        }
+        if len(shared) + len(unique) != len(Deduplicate(items[i])) {
+            t.Errorf("repeated items in output: %v, %v", shared, unique)
+        }
+    }
+}